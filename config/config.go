@@ -22,6 +22,7 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/md5"
+	"crypto/sha256"
 	"math/big"
 	"time"
 )
@@ -130,6 +131,12 @@ var HkdfSalt = []byte("iris.proto.session.hkdf.salt")
 // Info value for the HKDF key expansion.
 var HkdfInfo = []byte("iris.proto.session.hkdf.info")
 
+// Info value for the HKDF channel binding expansion.
+var HkdfBindInfo = []byte("iris.proto.session.hkdf.binding")
+
+// Maximum size of a single stream frame accepted from the wire (bytes).
+var StreamMaxFrame = 64 * 1024 * 1024
+
 // Symmetric cipher to use for session encryption.
 var SessionCipher = aes.NewCipher
 
@@ -154,12 +161,33 @@ var SessionLinkTimeout = time.Second
 // Time allowance to gracefully terminate a session link.
 var SessionGraceTimeout = 3 * time.Second
 
+// Maximum number of messages to coalesce into a single link frame.
+var SessionBatchSize = 64
+
+// Time to linger for further messages to coalesce while a link is under load.
+var SessionBatchLinger = 20 * time.Microsecond
+
+// Whether to offer and accept payload compression on the session links.
+var SessionCompress = true
+
+// Minimum payload size to attempt compressing (bytes).
+var SessionCompressThreshold = 512
+
+// Maximum size of a decompressed payload, to prevent decompression bombs (bytes).
+var SessionCompressLimit = 64 * 1024 * 1024
+
 // Symmetric cipher for the temporary message encryption.
 var PacketCipher = aes.NewCipher
 
 // Key size for the temporary cipher (bits).
 var PacketCipherBits = 128
 
+// Interfaces (names, CIDRs or "*") to bind to (all non-loopback IPv4 ones if empty, IPv6 ones only with multicast discovery).
+var NetInclude = []string{}
+
+// Interfaces (names, CIDRs or "*") never to bind to, taking precedence over inclusions.
+var NetExclude = []string{}
+
 // Bootstrapping ports to use.
 var BootPorts = []int{14142, 27182, 31415, 45654, 22222, 33333}
 
@@ -175,15 +203,52 @@ var BootSlowProbe = 1000
 // Scanning interval during bootstrapping (ms).
 var BootScan = 100
 
-// Virtual address space (bits).
+// Interfaces (names, CIDRs or "*") to discover peers on via multicast instead of probing and scanning.
+var BootMulticast = []string{}
+
+// IPv4 multicast group for bootstrap discovery (organization-local scope).
+var BootMulticastGroup4 = "239.192.73.82"
+
+// Port of the IPv4 bootstrap multicast group.
+var BootMulticastPort4 = 41414
+
+// IPv6 multicast group for bootstrap discovery (link-local scope).
+var BootMulticastGroup6 = "ff12::6972:6973"
+
+// Port of the IPv6 bootstrap multicast group.
+var BootMulticastPort6 = 41414
+
+// Hash type for the bootstrap beacon HMACs.
+var BootMacHash = sha256.New
+
+// Info value for deriving the keyed cluster magic of the bootstrap beacons.
+var BootMagicInfo = []byte("iris.proto.bootstrap.magic")
+
+// Info value for deriving the bootstrap beacon authentication key.
+var BootMacInfo = []byte("iris.proto.bootstrap.mac")
+
+// Maximum clock skew and replay memory of the bootstrap beacons.
+var BootReplayWindow = 30 * time.Second
+
+// Fixed listener port of the overlay on each interface (random if 0).
+var PastryListenPort = 0
+
+// Overlay addresses (host:port) to advertise instead of the listener ones (e.g. NAT).
+var PastryAdvertise = []string{}
+
+// Virtual address space (bits, must match cluster wide).
 var PastrySpace = 40
 
-// Number of matching bits for the next hop.
+// Number of matching bits for the next hop (must match cluster wide).
 var PastryBase = 4
 
-// Number of closest nodes to track in the virtual network.
+// Number of closest nodes to track in the virtual network (even, may differ per node).
 var PastryLeaves = 8
 
+// Node id assignment (empty for random, "id:<hex>", "name:<text>" or "file:<path>").
+// With secure routing only random and "file:<path>" (persisting the node key) apply.
+var PastryNodeId = ""
+
 // Hash for mapping external ids into the overlay id space.
 var PastryResolver = md5.New
 
@@ -199,6 +264,31 @@ var PastryBeatPeriod = 3 * time.Second
 // Number of missed heartbeats after which to consider a node down.
 var PastryKillCount = 3
 
+// Latency ratio below which a routing table entry is replaced by a closer node.
+var PastryProximityMargin = 0.75
+
+// Period of probing failed peers to detect a healed network partition.
+var PastryHealPeriod = 10 * time.Second
+
+// Time after which a failed peer is not probed any more.
+var PastryHealTimeout = 30 * time.Minute
+
+// Maximum number of peer addresses remembered for partition healing.
+var PastryHealMemory = 1024
+
+// Whether to enforce secure routing (self-certified ids, constrained routing
+// tables and leaf set density checks). Must match cluster wide.
+var PastrySecureRouting = false
+
+// Leaf set density ratio (remote vs. local) above which a state is distrusted.
+var PastryDensityFactor = 4.0
+
+// Maximum number of hops a routed message may take before being discarded.
+var PastryRouteTTL = 32
+
+// Whether to record the route of overlay messages (debugging, adds overhead).
+var PastryRouteTrace = false
+
 // Maximum time to queue an authenticated session connection before dropping it.
 var PastryAcceptTimeout = time.Second
 
@@ -229,12 +319,36 @@ var ScribeSpace = 32
 // Number of messages to buffer for application delivery before dropping.
 var ScribeAppBuffer = 128
 
+// Time reserved at each topic tree hop to report publish acknowledgements.
+var ScribeAckHopTime = 50 * time.Millisecond
+
+// Time to retain the state of a released or expired lease (fencing continuity).
+var ScribeLeaseLinger = time.Minute
+
+// Minimum lease duration to grant, leaving room for a few renewal round trips.
+var ScribeLeaseMinTTL = 150 * time.Millisecond
+
+// Time for a new lock root to collect the lock state from its leaf set before refusing operations.
+var ScribeLeasePullTimeout = 500 * time.Millisecond
+
+// Time to remember a replicated message to discard its further copies.
+var ScribeReplicaMemory = time.Minute
+
+// Maximum number of overlay paths a replicated request or its reply is sent along.
+var IrisRequestCopies = 4
+
 // Number of sub-clusters an app cluster or topic is split into.
 var IrisClusterSplits = 5
 
 // Maximum number of handlers allowed concurrently per Iris application.
 var IrisHandlerThreads = 16
 
+// Fixed listener port of the tunnel endpoints on each interface (random if 0).
+var IrisTunnelPort = 0
+
+// Tunnel addresses (host:port) to advertise instead of the listener ones (e.g. NAT).
+var IrisTunnelAdvertise = []string{}
+
 // Maximum time to queue an established tunnel stream before dropping it.
 var IrisTunnelAcceptTimeout = time.Second
 
@@ -244,6 +358,52 @@ var IrisTunnelInitTimeout = time.Second
 // Send and receive window for tunnel ordering and throttling.
 var IrisTunnelBuffer = 256
 
+// Number of messages a tunnel endpoint accepts before the remote must wait for
+// further credits.
+var IrisTunnelWindow = 128
+
+// Time to wait for the acknowledgement of a routed tunnel frame before resending.
+var IrisTunnelRetransmit = 500 * time.Millisecond
+
+// Time to batch up the acknowledgements of arrived routed tunnel frames.
+var IrisTunnelAckDelay = 50 * time.Millisecond
+
+// Time allowed for the remote endpoint of a routed tunnel to stay silent.
+var IrisTunnelRouteTimeout = 5 * time.Second
+
+// Time to wait for the remote endpoint to confirm a tunnel closure.
+var IrisTunnelCloseTimeout = 3 * time.Second
+
+// Time allowed for a failed direct tunnel link to be redialed and resumed.
+var IrisTunnelResumeGrace = 5 * time.Second
+
+// Time to wait between redial rounds of a failed tunnel link.
+var IrisTunnelResumeBackoff = 250 * time.Millisecond
+
+// Number of replies to buffer for a pending gather before dropping.
+var IrisGatherBuffer = 256
+
+// Time allowed for the members of a cluster to report their addresses.
+var IrisMembersTimeout = time.Second
+
+// Period of the full membership refresh of watched clusters.
+var IrisMembersRefresh = 5 * time.Second
+
+// Maximum time to wait for a lock service reply.
+var IrisLockTimeout = time.Second
+
+// Lease duration of the leadership of an elected role.
+var IrisElectionLease = 3 * time.Second
+
+// Maximum payload size of a single message, larger ones being chunked (bytes).
+var IrisChunkSize = 256 * 1024
+
+// Maximum number of chunks a single message can be split into.
+var IrisChunkLimit = 256
+
+// Time allowed for all the chunks of a message to arrive.
+var IrisChunkTimeout = 10 * time.Second
+
 // Use in case of federated applications.
 var AppParentId = []byte(nil)
 
@@ -261,3 +421,18 @@ var RelayTunnelTimeout = 3000
 
 // Block time when trying a tunnel read (ms).
 var RelayTunnelPoll = 1000
+
+// Maximum size of a message payload accepted from a client, inline or streamed (bytes).
+var RelayMaxMessageSize = 32 * 1024 * 1024
+
+// Size of the frames a large payload is streamed in (bytes).
+var RelayStreamChunk = 256 * 1024
+
+// Number of unacknowledged stream frames allowed in flight.
+var RelayStreamWindow = 16
+
+// Maximum number of inbound streams a client may have open concurrently.
+var RelayStreamMaxOpen = 16
+
+// Maximum total size of the partial inbound streams buffered per client (bytes).
+var RelayStreamMaxBuffer = 2 * RelayMaxMessageSize
@@ -71,6 +71,8 @@ type Session struct {
 	hash    crypto.Hash
 	crypter func([]byte) (cipher.Block, error)
 	keybits int
+
+	context []byte
 }
 
 // Ensure unique key expansion for STS
@@ -109,6 +111,13 @@ func New(random io.Reader, group, generator *big.Int, cipher func([]byte) (ciphe
 	return ses, nil
 }
 
+// Binds additional handshake data (e.g. negotiated protocol options) into the
+// authorization tokens of both sides, so any tampering with it fails the exchange.
+// Must be called before accepting or verifying, with the same data on both sides.
+func (s *Session) Bind(context []byte) {
+	s.context = context
+}
+
 // Initiates an STS exchange session, returning the local exponential to connect with.
 func (s *Session) Initiate() (*big.Int, error) {
 	// Sanity check
@@ -189,10 +198,12 @@ func (s *Session) Secret() ([]byte, error) {
 }
 
 // Calculates the authorization token: the encrypted RSA signature of the two exponentials (local first!)
+// and the bound context
 func (s *Session) genToken(random io.Reader, key *rsa.PrivateKey) ([]byte, error) {
 	// Calculate the RSA signature
 	hasher := s.hash.New()
 	hasher.Write(append(s.localExp.Bytes(), s.foreignExp.Bytes()...))
+	hasher.Write(s.context)
 	hashsum := hasher.Sum(nil)
 	sig, err := rsa.SignPKCS1v15(random, key, s.hash, hashsum)
 	if err != nil {
@@ -208,10 +219,12 @@ func (s *Session) genToken(random io.Reader, key *rsa.PrivateKey) ([]byte, error
 }
 
 // Verify the authorization token: the encrypted RSA signature of the two exponentials (foreign first!)
+// and the bound context
 func (s *Session) verToken(key *rsa.PublicKey, token []byte) error {
 	// Calculate the required hash sum
 	hasher := s.hash.New()
 	hasher.Write(append(s.foreignExp.Bytes(), s.localExp.Bytes()...))
+	hasher.Write(s.context)
 	hashsum := hasher.Sum(nil)
 
 	// Create the stream cipher and decrypt the RSA signature
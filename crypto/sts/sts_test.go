@@ -439,6 +439,28 @@ func TestToken(t *testing.T) {
 	}
 }
 
+func TestBind(t *testing.T) {
+	iniKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	accKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	for i, tt := range stsTests {
+		// Matching contexts should verify, differing ones fail
+		for j, iniCtx := range [][]byte{{1}, {0}} {
+			iniSes, _ := New(bytes.NewReader(tt.iniExponent.Bytes()), tt.group, tt.generator, tt.cipher, tt.bits, tt.hash)
+			accSes, _ := New(bytes.NewReader(tt.accExponent.Bytes()), tt.group, tt.generator, tt.cipher, tt.bits, tt.hash)
+			iniSes.Bind(iniCtx)
+			accSes.Bind([]byte{1})
+
+			iniExp, _ := iniSes.Initiate()
+			accExp, accToken, _ := accSes.Accept(rand.Reader, accKey, iniExp)
+			_, err := iniSes.Verify(rand.Reader, iniKey, &accKey.PublicKey, accExp, accToken)
+			if valid := j == 0; (err == nil) != valid {
+				t.Errorf("test %d, context %d: verification mismatch: have %v, want %v", i, j, err == nil, valid)
+			}
+		}
+	}
+}
+
 func TestSecret(t *testing.T) {
 	iniKey, _ := rsa.GenerateKey(rand.Reader, 1024)
 	accKey, _ := rsa.GenerateKey(rand.Reader, 1024)
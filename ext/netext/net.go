@@ -0,0 +1,117 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Package netext contains extensions to the base Go net package.
+package netext
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Checks whether an interface address matches any of the patterns, each being
+// an interface name, a CIDR range containing the address or "*" for any.
+func Matches(name string, ip net.IP, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == name {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(pattern); err == nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retrieves the network interface owning a local address, or nil if none does.
+func Owner(ip net.IP) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(ifaces); i++ {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Collects the interface addresses to bind to. Without an include list all
+// non-loopback IPv4 addresses are selected, otherwise only the matching ones
+// (even loopback). IPv6 subnets are too large to probe, so global IPv6 addresses
+// are only selected on multicast capable interfaces matching the multicast list.
+// Addresses matching the exclude list are always dropped.
+func Interfaces(include, exclude, multicast []string) ([]*net.IPNet, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ipnets := []*net.IPNet{}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipnet.IP.To4() == nil {
+				if !ipnet.IP.IsGlobalUnicast() || iface.Flags&net.FlagMulticast == 0 || !Matches(iface.Name, ipnet.IP, multicast) {
+					continue
+				}
+			}
+			if len(include) == 0 && ipnet.IP.IsLoopback() {
+				continue
+			}
+			if len(include) > 0 && !Matches(iface.Name, ipnet.IP, include) {
+				continue
+			}
+			if Matches(iface.Name, ipnet.IP, exclude) {
+				continue
+			}
+			ipnets = append(ipnets, ipnet)
+		}
+	}
+	return ipnets, nil
+}
+
+// Verifies that all the addresses are in a valid host:port form.
+func CheckAddrs(addrs []string) error {
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		if host == "" {
+			return fmt.Errorf("missing host in address %s", addr)
+		}
+		if num, err := strconv.Atoi(port); err != nil || num <= 0 || num >= 65536 {
+			return fmt.Errorf("invalid port in address %s", addr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package netext
+
+import (
+	"net"
+	"testing"
+)
+
+type matchTest struct {
+	name     string
+	ip       net.IP
+	patterns []string
+	match    bool
+}
+
+var matchTests = []matchTest{
+	{"eth0", net.IPv4(10, 0, 0, 1), nil, false},
+	{"eth0", net.IPv4(10, 0, 0, 1), []string{"*"}, true},
+	{"eth0", net.IPv4(10, 0, 0, 1), []string{"eth0"}, true},
+	{"eth0", net.IPv4(10, 0, 0, 1), []string{"eth1"}, false},
+	{"eth0", net.IPv4(10, 0, 0, 1), []string{"10.0.0.0/8"}, true},
+	{"docker0", net.IPv4(172, 17, 0, 1), []string{"10.0.0.0/8", "eth0"}, false},
+	{"docker0", net.IPv4(172, 17, 0, 1), []string{"10.0.0.0/8", "172.16.0.0/12"}, true},
+}
+
+func TestMatches(t *testing.T) {
+	for i, tt := range matchTests {
+		if match := Matches(tt.name, tt.ip, tt.patterns); match != tt.match {
+			t.Errorf("test %d: match mismatch: have %v, want %v.", i, match, tt.match)
+		}
+	}
+}
+
+func TestInterfaces(t *testing.T) {
+	// Default selection should skip loopback
+	ipnets, err := Interfaces(nil, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to collect interfaces: %v.", err)
+	}
+	for _, ipnet := range ipnets {
+		if ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+			t.Errorf("invalid default interface: %v.", ipnet)
+		}
+	}
+	// Explicit inclusion should allow loopback
+	ipnets, err = Interfaces([]string{"127.0.0.0/8"}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to collect interfaces: %v.", err)
+	}
+	if len(ipnets) == 0 {
+		t.Fatalf("included loopback interface not selected.")
+	}
+	for _, ipnet := range ipnets {
+		if !ipnet.IP.IsLoopback() {
+			t.Errorf("non included interface selected: %v.", ipnet)
+		}
+	}
+	// IPv6 addresses should only be selected for multicast discovery
+	if ipnets, err = Interfaces([]string{"*"}, nil, nil); err != nil {
+		t.Fatalf("failed to collect interfaces: %v.", err)
+	}
+	for _, ipnet := range ipnets {
+		if ipnet.IP.To4() == nil {
+			t.Errorf("IPv6 interface selected without multicast: %v.", ipnet)
+		}
+	}
+	if ipnets, err = Interfaces([]string{"*"}, nil, []string{"*"}); err != nil {
+		t.Fatalf("failed to collect interfaces: %v.", err)
+	}
+	for _, ipnet := range ipnets {
+		if ipnet.IP.To4() == nil && !ipnet.IP.IsGlobalUnicast() {
+			t.Errorf("non global IPv6 interface selected: %v.", ipnet)
+		}
+	}
+	// Exclusions should take precedence
+	if ipnets, err = Interfaces([]string{"*"}, []string{"*"}, []string{"*"}); err != nil || len(ipnets) != 0 {
+		t.Fatalf("excluded interfaces selected: %v, %v.", ipnets, err)
+	}
+}
+
+func TestCheckAddrs(t *testing.T) {
+	if err := CheckAddrs([]string{"1.2.3.4:5", "example.com:65535", "[::1]:80"}); err != nil {
+		t.Errorf("valid addresses refused: %v.", err)
+	}
+	for _, addr := range []string{"1.2.3.4", ":80", "1.2.3.4:0", "1.2.3.4:65536", "1.2.3.4:http"} {
+		if err := CheckAddrs([]string{addr}); err == nil {
+			t.Errorf("invalid address accepted: %v.", addr)
+		}
+	}
+}
@@ -33,7 +33,9 @@ import (
 	"runtime/pprof"
 	"strings"
 
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/proto/pastry"
 	"github.com/project-iris/iris/service/relay"
 )
 
@@ -43,6 +45,19 @@ var relayPort = flag.Int("port", 55555, "relay endpoint for locally connecting c
 var clusterName = flag.String("net", "", "name of the cluster to join or create")
 var rsaKeyPath = flag.String("rsa", "", "path to the RSA private key to use for data security")
 
+var idSpace = flag.Int("space", config.PastrySpace, "bit size of the overlay id space (must match cluster wide)")
+var idBase = flag.Int("base", config.PastryBase, "bits per overlay routing digit (must match cluster wide)")
+var leafSet = flag.Int("leaves", config.PastryLeaves, "number of closest nodes to track in the overlay")
+var nodeId = flag.String("id", "", "overlay node id: id:<hex>, name:<text> or file:<path> (random if empty)")
+var secureRouting = flag.Bool("secure", false, "enforce secure routing with certified node ids (must match cluster wide)")
+var multicast = flag.String("multicast", "", "comma separated interfaces or CIDRs to discover peers on via multicast (* for all)")
+var include = flag.String("include", "", "comma separated interfaces or CIDRs to bind to (all non-loopback if empty)")
+var exclude = flag.String("exclude", "", "comma separated interfaces or CIDRs never to bind to")
+var overlayPort = flag.Int("overport", 0, "fixed overlay listener port on each interface (random if 0)")
+var overlayAddrs = flag.String("overadv", "", "comma separated host:port overlay addresses to advertise instead of the listeners")
+var tunnelPort = flag.Int("tunport", 0, "fixed tunnel listener port on each interface (random if 0)")
+var tunnelAddrs = flag.String("tunadv", "", "comma separated host:port tunnel addresses to advertise instead of the listeners")
+
 var cpuProfile = flag.String("cpuprof", "", "path to CPU profiling results")
 var blockProfile = flag.String("blockprof", "", "path to lock contention profiling results")
 
@@ -86,6 +101,32 @@ func parseFlags() (int, string, *rsa.PrivateKey) {
 		fmt.Fprintf(os.Stderr, "Invalid relay port: have %v, want [1-65535].\n", *relayPort)
 		os.Exit(-1)
 	}
+	// Apply the overlay parameters (validated during boot)
+	config.PastrySpace, config.PastryBase, config.PastryLeaves = *idSpace, *idBase, *leafSet
+	config.PastryNodeId = *nodeId
+	config.PastrySecureRouting = *secureRouting
+	if err := pastry.CheckIdentity(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid node id (-id): %v.\n", err)
+		os.Exit(-1)
+	}
+	if *multicast != "" {
+		config.BootMulticast = strings.Split(*multicast, ",")
+	}
+	// Apply the network interface selection and address overrides
+	if *include != "" {
+		config.NetInclude = strings.Split(*include, ",")
+	}
+	if *exclude != "" {
+		config.NetExclude = strings.Split(*exclude, ",")
+	}
+	config.PastryListenPort, config.IrisTunnelPort = *overlayPort, *tunnelPort
+	if *overlayAddrs != "" {
+		config.PastryAdvertise = strings.Split(*overlayAddrs, ",")
+	}
+	if *tunnelAddrs != "" {
+		config.IrisTunnelAdvertise = strings.Split(*tunnelAddrs, ",")
+	}
+
 	// User random cluster id and RSA key in developer mode
 	if *devMode {
 		// Generate a secure RSA key
@@ -0,0 +1,74 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// This file contains the prioritized task queue of the thread pool, consisting
+// of a FIFO lane for each priority class.
+
+package pool
+
+import "github.com/project-iris/iris/container/queue"
+
+// Task queue consisting of multiple FIFO lanes, lower lanes being more urgent.
+type taskQueue struct {
+	lanes []*queue.Queue
+}
+
+// Creates a new, empty task queue.
+func newTaskQueue() *taskQueue {
+	return &taskQueue{
+		lanes: []*queue.Queue{queue.New()},
+	}
+}
+
+// Pushes a task into the lane of the given priority, creating it if needed.
+func (q *taskQueue) Push(task Task, prio int) {
+	for len(q.lanes) <= prio {
+		q.lanes = append(q.lanes, queue.New())
+	}
+	q.lanes[prio].Push(task)
+}
+
+// Pops the oldest task from the most urgent non-empty lane.
+func (q *taskQueue) Pop() Task {
+	for _, lane := range q.lanes {
+		if !lane.Empty() {
+			return lane.Pop().(Task)
+		}
+	}
+	return nil
+}
+
+// Checks whether there are any tasks in the queue.
+func (q *taskQueue) Empty() bool {
+	return q.Size() == 0
+}
+
+// Returns the number of tasks in all the lanes.
+func (q *taskQueue) Size() int {
+	size := 0
+	for _, lane := range q.lanes {
+		size += lane.Size()
+	}
+	return size
+}
+
+// Clears out the contents of all the lanes.
+func (q *taskQueue) Reset() {
+	for _, lane := range q.lanes {
+		lane.Reset()
+	}
+}
@@ -24,8 +24,6 @@ package pool
 import (
 	"errors"
 	"sync"
-
-	"github.com/project-iris/iris/container/queue"
 )
 
 var ErrTerminating = errors.New("pool terminating")
@@ -36,7 +34,7 @@ type Task func()
 // A thread pool to place a hard limit on the number of go-routines doing some
 // type of (possibly too consuming) work.
 type ThreadPool struct {
-	tasks *queue.Queue // List of pending tasks
+	tasks *taskQueue // List of pending tasks
 
 	idle  int // Number of idle workers (i.e. not running)
 	total int // Maximum pool worker capacity
@@ -51,7 +49,7 @@ type ThreadPool struct {
 // Creates a thread pool with the given concurrent thread capacity.
 func NewThreadPool(cap int) *ThreadPool {
 	t := &ThreadPool{
-		tasks: queue.New(),
+		tasks: newTaskQueue(),
 		idle:  cap,
 		total: cap,
 	}
@@ -67,7 +65,7 @@ func (t *ThreadPool) Start() {
 	if !t.start {
 		for i := 0; i < t.total && !t.tasks.Empty(); i++ {
 			t.idle--
-			go t.runner(t.tasks.Pop().(Task))
+			go t.runner(t.tasks.Pop())
 		}
 		t.start = true
 	}
@@ -91,6 +89,12 @@ func (t *ThreadPool) Terminate(clear bool) {
 
 // Schedules a new task into the thread pool.
 func (t *ThreadPool) Schedule(task Task) error {
+	return t.SchedulePriority(task, 0)
+}
+
+// Schedules a new task into the thread pool with a given priority. Pending tasks
+// with lower priority values are started first, equal ones in scheduling order.
+func (t *ThreadPool) SchedulePriority(task Task, prio int) error {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
@@ -103,7 +107,7 @@ func (t *ThreadPool) Schedule(task Task) error {
 		t.idle--
 		go t.runner(task)
 	} else {
-		t.tasks.Push(task)
+		t.tasks.Push(task, prio)
 	}
 	return nil
 }
@@ -128,7 +132,7 @@ func (t *ThreadPool) runner(task Task) {
 		if t.tasks.Empty() {
 			t.idle++
 		} else {
-			go t.runner(t.tasks.Pop().(Task))
+			go t.runner(t.tasks.Pop())
 		}
 		t.mutex.Unlock()
 		t.done.Broadcast()
@@ -147,5 +151,5 @@ func (t *ThreadPool) next() Task {
 	if t.tasks.Empty() { // Note, tasks is reset on termination
 		return nil
 	}
-	return t.tasks.Pop().(Task)
+	return t.tasks.Pop()
 }
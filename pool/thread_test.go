@@ -160,6 +160,41 @@ func TestOrder(t *testing.T) {
 	wg.Wait() // deadlock if any task doesn't complete
 }
 
+// Tests that pending tasks are executed in priority order, and in scheduling
+// order within the same priority.
+func TestPriority(t *testing.T) {
+	t.Parallel()
+
+	tasks := 300
+	wg := new(sync.WaitGroup)
+	wg.Add(tasks)
+
+	// Create a thread pool (one task at a time) and queue tasks before starting
+	pool := NewThreadPool(1)
+
+	order := make([]int, 0, tasks)
+	for i := 0; i < tasks; i++ {
+		n := i
+		err := pool.SchedulePriority(func() {
+			order = append(order, n)
+			wg.Done()
+		}, 2-i%3)
+		if err != nil {
+			t.Fatalf("failed to schedule task: %v.", err)
+		}
+	}
+	pool.Start()
+	wg.Wait() // deadlock if any task doesn't complete
+
+	// Verify the lanes were drained in order of urgency
+	for i, n := range order {
+		prio, idx := i/(tasks/3), i%(tasks/3)
+		if want := 3*idx + 2 - prio; n != want {
+			t.Fatalf("unexpected task at position %d: have %d, want %d.", i, n, want)
+		}
+	}
+}
+
 // Tests that task dumping is possible, and pool keeps operating afterwards.
 func TestClear(t *testing.T) {
 	t.Parallel()
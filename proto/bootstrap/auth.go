@@ -0,0 +1,129 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// This file contains the bootstrap beacon authentication. Both the magic and
+// the MAC key are derived from the cluster name and the cluster credentials, so
+// hosts without the credentials can neither learn the cluster names from the
+// beacons, nor inject forged announcements. Each beacon is stamped with the
+// send time and a random nonce, and is MAC'd as a whole (trailing the encoded
+// message). Beacons outside the replay window, already seen within it, or sent
+// from an address other than the authenticated one are dropped, so recorded
+// beacons cannot be replayed to steer other nodes towards chosen addresses.
+
+package bootstrap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/codec"
+)
+
+// Derives the keyed cluster magic and the beacon MAC key from the cluster name
+// and the shared cluster secret.
+func deriveKeys(cluster, secret []byte) (magic, key []byte) {
+	master := mac(secret, cluster)
+	return mac(master, config.BootMagicInfo), mac(master, config.BootMacInfo)
+}
+
+// Calculates the HMAC of the given data with the configured hash.
+func mac(key, data []byte) []byte {
+	h := hmac.New(config.BootMacHash, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Assembles a fresh, authenticated beat request or response packet.
+func (bs *Bootstrapper) seal(request bool) []byte {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate beacon nonce: %v.", err))
+	}
+	msg := &Message{
+		Version: config.ProtocolVersion,
+		Magic:   bs.magic,
+		NodeId:  bs.node,
+		Overlay: bs.overlay,
+		Request: request,
+		Space:   config.PastrySpace,
+		Base:    config.PastryBase,
+		Leaves:  config.PastryLeaves,
+		Time:    time.Now().UnixNano(),
+		Nonce:   binary.BigEndian.Uint64(nonce[:]),
+		Addr:    bs.addr.IP,
+	}
+	payload := codec.NewEncoder().Encode(msg)
+
+	packet := make([]byte, len(payload), len(payload)+config.BootMacHash().Size())
+	copy(packet, payload)
+	return append(packet, mac(bs.key, payload)...)
+}
+
+// Verifies the authenticity, freshness and source of a beacon packet, and decodes
+// the message within. Successfully opened beacons are remembered until they
+// leave the replay window.
+func (bs *Bootstrapper) open(packet []byte, from net.IP) (*Message, error) {
+	// Split and verify the MAC before touching the payload
+	size := config.BootMacHash().Size()
+	if len(packet) <= size {
+		return nil, errors.New("beacon too short")
+	}
+	payload, sum := packet[:len(packet)-size], packet[len(packet)-size:]
+	if !hmac.Equal(sum, mac(bs.key, payload)) {
+		return nil, errors.New("beacon authentication failed")
+	}
+	msg := new(Message)
+	if err := codec.Decode(payload, msg); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(msg.Magic, bs.magic) {
+		return nil, errors.New("cluster magic mismatch")
+	}
+	if !net.IP(msg.Addr).Equal(from) {
+		return nil, fmt.Errorf("beacon source mismatch: have %v, want %v", from, net.IP(msg.Addr))
+	}
+	// Drop stale and replayed beacons
+	now := time.Now()
+	if skew := now.Sub(time.Unix(0, msg.Time)); skew > config.BootReplayWindow || skew < -config.BootReplayWindow {
+		return nil, fmt.Errorf("beacon outside of replay window: skew %v", skew)
+	}
+	id := string(sum)
+
+	bs.seenLock.Lock()
+	defer bs.seenLock.Unlock()
+
+	if expiry, ok := bs.seen[id]; ok && now.Before(expiry) {
+		return nil, errors.New("replayed beacon")
+	}
+	if len(bs.seen) >= bs.prune {
+		for k, expiry := range bs.seen {
+			if !now.Before(expiry) {
+				delete(bs.seen, k)
+			}
+		}
+		bs.prune = 2*len(bs.seen) + 64
+	}
+	// Remember the beacon until its stamp leaves the window (rejected afterwards anyway)
+	bs.seen[id] = time.Unix(0, msg.Time).Add(config.BootReplayWindow)
+	return msg, nil
+}
@@ -23,19 +23,24 @@
 //
 // Since the heartbeats are on UDP, each one is flagged as a beat request or
 // response (i.e. reply to requests, but don't loop indefinitely).
+//
+// Alternatively, on interfaces configured so, the peers are discovered through
+// multicast announcements instead of probing and scanning (see multicast.go).
+//
+// The heartbeats are authenticated with keys derived from the cluster name and
+// credentials, and carry replay protection (see auth.go).
 package bootstrap
 
 import (
-	"bytes"
 	"fmt"
 	"math/big"
 	"math/rand"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/project-iris/iris/config"
-	"github.com/project-iris/iris/gobber"
 )
 
 // Constants for the protocol UDP layer
@@ -48,13 +53,19 @@ type Event struct {
 	Resp bool         // Flag specifying bootstrap event type
 }
 
-// Bootstrap state message.
+// Bootstrap state message, also advertising the overlay parameters.
 type Message struct {
 	Version string
 	Magic   []byte
 	NodeId  *big.Int
 	Overlay int
 	Request bool
+	Space   int
+	Base    int
+	Leaves  int
+	Time    int64  // Send time of the beacon (unix nanoseconds)
+	Nonce   uint64 // Random nonce to distinguish beacons sent at once
+	Addr    []byte // IP address of the sender, to bind the beacon to its source
 }
 
 // Bootstrapper state for a single network interface.
@@ -63,11 +74,17 @@ type Bootstrapper struct {
 	sock *net.UDPConn
 	mask *net.IPMask
 
-	magic    []byte // Filters side-by-side Iris networks
-	request  []byte // Pre-generated request packet
-	response []byte // Pre-generated response packet
+	group *net.UDPAddr // Multicast group to announce to (nil if probing and scanning)
+	msock *net.UDPConn // Multicast group listener
+
+	magic   []byte   // Keyed cluster hash, filters side-by-side Iris networks
+	key     []byte   // Beacon authentication key
+	node    *big.Int // Overlay node id to advertise
+	overlay int      // Overlay listener port to advertise
 
-	gob *gobber.Gobber // Datagram gobber to decode the network messages
+	seen     map[string]time.Time // Recently accepted beacons, with their expiries
+	prune    int                  // Beacon count after which to evict expired ones
+	seenLock sync.Mutex           // Mutex protecting the beacon memory
 
 	beats chan *Event     // Channel on which to report bootstrap events
 	quit  chan chan error // Quit channel to synchronize bootstrapper termination
@@ -76,15 +93,21 @@ type Bootstrapper struct {
 }
 
 // Creates a new bootstrapper, configuring to listen on the given interface for
-// for incoming requests and scan the same interface for other peers. The magic
-// is used to filter multiple Iris networks in the same physical network, while
-// the overlay is the TCP listener port of the DHT.
-func New(ipnet *net.IPNet, magic []byte, node *big.Int, overlay int) (*Bootstrapper, chan *Event, error) {
+// for incoming requests and scan the same interface for other peers. The cluster
+// name is used to filter multiple Iris networks in the same physical network,
+// and together with the cluster secret to authenticate the beacons, while the
+// overlay is the TCP listener port of the DHT.
+func New(ipnet *net.IPNet, cluster, secret []byte, node *big.Int, overlay int) (*Bootstrapper, chan *Event, error) {
 	bs := &Bootstrapper{
-		magic: magic,
-		beats: make(chan *Event, config.BootBeatsBuffer),
-		fast:  true,
+		node:    node,
+		overlay: overlay,
+		seen:    make(map[string]time.Time),
+		prune:   64,
+		beats:   make(chan *Event, config.BootBeatsBuffer),
+		fast:    true,
 	}
+	bs.magic, bs.key = deriveKeys(cluster, secret)
+
 	// Open the server socket
 	var err error
 	for _, port := range config.BootPorts {
@@ -104,31 +127,21 @@ func New(ipnet *net.IPNet, magic []byte, node *big.Int, overlay int) (*Bootstrap
 	if err != nil {
 		return nil, nil, fmt.Errorf("no available ports")
 	}
-	// Generate the local heartbeat messages (request and response)
-	bs.magic = magic
-	bs.gob = gobber.New()
-	bs.gob.Init(new(Message))
-
-	msg := Message{
-		Version: config.ProtocolVersion,
-		Magic:   magic,
-		NodeId:  node,
-		Overlay: overlay,
-		Request: true,
-	}
-	if buf, err := bs.gob.Encode(msg); err != nil {
-		return nil, nil, fmt.Errorf("request encode failed: %v.", err)
-	} else {
-		bs.request = make([]byte, len(buf))
-		copy(bs.request, buf)
+	// Join the multicast group if configured on the interface
+	iface, group, err := multicast(ipnet)
+	if err != nil {
+		bs.sock.Close()
+		return nil, nil, err
 	}
-
-	msg.Request = false
-	if buf, err := bs.gob.Encode(msg); err != nil {
-		return nil, nil, fmt.Errorf("response encode failed: %v.", err)
-	} else {
-		bs.response = make([]byte, len(buf))
-		copy(bs.response, buf)
+	if iface != nil {
+		if bs.msock, err = net.ListenMulticastUDP(group.Network(), iface, group); err != nil {
+			bs.sock.Close()
+			return nil, nil, err
+		}
+		bs.group = group
+	} else if ipnet.IP.To4() == nil {
+		bs.sock.Close()
+		return nil, nil, fmt.Errorf("multicast discovery unavailable on IPv6 interface %v", ipnet.IP)
 	}
 	// Return the ready-to-boot bootstrapper
 	return bs, bs.beats, nil
@@ -138,9 +151,14 @@ func New(ipnet *net.IPNet, magic []byte, node *big.Int, overlay int) (*Bootstrap
 func (bs *Bootstrapper) Boot() error {
 	bs.quit = make(chan chan error, 3)
 
-	go bs.accept()
-	go bs.probe()
-	go bs.scan()
+	go bs.accept(bs.sock)
+	if bs.group != nil {
+		go bs.accept(bs.msock)
+		go bs.announce()
+	} else {
+		go bs.probe()
+		go bs.scan()
+	}
 
 	return nil
 }
@@ -151,7 +169,8 @@ func (bs *Bootstrapper) Terminate() error {
 	if bs.quit == nil {
 		return fmt.Errorf("non-booted bootstrapper")
 	}
-	// Retrieve three errors for the acceptor, prober and scanner routines
+	// Retrieve three errors for the acceptor, prober and scanner routines (or the
+	// acceptors and announcer in multicast mode)
 	errc := make([]chan error, 3)
 	errs := []error{}
 	for i := 0; i < len(errc); i++ {
@@ -163,6 +182,8 @@ func (bs *Bootstrapper) Terminate() error {
 			errs = append(errs, err)
 		}
 	}
+	close(bs.beats)
+
 	// Report the errors and return
 	switch len(errs) {
 	case 0:
@@ -180,10 +201,11 @@ func (bs *Bootstrapper) SetMode(startup bool) {
 }
 
 // Heartbeat and connect packet acceptor routine. It listens for incoming UDP
-// packets, and for each one verifies that the protocol version and bootstrap
-// magic number match the local one. If the verifications passes, the remote
-// overlay's id and listener port is sent to the maintenance thread to sort out.
-func (bs *Bootstrapper) accept() {
+// packets, and for each one verifies its authenticity and freshness, and that
+// the protocol version and overlay parameters match the local ones. If the
+// verifications passes, the remote overlay's id and listener port is sent to
+// the maintenance thread to sort out.
+func (bs *Bootstrapper) accept(sock *net.UDPConn) {
 	buf := make([]byte, 1500) // UDP MTU
 	var errc chan error
 
@@ -194,14 +216,17 @@ func (bs *Bootstrapper) accept() {
 			break
 		default:
 			// Wait for a UDP packet (with a reasonable timeout)
-			bs.sock.SetReadDeadline(time.Now().Add(acceptTimeout))
-			if size, from, err := bs.sock.ReadFromUDP(buf); err == nil {
-				msg := new(Message)
-				if err := bs.gob.Decode(buf[:size], msg); err == nil {
-					if config.ProtocolVersion == msg.Version && msg.Magic != nil && bytes.Compare(bs.magic, msg.Magic) == 0 {
+			sock.SetReadDeadline(time.Now().Add(acceptTimeout))
+			if size, from, err := sock.ReadFromUDP(buf); err == nil {
+				// Drop looped back and foreign subnet announcements
+				if sock == bs.msock && (!bs.local(from.IP) || (from.IP.Equal(bs.addr.IP) && from.Port == bs.addr.Port)) {
+					continue
+				}
+				if msg, err := bs.open(buf[:size], from.IP); err == nil {
+					if config.ProtocolVersion == msg.Version && compatible(msg) {
 						// If it's a beat request, respond to it
 						if msg.Request {
-							bs.sock.WriteToUDP(bs.response, from)
+							bs.sock.WriteToUDP(bs.seal(false), from)
 						}
 						// Notify the maintenance routine
 						host := net.JoinHostPort(from.IP.String(), strconv.Itoa(msg.Overlay))
@@ -218,8 +243,13 @@ func (bs *Bootstrapper) accept() {
 		}
 	}
 	// Clean up resources and report results
-	close(bs.beats)
-	errc <- bs.sock.Close()
+	errc <- sock.Close()
+}
+
+// Checks whether a remote bootstrapper advertised overlay parameters matching
+// the local ones.
+func compatible(msg *Message) bool {
+	return msg.Space == config.PastrySpace && msg.Base == config.PastryBase
 }
 
 // Sends heartbeat messages to random hosts on the listener-local address. The
@@ -246,7 +276,8 @@ func (bs *Bootstrapper) probe() {
 					subip >>= 8
 				}
 			}
-			// Iterate over every bootstrap port
+			// Iterate over every bootstrap port (with a freshly stamped beacon)
+			request := bs.seal(true)
 			for _, port := range config.BootPorts {
 				dest := net.JoinHostPort(host.String(), strconv.Itoa(port))
 
@@ -255,7 +286,7 @@ func (bs *Bootstrapper) probe() {
 				if err != nil {
 					panic(fmt.Sprintf("failed to resolve remote bootstrapper (%v): %v.", dest, err))
 				}
-				bs.sock.WriteToUDP(bs.request, raddr)
+				bs.sock.WriteToUDP(request, raddr)
 			}
 			// Wait for the next cycle
 			var wake <-chan time.Time
@@ -322,7 +353,8 @@ func (bs *Bootstrapper) scan() {
 				host[i] |= byte(scanip & 255)
 				scanip >>= 8
 			}
-			// Iterate over every bootstrap port
+			// Iterate over every bootstrap port (with a freshly stamped beacon)
+			request := bs.seal(true)
 			for _, port := range config.BootPorts {
 				// Don't connect to ourselves
 				if port == bs.addr.Port && host.Equal(bs.addr.IP) {
@@ -335,7 +367,7 @@ func (bs *Bootstrapper) scan() {
 				if err != nil {
 					panic(fmt.Sprintf("failed to resolve remote bootstrapper (%v): %v.", dest, err))
 				}
-				bs.sock.WriteToUDP(bs.request, raddr)
+				bs.sock.WriteToUDP(request, raddr)
 			}
 			// Wait for the next cycle
 			select {
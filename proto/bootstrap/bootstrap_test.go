@@ -18,6 +18,7 @@
 package bootstrap
 
 import (
+	"bytes"
 	"math/big"
 	"net"
 	"testing"
@@ -34,7 +35,7 @@ func TestPortSelection(t *testing.T) {
 	}
 	// Make sure bootstrappers can select unused ports
 	for i := 0; i < len(config.BootPorts); i++ {
-		if bs, _, err := New(ipnet, []byte("magic"), big.NewInt(int64(i)), 11111); err != nil {
+		if bs, _, err := New(ipnet, []byte("magic"), []byte("secret"), big.NewInt(int64(i)), 11111); err != nil {
 			t.Fatalf("failed to create bootstrapper: %v.", err)
 		} else {
 			if err := bs.Boot(); err != nil {
@@ -44,7 +45,7 @@ func TestPortSelection(t *testing.T) {
 		}
 	}
 	// Ensure failure after all ports are used
-	if _, _, err := New(ipnet, []byte("magic"), big.NewInt(333), 11111); err == nil {
+	if _, _, err := New(ipnet, []byte("magic"), []byte("secret"), big.NewInt(333), 11111); err == nil {
 		t.Errorf("bootstrapper created even though no ports were available.")
 	}
 }
@@ -62,7 +63,7 @@ func TestScan(t *testing.T) {
 		Mask: over2.IP.DefaultMask(),
 	}
 	// Start up two bootstrappers
-	bs1, evs1, err := New(ipnet1, []byte("magic"), big.NewInt(1), over1.Port)
+	bs1, evs1, err := New(ipnet1, []byte("magic"), []byte("secret"), big.NewInt(1), over1.Port)
 	if err != nil {
 		t.Fatalf("failed to create first booter: %v.", err)
 	}
@@ -71,7 +72,7 @@ func TestScan(t *testing.T) {
 	}
 	defer bs1.Terminate()
 
-	bs2, evs2, err := New(ipnet2, []byte("magic"), big.NewInt(2), over2.Port)
+	bs2, evs2, err := New(ipnet2, []byte("magic"), []byte("secret"), big.NewInt(2), over2.Port)
 	if err != nil {
 		t.Fatalf("failed to create second booter: %v.", err)
 	}
@@ -123,7 +124,7 @@ func TestMagic(t *testing.T) {
 		Mask: over2.IP.DefaultMask(),
 	}
 	// Start up two bootstrappers
-	bs1, evs1, err := New(ipnet1, []byte("magic1"), big.NewInt(1), over1.Port)
+	bs1, evs1, err := New(ipnet1, []byte("magic1"), []byte("secret"), big.NewInt(1), over1.Port)
 	if err != nil {
 		t.Fatalf("failed to create first booter: %v.", err)
 	}
@@ -132,7 +133,7 @@ func TestMagic(t *testing.T) {
 	}
 	defer bs1.Terminate()
 
-	bs2, evs2, err := New(ipnet2, []byte("magic2"), big.NewInt(2), over2.Port)
+	bs2, evs2, err := New(ipnet2, []byte("magic2"), []byte("secret"), big.NewInt(2), over2.Port)
 	if err != nil {
 		t.Fatalf("failed to create second booter: %v.", err)
 	}
@@ -153,5 +154,217 @@ func TestMagic(t *testing.T) {
 	}
 }
 
+func TestAuthentication(t *testing.T) {
+	// Define some local constants
+	over1, _ := net.ResolveTCPAddr("tcp", "127.0.0.3:33333")
+	over2, _ := net.ResolveTCPAddr("tcp", "127.0.0.5:55555")
+	ipnet1 := &net.IPNet{
+		IP:   over1.IP,
+		Mask: over1.IP.DefaultMask(),
+	}
+	ipnet2 := &net.IPNet{
+		IP:   over2.IP,
+		Mask: over2.IP.DefaultMask(),
+	}
+	// Start up two bootstrappers with the same cluster name, but different secrets
+	bs1, evs1, err := New(ipnet1, []byte("magic"), []byte("secret1"), big.NewInt(1), over1.Port)
+	if err != nil {
+		t.Fatalf("failed to create first booter: %v.", err)
+	}
+	if err := bs1.Boot(); err != nil {
+		t.Fatalf("failed to boot first booter: %v.", err)
+	}
+	defer bs1.Terminate()
+
+	bs2, evs2, err := New(ipnet2, []byte("magic"), []byte("secret2"), big.NewInt(2), over2.Port)
+	if err != nil {
+		t.Fatalf("failed to create second booter: %v.", err)
+	}
+	if err := bs2.Boot(); err != nil {
+		t.Fatalf("failed to boot second booter: %v.", err)
+	}
+	defer bs2.Terminate()
+
+	// No beats should arrive since the beacons cannot be authenticated
+	timeout := time.Tick(500 * time.Millisecond)
+	select {
+	case <-timeout:
+		// Do nothing
+	case a := <-evs1:
+		t.Fatalf("extra address on first booter: %v.", a)
+	case a := <-evs2:
+		t.Fatalf("extra address on second booter: %v.", a)
+	}
+}
+
+func TestBeacons(t *testing.T) {
+	// Create a socketless bootstrapper to seal and open beacons with
+	bs := &Bootstrapper{
+		addr:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		node:    big.NewInt(1),
+		overlay: 11111,
+		seen:    make(map[string]time.Time),
+		prune:   64,
+	}
+	bs.magic, bs.key = deriveKeys([]byte("magic"), []byte("secret"))
+
+	// The cluster name should not leak in cleartext
+	if bytes.Contains(bs.seal(true), []byte("magic")) {
+		t.Fatalf("cluster name leaked into beacon.")
+	}
+	// Valid beacons should open exactly once
+	packet := bs.seal(true)
+	if msg, err := bs.open(packet, bs.addr.IP); err != nil {
+		t.Fatalf("failed to open valid beacon: %v.", err)
+	} else if msg.NodeId.Cmp(bs.node) != 0 || msg.Overlay != bs.overlay || !msg.Request {
+		t.Fatalf("beacon content mismatch: have %v/%v/%v, want %v/%v/%v.", msg.NodeId, msg.Overlay, msg.Request, bs.node, bs.overlay, true)
+	}
+	if _, err := bs.open(packet, bs.addr.IP); err == nil {
+		t.Fatalf("replayed beacon accepted.")
+	}
+	// Beacons replayed from other sources should be refused
+	if _, err := bs.open(bs.seal(true), net.IPv4(127, 0, 0, 2)); err == nil {
+		t.Fatalf("beacon from foreign source accepted.")
+	}
+	// Tampered and truncated beacons should be refused
+	packet = bs.seal(false)
+	for i := 0; i < len(packet); i++ {
+		tampered := append([]byte{}, packet...)
+		tampered[i] ^= 0x01
+		if _, err := bs.open(tampered, bs.addr.IP); err == nil {
+			t.Fatalf("beacon tampered at byte %d accepted.", i)
+		}
+	}
+	if _, err := bs.open(packet[:len(packet)-1], bs.addr.IP); err == nil {
+		t.Fatalf("truncated beacon accepted.")
+	}
+	// Stale beacons should be refused
+	window := config.BootReplayWindow
+	defer func() { config.BootReplayWindow = window }()
+
+	packet = bs.seal(false)
+	config.BootReplayWindow = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, err := bs.open(packet, bs.addr.IP); err == nil {
+		t.Fatalf("stale beacon accepted.")
+	}
+}
+
+// Finds a multicast capable interface address of the requested family to test
+// multicast discovery on, or nil if none is available.
+func multicastNet(v6 bool) (*net.IPNet, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if in, ok := addr.(*net.IPNet); ok {
+				if !v6 && in.IP.To4() != nil {
+					return in, nil
+				}
+				if v6 && in.IP.To4() == nil && in.IP.IsGlobalUnicast() {
+					return in, nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func TestMulticast4(t *testing.T) {
+	ipnet, err := multicastNet(false)
+	if err != nil {
+		t.Fatalf("failed to retrieve network interfaces: %v.", err)
+	}
+	if ipnet == nil {
+		t.Skip("no IPv4 multicast capable interface found.")
+	}
+	testMulticast(t, ipnet)
+}
+
+func TestMulticast6(t *testing.T) {
+	ipnet, err := multicastNet(true)
+	if err != nil {
+		t.Fatalf("failed to retrieve network interfaces: %v.", err)
+	}
+	if ipnet == nil {
+		t.Skip("no IPv6 multicast capable interface found.")
+	}
+	testMulticast(t, ipnet)
+}
+
+func testMulticast(t *testing.T, ipnet *net.IPNet) {
+	// Enable multicast discovery on the interface
+	olds := config.BootMulticast
+	defer func() { config.BootMulticast = olds }()
+	config.BootMulticast = []string{ipnet.String()}
+
+	// Start up two bootstrappers on the same interface
+	bs1, evs1, err := New(ipnet, []byte("magic"), []byte("secret"), big.NewInt(1), 11111)
+	if err != nil {
+		t.Fatalf("failed to create first booter: %v.", err)
+	}
+	if bs1.group == nil {
+		t.Fatalf("multicast discovery not enabled.")
+	}
+	if (bs1.group.IP.To4() == nil) != (ipnet.IP.To4() == nil) {
+		t.Fatalf("multicast group family mismatch: have %v, want family of %v.", bs1.group, ipnet.IP)
+	}
+	if err := bs1.Boot(); err != nil {
+		t.Fatalf("failed to boot first booter: %v.", err)
+	}
+	defer bs1.Terminate()
+
+	bs2, evs2, err := New(ipnet, []byte("magic"), []byte("secret"), big.NewInt(2), 22222)
+	if err != nil {
+		t.Fatalf("failed to create second booter: %v.", err)
+	}
+	if err := bs2.Boot(); err != nil {
+		t.Fatalf("failed to boot second booter: %v.", err)
+	}
+	defer bs2.Terminate()
+
+	// Make sure they found each other (both request and response) and not themselves
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-evs1:
+			if e.Peer.Cmp(big.NewInt(2)) != 0 || !e.Addr.IP.Equal(ipnet.IP) || e.Addr.Port != 22222 {
+				t.Fatalf("invalid event on first booter: have %v/%v, want %v/%v.", e.Peer, e.Addr, 2, 22222)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("first booter timed out.")
+		}
+		select {
+		case e := <-evs2:
+			if e.Peer.Cmp(big.NewInt(1)) != 0 || !e.Addr.IP.Equal(ipnet.IP) || e.Addr.Port != 11111 {
+				t.Fatalf("invalid event on second booter: have %v/%v, want %v/%v.", e.Peer, e.Addr, 1, 11111)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("second booter timed out.")
+		}
+	}
+}
+
+func TestMulticastRequired6(t *testing.T) {
+	// IPv6 interfaces cannot be probed, so bootstrappers must refuse them without multicast
+	ipnet := &net.IPNet{
+		IP:   net.ParseIP("::1"),
+		Mask: net.CIDRMask(128, 128),
+	}
+	olds := config.BootMulticast
+	defer func() { config.BootMulticast = olds }()
+	config.BootMulticast = []string{}
+
+	if bs, _, err := New(ipnet, []byte("magic"), []byte("secret"), big.NewInt(1), 11111); err == nil {
+		bs.sock.Close()
+		t.Fatalf("bootstrapper created on IPv6 interface without multicast.")
+	}
+}
+
 // Missing test for probing. A bit complicated as a small subnet is needed with
 // scanning disabled. Delay for now.
@@ -0,0 +1,70 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the binary codec serializers of the bootstrap messages.
+
+package bootstrap
+
+import "github.com/project-iris/iris/proto/codec"
+
+// Serializes the bootstrap state message.
+func (m *Message) MarshalCodec(e *codec.Encoder) {
+	e.String(1, m.Version)
+	e.Bytes(2, m.Magic)
+	e.BigInt(3, m.NodeId)
+	e.Int(4, int64(m.Overlay))
+	e.Bool(5, m.Request)
+	e.Int(6, int64(m.Space))
+	e.Int(7, int64(m.Base))
+	e.Int(8, int64(m.Leaves))
+	e.Int(9, m.Time)
+	e.Uint(10, m.Nonce)
+	e.Bytes(11, m.Addr)
+}
+
+// Deserializes the bootstrap state message.
+func (m *Message) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			m.Version = d.String()
+		case 2:
+			m.Magic = d.Bytes()
+		case 3:
+			m.NodeId = d.BigInt()
+		case 4:
+			m.Overlay = int(d.Int())
+		case 5:
+			m.Request = d.Bool()
+		case 6:
+			m.Space = int(d.Int())
+		case 7:
+			m.Base = int(d.Int())
+		case 8:
+			m.Leaves = int(d.Int())
+		case 9:
+			m.Time = d.Int()
+		case 10:
+			m.Nonce = d.Uint()
+		case 11:
+			m.Addr = d.Bytes()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
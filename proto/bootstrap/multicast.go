@@ -0,0 +1,98 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// This file contains the multicast discovery mode. Instead of probing random
+// hosts and scanning the whole subnet, the bootstrapper periodically announces
+// itself to a multicast group joined by all the peers on the interface. The
+// announcements are regular beat requests, answered with unicast responses, so
+// the reported events are the same as in the probing mode.
+//
+// IPv4 interfaces use an organization-local group, whereas IPv6 interfaces a
+// link-local one (zoned to the interface). As IPv6 subnets cannot be probed or
+// scanned, multicast is the only discovery mode available on them.
+//
+// Note, the announcements are sent from the unicast socket bound to the
+// interface address, which on most systems also selects the outbound interface.
+
+package bootstrap
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/ext/netext"
+)
+
+// Looks up the network interface owning the given address and checks whether
+// multicast discovery is configured for it. If so, the interface is returned
+// along with the multicast group to use.
+func multicast(ipnet *net.IPNet) (*net.Interface, *net.UDPAddr, error) {
+	if len(config.BootMulticast) == 0 {
+		return nil, nil, nil
+	}
+	iface, err := netext.Owner(ipnet.IP)
+	if err != nil || iface == nil {
+		return nil, nil, err
+	}
+	if !netext.Matches(iface.Name, ipnet.IP, config.BootMulticast) || iface.Flags&net.FlagMulticast == 0 {
+		return nil, nil, nil
+	}
+	// Select the group matching the interface address family
+	host, port, network := config.BootMulticastGroup4, config.BootMulticastPort4, "udp4"
+	if ipnet.IP.To4() == nil {
+		host, port, network = config.BootMulticastGroup6, config.BootMulticastPort6, "udp6"
+	}
+	group, err := net.ResolveUDPAddr(network, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if group.IP.To4() == nil {
+		group.Zone = iface.Name
+	}
+	return iface, group, nil
+}
+
+// Checks whether an address is inside the bootstrapper's subnet.
+func (bs *Bootstrapper) local(ip net.IP) bool {
+	return bs.addr.IP.Mask(*bs.mask).Equal(ip.Mask(*bs.mask))
+}
+
+// Periodically sends heartbeat messages to the multicast group of the interface,
+// using the same sampling speeds as the prober.
+func (bs *Bootstrapper) announce() {
+	var errc chan error
+	for errc == nil {
+		// Announce the local node to the group
+		bs.sock.WriteToUDP(bs.seal(true), bs.group)
+
+		// Wait for the next cycle
+		var wake <-chan time.Time
+		if bs.fast {
+			wake = time.After(time.Duration(config.BootFastProbe) * time.Millisecond)
+		} else {
+			wake = time.After(time.Duration(config.BootSlowProbe) * time.Millisecond)
+		}
+		select {
+		case errc = <-bs.quit:
+		case <-wake:
+		}
+	}
+	// Report termination
+	errc <- nil
+}
@@ -0,0 +1,102 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Package buffer implements reference counted, size classed byte buffers, which
+// are recycled through a set of global pools to reduce the garbage collector
+// overhead of the message payloads flowing through the protocol stack.
+//
+// A buffer starts with a single reference held by its creator. Every party that
+// needs the buffer beyond a synchronous call must retain it, and release it once
+// done. The last release returns the buffer into its pool. Buffers that are not
+// released are simply garbage collected, so leaking a reference is always safe,
+// while releasing too many is an implementation bug.
+package buffer
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Size limits of the pooled buffers. Buffers outside this range are allocated
+// directly and never recycled.
+const (
+	minClassBits = 6  // Smallest size class (64B)
+	maxClassBits = 20 // Largest size class (1MB)
+)
+
+// Pools of the individual size classes.
+var pools [maxClassBits - minClassBits + 1]sync.Pool
+
+// Reference counted byte buffer.
+type Buffer struct {
+	Data []byte // Payload contents, sized to the requested length
+
+	refs  int32 // Number of live references to the buffer
+	class int   // Size class of the buffer (-1 if not pooled)
+}
+
+// Retrieves a buffer from the pools, capable of holding size bytes. The data of
+// the buffer is not cleared. The returned buffer holds a single reference.
+func Get(size int) *Buffer {
+	class := classOf(size)
+	if class < 0 {
+		return &Buffer{Data: make([]byte, size), refs: 1, class: -1}
+	}
+	if buf, ok := pools[class].Get().(*Buffer); ok {
+		buf.Data = buf.Data[:size]
+		buf.refs = 1
+		return buf
+	}
+	return &Buffer{Data: make([]byte, size, 1<<uint(class+minClassBits)), refs: 1, class: class}
+}
+
+// Wraps an unmanaged byte slice into a buffer, which is never recycled. Useful
+// to pass payloads not originating from the pools along the pooled ones.
+func Wrap(data []byte) *Buffer {
+	return &Buffer{Data: data, refs: 1, class: -1}
+}
+
+// Calculates the size class of a buffer length, or -1 if it's not poolable.
+func classOf(size int) int {
+	if size > 1<<maxClassBits {
+		return -1
+	}
+	class := 0
+	for 1<<uint(class+minClassBits) < size {
+		class++
+	}
+	return class
+}
+
+// Adds an extra reference to the buffer.
+func (b *Buffer) Retain() {
+	atomic.AddInt32(&b.refs, 1)
+}
+
+// Drops a reference of the buffer, returning it to its pool if it was the last
+// one. The buffer must not be accessed by the releaser afterwards.
+func (b *Buffer) Release() {
+	switch refs := atomic.AddInt32(&b.refs, -1); {
+	case refs > 0:
+		return
+	case refs < 0:
+		panic("buffer: released more than retained")
+	}
+	if b.class >= 0 {
+		pools[b.class].Put(b)
+	}
+}
@@ -0,0 +1,98 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package buffer
+
+import "testing"
+
+// Sink to prevent the compiler from optimizing away benchmark allocations.
+var sink []byte
+
+// Tests that buffers are sized correctly and recycled only after the last
+// reference is released.
+func TestRefCounting(t *testing.T) {
+	for _, size := range []int{0, 1, 63, 64, 65, 1000, 1 << 20, 1<<20 + 1} {
+		buf := Get(size)
+		if len(buf.Data) != size {
+			t.Fatalf("size %d: buffer length mismatch: have %d, want %d.", size, len(buf.Data), size)
+		}
+		buf.Retain()
+		buf.Release()
+		if buf.refs != 1 {
+			t.Fatalf("size %d: reference count mismatch: have %d, want %d.", size, buf.refs, 1)
+		}
+		buf.Release()
+		if buf.refs != 0 {
+			t.Fatalf("size %d: reference count mismatch: have %d, want %d.", size, buf.refs, 0)
+		}
+	}
+	// Make sure over-releasing is caught
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("over-release not detected.")
+		}
+	}()
+	buf := Get(128)
+	buf.Release()
+	buf.Release()
+}
+
+// Benchmarks the payload handling of a 16 way fan-out with copying.
+func BenchmarkFanOutCopy(b *testing.B) {
+	data := make([]byte, 4096)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 16; j++ {
+			sink = make([]byte, len(data))
+			copy(sink, data)
+		}
+	}
+}
+
+// Benchmarks the payload handling of a 16 way fan-out with a pooled buffer.
+func BenchmarkFanOutPooled(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := Get(4096)
+		for j := 0; j < 16; j++ {
+			buf.Retain()
+		}
+		for j := 0; j < 16; j++ {
+			buf.Release()
+		}
+		buf.Release()
+	}
+}
+
+// Benchmarks the allocation of a fresh receive buffer.
+func BenchmarkRecvAlloc(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sink = make([]byte, 4096)
+	}
+}
+
+// Benchmarks the retrieval of a pooled receive buffer.
+func BenchmarkRecvPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Get(4096).Release()
+	}
+}
@@ -0,0 +1,436 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Package codec implements the compact, versioned binary serialization format
+// used on the wire by all the protocol layers.
+//
+// An encoded message starts with a single version byte, followed by a sequence
+// of tagged fields. Each field is prefixed by a varint key, composed of the field
+// tag (explicitly assigned by the message schema) and the wire type: either a
+// varint or a length prefixed byte blob. Nested messages are encoded as blobs.
+// Fields can be repeated, and unknown fields are skipped during decoding, which
+// allows extending the schemas in a backward compatible way.
+//
+// Polymorphic (meta) fields are encoded as a blob prefixed by the registered
+// kind of the contained message. Kinds must be globally unique, currently:
+//
+//	0 - raw binary blob (built in)
+//	1 - link close packet
+//	2 - session link request
+//	3 - pastry header
+//	4 - pastry init packet
+//	5 - scribe header
+//	6 - iris header
+//	7 - iris tunnel init packet
+//	8 - iris tunnel auth packet
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Version of the wire format.
+const Version byte = 1
+
+// Wire types of the individual fields.
+const (
+	wireVarint = 0 // Variable length integer
+	wireBlob   = 2 // Length prefixed byte array
+)
+
+// Codec errors.
+var ErrVersion = errors.New("codec: unsupported version")
+var ErrTruncated = errors.New("codec: truncated data")
+var ErrWireType = errors.New("codec: wire type mismatch")
+
+// Message which can be serialized into the binary format.
+type Message interface {
+	// Serializes the fields of the message into the encoder.
+	MarshalCodec(e *Encoder)
+
+	// Deserializes the fields of the message from the decoder.
+	UnmarshalCodec(d *Decoder) error
+}
+
+// Registry of the polymorphic message kinds.
+var kinds = make(map[uint64]reflect.Type)
+var types = make(map[reflect.Type]uint64)
+var lock sync.RWMutex
+
+// Registers a message type (pointer to a struct) as a polymorphic kind.
+func Register(kind uint64, msg Message) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	typ := reflect.TypeOf(msg)
+	if old, ok := kinds[kind]; ok && old != typ {
+		panic(fmt.Sprintf("codec: kind %d already registered for %v", kind, old))
+	}
+	kinds[kind], types[typ] = typ, kind
+}
+
+// Encoder serializing messages into a reusable buffer.
+type Encoder struct {
+	buf  []byte                      // Output buffer
+	subs []*Encoder                  // Pool of encoders for nested messages
+	vint [binary.MaxVarintLen64]byte // Scratch space for varint encoding
+}
+
+// Creates a new encoder.
+func NewEncoder() *Encoder {
+	return new(Encoder)
+}
+
+// Serializes a message into the internal buffer, prefixed with the version. The
+// returned slice is valid only until the next call to the encoder.
+func (e *Encoder) Encode(msg Message) []byte {
+	e.buf = append(e.buf[:0], Version)
+	msg.MarshalCodec(e)
+	return e.buf
+}
+
+// Appends a raw varint to the buffer.
+func (e *Encoder) varint(v uint64) {
+	n := binary.PutUvarint(e.vint[:], v)
+	e.buf = append(e.buf, e.vint[:n]...)
+}
+
+// Appends a field key to the buffer.
+func (e *Encoder) key(tag int, wire int) {
+	e.varint(uint64(tag)<<3 | uint64(wire))
+}
+
+// Serializes an unsigned integer field (omitted if zero).
+func (e *Encoder) Uint(tag int, v uint64) {
+	if v != 0 {
+		e.key(tag, wireVarint)
+		e.varint(v)
+	}
+}
+
+// Serializes a signed integer field (omitted if zero).
+func (e *Encoder) Int(tag int, v int64) {
+	e.Uint(tag, uint64(v<<1)^uint64(v>>63))
+}
+
+// Serializes a boolean field (omitted if false).
+func (e *Encoder) Bool(tag int, v bool) {
+	if v {
+		e.Uint(tag, 1)
+	}
+}
+
+// Serializes a time duration field (omitted if zero).
+func (e *Encoder) Duration(tag int, v time.Duration) {
+	e.Int(tag, int64(v))
+}
+
+// Serializes a binary blob field (omitted if nil).
+func (e *Encoder) Bytes(tag int, v []byte) {
+	if v != nil {
+		e.key(tag, wireBlob)
+		e.varint(uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// Serializes a string field (omitted if empty).
+func (e *Encoder) String(tag int, v string) {
+	if v != "" {
+		e.key(tag, wireBlob)
+		e.varint(uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// Serializes a big integer field (omitted if nil). The first byte of the blob
+// is the sign, followed by the big endian absolute value.
+func (e *Encoder) BigInt(tag int, v *big.Int) {
+	if v != nil {
+		abs := v.Bytes()
+
+		e.key(tag, wireBlob)
+		e.varint(uint64(len(abs) + 1))
+		if v.Sign() < 0 {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+		e.buf = append(e.buf, abs...)
+	}
+}
+
+// Serializes a nested message field (omitted if nil).
+func (e *Encoder) Message(tag int, v Message) {
+	if v == nil || reflect.ValueOf(v).IsNil() {
+		return
+	}
+	sub := e.sub()
+	v.MarshalCodec(sub)
+	e.Bytes(tag, sub.buf)
+	e.release(sub)
+}
+
+// Serializes a polymorphic message field, tagged with its registered kind. Raw
+// binary blobs are also accepted. The method panics if the type of the message
+// was not registered, or the value is not a codec message altogether.
+func (e *Encoder) Meta(tag int, v interface{}) {
+	if v == nil {
+		return
+	}
+	if blob, ok := v.([]byte); ok {
+		sub := e.sub()
+		sub.varint(0)
+		sub.buf = append(sub.buf, blob...)
+		e.Bytes(tag, sub.buf)
+		e.release(sub)
+		return
+	}
+	msg, ok := v.(Message)
+	if !ok {
+		panic(fmt.Sprintf("codec: non-serializable meta: %T", v))
+	}
+	lock.RLock()
+	kind, ok := types[reflect.TypeOf(msg)]
+	lock.RUnlock()
+	if !ok {
+		panic(fmt.Sprintf("codec: unregistered meta: %T", v))
+	}
+	sub := e.sub()
+	sub.varint(kind)
+	msg.MarshalCodec(sub)
+	e.Bytes(tag, sub.buf)
+	e.release(sub)
+}
+
+// Fetches a cleared encoder for a nested message.
+func (e *Encoder) sub() *Encoder {
+	if n := len(e.subs); n > 0 {
+		sub := e.subs[n-1]
+		e.subs = e.subs[:n-1]
+		sub.buf = sub.buf[:0]
+		return sub
+	}
+	return new(Encoder)
+}
+
+// Returns a nested encoder into the pool.
+func (e *Encoder) release(sub *Encoder) {
+	e.subs = append(e.subs, sub)
+}
+
+// Decoder deserializing messages from a byte buffer.
+type Decoder struct {
+	buf  []byte // Input buffer
+	pos  int    // Position of the next byte to decode
+	tag  int    // Tag of the current field
+	wire int    // Wire type of the current field
+	err  error  // Sticky decoding error
+}
+
+// Deserializes a message from a binary blob, checking the version first. The
+// data is not retained after the call.
+func Decode(data []byte, msg Message) error {
+	if len(data) == 0 {
+		return ErrTruncated
+	}
+	if data[0] != Version {
+		return ErrVersion
+	}
+	d := &Decoder{buf: data[1:]}
+	if err := msg.UnmarshalCodec(d); err != nil {
+		return err
+	}
+	return d.err
+}
+
+// Retrieves a raw varint from the buffer.
+func (d *Decoder) varint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf[d.pos:])
+	if n <= 0 {
+		d.err = ErrTruncated
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+// Retrieves a raw length prefixed blob from the buffer, without copying.
+func (d *Decoder) blob() []byte {
+	if d.wire != wireBlob {
+		d.fail(ErrWireType)
+		return nil
+	}
+	size := d.varint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.buf)-d.pos) < size {
+		d.err = ErrTruncated
+		return nil
+	}
+	data := d.buf[d.pos : d.pos+int(size)]
+	d.pos += int(size)
+	return data
+}
+
+// Sets the sticky error, unless one was already set.
+func (d *Decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// Advances to the next field, returning false if no more are available or an
+// error occurred.
+func (d *Decoder) Next() bool {
+	if d.err != nil || d.pos >= len(d.buf) {
+		return false
+	}
+	key := d.varint()
+	d.tag, d.wire = int(key>>3), int(key&7)
+	return d.err == nil
+}
+
+// Returns the tag of the current field.
+func (d *Decoder) Tag() int {
+	return d.tag
+}
+
+// Returns the sticky decoding error, if any.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Skips the current (unknown) field.
+func (d *Decoder) Skip() {
+	switch d.wire {
+	case wireVarint:
+		d.varint()
+	case wireBlob:
+		d.blob()
+	default:
+		d.fail(ErrWireType)
+	}
+}
+
+// Deserializes the current field as an unsigned integer.
+func (d *Decoder) Uint() uint64 {
+	if d.wire != wireVarint {
+		d.fail(ErrWireType)
+		return 0
+	}
+	return d.varint()
+}
+
+// Deserializes the current field as a signed integer.
+func (d *Decoder) Int() int64 {
+	v := d.Uint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// Deserializes the current field as a boolean.
+func (d *Decoder) Bool() bool {
+	return d.Uint() != 0
+}
+
+// Deserializes the current field as a time duration.
+func (d *Decoder) Duration() time.Duration {
+	return time.Duration(d.Int())
+}
+
+// Deserializes the current field as a binary blob (copied out).
+func (d *Decoder) Bytes() []byte {
+	data := d.blob()
+	if data == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(data)), data...)
+}
+
+// Deserializes the current field as a string.
+func (d *Decoder) String() string {
+	return string(d.blob())
+}
+
+// Deserializes the current field as a big integer.
+func (d *Decoder) BigInt() *big.Int {
+	data := d.blob()
+	if len(data) == 0 {
+		d.fail(ErrTruncated)
+		return nil
+	}
+	v := new(big.Int).SetBytes(data[1:])
+	if data[0] != 0 {
+		v.Neg(v)
+	}
+	return v
+}
+
+// Deserializes the current field as a nested message.
+func (d *Decoder) Message(v Message) {
+	data := d.blob()
+	if d.err != nil {
+		return
+	}
+	sub := &Decoder{buf: data}
+	if err := v.UnmarshalCodec(sub); err != nil {
+		d.fail(err)
+	}
+	d.fail(sub.err)
+}
+
+// Deserializes the current field as a polymorphic message, instantiating the
+// registered kind it was tagged with.
+func (d *Decoder) Meta() interface{} {
+	data := d.blob()
+	if d.err != nil {
+		return nil
+	}
+	sub := &Decoder{buf: data}
+	kind := sub.varint()
+	if sub.err != nil {
+		d.fail(sub.err)
+		return nil
+	}
+	if kind == 0 {
+		return append([]byte{}, sub.buf[sub.pos:]...)
+	}
+	lock.RLock()
+	typ, ok := kinds[kind]
+	lock.RUnlock()
+	if !ok {
+		d.fail(fmt.Errorf("codec: unknown meta kind: %d", kind))
+		return nil
+	}
+	msg := reflect.New(typ.Elem()).Interface().(Message)
+	if err := msg.UnmarshalCodec(sub); err != nil {
+		d.fail(err)
+		return nil
+	}
+	d.fail(sub.err)
+	return msg
+}
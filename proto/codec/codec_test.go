@@ -0,0 +1,254 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Outer test header, similar to the routing layer headers.
+type testOuter struct {
+	Meta  interface{}
+	Op    uint64
+	Dest  *big.Int
+	Addrs []string
+}
+
+// Inner test header, similar to the application layer headers.
+type testInner struct {
+	Src  uint64
+	Time time.Duration
+	Key  []byte
+	Name string
+	Neg  int64
+	Flag bool
+}
+
+// Reduced outer test header, simulating an older schema version.
+type testOuterOld struct {
+	Op uint64
+}
+
+func init() {
+	Register(100, &testOuter{})
+	Register(101, &testInner{})
+
+	gob.Register(&testOuter{})
+	gob.Register(&testInner{})
+}
+
+func (o *testOuter) MarshalCodec(e *Encoder) {
+	e.Meta(1, o.Meta)
+	e.Uint(2, o.Op)
+	e.BigInt(3, o.Dest)
+	for _, addr := range o.Addrs {
+		e.String(4, addr)
+	}
+}
+
+func (o *testOuter) UnmarshalCodec(d *Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			o.Meta = d.Meta()
+		case 2:
+			o.Op = d.Uint()
+		case 3:
+			o.Dest = d.BigInt()
+		case 4:
+			o.Addrs = append(o.Addrs, d.String())
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+func (o *testOuterOld) MarshalCodec(e *Encoder) {
+	e.Uint(2, o.Op)
+}
+
+func (o *testOuterOld) UnmarshalCodec(d *Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 2:
+			o.Op = d.Uint()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+func (i *testInner) MarshalCodec(e *Encoder) {
+	e.Uint(1, i.Src)
+	e.Duration(2, i.Time)
+	e.Bytes(3, i.Key)
+	e.String(4, i.Name)
+	e.Int(5, i.Neg)
+	e.Bool(6, i.Flag)
+}
+
+func (i *testInner) UnmarshalCodec(d *Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			i.Src = d.Uint()
+		case 2:
+			i.Time = d.Duration()
+		case 3:
+			i.Key = d.Bytes()
+		case 4:
+			i.Name = d.String()
+		case 5:
+			i.Neg = d.Int()
+		case 6:
+			i.Flag = d.Bool()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Assembles a header chain resembling the ones passed down to the links.
+func testHeaders() *testOuter {
+	dest, _ := new(big.Int).SetString("123456789012345678901234567890123456789", 10)
+	return &testOuter{
+		Meta: &testInner{
+			Src:  3141592,
+			Time: 3 * time.Second,
+			Key:  bytes.Repeat([]byte{0x55}, 16),
+			Name: "c#2-cluster",
+			Neg:  -314,
+			Flag: true,
+		},
+		Op:    5,
+		Dest:  dest,
+		Addrs: []string{"192.168.1.1:4444", "10.0.0.1:4444"},
+	}
+}
+
+// Tests whether messages survive an encode/decode round trip.
+func TestRoundTrip(t *testing.T) {
+	tests := []*testOuter{
+		{},
+		{Meta: []byte{0x99, 0x98, 0x97}},
+		{Dest: big.NewInt(-42)},
+		{Meta: &testInner{Key: []byte{}}},
+		testHeaders(),
+	}
+	enc := NewEncoder()
+	for i, tt := range tests {
+		have := new(testOuter)
+		if err := Decode(enc.Encode(tt), have); err != nil {
+			t.Fatalf("test %d: failed to decode message: %v.", i, err)
+		}
+		if !reflect.DeepEqual(have, tt) {
+			t.Fatalf("test %d: message mismatch: have %+v, want %+v.", i, have, tt)
+		}
+	}
+}
+
+// Tests that unknown fields are skipped and corrupt data is detected.
+func TestDecodeErrors(t *testing.T) {
+	enc := NewEncoder()
+	blob := append([]byte{}, enc.Encode(testHeaders())...)
+
+	// Unknown fields should be skipped
+	old := new(testOuterOld)
+	if err := Decode(blob, old); err != nil {
+		t.Fatalf("failed to decode with unknown fields: %v.", err)
+	}
+	if old.Op != testHeaders().Op {
+		t.Fatalf("known field mismatch: have %v, want %v.", old.Op, testHeaders().Op)
+	}
+	// Version mismatch and truncations should fail
+	bad := append([]byte{}, blob...)
+	bad[0] = Version + 1
+	if err := Decode(bad, new(testOuter)); err != ErrVersion {
+		t.Fatalf("version mismatch error mismatch: have %v, want %v.", err, ErrVersion)
+	}
+	if err := Decode(nil, new(testOuter)); err != ErrTruncated {
+		t.Fatalf("empty data error mismatch: have %v, want %v.", err, ErrTruncated)
+	}
+	// Truncations inside a field should fail (field boundaries are valid)
+	meta := enc.Encode(&testOuter{Meta: testHeaders().Meta})
+	for i := 2; i < len(meta); i++ {
+		if err := Decode(meta[:i], new(testOuter)); err == nil {
+			t.Fatalf("truncation %d: decoding succeeded.", i)
+		}
+	}
+}
+
+func BenchmarkEncodeCodec(b *testing.B) {
+	msg, enc := testHeaders(), NewEncoder()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enc.Encode(msg)
+	}
+}
+
+func BenchmarkEncodeGob(b *testing.B) {
+	msg, buf := testHeaders(), new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := enc.Encode(msg); err != nil {
+			b.Fatalf("failed to encode message: %v.", err)
+		}
+	}
+}
+
+func BenchmarkDecodeCodec(b *testing.B) {
+	blob := NewEncoder().Encode(testHeaders())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := Decode(blob, new(testOuter)); err != nil {
+			b.Fatalf("failed to decode message: %v.", err)
+		}
+	}
+}
+
+func BenchmarkDecodeGob(b *testing.B) {
+	// Gob streams are stateful, pre-encode all the messages
+	msg, buf := testHeaders(), new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(msg); err != nil {
+			b.Fatalf("failed to encode message: %v.", err)
+		}
+	}
+	dec := gob.NewDecoder(buf)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := dec.Decode(new(testOuter)); err != nil {
+			b.Fatalf("failed to decode message: %v.", err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the payload compression primitives. Payloads are compressed before
+// encryption (ciphertext would be incompressible), flagged in the headers, and
+// transparently decompressed after decryption.
+
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Pool of compressors to avoid reallocating their sizable internal state.
+var deflaters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// Compresses a binary blob if it's above the compression threshold and if the
+// compressed version is smaller. The returned flag reports whether the data was
+// compressed or returned unmodified.
+func Deflate(data []byte) ([]byte, bool) {
+	if len(data) < config.SessionCompressThreshold {
+		return data, false
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+
+	w := deflaters.Get().(*flate.Writer)
+	defer deflaters.Put(w)
+
+	w.Reset(out)
+	if _, err := w.Write(data); err != nil {
+		return data, false
+	}
+	if err := w.Close(); err != nil {
+		return data, false
+	}
+	if out.Len() >= len(data) {
+		return data, false
+	}
+	return out.Bytes(), true
+}
+
+// Decompresses a binary blob compressed by Deflate.
+func Inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(config.SessionCompressLimit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > config.SessionCompressLimit {
+		return nil, errors.New("decompressed payload too large")
+	}
+	return out, nil
+}
+
+// Compresses a plaintext message if worthwhile, flagging it in the headers. The
+// pooled buffer (if any) is left attached for the owners to release.
+func (m *Message) Compress() {
+	if m.Head.Comp {
+		return
+	}
+	if data, ok := Deflate(m.Data); ok {
+		m.Data, m.Head.Comp = data, true
+	}
+}
+
+// Decompresses a plaintext message if it was compressed.
+func (m *Message) Decompress() error {
+	if !m.Head.Comp {
+		return nil
+	}
+	data, err := Inflate(m.Data)
+	if err != nil {
+		return err
+	}
+	m.Data, m.Head.Comp = data, false
+	return nil
+}
+
+// Assembles an uncompressed copy of an encrypted, compressed message, for peers
+// not supporting compression. The original message is left intact.
+func (m *Message) Uncompressed() (*Message, error) {
+	cpy := &Message{
+		Head: m.Head,
+		Data: append([]byte{}, m.Data...),
+	}
+	if err := cpy.Decrypt(); err != nil {
+		return nil, err
+	}
+	if err := cpy.Encrypt(); err != nil {
+		return nil, err
+	}
+	return cpy, nil
+}
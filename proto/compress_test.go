@@ -0,0 +1,91 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that only worthwhile payloads get compressed, and that they round trip.
+func TestCompress(t *testing.T) {
+	// Generate some compressible and incompressible payloads
+	small := bytes.Repeat([]byte{0x01}, config.SessionCompressThreshold-1)
+	large := bytes.Repeat([]byte("iris compression test "), 1024)
+	noise := make([]byte, 64*1024)
+	if _, err := io.ReadFull(rand.Reader, noise); err != nil {
+		t.Fatalf("failed to generate random payload: %v.", err)
+	}
+	tests := []struct {
+		data []byte
+		comp bool
+	}{
+		{small, false},
+		{large, true},
+		{noise, false},
+	}
+	for i, tt := range tests {
+		// Compress and encrypt a copy of the payload
+		msg := &Message{Data: append([]byte{}, tt.data...)}
+		msg.Compress()
+		if msg.Head.Comp != tt.comp {
+			t.Fatalf("test %d: compression flag mismatch: have %v, want %v.", i, msg.Head.Comp, tt.comp)
+		}
+		if err := msg.Encrypt(); err != nil {
+			t.Fatalf("test %d: failed to encrypt message: %v.", i, err)
+		}
+		// Create an uncompressed variant and verify that the original is intact
+		plain, err := msg.Uncompressed()
+		if err != nil {
+			t.Fatalf("test %d: failed to uncompress message: %v.", i, err)
+		}
+		if plain.Head.Comp || plain.Head.Key == nil {
+			t.Fatalf("test %d: invalid uncompressed headers: %+v.", i, plain.Head)
+		}
+		// Decrypt both variants and check the payloads
+		for j, m := range []*Message{msg, plain} {
+			if err := m.Decrypt(); err != nil {
+				t.Fatalf("test %d, variant %d: failed to decrypt message: %v.", i, j, err)
+			}
+			if m.Head.Comp {
+				t.Fatalf("test %d, variant %d: compression flag not cleared.", i, j)
+			}
+			if !bytes.Equal(m.Data, tt.data) {
+				t.Fatalf("test %d, variant %d: payload mismatch.", i, j)
+			}
+		}
+	}
+}
+
+// Tests that decompression bombs are rejected.
+func TestInflateLimit(t *testing.T) {
+	defer func(limit int) { config.SessionCompressLimit = limit }(config.SessionCompressLimit)
+	config.SessionCompressLimit = 1024
+
+	data, ok := Deflate(make([]byte, 4096))
+	if !ok {
+		t.Fatalf("failed to compress zero payload.")
+	}
+	if _, err := Inflate(data); err == nil {
+		t.Fatalf("oversized payload inflated.")
+	}
+}
@@ -0,0 +1,56 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the globally routable addresses of individual connections.
+
+package iris
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Globally routable address of a single application connection, composed of
+// the overlay node id and the node-local connection id.
+type Address struct {
+	Node *big.Int // Overlay node hosting the connection
+	Conn uint64   // Connection id within the hosting node
+}
+
+// Formats the address into its textual representation.
+func (a *Address) String() string {
+	return fmt.Sprintf("%x:%d", a.Node, a.Conn)
+}
+
+// Parses the textual representation of a connection address.
+func ParseAddress(addr string) (*Address, error) {
+	parts := strings.Split(addr, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid address format: %v", addr)
+	}
+	node, ok := new(big.Int).SetString(parts[0], 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid node id: %v", parts[0])
+	}
+	conn, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection id: %v", err)
+	}
+	return &Address{Node: node, Conn: conn}, nil
+}
@@ -18,13 +18,10 @@
 package iris
 
 import (
-	"crypto/x509"
 	"fmt"
 	"sync"
 	"testing"
 	"time"
-
-	"github.com/project-iris/iris/config"
 )
 
 // Connection handler for the broadcast tests.
@@ -49,6 +46,10 @@ func (b *broadcaster) HandleTunnel(tun *Tunnel) {
 	panic("Inbound tunnel on broadcast handler")
 }
 
+func (b *broadcaster) HandleMessage(msg []byte) {
+	panic("Direct message passed to broadcast handler")
+}
+
 // Individual broadcast tests.
 func TestBroadcastSingleNodeSingleConn(t *testing.T) {
 	testBroadcast(t, 1, 1, 1000)
@@ -68,58 +69,21 @@ func TestBroadcastMultiNodeMultiConn(t *testing.T) {
 
 // Tests multi node multi connection broadcasting.
 func testBroadcast(t *testing.T, nodes, conns, msgs int) {
-	// Configure the test
-	swapConfigs()
-	defer swapConfigs()
-
-	olds := config.BootPorts
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65000+i)
-	}
-	defer func() { config.BootPorts = olds }()
-
-	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
-	overlay := "broadcast-test"
 	cluster := fmt.Sprintf("broadcast-test-%d-%d", nodes, conns)
 
-	// Boot the iris overlays
-	liveNodes := make([]*Overlay, nodes)
+	// Boot the iris overlays and connect with a lot of clients
+	liveHands := make([][]*broadcaster, nodes)
 	for i := 0; i < nodes; i++ {
-		liveNodes[i] = New(overlay, key)
-		if _, err := liveNodes[i].Boot(); err != nil {
-			t.Fatalf("failed to boot iris overlay: %v.", err)
-		}
-		defer func(node *Overlay) {
-			if err := node.Shutdown(); err != nil {
-				t.Fatalf("failed to terminate iris node: %v.", err)
-			}
-		}(liveNodes[i])
-	}
-	// Connect to all nodes with a lot of clients
-	liveHands := make(map[int][]*broadcaster)
-	liveConns := make(map[int][]*Connection)
-	for i, node := range liveNodes {
 		liveHands[i] = make([]*broadcaster, conns)
-		liveConns[i] = make([]*Connection, conns)
 		for j := 0; j < conns; j++ {
 			liveHands[i][j] = &broadcaster{make(chan []byte, nodes*conns*msgs)}
-			conn, err := node.Connect(cluster, liveHands[i][j])
-			if err != nil {
-				t.Fatalf("failed to connect to the iris overlay: %v.", err)
-			}
-			liveConns[i][j] = conn
-
-			defer func(conn *Connection) {
-				if err := conn.Close(); err != nil {
-					t.Fatalf("failed to close iris connection: %v.", err)
-				}
-			}(liveConns[i][j])
 		}
 	}
-	// Make sure there is a little time to propagate state and reports (TODO, fix this)
-	if nodes > 1 {
-		time.Sleep(3 * time.Second)
-	}
+	_, liveConns, closer := bootCluster(t, "broadcast-test", cluster, nodes, conns, func(i, j int) ConnectionHandler {
+		return liveHands[i][j]
+	})
+	defer closer()
+
 	// Broadcast with each and every node in parallel
 	pend := new(sync.WaitGroup)
 	for i := 0; i < nodes; i++ {
@@ -150,3 +114,52 @@ func testBroadcast(t *testing.T, nodes, conns, msgs int) {
 		}
 	}
 }
+
+// Individual acknowledged broadcast tests.
+func TestBroadcastAckSingleNodeMultiConn(t *testing.T) {
+	testBroadcastAck(t, 1, 10, 10)
+}
+
+func TestBroadcastAckMultiNodeMultiConn(t *testing.T) {
+	testBroadcastAck(t, 5, 5, 5)
+}
+
+// Tests multi node multi connection acknowledged broadcasting.
+func testBroadcastAck(t *testing.T, nodes, conns, msgs int) {
+	cluster := fmt.Sprintf("broadcast-ack-test-%d-%d", nodes, conns)
+
+	// Boot the iris overlays and connect with a lot of clients
+	liveHands := make([][]*broadcaster, nodes)
+	for i := 0; i < nodes; i++ {
+		liveHands[i] = make([]*broadcaster, conns)
+		for j := 0; j < conns; j++ {
+			liveHands[i][j] = &broadcaster{make(chan []byte, nodes*conns*msgs)}
+		}
+	}
+	_, liveConns, closer := bootCluster(t, "broadcast-ack-test", cluster, nodes, conns, func(i, j int) ConnectionHandler {
+		return liveHands[i][j]
+	})
+	defer closer()
+
+	// Broadcast with each node sequentially, verifying the confirmations
+	for i := 0; i < nodes; i++ {
+		for j := 0; j < conns; j++ {
+			for k := 0; k < msgs; k++ {
+				msg := []byte{byte(i), byte(j), byte(k)}
+				if n, err := liveConns[i][j].BroadcastAck(cluster, msg, time.Second); err != nil {
+					t.Fatalf("failed to broadcast message: %v.", err)
+				} else if n != nodes*conns {
+					t.Fatalf("confirmation count mismatch: have %d, want %d", n, nodes*conns)
+				}
+			}
+		}
+	}
+	// Verify that all broadcasts were delivered before being confirmed
+	for i := 0; i < nodes; i++ {
+		for j := 0; j < conns; j++ {
+			if n := len(liveHands[i][j].msgs); n != nodes*conns*msgs {
+				t.Fatalf("broadcast/deliver count mismatch: have %d, want %d", n, nodes*conns*msgs)
+			}
+		}
+	}
+}
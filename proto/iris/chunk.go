@@ -0,0 +1,250 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the chunking of large messages into bounded pieces, and their
+// reassembly at the recipients. Published and direct chunks are all routed the
+// same way as the original message would be, but balanced ones would end up at
+// random members, so only the first chunk is balanced, the remaining ones being
+// pulled directly by the member that received it.
+
+package iris
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Partially assembled chunked message.
+type partial struct {
+	chunks  [][]byte // Payloads of the individual chunks (nil if missing)
+	missing int      // Number of chunks still missing
+	size    int      // Total size of the chunks arrived so far
+}
+
+// Reassembler of chunked messages arriving from remote connections.
+type assembler struct {
+	pend map[string]*partial // Messages waiting for further chunks
+	lock sync.Mutex          // Mutex to protect the pending map
+}
+
+// Creates a new, empty chunk reassembler.
+func newAssembler() *assembler {
+	return &assembler{
+		pend: make(map[string]*partial),
+	}
+}
+
+// Inserts a chunk into the reassembler, returning the full payload if this was
+// the last missing piece, or nil otherwise. Incomplete messages are dropped
+// after a timeout.
+func (a *assembler) add(src *big.Int, head *header, data []byte) []byte {
+	// Make sure the chunk is sane
+	if head.ChunkCnt > uint64(config.IrisChunkLimit) || head.ChunkIdx >= head.ChunkCnt {
+		log.Printf("iris: invalid chunk %d/%d, dropping.", head.ChunkIdx, head.ChunkCnt)
+		return nil
+	}
+	id := fmt.Sprintf("%v:%d", src, head.ChunkId)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// Fetch the pending message or create a new one
+	msg, ok := a.pend[id]
+	if !ok {
+		msg = &partial{
+			chunks:  make([][]byte, head.ChunkCnt),
+			missing: int(head.ChunkCnt),
+		}
+		a.pend[id] = msg
+
+		time.AfterFunc(config.IrisChunkTimeout, func() {
+			a.lock.Lock()
+			defer a.lock.Unlock()
+
+			if a.pend[id] == msg {
+				log.Printf("iris: chunked message timed out, %d/%d chunks missing.", msg.missing, len(msg.chunks))
+				delete(a.pend, id)
+			}
+		})
+	}
+	if int(head.ChunkCnt) != len(msg.chunks) || msg.chunks[head.ChunkIdx] != nil {
+		log.Printf("iris: mismatched or duplicate chunk %d/%d, dropping.", head.ChunkIdx, head.ChunkCnt)
+		return nil
+	}
+	// Store the chunk and assemble the message if complete
+	msg.chunks[head.ChunkIdx] = data
+	msg.missing--
+	msg.size += len(data)
+
+	if msg.missing > 0 {
+		return nil
+	}
+	delete(a.pend, id)
+
+	blob := make([]byte, 0, msg.size)
+	for _, chunk := range msg.chunks {
+		blob = append(blob, chunk...)
+	}
+	return blob
+}
+
+// Splits a packet into chunks not exceeding the configured chunk size. Small
+// packets are returned as they are. The chunks share the pooled buffer of the
+// original packet, if any. Packets needing more chunks than the recipients would
+// reassemble are refused with ErrTooLarge.
+func (c *Connection) split(packet *proto.Message) ([]*proto.Message, error) {
+	size := config.IrisChunkSize
+	if len(packet.Data) <= size {
+		return []*proto.Message{packet}, nil
+	}
+	count := (len(packet.Data) + size - 1) / size
+	if count > config.IrisChunkLimit {
+		return nil, ErrTooLarge
+	}
+	head := packet.Head.Meta.(*header)
+	id := atomic.AddUint64(&c.iris.chunkIdx, 1)
+
+	chunks := make([]*proto.Message, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(packet.Data) {
+			end = len(packet.Data)
+		}
+		meta := *head
+		meta.ChunkId, meta.ChunkIdx, meta.ChunkCnt = id, uint64(i), uint64(count)
+
+		chunks[i] = &proto.Message{
+			Head: proto.Header{
+				Meta: &meta,
+				Prio: packet.Head.Prio,
+			},
+			Data: packet.Data[i*size : end],
+			Buf:  packet.Buf,
+		}
+	}
+	return chunks, nil
+}
+
+// Publishes a packet into a topic, chunking it if too large.
+func (c *Connection) publish(topic string, packet *proto.Message) error {
+	chunks, err := c.split(packet)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := c.iris.scribe.Publish(topic, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends a packet directly to a remote node, chunking it if too large.
+func (c *Connection) direct(dest *big.Int, packet *proto.Message) error {
+	return c.directReplicated(dest, packet, 1)
+}
+
+// Sends a packet directly to a remote node along multiple overlay paths if more
+// than one copy is requested, chunking it if too large.
+func (c *Connection) directReplicated(dest *big.Int, packet *proto.Message, copies int) error {
+	chunks, err := c.split(packet)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		var err error
+		if copies > 1 {
+			err = c.iris.scribe.DirectReplicated(dest, chunk, copies)
+		} else {
+			err = c.iris.scribe.Direct(dest, chunk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Balances a packet to one member of a topic. If the packet is too large, only
+// its first chunk is balanced, the rest waiting for the recipient to pull them.
+func (c *Connection) balance(topic string, packet *proto.Message) error {
+	return c.balanceReplicated(topic, packet, 1)
+}
+
+// Balances a packet to one member of a topic along multiple overlay paths if more
+// than one copy is requested. Copies may reach different members, so delivery is
+// at least once; only the first member pulling a chunked message gets the rest.
+func (c *Connection) balanceReplicated(topic string, packet *proto.Message, copies int) error {
+	chunks, err := c.split(packet)
+	if err != nil {
+		return err
+	}
+	if len(chunks) > 1 {
+		// Retain the shared payload while the chunks are waiting
+		id, rest := chunks[0].Head.Meta.(*header).ChunkId, chunks[1:]
+		rest[0].Retain()
+
+		c.chunkLock.Lock()
+		c.chunkPend[id] = rest
+		c.chunkLock.Unlock()
+
+		time.AfterFunc(config.IrisChunkTimeout, func() {
+			c.chunkLock.Lock()
+			_, ok := c.chunkPend[id]
+			delete(c.chunkPend, id)
+			c.chunkLock.Unlock()
+
+			if ok {
+				rest[0].Release()
+			}
+		})
+	}
+	if copies > 1 {
+		return c.iris.scribe.BalanceReplicated(topic, chunks[0], copies)
+	}
+	return c.iris.scribe.Balance(topic, chunks[0])
+}
+
+// Sends the remaining chunks of a balanced message to the member that pulled
+// them.
+func (c *Connection) handlePull(node *big.Int, conn uint64, chunkId uint64) {
+	c.chunkLock.Lock()
+	chunks, ok := c.chunkPend[chunkId]
+	delete(c.chunkPend, chunkId)
+	c.chunkLock.Unlock()
+
+	if !ok {
+		log.Printf("iris: pull for unknown chunked message %d.", chunkId)
+		return
+	}
+	defer chunks[0].Release()
+
+	for _, chunk := range chunks {
+		chunk.Head.Meta.(*header).Dest = conn
+		if err := c.iris.scribe.Direct(node, chunk); err != nil {
+			log.Printf("iris: failed to send pulled chunk: %v.", err)
+			return
+		}
+	}
+}
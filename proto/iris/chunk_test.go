@@ -0,0 +1,169 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package iris
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Connection handler for the chunking tests, echoing requests and collecting
+// broadcasts and direct messages.
+type chunker struct {
+	msgs chan []byte
+}
+
+func (c *chunker) HandleBroadcast(msg []byte) {
+	c.msgs <- msg
+}
+
+func (c *chunker) HandleRequest(req []byte, timeout time.Duration) []byte {
+	return req
+}
+
+func (c *chunker) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on chunking handler")
+}
+
+func (c *chunker) HandleMessage(msg []byte) {
+	c.msgs <- msg
+}
+
+func (c *chunker) HandleDrop(reason error) {
+	panic("Connection dropped on chunking handler")
+}
+
+// Tests that chunks are reassembled in any order, and that invalid ones are
+// discarded.
+func TestAssembler(t *testing.T) {
+	asm := newAssembler()
+	src := big.NewInt(314)
+
+	// Insert some chunks out of order, with duplicates and junk in between
+	chunks := [][]byte{[]byte("chunk-0"), []byte("chunk-1"), []byte("chunk-2")}
+	order := []int{2, 0, 0, 1}
+	for i, idx := range order {
+		head := &header{Src: 1, ChunkId: 2, ChunkIdx: uint64(idx), ChunkCnt: uint64(len(chunks))}
+		junk := &header{Src: 1, ChunkId: 2, ChunkIdx: uint64(len(chunks)), ChunkCnt: uint64(len(chunks))}
+		if blob := asm.add(src, junk, []byte("junk")); blob != nil {
+			t.Fatalf("invalid chunk accepted: %v.", blob)
+		}
+		blob := asm.add(src, head, chunks[idx])
+		if i < len(order)-1 && blob != nil {
+			t.Fatalf("premature assembly after chunk %d: %v.", i, blob)
+		}
+		if i == len(order)-1 && !bytes.Equal(blob, bytes.Join(chunks, nil)) {
+			t.Fatalf("assembly mismatch: have %q, want %q.", blob, bytes.Join(chunks, nil))
+		}
+	}
+	if len(asm.pend) != 0 {
+		t.Fatalf("leftover partial messages: %v.", asm.pend)
+	}
+}
+
+// Tests that large messages are transparently chunked and reassembled across
+// multiple nodes.
+func TestChunking(t *testing.T) {
+	defer func(size int) { config.IrisChunkSize = size }(config.IrisChunkSize)
+	config.IrisChunkSize = 1024
+
+	// Boot the iris overlays and connect with a single client to each
+	nodes := 3
+	liveHands := make([]*chunker, nodes)
+	for i := 0; i < nodes; i++ {
+		liveHands[i] = &chunker{make(chan []byte, 16)}
+	}
+	_, clients, closer := bootCluster(t, "chunk-test", "chunk-test", nodes, 1, func(i, j int) ConnectionHandler {
+		return liveHands[i]
+	})
+	defer closer()
+
+	liveConns := make([]*Connection, nodes)
+	for i := 0; i < nodes; i++ {
+		liveConns[i] = clients[i][0]
+	}
+	// Assemble a large payload spanning many chunks
+	data := make([]byte, 10*config.IrisChunkSize+17)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i * 7)
+	}
+	// Execute a batch of requests, balanced to random members (payloads are
+	// encrypted in place, so always send a copy)
+	for i := 0; i < 10; i++ {
+		rep, err := liveConns[0].Request("chunk-test", append([]byte{}, data...), time.Second)
+		if err != nil {
+			t.Fatalf("request %d failed: %v.", i, err)
+		}
+		if !bytes.Equal(rep, data) {
+			t.Fatalf("request %d: reply mismatch.", i)
+		}
+	}
+	// Broadcast to all members and verify reassembly
+	if err := liveConns[0].Broadcast("chunk-test", append([]byte{}, data...)); err != nil {
+		t.Fatalf("failed to broadcast: %v.", err)
+	}
+	for i, hand := range liveHands {
+		select {
+		case msg := <-hand.msgs:
+			if !bytes.Equal(msg, data) {
+				t.Fatalf("member %d: broadcast mismatch.", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("member %d: broadcast timed out.", i)
+		}
+	}
+	// Send a direct message to a remote member
+	if err := liveConns[0].SendTo(liveConns[nodes-1].Address(), append([]byte{}, data...)); err != nil {
+		t.Fatalf("failed to send direct message: %v.", err)
+	}
+	select {
+	case msg := <-liveHands[nodes-1].msgs:
+		if !bytes.Equal(msg, data) {
+			t.Fatalf("direct message mismatch.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("direct message timed out.")
+	}
+	// Messages needing more chunks than reassembled should be refused when sent
+	defer func(limit int) { config.IrisChunkLimit = limit }(config.IrisChunkLimit)
+	config.IrisChunkLimit = 10
+
+	if _, err := liveConns[0].Request("chunk-test", append([]byte{}, data...), time.Second); err != ErrTooLarge {
+		t.Fatalf("oversized request error mismatch: have %v, want %v.", err, ErrTooLarge)
+	}
+	if _, err := liveConns[0].RequestTo(liveConns[nodes-1].Address(), append([]byte{}, data...), time.Second); err != ErrTooLarge {
+		t.Fatalf("oversized addressed request error mismatch: have %v, want %v.", err, ErrTooLarge)
+	}
+	if err := liveConns[0].Broadcast("chunk-test", append([]byte{}, data...)); err != ErrTooLarge {
+		t.Fatalf("oversized broadcast error mismatch: have %v, want %v.", err, ErrTooLarge)
+	}
+	if err := liveConns[0].SendTo(liveConns[nodes-1].Address(), append([]byte{}, data...)); err != ErrTooLarge {
+		t.Fatalf("oversized direct message error mismatch: have %v, want %v.", err, ErrTooLarge)
+	}
+	// Messages right at the limit should still go through
+	limit := data[:config.IrisChunkLimit*config.IrisChunkSize]
+	if rep, err := liveConns[0].Request("chunk-test", append([]byte{}, limit...), time.Second); err != nil {
+		t.Fatalf("request at chunk limit failed: %v.", err)
+	} else if !bytes.Equal(rep, limit) {
+		t.Fatalf("request at chunk limit: reply mismatch.")
+	}
+}
@@ -0,0 +1,195 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the binary codec serializers of the Iris headers and tunnel packets.
+
+package iris
+
+import "github.com/project-iris/iris/proto/codec"
+
+// Serializes the Iris header.
+func (h *header) MarshalCodec(e *codec.Encoder) {
+	e.Uint(1, uint64(h.Op))
+	e.Uint(2, h.Src)
+	e.Uint(3, h.Dest)
+	e.Uint(4, h.ReqId)
+	e.Duration(5, h.ReqTime)
+	e.Uint(6, h.TunId)
+	e.Bytes(7, h.TunKey)
+	for _, addr := range h.TunAddrs {
+		e.String(8, addr)
+	}
+	e.Duration(9, h.TunTime)
+	e.Uint(10, h.ChunkId)
+	e.Uint(11, h.ChunkIdx)
+	e.Uint(12, h.ChunkCnt)
+	e.Uint(13, h.TunPeer)
+	e.Uint(14, h.TunSeq)
+	e.Uint(15, h.TunCredit)
+	e.Bool(16, h.TunHalf)
+	e.Uint(17, h.ReqCopies)
+}
+
+// Deserializes the Iris header.
+func (h *header) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			h.Op = opcode(d.Uint())
+		case 2:
+			h.Src = d.Uint()
+		case 3:
+			h.Dest = d.Uint()
+		case 4:
+			h.ReqId = d.Uint()
+		case 5:
+			h.ReqTime = d.Duration()
+		case 6:
+			h.TunId = d.Uint()
+		case 7:
+			h.TunKey = d.Bytes()
+		case 8:
+			h.TunAddrs = append(h.TunAddrs, d.String())
+		case 9:
+			h.TunTime = d.Duration()
+		case 10:
+			h.ChunkId = d.Uint()
+		case 11:
+			h.ChunkIdx = d.Uint()
+		case 12:
+			h.ChunkCnt = d.Uint()
+		case 13:
+			h.TunPeer = d.Uint()
+		case 14:
+			h.TunSeq = d.Uint()
+		case 15:
+			h.TunCredit = d.Uint()
+		case 16:
+			h.TunHalf = d.Bool()
+		case 17:
+			h.ReqCopies = d.Uint()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the tunnel initialization packet.
+func (p *initPacket) MarshalCodec(e *codec.Encoder) {
+	e.Uint(1, p.ConnId)
+	e.Uint(2, p.TunId)
+	e.Bytes(3, p.Nonce)
+}
+
+// Deserializes the tunnel initialization packet.
+func (p *initPacket) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			p.ConnId = d.Uint()
+		case 2:
+			p.TunId = d.Uint()
+		case 3:
+			p.Nonce = d.Bytes()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the tunnel authorization packet.
+func (p *authPacket) MarshalCodec(e *codec.Encoder) {
+	e.Uint(1, p.Id)
+	e.Uint(2, p.Window)
+}
+
+// Deserializes the tunnel authorization packet.
+func (p *authPacket) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			p.Id = d.Uint()
+		case 2:
+			p.Window = d.Uint()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the tunnel window update packet.
+func (p *windowPacket) MarshalCodec(e *codec.Encoder) {
+	e.Uint(1, p.Credit)
+}
+
+// Deserializes the tunnel window update packet.
+func (p *windowPacket) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			p.Credit = d.Uint()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the tunnel end-of-stream packet.
+func (p *finPacket) MarshalCodec(e *codec.Encoder) {
+	e.Bool(1, p.Half)
+	e.String(2, p.Reason)
+}
+
+// Deserializes the tunnel end-of-stream packet.
+func (p *finPacket) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			p.Half = d.Bool()
+		case 2:
+			p.Reason = d.String()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the tunnel resumption packet.
+func (p *resumePacket) MarshalCodec(e *codec.Encoder) {
+	e.Uint(1, p.Recv)
+	e.Uint(2, p.Credit)
+}
+
+// Deserializes the tunnel resumption packet.
+func (p *resumePacket) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			p.Recv = d.Uint()
+		case 2:
+			p.Credit = d.Uint()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
@@ -18,6 +18,8 @@
 package iris
 
 import (
+	"crypto/x509"
+	"testing"
 	"time"
 
 	"github.com/project-iris/iris/config"
@@ -83,3 +85,75 @@ func swapConfigs() {
 	config.PastryLeaves, pastryLeaves = pastryLeaves, config.PastryLeaves
 	config.ScribeBeatPeriod, scribeBeat = scribeBeat, config.ScribeBeatPeriod
 }
+
+// Boots an iris cluster of the given size on the test ports, connecting to each
+// node with a number of clients, their handlers made by the generator. Returns
+// only after all the clients are reachable through every split of the cluster,
+// along with a closer tearing the cluster down and restoring the configs.
+func bootCluster(t *testing.T, overlay, cluster string, nodes, conns int, handler func(node, conn int) ConnectionHandler) ([]*Overlay, [][]*Connection, func()) {
+	// Configure the test
+	swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	// Assemble the closer, skipping connections closed by the test itself
+	liveNodes := make([]*Overlay, 0, nodes)
+	liveConns := make([][]*Connection, 0, nodes)
+	closer := func() {
+		for _, conns := range liveConns {
+			for _, conn := range conns {
+				select {
+				case <-conn.term:
+				default:
+					if err := conn.Close(); err != nil {
+						t.Errorf("failed to close iris connection: %v.", err)
+					}
+				}
+			}
+		}
+		for _, node := range liveNodes {
+			if err := node.Shutdown(); err != nil {
+				t.Errorf("failed to terminate iris node: %v.", err)
+			}
+		}
+		config.BootPorts = olds
+		swapConfigs()
+	}
+	// Boot the iris overlays and connect the clients
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	for i := 0; i < nodes; i++ {
+		node := New(overlay, key)
+		if _, err := node.Boot(); err != nil {
+			closer()
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		liveNodes = append(liveNodes, node)
+		liveConns = append(liveConns, make([]*Connection, 0, conns))
+
+		for j := 0; j < conns; j++ {
+			conn, err := node.Connect(cluster, handler(i, j))
+			if err != nil {
+				closer()
+				t.Fatalf("failed to connect to the iris overlay: %v.", err)
+			}
+			liveConns[i] = append(liveConns[i], conn)
+		}
+	}
+	// Poll the membership until all the splits report every client
+	deadline := time.Now().Add(10 * time.Second)
+	for done := 0; done < config.IrisClusterSplits; {
+		if addrs, err := liveConns[0][0].Members(cluster); err == nil && len(addrs) == nodes*conns {
+			done++
+			continue
+		}
+		if time.Now().After(deadline) {
+			closer()
+			t.Fatalf("cluster failed to converge.")
+		}
+		done = 0
+		time.Sleep(50 * time.Millisecond)
+	}
+	return liveNodes, liveConns, closer
+}
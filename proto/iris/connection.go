@@ -26,6 +26,9 @@ import (
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/pool"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/buffer"
+	"github.com/project-iris/iris/proto/scribe"
 )
 
 // Iris specific errors
@@ -33,6 +36,12 @@ var ErrTerminating = errors.New("terminating")
 var ErrTimeout = errors.New("timeout")
 var ErrSubscribed = errors.New("already subscribed")
 var ErrNotSubscribed = errors.New("not subscribed")
+var ErrWatched = errors.New("already watched")
+var ErrNotWatched = errors.New("not watched")
+var ErrLocked = errors.New("locked")
+var ErrNotLocked = errors.New("not locked")
+var ErrInvalidTTL = errors.New("invalid lease duration")
+var ErrTooLarge = errors.New("message too large")
 
 // Prefixes for multi-clustering.
 var clusterPrefixes []string
@@ -63,6 +72,9 @@ type ConnectionHandler interface {
 
 	// Handles the request to open a direct tunnel.
 	HandleTunnel(tun *Tunnel)
+
+	// Handles a message sent directly to the local connection.
+	HandleMessage(msg []byte)
 }
 
 // Subscription handler receiving events from a single subscribed topic.
@@ -71,6 +83,12 @@ type SubscriptionHandler interface {
 	HandleEvent(msg []byte)
 }
 
+// Reply of a single cluster member to a scatter-gather request.
+type gatherReply struct {
+	from *Address // Address of the replying connection
+	data []byte   // Reply payload
+}
+
 // Connection through which to interact with other iris clients.
 type Connection struct {
 	// Application layer fields
@@ -83,6 +101,10 @@ type Connection struct {
 	reqPend map[uint64]chan []byte // Active requests waiting for a reply
 	reqLock sync.RWMutex           // Mutex to protect the request map
 
+	gatIdx  uint64                       // Index to assign the next gather
+	gatPend map[uint64]chan *gatherReply // Active gathers collecting replies
+	gatLock sync.RWMutex                 // Mutex to protect the gather map
+
 	subLive map[string]SubscriptionHandler // Active subscriptions
 	subLock sync.RWMutex                   // Mutex to protect the subscription map
 
@@ -90,6 +112,15 @@ type Connection struct {
 	tunLive map[uint64]*Tunnel // Tunnels either live, or being established
 	tunLock sync.RWMutex       // Mutex to protect the tunnel map
 
+	watLive map[string]*watcher // Active membership watches
+	watLock sync.RWMutex        // Mutex to protect the watch map
+
+	lckLive map[string]chan chan error // Active lease keepers of locks and elections
+	lckLock sync.Mutex                 // Mutex to protect the lease keeper map
+
+	chunkPend map[uint64][]*proto.Message // Balanced chunks waiting to be pulled
+	chunkLock sync.Mutex                  // Mutex to protect the pending chunk map
+
 	// Quality of service fields
 	workers *pool.ThreadPool // Concurrent threads handling the connection
 	splitId uint32           // Id of the next prefix for split cluster round-robin
@@ -108,8 +139,13 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 		iris:    o,
 
 		reqPend: make(map[uint64]chan []byte),
+		gatPend: make(map[uint64]chan *gatherReply),
 		subLive: make(map[string]SubscriptionHandler),
 		tunLive: make(map[uint64]*Tunnel),
+		watLive: make(map[string]*watcher),
+		lckLive: make(map[string]chan chan error),
+
+		chunkPend: make(map[uint64][]*proto.Message),
 
 		// Quality of service
 		workers: pool.NewThreadPool(config.IrisHandlerThreads),
@@ -132,19 +168,115 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 	}
 	c.workers.Start()
 
+	// Announce the new member to any watchers
+	c.iris.scribe.Publish(memberPrefix+cluster, c.assembleMembership(opJoin))
+
 	return c, nil
 }
 
 // Broadcasts asynchronously a message to all members of an iris cluster. No
 // guarantees are made that all nodes receive the message (best effort).
 func (c *Connection) Broadcast(cluster string, msg []byte) error {
+	return c.BroadcastPriority(cluster, msg, proto.PrioInteractive)
+}
+
+// Broadcasts asynchronously a message to all members of an iris cluster, tagged
+// with a specific priority class.
+func (c *Connection) BroadcastPriority(cluster string, msg []byte, prio proto.Priority) error {
+	packet := c.assembleBroadcast(msg)
+	packet.Head.Prio = appPriority(prio)
+
 	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, c.assembleBroadcast(msg))
+	return c.publish(clusterPrefixes[prefixIdx]+cluster, packet)
+}
+
+// Broadcasts asynchronously a pooled message to all members of an iris cluster,
+// taking over the buffer reference of the caller.
+func (c *Connection) BroadcastBuffer(cluster string, msg *buffer.Buffer, prio proto.Priority) error {
+	packet := c.assembleBroadcast(msg.Data)
+	packet.Head.Prio = appPriority(prio)
+	packet.Buf = msg
+	defer packet.Release()
+
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	return c.publish(clusterPrefixes[prefixIdx]+cluster, packet)
+}
+
+// Broadcasts a message to all members of an iris cluster, waiting for them to
+// handle it. The number of members confirming the delivery within the timeout
+// is returned, or an error if no confirmation arrived at all.
+func (c *Connection) BroadcastAck(cluster string, msg []byte, timeout time.Duration) (int, error) {
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	count, err := c.iris.scribe.PublishAck(clusterPrefixes[prefixIdx]+cluster, c.assembleBroadcast(msg), timeout)
+	if err == scribe.ErrTimeout {
+		err = ErrTimeout
+	}
+	return count, err
 }
 
 // Executes a synchronous request to cluster (load balanced between all active),
 // and returns the received reply, or an error if a timeout is reached.
 func (c *Connection) Request(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+	return c.RequestPriority(cluster, req, timeout, proto.PrioInteractive)
+}
+
+// Executes a synchronous request to cluster, tagged with a specific priority
+// class. The reply inherits the priority of the request.
+func (c *Connection) RequestPriority(cluster string, req []byte, timeout time.Duration, prio proto.Priority) ([]byte, error) {
+	return c.request(timeout, func(reqId uint64) error {
+		packet := c.assembleRequest(reqId, req, timeout, 1)
+		packet.Head.Prio = appPriority(prio)
+
+		prefixIdx := int(reqId) % config.IrisClusterSplits
+		return c.balance(clusterPrefixes[prefixIdx]+cluster, packet)
+	})
+}
+
+// Executes a synchronous request to cluster, sending both the request and the
+// reply along multiple overlay paths (capped at config.IrisRequestCopies) to
+// survive nodes dropping messages during churn. Copies may reach different
+// members, so the request is executed at least once: handlers should be
+// idempotent. Only the first reply is returned.
+func (c *Connection) RequestReplicated(cluster string, req []byte, timeout time.Duration, copies int) ([]byte, error) {
+	copies = requestCopies(copies)
+	return c.request(timeout, func(reqId uint64) error {
+		prefixIdx := int(reqId) % config.IrisClusterSplits
+		return c.balanceReplicated(clusterPrefixes[prefixIdx]+cluster, c.assembleRequest(reqId, req, timeout, copies), copies)
+	})
+}
+
+// Executes a synchronous request to a specific connection, and returns the
+// received reply, or an error if a timeout is reached.
+func (c *Connection) RequestTo(addr *Address, req []byte, timeout time.Duration) ([]byte, error) {
+	return c.request(timeout, func(reqId uint64) error {
+		return c.direct(addr.Node, c.assembleRequestTo(addr.Conn, reqId, req, timeout, 1))
+	})
+}
+
+// Executes a synchronous request to a specific connection, sending both the
+// request and the reply along multiple overlay paths (capped at config.IrisRequestCopies).
+// The recipient node discards duplicate copies.
+func (c *Connection) RequestToReplicated(addr *Address, req []byte, timeout time.Duration, copies int) ([]byte, error) {
+	copies = requestCopies(copies)
+	return c.request(timeout, func(reqId uint64) error {
+		return c.directReplicated(addr.Node, c.assembleRequestTo(addr.Conn, reqId, req, timeout, copies), copies)
+	})
+}
+
+// Limits the number of paths a request or reply is replicated along.
+func requestCopies(copies int) int {
+	if copies < 1 {
+		return 1
+	}
+	if copies > config.IrisRequestCopies {
+		return config.IrisRequestCopies
+	}
+	return copies
+}
+
+// Registers a pending request, sends it out via the given method and waits for
+// the reply to arrive, or an error if a timeout is reached.
+func (c *Connection) request(timeout time.Duration, send func(reqId uint64) error) ([]byte, error) {
 	// Create a reply channel for the results
 	c.reqLock.Lock()
 	reqCh := make(chan []byte, 1)
@@ -162,8 +294,9 @@ func (c *Connection) Request(cluster string, req []byte, timeout time.Duration)
 		close(reqCh)
 	}()
 	// Send the request
-	prefixIdx := int(reqId) % config.IrisClusterSplits
-	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleRequest(reqId, req, timeout))
+	if err := send(reqId); err != nil {
+		return nil, err
+	}
 
 	// Retrieve the results, time out or fail if terminating
 	select {
@@ -176,6 +309,100 @@ func (c *Connection) Request(cluster string, req []byte, timeout time.Duration)
 	}
 }
 
+// Sends asynchronously a message directly to a specific connection. No
+// guarantees are made that the message is delivered (best effort).
+func (c *Connection) SendTo(addr *Address, msg []byte) error {
+	return c.direct(addr.Node, c.assembleSend(addr.Conn, msg))
+}
+
+// Returns the globally routable address of the connection.
+func (c *Connection) Address() *Address {
+	return &Address{Node: c.iris.scribe.Self(), Conn: c.id}
+}
+
+// Executes a synchronous scatter-gather request to all members of a cluster,
+// collecting the replies until either all members responded or the timeout is
+// reached. The partial results are returned together with the number of members
+// that received the request but did not respond in time (-1 if unknown).
+func (c *Connection) Gather(cluster string, req []byte, timeout time.Duration) ([][]byte, int, error) {
+	reps := [][]byte{}
+	missing, err := c.GatherStream(cluster, req, timeout, func(from *Address, rep []byte) {
+		reps = append(reps, rep)
+	})
+	return reps, missing, err
+}
+
+// Executes a synchronous scatter-gather request to all members of a cluster,
+// passing each reply and its origin to sink as soon as it arrives. The call returns when either
+// all members responded or the timeout is reached, reporting the number of the
+// members that received the request but did not respond in time (-1 if unknown).
+func (c *Connection) GatherStream(cluster string, req []byte, timeout time.Duration, sink func(from *Address, rep []byte)) (int, error) {
+	return c.gather(cluster, timeout, func(gatId uint64) *proto.Message {
+		return c.assembleGather(gatId, req, timeout)
+	}, sink)
+}
+
+// Sends a scatter-gather message to all members of a cluster and collects the
+// replies until either all the reached members responded or the timeout is hit.
+// The number of missing replies is -1 if the recipients could not be counted,
+// and a timeout is only reported if not a single reply arrived in that case.
+func (c *Connection) gather(cluster string, timeout time.Duration, assemble func(gatId uint64) *proto.Message, sink func(from *Address, rep []byte)) (int, error) {
+	// Create a reply channel for the results
+	c.gatLock.Lock()
+	gatCh := make(chan *gatherReply, config.IrisGatherBuffer)
+	gatId := c.gatIdx
+	c.gatIdx++
+	c.gatPend[gatId] = gatCh
+	c.gatLock.Unlock()
+
+	// Make sure reply channel is cleaned up
+	defer func() {
+		c.gatLock.Lock()
+		defer c.gatLock.Unlock()
+
+		delete(c.gatPend, gatId)
+		close(gatCh)
+	}()
+	// Send the request through the cluster tree, counting the recipients
+	type result struct {
+		count int
+		err   error
+	}
+	ackCh := make(chan result, 1)
+	go func() {
+		prefixIdx := int(gatId) % config.IrisClusterSplits
+		count, err := c.iris.scribe.PublishAck(clusterPrefixes[prefixIdx]+cluster, assemble(gatId), timeout)
+		ackCh <- result{count, err}
+	}()
+	// Collect the replies until all arrive, time out or fail if terminating. If
+	// the recipients could not be counted, keep collecting until the deadline.
+	deadline := time.After(timeout)
+	replies, members := 0, -1
+	for members < 0 || replies < members {
+		select {
+		case <-c.term:
+			return 0, ErrTerminating
+		case <-deadline:
+			if members < 0 {
+				if replies == 0 {
+					return -1, ErrTimeout
+				}
+				return -1, nil
+			}
+			return members - replies, nil
+		case res := <-ackCh:
+			ackCh = nil
+			if res.err == nil {
+				members = res.count
+			}
+		case rep := <-gatCh:
+			sink(rep.from, rep.data)
+			replies++
+		}
+	}
+	return 0, nil
+}
+
 // Subscribes to topic, using handler as the callback for arriving events. An
 // error is returned if subscription fails.
 func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error {
@@ -208,8 +435,29 @@ func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error
 // Publishes an event asynchronously to topic. No guarantees are made that all
 // subscribers receive the message.
 func (c *Connection) Publish(topic string, msg []byte) error {
+	return c.PublishPriority(topic, msg, proto.PrioInteractive)
+}
+
+// Publishes an event asynchronously to topic, tagged with a specific priority
+// class.
+func (c *Connection) PublishPriority(topic string, msg []byte, prio proto.Priority) error {
+	packet := c.assemblePublish(msg)
+	packet.Head.Prio = appPriority(prio)
+
 	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(topicPrefixes[prefixIdx]+topic, c.assemblePublish(msg))
+	return c.publish(topicPrefixes[prefixIdx]+topic, packet)
+}
+
+// Publishes a pooled event asynchronously to topic, taking over the buffer
+// reference of the caller.
+func (c *Connection) PublishBuffer(topic string, msg *buffer.Buffer, prio proto.Priority) error {
+	packet := c.assemblePublish(msg.Data)
+	packet.Head.Prio = appPriority(prio)
+	packet.Buf = msg
+	defer packet.Release()
+
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	return c.publish(topicPrefixes[prefixIdx]+topic, packet)
 }
 
 // Unsubscribes from topic, receiving no more event notifications for it.
@@ -274,6 +522,31 @@ func (c *Connection) Close() error {
 	}
 	c.subLock.Unlock()
 
+	// Remove all membership watches
+	c.watLock.RLock()
+	watched := make([]string, 0, len(c.watLive))
+	for cluster, _ := range c.watLive {
+		watched = append(watched, cluster)
+	}
+	c.watLock.RUnlock()
+
+	for _, cluster := range watched {
+		c.Unwatch(cluster)
+	}
+	// Release all locks and leaderships
+	c.lckLock.Lock()
+	leases := make([]string, 0, len(c.lckLive))
+	for name, _ := range c.lckLive {
+		leases = append(leases, name)
+	}
+	c.lckLock.Unlock()
+
+	for _, name := range leases {
+		c.drop(name)
+	}
+	// Announce the departure to any watchers
+	c.iris.scribe.Publish(memberPrefix+c.cluster, c.assembleMembership(opLeave))
+
 	// Leave the cluster and close the carrier connection
 	for _, prefix := range clusterPrefixes {
 		c.iris.unsubscribe(c.id, prefix+c.cluster)
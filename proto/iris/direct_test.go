@@ -0,0 +1,147 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Connection handler for the direct addressing tests.
+type addressee struct {
+	self int         // Index of the owner connection
+	msgs chan []byte // Directly received messages
+}
+
+func (a *addressee) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to direct handler")
+}
+
+func (a *addressee) HandleRequest(req []byte, timeout time.Duration) []byte {
+	return []byte{byte(a.self)}
+}
+
+func (a *addressee) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on direct handler")
+}
+
+func (a *addressee) HandleMessage(msg []byte) {
+	select {
+	case a.msgs <- msg:
+		// Ok
+	default:
+		panic("Direct message queue full")
+	}
+}
+
+func TestAddressParsing(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("address-test", key)
+	conn := &Connection{id: 42, iris: node}
+
+	addr := conn.Address()
+	parsed, err := ParseAddress(addr.String())
+	if err != nil {
+		t.Fatalf("failed to parse address %v: %v.", addr, err)
+	}
+	if parsed.Node.Cmp(addr.Node) != 0 || parsed.Conn != addr.Conn {
+		t.Fatalf("address mismatch: have %v, want %v.", parsed, addr)
+	}
+	for _, invalid := range []string{"", "abc", "xyz:1", "abc:-1", "abc:1:2"} {
+		if _, err := ParseAddress(invalid); err == nil {
+			t.Fatalf("invalid address accepted: %v.", invalid)
+		}
+	}
+}
+
+// Individual direct addressing tests.
+func TestDirectSingleNode(t *testing.T) {
+	testDirect(t, 1, 5, 10)
+}
+
+func TestDirectMultiNode(t *testing.T) {
+	testDirect(t, 5, 2, 10)
+}
+
+// Tests that gathered replies can be followed up with directly addressed
+// messages and requests.
+func testDirect(t *testing.T, nodes, conns, msgs int) {
+	cluster := fmt.Sprintf("direct-test-%d-%d", nodes, conns)
+
+	// Boot the iris overlays and connect with a few clients
+	liveHands := make([]*addressee, nodes*conns)
+	for i := 0; i < len(liveHands); i++ {
+		liveHands[i] = &addressee{i, make(chan []byte, nodes*conns*msgs)}
+	}
+	_, clients, closer := bootCluster(t, "direct-test", cluster, nodes, conns, func(i, j int) ConnectionHandler {
+		return liveHands[i*conns+j]
+	})
+	defer closer()
+
+	liveConns := make([]*Connection, 0, nodes*conns)
+	for _, conns := range clients {
+		liveConns = append(liveConns, conns...)
+	}
+	// Gather the addresses of all the members with the first connection
+	addrs := make(map[int]*Address)
+	missing, err := liveConns[0].GatherStream(cluster, []byte{0}, 5*time.Second, func(from *Address, rep []byte) {
+		addrs[int(rep[0])] = from
+	})
+	if err != nil || missing != 0 || len(addrs) != len(liveConns) {
+		t.Fatalf("failed to gather addresses: have %d/%d missing (err %v), want %d/0.", len(addrs), missing, err, len(liveConns))
+	}
+	for i, conn := range liveConns {
+		if have, want := addrs[i].String(), conn.Address().String(); have != want {
+			t.Fatalf("gathered address mismatch: have %v, want %v.", have, want)
+		}
+	}
+	// Follow up with each member both with messages and requests
+	for i, addr := range addrs {
+		for k := 0; k < msgs; k++ {
+			if err := liveConns[0].SendTo(addr, []byte{byte(i), byte(k)}); err != nil {
+				t.Fatalf("failed to send direct message: %v.", err)
+			}
+			if rep, err := liveConns[0].RequestTo(addr, []byte{byte(k)}, 5*time.Second); err != nil {
+				t.Fatalf("failed to send direct request: %v.", err)
+			} else if bytes.Compare(rep, []byte{byte(i)}) != 0 {
+				t.Fatalf("direct request answered by wrong member: have %v, want %v.", rep, i)
+			}
+			if rep, err := liveConns[0].RequestToReplicated(addr, []byte{byte(k)}, 5*time.Second, 3); err != nil {
+				t.Fatalf("failed to send replicated direct request: %v.", err)
+			} else if bytes.Compare(rep, []byte{byte(i)}) != 0 {
+				t.Fatalf("replicated direct request answered by wrong member: have %v, want %v.", rep, i)
+			}
+		}
+	}
+	// Verify that all messages arrived to the exact recipient
+	for i, hand := range liveHands {
+		for k := 0; k < msgs; k++ {
+			select {
+			case msg := <-hand.msgs:
+				if msg[0] != byte(i) {
+					t.Fatalf("direct message delivered to wrong member: have %v, want %v.", msg[0], i)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("direct message count mismatch: have %v, want %v.", k, msgs)
+			}
+		}
+	}
+}
@@ -23,48 +23,116 @@ import (
 	"log"
 	"math/big"
 	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/scribe"
 )
 
-// Implements proto.iris.ConnectionCallback.HandlePublish. Extracts the data from
-// the Iris envelope and calls the appropriate handler.
-func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message) {
-	head := msg.Head.Meta.(*header)
-
-	// Fetch the message recipients
+// Fetches the live connections subscribed to a topic.
+func (o *Overlay) subscribers(topic string) []*Connection {
 	o.lock.RLock()
+	defer o.lock.RUnlock()
+
 	subs, ok := o.subLive[topic]
 	if !ok {
-		o.lock.RUnlock()
 		log.Printf("iris: non-existent topic: %v.", topic)
-		return
+		return nil
 	}
 	conns := make([]*Connection, len(subs))
 	for i, id := range subs {
 		conns[i] = o.conns[id]
 	}
-	o.lock.RUnlock()
+	return conns
+}
+
+// Implements proto.iris.ConnectionCallback.HandlePublish. Extracts the data from
+// the Iris envelope and calls the appropriate handler.
+func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+	prio := int(msg.Head.Prio)
+
+	// Reassemble chunked messages, delivering only complete ones
+	if head.ChunkCnt > 1 {
+		if msg.Data = o.chunks.add(src, head, msg.Data); msg.Data == nil {
+			return
+		}
+	}
+
+	// Fetch the message recipients
+	conns := o.subscribers(topic)
 
 	// Publish to every live subscription
 	for i := 0; i < len(conns); i++ {
 		conn := conns[i] // Closure
 		switch head.Op {
 		case opBcast:
-			conn.workers.Schedule(func() { conn.handleBroadcast(msg.Data) })
+			conn.workers.SchedulePriority(func() { conn.handleBroadcast(msg.Data) }, prio)
 		case opPub:
-			conn.workers.Schedule(func() { conn.handlePublish(topic, msg.Data) })
+			conn.workers.SchedulePriority(func() { conn.handlePublish(topic, msg.Data) }, prio)
+		case opJoin, opLeave:
+			addr, join := &Address{Node: src, Conn: head.Src}, head.Op == opJoin
+			conn.workers.SchedulePriority(func() { conn.handleMembership(topic, addr, join) }, prio)
 		default:
 			log.Printf("iris: invalid publish opcode: %v.", head.Op)
 		}
 	}
 }
 
+// Implements proto.scribe.Callback.HandlePublishAck. Extracts the data from the
+// Iris envelope, calls the appropriate handlers and confirms the number of the
+// completed deliveries after the last one finishes.
+func (o *Overlay) HandlePublishAck(src *big.Int, topic string, msg *proto.Message, ack *scribe.Ack) {
+	head := msg.Head.Meta.(*header)
+	prio := int(msg.Head.Prio)
+
+	// Fetch the message recipients
+	conns := o.subscribers(topic)
+	if len(conns) == 0 {
+		ack.Confirm(0)
+		return
+	}
+	// Track the handler completions and confirm after the last
+	pend, done := int32(len(conns)), int32(0)
+	finish := func(handled bool) {
+		if handled {
+			atomic.AddInt32(&done, 1)
+		}
+		if atomic.AddInt32(&pend, -1) == 0 {
+			ack.Confirm(int(atomic.LoadInt32(&done)))
+		}
+	}
+	// Publish to every live subscription
+	for i := 0; i < len(conns); i++ {
+		conn := conns[i] // Closure
+		switch head.Op {
+		case opBcast:
+			if err := conn.workers.SchedulePriority(func() { conn.handleBroadcast(msg.Data); finish(true) }, prio); err != nil {
+				finish(false)
+			}
+		case opGather:
+			// Gathers count the recipients, replies are tracked by the requester
+			data := make([]byte, len(msg.Data))
+			copy(data, msg.Data) // Replies might alias the request, encrypted in-place
+
+			err := conn.workers.SchedulePriority(func() { conn.handleGather(src, head.Src, head.ReqId, data, head.ReqTime) }, prio)
+			finish(err == nil)
+		case opMember:
+			// Membership queries are answered without the application
+			finish(o.scribe.Direct(src, conn.assembleMembersReply(head.Src, head.ReqId)) == nil)
+		default:
+			log.Printf("iris: invalid acknowledged publish opcode: %v.", head.Op)
+			finish(false)
+		}
+	}
+}
+
 // Implements proto.iris.ConnectionCallback.HandlePublish. Extracts the data from
 // the Iris envelope and calls the appropriate handler.
 func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
+	prio := int(msg.Head.Prio)
 
 	// Fetch the possible message recipients and pick one at random
 	o.lock.RLock()
@@ -77,12 +145,24 @@ func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message)
 	conn := o.conns[subs[rand.Intn(len(subs))]]
 	o.lock.RUnlock()
 
+	// If a chunked message arrived, pull the rest directly to the chosen one
+	if head.ChunkCnt > 1 {
+		if msg.Data = o.chunks.add(src, head, msg.Data); msg.Data == nil {
+			if err := o.scribe.Direct(src, conn.assemblePull(head.Src, head.ChunkId)); err != nil {
+				log.Printf("iris: failed to pull chunked message: %v.", err)
+			}
+			return
+		}
+	}
+
 	// Balance to the chose one
 	switch head.Op {
 	case opReq:
-		conn.workers.Schedule(func() { conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime) })
+		conn.workers.SchedulePriority(func() {
+			conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime, msg.Head.Prio, head.ReqCopies)
+		}, prio)
 	case opTun:
-		conn.workers.Schedule(func() { conn.handleTunnelRequest(head.Src, head.TunId, head.TunKey, head.TunAddrs, head.TunTime) })
+		conn.workers.SchedulePriority(func() { conn.handleTunnelRequest(src, head.Src, head.TunId, head.TunKey, head.TunAddrs, head.TunTime) }, prio)
 	default:
 		log.Printf("iris: invalid balance opcode: %v.", head.Op)
 	}
@@ -92,6 +172,14 @@ func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message)
 // from the Iris envelope and calls the appropriate handler.
 func (o *Overlay) HandleDirect(src *big.Int, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
+	prio := int(msg.Head.Prio)
+
+	// Reassemble chunked messages, delivering only complete ones
+	if head.ChunkCnt > 1 {
+		if msg.Data = o.chunks.add(src, head, msg.Data); msg.Data == nil {
+			return
+		}
+	}
 
 	// Fetch the intended recipient
 	o.lock.RLock()
@@ -104,7 +192,26 @@ func (o *Overlay) HandleDirect(src *big.Int, msg *proto.Message) {
 	// Pass the message to the connection to handle
 	switch head.Op {
 	case opRep:
-		conn.workers.Schedule(func() { conn.handleReply(head.ReqId, msg.Data) })
+		conn.workers.SchedulePriority(func() { conn.handleReply(head.ReqId, msg.Data) }, prio)
+	case opGatRep:
+		from := &Address{Node: src, Conn: head.Src}
+		conn.workers.SchedulePriority(func() { conn.handleGatherReply(head.ReqId, from, msg.Data) }, prio)
+	case opMemRep:
+		from := &Address{Node: src, Conn: head.Src}
+		conn.workers.SchedulePriority(func() { conn.handleGatherReply(head.ReqId, from, nil) }, prio)
+	case opReq:
+		conn.workers.SchedulePriority(func() {
+			conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime, msg.Head.Prio, head.ReqCopies)
+		}, prio)
+	case opSend:
+		conn.workers.SchedulePriority(func() { conn.handleMessage(msg.Data) }, prio)
+	case opPull:
+		conn.workers.SchedulePriority(func() { conn.handlePull(src, head.Src, head.ChunkId) }, prio)
+	case opTunOpen:
+		conn.workers.SchedulePriority(func() { conn.handleTunnelOpen(src, head.Src, head.TunId, head.TunPeer, head.TunKey, head.TunCredit) }, prio)
+	case opTunData, opTunFin, opTunClose, opTunAck:
+		// Non-blocking, reordered by the route, no need for a worker
+		conn.handleTunnelData(head.TunId, msg)
 	default:
 		log.Printf("iris: invalid direct opcode: %v.", head.Op)
 	}
@@ -115,12 +222,22 @@ func (c *Connection) handleBroadcast(msg []byte) {
 	c.handler.HandleBroadcast(msg)
 }
 
+// Passes a directly addressed message up to the application handler.
+func (c *Connection) handleMessage(msg []byte) {
+	c.handler.HandleMessage(msg)
+}
+
 // Passes the request up to the application handler, also specifying the timeout
 // under which the reply must be sent back. Only a non-nil reply is forwarded to
-// the requester.
-func (c *Connection) handleRequest(srcNode *big.Int, srcConn uint64, reqId uint64, msg []byte, timeout time.Duration) {
+// the requester, using the same priority class and number of paths as the
+// request.
+func (c *Connection) handleRequest(srcNode *big.Int, srcConn uint64, reqId uint64, msg []byte, timeout time.Duration, prio proto.Priority, copies uint64) {
 	if rep := c.handler.HandleRequest(msg, timeout); rep != nil {
-		c.iris.scribe.Direct(srcNode, c.assembleReply(srcConn, reqId, rep))
+		packet := c.assembleReply(srcConn, reqId, rep)
+		packet.Head.Prio = appPriority(prio)
+		if err := c.directReplicated(srcNode, packet, requestCopies(int(copies))); err != nil {
+			log.Printf("iris: failed to send reply: %v.", err)
+		}
 	}
 }
 
@@ -130,9 +247,38 @@ func (c *Connection) handleReply(reqId uint64, rep []byte) {
 	c.reqLock.RLock()
 	defer c.reqLock.RUnlock()
 
-	// Make sure the request is still alive and don't block if dying
+	// Make sure the request is still alive and don't block if dying or if a
+	// replicated request's duplicate reply arrives after the first one
 	if ch, ok := c.reqPend[reqId]; ok {
-		ch <- rep
+		select {
+		case ch <- rep:
+		default:
+		}
+	}
+}
+
+// Passes a scatter-gather request up to the application handler, and forwards
+// any non-nil reply back to the gathering connection.
+func (c *Connection) handleGather(srcNode *big.Int, srcConn uint64, gatId uint64, msg []byte, timeout time.Duration) {
+	if rep := c.handler.HandleRequest(msg, timeout); rep != nil {
+		if err := c.direct(srcNode, c.assembleGatherReply(srcConn, gatId, rep)); err != nil {
+			log.Printf("iris: failed to send gather reply: %v.", err)
+		}
+	}
+}
+
+// Looks up the result channel for the pending gather and inserts the reply. If
+// the channel doesn't exist any more or it's full, the reply is dropped.
+func (c *Connection) handleGatherReply(gatId uint64, from *Address, rep []byte) {
+	c.gatLock.RLock()
+	defer c.gatLock.RUnlock()
+
+	if ch, ok := c.gatPend[gatId]; ok {
+		select {
+		case ch <- &gatherReply{from, rep}:
+		default:
+			log.Printf("iris: gather reply buffer full, dropping reply.")
+		}
 	}
 }
 
@@ -152,8 +298,8 @@ func (c *Connection) handlePublish(topic string, msg []byte) {
 
 // Accepts the inbound tunnel, notifies the remote endpoint of the success and
 // starts the local handler.
-func (c *Connection) handleTunnelRequest(conn uint64, id uint64, key []byte, addrs []string, timeout time.Duration) {
-	if tun, err := c.buildTunnel(conn, id, key, addrs, timeout); err != nil {
+func (c *Connection) handleTunnelRequest(node *big.Int, conn uint64, id uint64, key []byte, addrs []string, timeout time.Duration) {
+	if tun, err := c.buildTunnel(node, conn, id, key, addrs, timeout); err != nil {
 		log.Printf("iris: failed to accept tunnel: %v.", err)
 	} else {
 		c.handler.HandleTunnel(tun)
@@ -0,0 +1,220 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the distributed locks and leader election built on the scribe lease
+// service. Acquired leases are renewed in the background until released, and
+// elections are simply continuous campaigns for the lease of the role.
+
+package iris
+
+import (
+	"log"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/scribe"
+)
+
+// Prefixes for the lock and election lease names.
+var lockPrefix = "l#-"
+var electPrefix = "e#-"
+
+// Handler for the leadership changes of an elected role.
+type ElectionHandler interface {
+	// Handles the local connection being elected as the leader of the role.
+	HandleElected()
+
+	// Handles the local connection losing the leadership of the role.
+	HandleDeposed()
+}
+
+// Acquires the distributed lock name for the duration of ttl, renewing the lease
+// in the background until unlocked. ErrLocked is returned if the lock is held by
+// someone else (or by the local connection already), and ErrInvalidTTL if the
+// lease would be shorter than the configured minimum.
+func (c *Connection) Lock(name string, ttl time.Duration) error {
+	if ttl < config.ScribeLeaseMinTTL {
+		return ErrInvalidTTL
+	}
+	// Reserve the local keeper first, so a granted lease is never left unkept
+	quit, err := c.reserve(lockPrefix + name)
+	if err != nil {
+		return err
+	}
+	// Acquire the lease and start renewing it
+	if _, err := c.iris.scribe.Acquire(lockPrefix+name, c.Address().String(), ttl, config.IrisLockTimeout); err != nil {
+		c.cancel(lockPrefix+name, quit)
+		switch err {
+		case scribe.ErrLocked:
+			return ErrLocked
+		case scribe.ErrTimeout:
+			// The lease might have been granted nonetheless, release it to be safe
+			go c.iris.scribe.Release(lockPrefix+name, c.Address().String(), config.IrisLockTimeout)
+			return ErrTimeout
+		case scribe.ErrInvalidTTL:
+			return ErrInvalidTTL
+		default:
+			return err
+		}
+	}
+	go c.keeper(lockPrefix+name, ttl, true, nil, quit)
+	return nil
+}
+
+// Releases the distributed lock name. ErrNotLocked is returned if the lock was
+// not held by the connection (or the lease was lost in the mean time).
+func (c *Connection) Unlock(name string) error {
+	return c.drop(lockPrefix + name)
+}
+
+// Starts campaigning for the leadership of role, notifying handler whenever it
+// is gained or lost. The leadership is guaranteed to be exclusive only for the
+// duration of the leases, so deposing is reported before the lease expires.
+func (c *Connection) Elect(role string, handler ElectionHandler) error {
+	if config.IrisElectionLease < config.ScribeLeaseMinTTL {
+		return ErrInvalidTTL
+	}
+	return c.keep(electPrefix+role, config.IrisElectionLease, false, handler)
+}
+
+// Stops campaigning for the leadership of role, releasing it if held.
+func (c *Connection) Resign(role string) error {
+	return c.drop(electPrefix + role)
+}
+
+// Starts a lease keeper for a lock or election.
+func (c *Connection) keep(name string, ttl time.Duration, held bool, handler ElectionHandler) error {
+	quit, err := c.reserve(name)
+	if err != nil {
+		return err
+	}
+	go c.keeper(name, ttl, held, handler, quit)
+	return nil
+}
+
+// Reserves the lease keeper slot of a lock or election, failing if the lease is
+// already kept locally or the connection is terminating.
+func (c *Connection) reserve(name string) (chan chan error, error) {
+	c.lckLock.Lock()
+	defer c.lckLock.Unlock()
+
+	select {
+	case <-c.term:
+		return nil, ErrTerminating
+	default:
+		if _, ok := c.lckLive[name]; ok {
+			return nil, ErrLocked
+		}
+		quit := make(chan chan error)
+		c.lckLive[name] = quit
+		return quit, nil
+	}
+}
+
+// Cancels the keeper reservation of a lease that could not be acquired. If the
+// reservation was dropped in the mean time, the drop is answered instead.
+func (c *Connection) cancel(name string, quit chan chan error) {
+	c.lckLock.Lock()
+	if c.lckLive[name] == quit {
+		delete(c.lckLive, name)
+		c.lckLock.Unlock()
+		return
+	}
+	c.lckLock.Unlock()
+
+	errc := <-quit
+	errc <- ErrNotLocked
+}
+
+// Terminates a lease keeper, releasing the lease if held.
+func (c *Connection) drop(name string) error {
+	c.lckLock.Lock()
+	quit, ok := c.lckLive[name]
+	delete(c.lckLive, name)
+	c.lckLock.Unlock()
+
+	if !ok {
+		return ErrNotLocked
+	}
+	errc := make(chan error)
+	quit <- errc
+	return <-errc
+}
+
+// Renews a held lease periodically until terminated. If a handler is given, the
+// keeper also campaigns for the lease whenever it's not held, otherwise once the
+// lease is lost, it remains so.
+func (c *Connection) keeper(name string, ttl time.Duration, held bool, handler ElectionHandler, quit chan chan error) {
+	holder := c.Address().String()
+	expiry := time.Now().Add(ttl)
+
+	// Campaign straight away if electing
+	if handler != nil {
+		if _, err := c.iris.scribe.Acquire(name, holder, ttl, ttl/3); err == nil {
+			held, expiry = true, time.Now().Add(ttl)
+			handler.HandleElected()
+		}
+	}
+	tick := time.NewTicker(ttl / 3)
+	defer tick.Stop()
+
+	var errc chan error
+	for errc == nil {
+		select {
+		case errc = <-quit:
+			continue
+		case <-tick.C:
+			if !held && handler == nil {
+				continue
+			}
+		}
+		// Renew or acquire the lease
+		start := time.Now()
+		_, err := c.iris.scribe.Acquire(name, holder, ttl, ttl/3)
+		switch {
+		case err == nil:
+			if !held {
+				held = true
+				handler.HandleElected()
+			}
+			expiry = start.Add(ttl)
+
+		case held && (err == scribe.ErrLocked || time.Now().Add(ttl/3).After(expiry)):
+			// Lease lost or about to expire without a renewal
+			held = false
+			if handler != nil {
+				handler.HandleDeposed()
+			} else {
+				log.Printf("iris: lease lost: %v.", name)
+			}
+		}
+	}
+	// Release the lease if held and report
+	if !held {
+		if handler == nil {
+			errc <- ErrNotLocked
+		} else {
+			errc <- nil
+		}
+		return
+	}
+	if err := c.iris.scribe.Release(name, holder, ttl/3); err == scribe.ErrTimeout {
+		errc <- ErrTimeout
+	} else {
+		errc <- err
+	}
+}
@@ -0,0 +1,179 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package iris
+
+import (
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Election handler for the leadership tests.
+type candidate struct {
+	id     int
+	events chan int // Positive ids for elections, negative for deposes
+}
+
+func (c *candidate) HandleElected() {
+	c.events <- c.id
+}
+
+func (c *candidate) HandleDeposed() {
+	c.events <- -c.id
+}
+
+// Boots a number of iris nodes and connects to each with a single client.
+func bootLockTest(t *testing.T, nodes int) ([]*Overlay, []*Connection, func()) {
+	liveNodes, clients, closer := bootCluster(t, "lock-test", "lock-test", nodes, 1, func(i, j int) ConnectionHandler {
+		return &addressee{}
+	})
+	liveConns := make([]*Connection, nodes)
+	for i := 0; i < nodes; i++ {
+		liveConns[i] = clients[i][0]
+	}
+	return liveNodes, liveConns, closer
+}
+
+func TestLock(t *testing.T) {
+	nodes := 3
+	_, liveConns, closer := bootLockTest(t, nodes)
+	defer closer()
+
+	// Bogus lease durations should be refused
+	for _, ttl := range []time.Duration{-time.Second, 0, time.Nanosecond} {
+		if err := liveConns[0].Lock("lock", ttl); err != ErrInvalidTTL {
+			t.Fatalf("invalid lease %v error mismatch: have %v, want %v.", ttl, err, ErrInvalidTTL)
+		}
+	}
+	// Acquire the lock and verify exclusivity, even past the initial lease
+	if err := liveConns[0].Lock("lock", 300*time.Millisecond); err != nil {
+		t.Fatalf("failed to acquire free lock: %v.", err)
+	}
+	if err := liveConns[0].Lock("lock", 300*time.Millisecond); err != ErrLocked {
+		t.Fatalf("double lock error mismatch: have %v, want %v.", err, ErrLocked)
+	}
+	time.Sleep(time.Second)
+	for i := 1; i < nodes; i++ {
+		if err := liveConns[i].Lock("lock", 300*time.Millisecond); err != ErrLocked {
+			t.Fatalf("held lock error mismatch: have %v, want %v.", err, ErrLocked)
+		}
+	}
+	// Release and verify that others can acquire it
+	if err := liveConns[0].Unlock("lock"); err != nil {
+		t.Fatalf("failed to release lock: %v.", err)
+	}
+	if err := liveConns[0].Unlock("lock"); err != ErrNotLocked {
+		t.Fatalf("double unlock error mismatch: have %v, want %v.", err, ErrNotLocked)
+	}
+	if err := liveConns[nodes-1].Lock("lock", 300*time.Millisecond); err != nil {
+		t.Fatalf("failed to acquire released lock: %v.", err)
+	}
+	if err := liveConns[nodes-1].Unlock("lock"); err != nil {
+		t.Fatalf("failed to release lock: %v.", err)
+	}
+}
+
+// Tests that racing lock operations never leave an unkept lease behind.
+func TestLockRace(t *testing.T) {
+	nodes := 2
+	liveNodes, liveConns, closer := bootLockTest(t, nodes)
+	defer closer()
+
+	// Concurrent locks on the same connection should succeed exactly once
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- liveConns[0].Lock("lock", 5*time.Second) }()
+	}
+	granted := 0
+	for i := 0; i < cap(errs); i++ {
+		switch err := <-errs; err {
+		case nil:
+			granted++
+		case ErrLocked:
+		default:
+			t.Fatalf("concurrent lock failed: %v.", err)
+		}
+	}
+	if granted != 1 {
+		t.Fatalf("concurrent lock grants mismatch: have %v, want %v.", granted, 1)
+	}
+	if err := liveConns[0].Unlock("lock"); err != nil {
+		t.Fatalf("failed to release lock: %v.", err)
+	}
+	// Locks racing with the connection closing should be released too
+	for i := 0; i < 5; i++ {
+		conn, err := liveNodes[0].Connect("lock-test", &addressee{})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- conn.Lock("lock", 5*time.Second) }()
+		time.Sleep(time.Duration(i) * 5 * time.Millisecond)
+		conn.Close()
+		<-done
+
+		if err := liveConns[1].Lock("lock", 5*time.Second); err != nil {
+			t.Fatalf("iteration %d: failed to acquire lock released by closed connection: %v.", i, err)
+		}
+		if err := liveConns[1].Unlock("lock"); err != nil {
+			t.Fatalf("iteration %d: failed to release lock: %v.", i, err)
+		}
+	}
+}
+
+func TestElect(t *testing.T) {
+	oldLease := config.IrisElectionLease
+	config.IrisElectionLease = 300 * time.Millisecond
+	defer func() { config.IrisElectionLease = oldLease }()
+
+	nodes := 3
+	_, liveConns, closer := bootLockTest(t, nodes)
+	defer closer()
+
+	// Start a campaign with each connection and wait for a leader
+	events := make(chan int, 4*nodes)
+	for i := 0; i < nodes; i++ {
+		if err := liveConns[i].Elect("role", &candidate{i + 1, events}); err != nil {
+			t.Fatalf("failed to start campaign: %v.", err)
+		}
+	}
+	resigned := make(map[int]bool)
+	for round := 0; round < nodes; round++ {
+		var leader int
+		select {
+		case leader = <-events:
+			if leader < 0 || resigned[leader] {
+				t.Fatalf("invalid election event: %v.", leader)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no leader elected in round %d.", round)
+		}
+		// Make sure nobody else gets elected meanwhile
+		select {
+		case event := <-events:
+			t.Fatalf("unexpected election event: %v.", event)
+		case <-time.After(time.Second):
+		}
+		// Close the leader and wait for the next
+		resigned[leader] = true
+		if err := liveConns[leader-1].Close(); err != nil {
+			t.Fatalf("failed to close leader connection: %v.", err)
+		}
+	}
+}
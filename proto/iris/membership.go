@@ -0,0 +1,236 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the cluster membership listing and change notifications. Members are
+// enumerated by a scatter-gather through the cluster's scribe tree, answered by
+// the Iris layer itself. Watchers additionally subscribe to an internal topic of
+// the cluster through which joins and graceful leaves are announced, and to
+// catch crashed members (pruned from the tree by the scribe heartbeats), the
+// whole membership is periodically refreshed. The view is eventually consistent.
+
+package iris
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Prefix of the internal topics announcing membership changes.
+var memberPrefix = "m#-"
+
+// Handler for the membership changes of a watched cluster.
+type MembershipHandler interface {
+	// Handles the joining of a new member into the watched cluster.
+	HandleJoin(addr *Address)
+
+	// Handles the leaving (or the detected death) of a member of the cluster.
+	HandleLeave(addr *Address)
+}
+
+// Membership change announcement of a single cluster member.
+type memberEvent struct {
+	addr *Address // Address of the member connection
+	join bool     // Flag whether the member joined or left
+}
+
+// Snapshot of the full membership of a cluster.
+type memberSnapshot struct {
+	began time.Time  // Time when the snapshot was requested
+	addrs []*Address // Members reporting in
+	err   error      // Failure reason, if any
+}
+
+// Tracks the membership of a single watched cluster.
+type watcher struct {
+	cluster string            // Cluster being watched
+	handler MembershipHandler // Handler for the membership changes
+
+	events chan *memberEvent // Announcements arriving from the network
+	quit   chan chan error   // Quit channel to synchronize termination
+	term   chan struct{}     // Channel to signal termination to blocked go-routines
+}
+
+// Retrieves the addresses of all the current members of a cluster. The result
+// is a snapshot of the cluster's topic tree, it may miss very recent joins or
+// contain very recent leaves.
+func (c *Connection) Members(cluster string) ([]*Address, error) {
+	members := []*Address{}
+	_, err := c.gather(cluster, config.IrisMembersTimeout, c.assembleMembers, func(from *Address, rep []byte) {
+		members = append(members, from)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// Starts watching the membership of a cluster, using handler as the callback
+// for the arriving changes. All current members are reported as joins too.
+func (c *Connection) Watch(cluster string, handler MembershipHandler) error {
+	w := &watcher{
+		cluster: cluster,
+		handler: handler,
+		events:  make(chan *memberEvent, config.IrisGatherBuffer),
+		quit:    make(chan chan error),
+		term:    make(chan struct{}),
+	}
+	// Make sure there are no double watches and not closing
+	c.watLock.Lock()
+	select {
+	case <-c.term:
+		c.watLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.watLive[cluster]; ok {
+			c.watLock.Unlock()
+			return ErrWatched
+		}
+		c.watLive[cluster] = w
+	}
+	c.watLock.Unlock()
+
+	// Subscribe to the membership announcements and start tracking
+	if err := c.iris.subscribe(c.id, memberPrefix+cluster); err != nil {
+		c.watLock.Lock()
+		delete(c.watLive, cluster)
+		c.watLock.Unlock()
+		return err
+	}
+	go w.loop(c)
+	return nil
+}
+
+// Stops watching the membership of a cluster.
+func (c *Connection) Unwatch(cluster string) error {
+	c.watLock.Lock()
+	w, ok := c.watLive[cluster]
+	if !ok {
+		c.watLock.Unlock()
+		return ErrNotWatched
+	}
+	delete(c.watLive, cluster)
+	c.watLock.Unlock()
+
+	// Stop the announcements and the tracker
+	err := c.iris.unsubscribe(c.id, memberPrefix+cluster)
+
+	close(w.term)
+	errc := make(chan error)
+	w.quit <- errc
+	if e := <-errc; e != nil {
+		err = e
+	}
+	return err
+}
+
+// Delivers a membership change announcement to the watcher of the cluster. If
+// the watch does not exist the announcement is silently dropped.
+func (c *Connection) handleMembership(topic string, addr *Address, join bool) {
+	c.watLock.RLock()
+	w, ok := c.watLive[strings.TrimPrefix(topic, memberPrefix)]
+	c.watLock.RUnlock()
+
+	if ok {
+		select {
+		case w.events <- &memberEvent{addr, join}:
+		case <-w.term:
+		}
+	}
+}
+
+// Merges the membership announcements and the periodic snapshots of a cluster
+// into a single view, notifying the handler of the changes.
+func (w *watcher) loop(c *Connection) {
+	known := make(map[string]*Address)  // Currently known members
+	stamp := make(map[string]time.Time) // Time of the last announcement of each member
+
+	// Requests a full membership snapshot in the background
+	snaps := make(chan *memberSnapshot, 1)
+	pending := false
+	refresh := func() {
+		pending = true
+		go func() {
+			began := time.Now()
+			addrs, err := c.Members(w.cluster)
+			snaps <- &memberSnapshot{began, addrs, err}
+		}()
+	}
+	refresh()
+
+	tick := time.NewTicker(config.IrisMembersRefresh)
+	defer tick.Stop()
+
+	var errc chan error
+	for errc == nil {
+		select {
+		case errc = <-w.quit:
+			continue
+
+		case <-tick.C:
+			if !pending {
+				refresh()
+			}
+
+		case ev := <-w.events:
+			id := ev.addr.String()
+			stamp[id] = time.Now()
+
+			if _, ok := known[id]; ev.join && !ok {
+				known[id] = ev.addr
+				w.handler.HandleJoin(ev.addr)
+			} else if !ev.join && ok {
+				delete(known, id)
+				w.handler.HandleLeave(ev.addr)
+			}
+
+		case snap := <-snaps:
+			pending = false
+			if snap.err != nil {
+				log.Printf("iris: failed to refresh cluster members: %v.", snap.err)
+				continue
+			}
+			// Report all new members, unless announced since (left?)
+			current := make(map[string]struct{})
+			for _, addr := range snap.addrs {
+				id := addr.String()
+				current[id] = struct{}{}
+
+				if _, ok := known[id]; !ok && !stamp[id].After(snap.began) {
+					known[id] = addr
+					w.handler.HandleJoin(addr)
+				}
+			}
+			// Report all missing members, unless announced since (joined?)
+			for id, addr := range known {
+				if _, ok := current[id]; !ok && !stamp[id].After(snap.began) {
+					delete(known, id)
+					w.handler.HandleLeave(addr)
+				}
+			}
+			// Drop the announcement stamps superseded by the snapshot
+			for id, t := range stamp {
+				if t.Before(snap.began) {
+					delete(stamp, id)
+				}
+			}
+		}
+	}
+	errc <- nil
+}
@@ -0,0 +1,166 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package iris
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Membership handler for the watch tests.
+type watchman struct {
+	joins  chan *Address
+	leaves chan *Address
+}
+
+func (w *watchman) HandleJoin(addr *Address) {
+	w.joins <- addr
+}
+
+func (w *watchman) HandleLeave(addr *Address) {
+	w.leaves <- addr
+}
+
+// Waits for a number of membership changes, returning them in a set.
+func (w *watchman) collect(t *testing.T, ch chan *Address, count int) map[string]struct{} {
+	addrs := make(map[string]struct{})
+	for i := 0; i < count; i++ {
+		select {
+		case addr := <-ch:
+			addrs[addr.String()] = struct{}{}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("membership change count mismatch: have %d, want %d.", i, count)
+		}
+	}
+	select {
+	case addr := <-ch:
+		t.Fatalf("unexpected membership change: %v.", addr)
+	case <-time.After(100 * time.Millisecond):
+	}
+	return addrs
+}
+
+func TestMembersSingleNode(t *testing.T) {
+	testMembers(t, 1, 5)
+}
+
+func TestMembersMultiNode(t *testing.T) {
+	testMembers(t, 4, 2)
+}
+
+// Tests the membership listing and the join/leave notifications.
+func testMembers(t *testing.T, nodes, conns int) {
+	cluster := fmt.Sprintf("members-test-%d-%d", nodes, conns)
+
+	// Boot the iris overlays and connect with a few members and an outside watcher
+	liveNodes, liveConns, closer := bootCluster(t, "members-test", cluster, nodes, conns, func(i, j int) ConnectionHandler {
+		return &addressee{}
+	})
+	defer closer()
+
+	watcher, err := liveNodes[0].Connect(cluster+"-watcher", &addressee{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer watcher.Close()
+
+	members := make(map[string]*Connection)
+	for _, conns := range liveConns {
+		for _, conn := range conns {
+			members[conn.Address().String()] = conn
+		}
+	}
+	// Verify the membership listing
+	addrs, err := watcher.Members(cluster)
+	if err != nil {
+		t.Fatalf("failed to list members: %v.", err)
+	}
+	if len(addrs) != len(members) {
+		t.Fatalf("member count mismatch: have %d, want %d.", len(addrs), len(members))
+	}
+	for _, addr := range addrs {
+		if _, ok := members[addr.String()]; !ok {
+			t.Fatalf("unknown member listed: %v.", addr)
+		}
+	}
+	// Start watching the cluster and verify the initial joins
+	hand := &watchman{make(chan *Address, 2*len(members)), make(chan *Address, 2*len(members))}
+	if err := watcher.Watch(cluster, hand); err != nil {
+		t.Fatalf("failed to watch cluster: %v.", err)
+	}
+	if err := watcher.Watch(cluster, hand); err != ErrWatched {
+		t.Fatalf("double watch error mismatch: have %v, want %v.", err, ErrWatched)
+	}
+	if joins := hand.collect(t, hand.joins, len(members)); len(joins) != len(members) {
+		t.Fatalf("initial join count mismatch: have %d, want %d.", len(joins), len(members))
+	}
+	// Cycle a probe member until the announcements reach the watcher
+	for probed := false; !probed; {
+		probe, err := liveNodes[nodes-1].Connect(cluster, &addressee{})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		select {
+		case addr := <-hand.joins:
+			if addr.String() != probe.Address().String() {
+				t.Fatalf("probe join mismatch: have %v, want %v.", addr, probe.Address())
+			}
+			probed = true
+		case <-time.After(time.Second):
+		}
+		if err := probe.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+		if probed {
+			if leaves := hand.collect(t, hand.leaves, 1); len(leaves) != 1 {
+				t.Fatalf("probe leave notification mismatch: %v.", leaves)
+			}
+		}
+	}
+	// Leave with all the members and verify the notifications
+	for _, conn := range members {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}
+	leaves := hand.collect(t, hand.leaves, len(members))
+	for addr, _ := range members {
+		if _, ok := leaves[addr]; !ok {
+			t.Fatalf("missing leave notification: %v.", addr)
+		}
+	}
+	// Join with a new member and verify the notification
+	conn, err := liveNodes[nodes-1].Connect(cluster, &addressee{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	if joins := hand.collect(t, hand.joins, 1); len(joins) != 1 {
+		t.Fatalf("join notification mismatch: %v.", joins)
+	} else if _, ok := joins[conn.Address().String()]; !ok {
+		t.Fatalf("join notification mismatch: have %v, want %v.", joins, conn.Address())
+	}
+	if err := watcher.Unwatch(cluster); err != nil {
+		t.Fatalf("failed to unwatch cluster: %v.", err)
+	}
+	if err := watcher.Unwatch(cluster); err != ErrNotWatched {
+		t.Fatalf("double unwatch error mismatch: have %v, want %v.", err, ErrNotWatched)
+	}
+}
@@ -22,9 +22,12 @@ import (
 	"crypto/rsa"
 	"fmt"
 	"log"
-	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/ext/netext"
 	"github.com/project-iris/iris/proto/scribe"
 )
 
@@ -39,8 +42,13 @@ type Overlay struct {
 	subLive map[string][]uint64     // Live members of each subscribed topic
 	subLock map[string]sync.RWMutex // Locks protecting the individual topics
 
-	tunAddrs []string          // Listener addresses for the tunnel endpoints
-	tunQuits []chan chan error // Quit channels for the tunnel acceptors
+	tunAddrs  []string          // Listener addresses for the tunnel endpoints
+	tunQuits  []chan chan error // Quit channels for the tunnel acceptors
+	tunDirect int64             // Number of live direct tunnels (atomic)
+	tunRouted int64             // Number of live overlay routed tunnels (atomic)
+
+	chunkIdx uint64     // Index to assign the next outbound chunked message
+	chunks   *assembler // Reassembler of the inbound chunked messages
 
 	lock sync.RWMutex // Protects the overlay state
 }
@@ -49,10 +57,11 @@ type Overlay struct {
 func New(overId string, key *rsa.PrivateKey) *Overlay {
 	// Create and initialize the overlay
 	o := &Overlay{
-		autoid:  1, // Zero's a special case with gob, skip it
+		autoid:  1, // Zero's a special case (unset field), skip it
 		conns:   make(map[uint64]*Connection),
 		subLive: make(map[string][]uint64),
 		subLock: make(map[string]sync.RWMutex),
+		chunks:  newAssembler(),
 	}
 	o.scribe = scribe.New(overId, key, o)
 	return o
@@ -65,24 +74,37 @@ func (o *Overlay) Boot() (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	// Start a tunnel acceptor on each network interface
-	addrs, err := net.InterfaceAddrs()
+	// Apply any advertised address override
+	if len(config.IrisTunnelAdvertise) > 0 {
+		if err := netext.CheckAddrs(config.IrisTunnelAdvertise); err != nil {
+			return 0, fmt.Errorf("invalid advertised tunnel address: %v", err)
+		}
+		o.lock.Lock()
+		o.tunAddrs = append([]string{}, config.IrisTunnelAdvertise...)
+		sort.Strings(o.tunAddrs)
+		o.lock.Unlock()
+	}
+	// Start a tunnel acceptor on each selected network interface
+	ipnets, err := netext.Interfaces(config.NetInclude, config.NetExclude, config.BootMulticast)
 	if err != nil {
 		return 0, err
 	}
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok {
-			if !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-				// Create a quit channel
-				quit := make(chan chan error)
-				o.tunQuits = append(o.tunQuits, quit)
-
-				// Start and sync the acceptor
-				live := make(chan struct{})
-				go o.tunneler(ipnet, live, quit)
-				<-live
+	for _, ipnet := range ipnets {
+		// Bind the listener, tearing down the ones started so far on failure
+		sock, err := o.tunListen(ipnet)
+		if err != nil {
+			errc := make(chan error)
+			for _, quit := range o.tunQuits {
+				quit <- errc
+				<-errc
 			}
+			o.tunQuits = nil
+			return 0, err
 		}
+		// Create a quit channel and start the acceptor
+		quit := make(chan chan error)
+		o.tunQuits = append(o.tunQuits, quit)
+		go o.tunneler(sock, quit)
 	}
 	return peers, nil
 }
@@ -116,6 +138,20 @@ func (o *Overlay) Shutdown() error {
 	}
 }
 
+// Tunnel statistics of the overlay node.
+type Stats struct {
+	DirectTunnels int // Number of live tunnels using a direct stream
+	RoutedTunnels int // Number of live tunnels routed through the overlay
+}
+
+// Gathers the statistics of the local node.
+func (o *Overlay) Stats() *Stats {
+	return &Stats{
+		DirectTunnels: int(atomic.LoadInt64(&o.tunDirect)),
+		RoutedTunnels: int(atomic.LoadInt64(&o.tunRouted)),
+	}
+}
+
 // Subscribes to a new topic, or adds the current connection to the list of live
 // subscriptions.
 func (o *Overlay) subscribe(id uint64, topic string) error {
@@ -20,21 +20,35 @@
 package iris
 
 import (
-	"encoding/gob"
 	"time"
 
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/codec"
 )
 
 // Iris operation code.
 type opcode uint8
 
 const (
-	opBcast opcode = iota // Cluster broadcast
-	opReq                 // Cluster request
-	opRep                 // Cluster reply
-	opPub                 // Topic publish
-	opTun                 // Tunneling request
+	opBcast    opcode = iota // Cluster broadcast
+	opReq                    // Cluster request
+	opRep                    // Cluster reply
+	opPub                    // Topic publish
+	opTun                    // Tunneling request
+	opGather                 // Cluster scatter-gather request
+	opGatRep                 // Cluster scatter-gather reply
+	opSend                   // Direct connection message
+	opMember                 // Cluster membership query
+	opMemRep                 // Cluster membership reply
+	opJoin                   // Cluster member join announcement
+	opLeave                  // Cluster member leave announcement
+	opPull                   // Chunked request continuation pull
+	opTunOpen                // Routed tunnel fallback setup
+	opTunData                // Routed tunnel data frame
+	opTunClose               // Routed tunnel termination
+	opTunFin                 // Routed tunnel end-of-stream
+	opTunAck                 // Routed tunnel acknowledgement
 )
 
 // Extra headers for the Iris layer.
@@ -43,30 +57,56 @@ type header struct {
 	Src  uint64 // Connection id of the sender (requests, tunnel)
 	Dest uint64 // Connection id of the recipient (direct messages)
 
-	// Optional fields for requests and replies
-	ReqId   uint64        // Request/response identifier
-	ReqTime time.Duration // Maximum amount of time spendable on the request
+	// Optional fields for requests, gathers and replies
+	ReqId     uint64        // Request/response identifier
+	ReqTime   time.Duration // Maximum amount of time spendable on the request
+	ReqCopies uint64        // Number of overlay paths to route the request and reply along
 
 	// Optional fields for tunnels
 	TunId    uint64        // Id of the tunnel being requested
 	TunKey   []byte        // Secret symmetric key of the tunnel
 	TunAddrs []string      // Tunnel listener endpoints
 	TunTime  time.Duration // Maximum time to establish tunnel
+
+	// Optional fields for routed tunnels
+	TunPeer   uint64 // Tunnel id of the sending endpoint
+	TunSeq    uint64 // Sequence number of the routed tunnel frame
+	TunCredit uint64 // Advertised window or granted credits
+	TunHalf   bool   // Whether the end-of-stream is a half close
+
+	// Optional fields for chunked messages
+	ChunkId  uint64 // Sender node unique id of the chunked message
+	ChunkIdx uint64 // Index of the chunk within the message
+	ChunkCnt uint64 // Total number of chunks of the message
 }
 
-// Make sure the header struct is registered with gob.
+// Make sure the header struct is registered with the codec.
 func init() {
-	gob.Register(&header{})
+	codec.Register(6, &header{})
 }
 
 // Envelopes an Iris header and payload into the generic packet container.
 func (c *Connection) assemblePacket(head *header, data []byte) *proto.Message {
-	return &proto.Message{
+	msg := &proto.Message{
 		Head: proto.Header{
 			Meta: head,
 		},
 		Data: data,
 	}
+	// Application payloads are interactive unless requested otherwise
+	if data != nil {
+		msg.Head.Prio = proto.PrioInteractive
+	}
+	return msg
+}
+
+// Restricts a priority class to the ones available to applications: control is
+// reserved for system traffic, and any unknown class is considered bulk.
+func appPriority(prio proto.Priority) proto.Priority {
+	if prio >= proto.PrioBulk {
+		return proto.PrioBulk
+	}
+	return proto.PrioInteractive
 }
 
 // Assembles an application broadcast message. It consists of the bcast opcode
@@ -76,9 +116,10 @@ func (c *Connection) assembleBroadcast(msg []byte) *proto.Message {
 }
 
 // Assembles an application request message. It consists of the request opcode,
-// the locally unique request id and the payload.
-func (c *Connection) assembleRequest(reqId uint64, req []byte, timeout time.Duration) *proto.Message {
-	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout}, req)
+// the locally unique request id, the number of paths to reply along and the
+// payload.
+func (c *Connection) assembleRequest(reqId uint64, req []byte, timeout time.Duration, copies int) *proto.Message {
+	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout, ReqCopies: uint64(copies)}, req)
 }
 
 // Assembles the reply message to an application request. It consists of the
@@ -99,3 +140,87 @@ func (c *Connection) assemblePublish(msg []byte) *proto.Message {
 func (c *Connection) assembleTunnelRequest(tunId uint64, key []byte, addrs []string, timeout time.Duration) *proto.Message {
 	return c.assemblePacket(&header{Op: opTun, Src: c.id, TunId: tunId, TunKey: key, TunAddrs: addrs, TunTime: timeout}, nil)
 }
+
+// Assembles a scatter-gather request message. It consists of the gather opcode,
+// the locally unique gather id and the payload.
+func (c *Connection) assembleGather(gatId uint64, req []byte, timeout time.Duration) *proto.Message {
+	return c.assemblePacket(&header{Op: opGather, Src: c.id, ReqId: gatId, ReqTime: timeout}, req)
+}
+
+// Assembles a single member's reply to a scatter-gather request. It consists of
+// the gather reply opcode, the replying connection's id, the original gather's
+// id and the payload itself.
+func (c *Connection) assembleGatherReply(dest uint64, gatId uint64, rep []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opGatRep, Src: c.id, Dest: dest, ReqId: gatId}, rep)
+}
+
+// Assembles a direct message to a specific connection. It consists of the send
+// opcode, the recipient connection's id and the payload.
+func (c *Connection) assembleSend(dest uint64, msg []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opSend, Src: c.id, Dest: dest}, msg)
+}
+
+// Assembles an application request addressed to a specific connection. It is
+// the same as a cluster request, with the recipient connection's id filled in.
+func (c *Connection) assembleRequestTo(dest uint64, reqId uint64, req []byte, timeout time.Duration, copies int) *proto.Message {
+	return c.assemblePacket(&header{Op: opReq, Src: c.id, Dest: dest, ReqId: reqId, ReqTime: timeout, ReqCopies: uint64(copies)}, req)
+}
+
+// Assembles a membership query message. It consists of the member opcode and
+// the locally unique gather id.
+func (c *Connection) assembleMembers(gatId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opMember, Src: c.id, ReqId: gatId}, nil)
+}
+
+// Assembles the reply to a membership query, consisting of the member reply
+// opcode, the replying connection's id and the original query's id.
+func (c *Connection) assembleMembersReply(dest uint64, gatId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opMemRep, Src: c.id, Dest: dest, ReqId: gatId}, nil)
+}
+
+// Assembles a pull request for the remaining chunks of a balanced message. It
+// consists of the pull opcode, the pulling connection's id and the id of the
+// chunked message.
+func (c *Connection) assemblePull(dest uint64, chunkId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opPull, Src: c.id, Dest: dest, ChunkId: chunkId}, nil)
+}
+
+// Assembles a routed tunnel setup message, consisting of the tunnel open opcode,
+// the ids of the two endpoints, the tunnel secret proving the sender's identity
+// and the receive window of the local endpoint.
+func (c *Connection) assembleTunnelOpen(dest uint64, tunId uint64, peer uint64, key []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opTunOpen, Src: c.id, Dest: dest, TunId: tunId, TunPeer: peer, TunKey: key, TunCredit: uint64(config.IrisTunnelWindow)}, nil)
+}
+
+// Assembles a routed tunnel frame, consisting of the tunnel data opcode, the
+// remote tunnel id, the frame sequence number and either the credits granted to
+// the remote endpoint or the payload.
+func (c *Connection) assembleTunnelData(dest uint64, tunId uint64, seq uint64, credit uint64, msg []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opTunData, Dest: dest, TunId: tunId, TunSeq: seq, TunCredit: credit}, msg)
+}
+
+// Assembles a routed tunnel end-of-stream frame, consisting of the tunnel fin
+// opcode, the remote tunnel id, the frame sequence number, the half close flag
+// and the close reason as the payload.
+func (c *Connection) assembleTunnelFin(dest uint64, tunId uint64, seq uint64, half bool, reason string) *proto.Message {
+	return c.assemblePacket(&header{Op: opTunFin, Dest: dest, TunId: tunId, TunSeq: seq, TunHalf: half}, []byte(reason))
+}
+
+// Assembles the final frame of a routed tunnel, consisting of the tunnel close
+// opcode, the remote tunnel id and the sequence number of the frame.
+func (c *Connection) assembleTunnelClose(dest uint64, tunId uint64, seq uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opTunClose, Dest: dest, TunId: tunId, TunSeq: seq}, nil)
+}
+
+// Assembles a routed tunnel acknowledgement, consisting of the tunnel ack opcode,
+// the remote tunnel id, the number of sequenced frames arrived in order and the
+// total credits granted to the remote endpoint.
+func (c *Connection) assembleTunnelAck(dest uint64, tunId uint64, seq uint64, credit uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opTunAck, Dest: dest, TunId: tunId, TunSeq: seq, TunCredit: credit}, nil)
+}
+
+// Assembles a membership change announcement, consisting of the join or leave
+// opcode and the id of the local connection.
+func (c *Connection) assembleMembership(op opcode) *proto.Message {
+	return c.assemblePacket(&header{Op: op, Src: c.id}, nil)
+}
@@ -18,9 +18,9 @@
 package iris
 
 import (
-	"crypto/x509"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -29,10 +29,16 @@ import (
 
 // Connection handler for the pub/sub tests.
 type subscriber struct {
-	msgs chan []byte
+	msgs   chan []byte
+	probes uint32 // Number of readiness probes received
 }
 
 func (s *subscriber) HandleEvent(msg []byte) {
+	// Empty events are readiness probes, count them separately
+	if len(msg) == 0 {
+		atomic.AddUint32(&s.probes, 1)
+		return
+	}
 	select {
 	case s.msgs <- msg:
 		// Ok
@@ -41,6 +47,36 @@ func (s *subscriber) HandleEvent(msg []byte) {
 	}
 }
 
+// Publishes a readiness probe to a topic, reporting whether all subscribers
+// received it within a short while.
+func probeTopic(conn *Connection, topic string, hands [][]*subscriber) bool {
+	// Snapshot the current probe counts and publish a new one
+	counts := make(map[*subscriber]uint32)
+	for _, row := range hands {
+		for _, hand := range row {
+			counts[hand] = atomic.LoadUint32(&hand.probes)
+		}
+	}
+	if err := conn.Publish(topic, []byte{}); err != nil {
+		return false
+	}
+	// Wait until all subscribers get it, or give up
+	for deadline := time.Now().Add(250 * time.Millisecond); time.Now().Before(deadline); {
+		arrived := true
+		for hand, count := range counts {
+			if atomic.LoadUint32(&hand.probes) == count {
+				arrived = false
+				break
+			}
+		}
+		if arrived {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
 // Individual pubsub tests.
 func TestPubSubSingleNodeSingleConn(t *testing.T) {
 	testPubSub(t, 1, 1, 1000)
@@ -60,56 +96,21 @@ func TestPubSubMultiNodeMultiConn(t *testing.T) {
 
 // Tests multi node multi connection broadcasting.
 func testPubSub(t *testing.T, nodes, conns, msgs int) {
-	// Configure the test
-	swapConfigs()
-	defer swapConfigs()
-
-	olds := config.BootPorts
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65000+i)
-	}
-	defer func() { config.BootPorts = olds }()
-
-	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
-	overlay := "pubsub-test"
 	cluster := fmt.Sprintf("pubsub-test-%d-%d", nodes, conns)
 	topic := fmt.Sprintf("pubsub-test-topic-%d-%d", nodes, conns)
 
-	// Boot the iris overlays
-	liveNodes := make([]*Overlay, nodes)
+	// Boot the iris overlays and connect with a lot of clients
+	_, liveConns, closer := bootCluster(t, "pubsub-test", cluster, nodes, conns, func(i, j int) ConnectionHandler {
+		return nil
+	})
+	defer closer()
+
+	// Subscribe to a new topic with all the clients
+	liveHands := make([][]*subscriber, nodes)
 	for i := 0; i < nodes; i++ {
-		liveNodes[i] = New(overlay, key)
-		if _, err := liveNodes[i].Boot(); err != nil {
-			t.Fatalf("failed to boot iris overlay: %v.", err)
-		}
-		defer func(node *Overlay) {
-			if err := node.Shutdown(); err != nil {
-				t.Fatalf("failed to terminate iris node: %v.", err)
-			}
-		}(liveNodes[i])
-	}
-	// Connect to all nodes with a lot of clients
-	liveHands := make(map[int][]*subscriber)
-	liveConns := make(map[int][]*Connection)
-	for i, node := range liveNodes {
 		liveHands[i] = make([]*subscriber, conns)
-		liveConns[i] = make([]*Connection, conns)
 		for j := 0; j < conns; j++ {
-			// Connect to the iris network
-			conn, err := node.Connect(cluster, nil)
-			if err != nil {
-				t.Fatalf("failed to connect to the iris overlay: %v.", err)
-			}
-			liveConns[i][j] = conn
-
-			defer func(conn *Connection) {
-				if err := conn.Close(); err != nil {
-					t.Fatalf("failed to close iris connection: %v.", err)
-				}
-			}(liveConns[i][j])
-
-			// Subscribe to a new topic
-			liveHands[i][j] = &subscriber{make(chan []byte, nodes*conns*msgs)}
+			liveHands[i][j] = &subscriber{msgs: make(chan []byte, nodes*conns*msgs)}
 			if err := liveConns[i][j].Subscribe(topic, liveHands[i][j]); err != nil {
 				t.Fatalf("failed to subscribe to the topic: %v.", err)
 			}
@@ -120,9 +121,17 @@ func testPubSub(t *testing.T, nodes, conns, msgs int) {
 			}(liveConns[i][j])
 		}
 	}
-	// Make sure there is a little time to propagate state and reports (TODO, fix this)
-	if nodes > 1 {
-		time.Sleep(3 * time.Second)
+	// Probe the topic until all the splits reach every subscriber
+	deadline := time.Now().Add(10 * time.Second)
+	for done := 0; done < config.IrisClusterSplits; {
+		if probeTopic(liveConns[0][0], topic, liveHands) {
+			done++
+			continue
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("topic failed to converge.")
+		}
+		done = 0
 	}
 	// Publish with each and every node in parallel
 	pend := new(sync.WaitGroup)
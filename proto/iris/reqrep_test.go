@@ -19,14 +19,11 @@ package iris
 
 import (
 	"bytes"
-	"crypto/x509"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
-
-	"github.com/project-iris/iris/config"
 )
 
 // Connection handler for the req/rep tests.
@@ -50,6 +47,10 @@ func (r *requester) HandleTunnel(tun *Tunnel) {
 	panic("Inbound tunnel on request handler")
 }
 
+func (r *requester) HandleMessage(msg []byte) {
+	panic("Direct message passed to request handler")
+}
+
 func (r *requester) HandleDrop(reason error) {
 	panic("Connection dropped on request handler")
 }
@@ -73,58 +74,21 @@ func TestReqRepMultiNodeMultiConn(t *testing.T) {
 
 // Tests multi node multi connection request/replies.
 func testReqRep(t *testing.T, nodes, conns, reqs int) {
-	// Configure the test
-	swapConfigs()
-	defer swapConfigs()
-
-	olds := config.BootPorts
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65000+i)
-	}
-	defer func() { config.BootPorts = olds }()
-
-	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
-	overlay := "reqrep-test"
 	cluster := fmt.Sprintf("reqrep-test-%d-%d", nodes, conns)
 
-	// Boot the iris overlays
-	liveNodes := make([]*Overlay, nodes)
+	// Boot the iris overlays and connect with a lot of clients
+	liveHands := make([][]*requester, nodes)
 	for i := 0; i < nodes; i++ {
-		liveNodes[i] = New(overlay, key)
-		if _, err := liveNodes[i].Boot(); err != nil {
-			t.Fatalf("failed to boot iris overlay: %v.", err)
-		}
-		defer func(node *Overlay) {
-			if err := node.Shutdown(); err != nil {
-				t.Fatalf("failed to terminate iris node: %v.", err)
-			}
-		}(liveNodes[i])
-	}
-	// Connect to all nodes with a lot of clients
-	liveHands := make(map[int][]*requester)
-	liveConns := make(map[int][]*Connection)
-	for i, node := range liveNodes {
 		liveHands[i] = make([]*requester, conns)
-		liveConns[i] = make([]*Connection, conns)
 		for j := 0; j < conns; j++ {
 			liveHands[i][j] = &requester{i, 0}
-			conn, err := node.Connect(cluster, liveHands[i][j])
-			if err != nil {
-				t.Fatalf("failed to connect to the iris overlay: %v.", err)
-			}
-			liveConns[i][j] = conn
-
-			defer func(conn *Connection) {
-				if err := conn.Close(); err != nil {
-					t.Fatalf("failed to close iris connection: %v.", err)
-				}
-			}(liveConns[i][j])
 		}
 	}
-	// Make sure there is a little time to propagate state and reports (TODO, fix this)
-	if nodes > 1 {
-		time.Sleep(3 * time.Second)
-	}
+	_, liveConns, closer := bootCluster(t, "reqrep-test", cluster, nodes, conns, func(i, j int) ConnectionHandler {
+		return liveHands[i][j]
+	})
+	defer closer()
+
 	// Request with each and every node in parallel
 	pend := new(sync.WaitGroup)
 	for i := 0; i < nodes; i++ {
@@ -137,7 +101,15 @@ func testReqRep(t *testing.T, nodes, conns, reqs int) {
 					req := make([]byte, len(orig))
 					copy(req, orig)
 
-					if rep, err := liveConns[i][j].Request(cluster, req, 5*time.Second); err != nil {
+					// Replicate every second request along multiple paths
+					var rep []byte
+					var err error
+					if k%2 == 0 {
+						rep, err = liveConns[i][j].Request(cluster, req, 5*time.Second)
+					} else {
+						rep, err = liveConns[i][j].RequestReplicated(cluster, req, 5*time.Second, 3)
+					}
+					if err != nil {
 						t.Fatalf("failed to send request: %v.", err)
 					} else if bytes.Compare(orig, rep) != 0 {
 						t.Fatalf("req/rep mismatch: have %v, want %v.", rep, orig)
@@ -159,3 +131,47 @@ func testReqRep(t *testing.T, nodes, conns, reqs int) {
 		}
 	}
 }
+
+// Individual scatter-gather tests.
+func TestGatherSingleNodeMultiConn(t *testing.T) {
+	testGather(t, 1, 10, 10)
+}
+
+func TestGatherMultiNodeMultiConn(t *testing.T) {
+	testGather(t, 5, 5, 5)
+}
+
+// Tests multi node multi connection scatter-gathers.
+func testGather(t *testing.T, nodes, conns, reqs int) {
+	cluster := fmt.Sprintf("gather-test-%d-%d", nodes, conns)
+
+	// Boot the iris overlays and connect with a lot of clients
+	_, liveConns, closer := bootCluster(t, "gather-test", cluster, nodes, conns, func(i, j int) ConnectionHandler {
+		return &requester{i, 0}
+	})
+	defer closer()
+
+	// Gather with each node sequentially, verifying all the replies
+	for i := 0; i < nodes; i++ {
+		for j := 0; j < conns; j++ {
+			for k := 0; k < reqs; k++ {
+				orig := []byte{byte(i), byte(j), byte(k)}
+				req := make([]byte, len(orig))
+				copy(req, orig)
+
+				reps, missing, err := liveConns[i][j].Gather(cluster, req, 5*time.Second)
+				if err != nil {
+					t.Fatalf("failed to gather: %v.", err)
+				}
+				if missing != 0 || len(reps) != nodes*conns {
+					t.Fatalf("reply count mismatch: have %d/%d missing, want %d/0.", len(reps), missing, nodes*conns)
+				}
+				for _, rep := range reps {
+					if bytes.Compare(orig, rep) != 0 {
+						t.Fatalf("req/rep mismatch: have %v, want %v.", rep, orig)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,374 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the overlay fallback of tunnels. If the accepting side cannot dial
+// any of the initiator's tunnel listeners (NAT, firewalls, segmented networks),
+// the tunnel frames are carried as routed direct messages through the overlay.
+// Since routing neither preserves ordering nor guarantees delivery, the frames
+// are sequenced and put back in order at the receiver, which acknowledges them
+// cumulatively. Unacknowledged frames are retransmitted from the replay buffer
+// of the tunnel (the same one used to resume direct tunnels), so only a remote
+// endpoint going silent for too long tears the tunnel down.
+//
+// Window updates are not sequenced, as they are cumulative. The acknowledgements
+// also carry the credits granted so far, and are repeated periodically even on
+// idle tunnels, so lost window updates cannot stall the remote sender.
+
+package iris
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Overlay route carrying the messages of a tunnel. It exposes the same channel
+// based interface as the encrypted link used by direct tunnels.
+type route struct {
+	owner *Connection // Local connection owning the tunnel
+	tun   *Tunnel     // Local tunnel endpoint, holding the replay buffer
+	node  *big.Int    // Overlay node hosting the remote endpoint
+	conn  uint64      // Connection id of the remote endpoint
+	tunId uint64      // Tunnel id of the remote endpoint
+
+	Send   chan *proto.Message // Outbound tunnel messages
+	Recv   chan *proto.Message // Inbound tunnel messages, in order
+	frames chan *proto.Message // Routed frames arrived, possibly out of order
+	acked  uint64              // Number of sequenced frames acknowledged by the remote (atomic)
+
+	sendQuit chan chan error
+	recvQuit chan chan error
+}
+
+// Creates a new overlay route to a remote tunnel endpoint and starts the frame
+// transfer processes.
+func (c *Connection) newRoute(tun *Tunnel, node *big.Int, conn uint64, tunId uint64) *route {
+	r := &route{
+		owner: c,
+		tun:   tun,
+		node:  node,
+		conn:  conn,
+		tunId: tunId,
+
+		Send:   make(chan *proto.Message, config.IrisTunnelBuffer),
+		Recv:   make(chan *proto.Message, config.IrisTunnelBuffer),
+		frames: make(chan *proto.Message, config.IrisTunnelBuffer+config.IrisTunnelWindow),
+
+		sendQuit: make(chan chan error),
+		recvQuit: make(chan chan error),
+	}
+	go r.sender()
+	go r.receiver()
+
+	return r
+}
+
+// Terminates the frame transfers, delivering any queued messages and notifying
+// the remote endpoint of the closure.
+func (r *route) Close() error {
+	var res error
+
+	for _, quit := range []chan chan error{r.sendQuit, r.recvQuit} {
+		errc := make(chan error)
+		quit <- errc
+		if err := <-errc; res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// Queues a routed frame arriving from the overlay for reordering. Never blocks,
+// a frame overflowing the buffer is dropped (and retransmitted by the remote).
+func (r *route) deliver(frame *proto.Message) {
+	select {
+	case r.frames <- frame:
+	default:
+		log.Printf("iris: routed tunnel buffer full, dropping frame.")
+	}
+}
+
+// Sends tunnel messages as sequenced frames through the overlay until an error
+// occurs or termination is requested, after which the queued messages and the
+// final close frame are sent. Frames not acknowledged in time are resent.
+func (r *route) sender() {
+	var errc chan error
+	var errv error
+
+	// Loop until an error occurs or quit is requested
+	seq := uint64(0)
+	var retry <-chan time.Time
+	for errv == nil && errc == nil {
+		select {
+		case errc = <-r.sendQuit:
+			continue
+		case msg := <-r.Send:
+			if seq, errv = r.forward(seq, msg); retry == nil {
+				retry = time.After(config.IrisTunnelRetransmit)
+			}
+		case <-retry:
+			retry = nil
+			if acked := atomic.LoadUint64(&r.acked); acked < seq {
+				errv = r.retransmit(acked, seq)
+				retry = time.After(config.IrisTunnelRetransmit)
+			}
+		}
+	}
+	// If quit was requested, send all pending messages and the close frame
+	if errc != nil {
+		for done := false; !done && errv == nil; {
+			select {
+			case msg := <-r.Send:
+				seq, errv = r.forward(seq, msg)
+			default:
+				done = true
+			}
+		}
+		if errv == nil {
+			errv = r.owner.direct(r.node, r.owner.assembleTunnelClose(r.conn, r.tunId, seq))
+		}
+	} else {
+		// Error, wait for channel to report on
+		errc = <-r.sendQuit
+	}
+	errc <- errv
+}
+
+// Envelopes a tunnel message (data, window update or end-of-stream) into a
+// routed frame and sends it to the remote endpoint. Data and end-of-stream are
+// sequenced, returning the sequence number of the next such frame.
+func (r *route) forward(seq uint64, msg *proto.Message) (uint64, error) {
+	if meta, ok := msg.Head.Meta.(*windowPacket); ok {
+		return seq, r.owner.direct(r.node, r.owner.assembleTunnelData(r.conn, r.tunId, 0, meta.Credit, nil))
+	}
+	return seq + 1, r.frame(seq, msg)
+}
+
+// Sends a sequenced tunnel message as a routed frame. The payload is copied, as
+// the overlay encrypts in place, whereas the original is kept for resending.
+func (r *route) frame(seq uint64, msg *proto.Message) error {
+	if meta, ok := msg.Head.Meta.(*finPacket); ok {
+		return r.owner.direct(r.node, r.owner.assembleTunnelFin(r.conn, r.tunId, seq, meta.Half, meta.Reason))
+	}
+	data := append([]byte{}, msg.Data...)
+	return r.owner.direct(r.node, r.owner.assembleTunnelData(r.conn, r.tunId, seq, 0, data))
+}
+
+// Resends the sequenced messages from the replay buffer of the tunnel that were
+// already sent, but not acknowledged by the remote endpoint yet.
+func (r *route) retransmit(acked uint64, sent uint64) error {
+	r.tun.replayLock.Lock()
+	base, replay := r.tun.replayBase, append([]*proto.Message{}, r.tun.replay...)
+	r.tun.replayLock.Unlock()
+
+	for i, msg := range replay {
+		if seq := base + uint64(i); seq >= acked && seq < sent {
+			if err := r.frame(seq, msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reorders the arriving frames and passes the contained messages upstream until
+// the remote endpoint closes the tunnel, goes silent for too long or termination
+// is requested. Arrived frames are acknowledged in batches, duplicates at once.
+func (r *route) receiver() {
+	var errc chan error
+	var errv error
+
+	pend := make(map[uint64]*proto.Message)
+	next := uint64(0)
+
+	// Acknowledgement state: last reported sequence, credits and time
+	ackSeq, ackCredit, ackTime := uint64(0), uint64(0), time.Now()
+	alive := time.Now()
+
+	ticker := time.NewTicker(config.IrisTunnelAckDelay)
+	defer ticker.Stop()
+
+	// Loop until an error occurs, the remote closes or quit is requested
+	for closed := false; !closed && errv == nil && errc == nil; {
+		var upstream *proto.Message
+		select {
+		case errc = <-r.recvQuit:
+			continue
+		case <-ticker.C:
+			if time.Since(alive) > config.IrisTunnelRouteTimeout {
+				errv = errors.New("routed tunnel endpoint unresponsive")
+				continue
+			}
+			// Acknowledge any progress, or periodically to keep the remote alive
+			credit := atomic.LoadUint64(&r.tun.granted)
+			if next != ackSeq || credit != ackCredit || time.Since(ackTime) >= config.IrisTunnelRetransmit {
+				if err := r.owner.direct(r.node, r.owner.assembleTunnelAck(r.conn, r.tunId, next, credit)); err != nil {
+					log.Printf("iris: failed to acknowledge routed frames: %v.", err)
+				}
+				ackSeq, ackCredit, ackTime = next, credit, time.Now()
+			}
+			continue
+		case frame := <-r.frames:
+			alive = time.Now()
+
+			head := frame.Head.Meta.(*header)
+			switch {
+			case head.Op == opTunAck:
+				// Remote progress report, release the acknowledged frames
+				for acked := atomic.LoadUint64(&r.acked); head.TunSeq > acked; acked = atomic.LoadUint64(&r.acked) {
+					if atomic.CompareAndSwapUint64(&r.acked, acked, head.TunSeq) {
+						r.tun.release(head.TunSeq)
+						break
+					}
+				}
+				if head.TunCredit > 0 {
+					upstream = &proto.Message{Head: proto.Header{Meta: &windowPacket{Credit: head.TunCredit}}}
+				}
+			case head.Op == opTunData && head.TunCredit > 0:
+				// Window update, cumulative, no need to sequence
+				upstream = &proto.Message{Head: proto.Header{Meta: &windowPacket{Credit: head.TunCredit}}}
+			default:
+				seq := head.TunSeq
+				if _, ok := pend[seq]; ok || seq < next {
+					// Duplicate (retransmission), make sure the remote learns the progress
+					ackSeq = ^uint64(0)
+					continue
+				}
+				if seq >= next+uint64(cap(r.frames)) {
+					log.Printf("iris: routed tunnel frame %d out of bounds, dropping.", seq)
+					continue
+				}
+				pend[seq] = frame
+			}
+		}
+		// Pass any window update upstream
+		if upstream != nil {
+			select {
+			case r.Recv <- upstream:
+			case errc = <-r.recvQuit:
+			}
+			continue
+		}
+		// Pass all the in-order frames upstream
+		for frame, ok := pend[next]; ok && !closed && errc == nil; frame, ok = pend[next] {
+			delete(pend, next)
+			next++
+
+			head := frame.Head.Meta.(*header)
+			if head.Op == opTunClose {
+				closed = true
+				break
+			}
+			msg := &proto.Message{Data: frame.Data}
+			if head.Op == opTunFin {
+				msg = &proto.Message{Head: proto.Header{Meta: &finPacket{Half: head.TunHalf, Reason: string(frame.Data)}}}
+			}
+			select {
+			case r.Recv <- msg:
+			case errc = <-r.recvQuit:
+			}
+		}
+	}
+	// Close the upward stream and sync termination
+	close(r.Recv)
+	if errc == nil {
+		errc = <-r.recvQuit
+	}
+	errc <- errv
+}
+
+// Falls back to carrying a tunnel through the overlay if no direct stream could
+// be established: sets up the local end of the route, requests the initiator to
+// do the same and waits for its confirmation.
+func (c *Connection) routeTunnel(tun *Tunnel, node *big.Int, remote uint64, id uint64, deadline time.Time) error {
+	c.tunLock.Lock()
+	tun.route = c.newRoute(tun, node, remote, id)
+	c.tunLock.Unlock()
+
+	// Request the fallback and wait for the confirmation
+	var err error
+	if err = c.direct(node, c.assembleTunnelOpen(remote, id, tun.id, tun.secret)); err == nil {
+		select {
+		case <-tun.fall:
+			return nil
+		case <-c.term:
+			err = ErrTerminating
+		case <-time.After(deadline.Sub(time.Now())):
+			err = ErrTimeout
+		}
+	}
+	// Fallback failed, tear down the local route
+	if err := tun.route.Close(); err != nil {
+		log.Printf("iris: failed to close routed tunnel: %v.", err)
+	}
+	return err
+}
+
+// Handles a routed tunnel setup message. On the initiating side the route is
+// created and the fallback confirmed back to the accepting side. On the accepting
+// side this is the confirmation itself. In both cases the remote window is set
+// and the pending tunnel notified.
+func (c *Connection) handleTunnelOpen(node *big.Int, remote uint64, id uint64, peer uint64, key []byte, window uint64) {
+	c.tunLock.Lock()
+	tun, ok := c.tunLive[id]
+	if !ok || tun.window != nil || tun.fall == nil || window == 0 || !bytes.Equal(tun.secret, key) {
+		c.tunLock.Unlock()
+		log.Printf("iris: invalid routed tunnel setup for %d, dropping.", id)
+		return
+	}
+	confirm := tun.route == nil
+	if confirm {
+		tun.route = c.newRoute(tun, node, remote, peer)
+	}
+	tun.window = make(chan struct{}, window)
+	c.tunLock.Unlock()
+
+	// Confirm the fallback if requested by the remote side
+	if confirm {
+		if err := c.direct(node, c.assembleTunnelOpen(remote, peer, id, key)); err != nil {
+			log.Printf("iris: failed to confirm routed tunnel: %v.", err)
+			if err := tun.route.Close(); err != nil {
+				log.Printf("iris: failed to close routed tunnel: %v.", err)
+			}
+			return
+		}
+	}
+	tun.fall <- tun.route
+}
+
+// Passes a routed tunnel frame to the overlay route of the tunnel.
+func (c *Connection) handleTunnelData(id uint64, frame *proto.Message) {
+	c.tunLock.RLock()
+	tun, ok := c.tunLive[id]
+	var route *route
+	if ok {
+		route = tun.route
+	}
+	c.tunLock.RUnlock()
+
+	if route == nil {
+		log.Printf("iris: routed frame for unknown tunnel %d, dropping.", id)
+		return
+	}
+	route.deliver(frame)
+}
@@ -19,19 +19,23 @@ package iris
 
 import (
 	"crypto/rand"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"log"
+	"math/big"
 	"net"
 	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.google.com/p/go.crypto/hkdf"
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/codec"
 	"github.com/project-iris/iris/proto/link"
 	"github.com/project-iris/iris/proto/stream"
 )
@@ -40,40 +44,90 @@ import (
 type initPacket struct {
 	ConnId uint64 // Id of the Iris client connection requesting the tunnel
 	TunId  uint64 // Id of the tunnel being built
+	Nonce  []byte // Key derivation nonce if an existing tunnel is resumed
 }
 
-// Authorization packet to send over the established encrypted tunnels.
+// Note, when resuming, the listener answers the initiator with an init packet of
+// its own, carrying only the listener's key derivation nonce. Mixing both nonces
+// into the link keys prevents replaying recorded resumption handshakes.
+
+// Authorization packet to send over the established encrypted tunnels, also
+// advertising the receive window of the sender.
 type authPacket struct {
-	Id uint64
+	Id     uint64
+	Window uint64
+}
+
+// Window update packet granting send credits to the remote endpoint. Credits are
+// cumulative, so lost or repeated updates are harmless.
+type windowPacket struct {
+	Credit uint64
+}
+
+// Resumption packet exchanged as the first message over a redialed tunnel link,
+// reporting the number of messages received and the credits granted so far.
+type resumePacket struct {
+	Recv   uint64
+	Credit uint64
+}
+
+// End-of-stream packet, sent after the last data message of an endpoint. A half
+// close still permits receiving, whilst a full close requests the remote to
+// confirm with its own full close, after which the tunnel is torn down.
+type finPacket struct {
+	Half   bool
+	Reason string
 }
 
-// Make sure the handshake packets are registered with gob.
+// Make sure the handshake and control packets are registered with the codec.
 func init() {
-	gob.Register(&initPacket{})
-	gob.Register(&authPacket{})
+	codec.Register(7, &initPacket{})
+	codec.Register(8, &authPacket{})
+	codec.Register(9, &windowPacket{})
+	codec.Register(10, &finPacket{})
+	codec.Register(11, &resumePacket{})
 }
 
-func (o *Overlay) tunneler(ipnet *net.IPNet, live chan struct{}, quit chan chan error) {
-	// Listen for incoming streams on the given interface and random port.
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), "0"))
+// Error returned by Tunnel.Recv after the remote endpoint closed the tunnel,
+// carrying the reason given by the remote side (if any).
+type CloseError struct {
+	Reason string
+}
+
+// Implements the error interface.
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return "closed by remote"
+	}
+	return "closed by remote: " + e.Reason
+}
+
+// Binds a tunnel listener to a specified interface on the configured port. Any
+// failure is reported synchronously, so the overlay can refuse to boot.
+func (o *Overlay) tunListen(ipnet *net.IPNet) (*stream.Listener, error) {
+	// Listen for incoming streams on the given interface and configured port.
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), strconv.Itoa(config.IrisTunnelPort)))
 	if err != nil {
-		panic(fmt.Sprintf("failed to resolve interface (%v): %v.", ipnet.IP, err))
+		return nil, fmt.Errorf("failed to resolve interface (%v): %v", ipnet.IP, err)
 	}
 	sock, err := stream.Listen(addr)
 	if err != nil {
-		panic(fmt.Sprintf("failed to start stream listener: %v.", err))
+		return nil, fmt.Errorf("failed to start stream listener: %v", err)
 	}
 	sock.Accept(config.IrisTunnelAcceptTimeout)
 
-	// Save the new listener address into the local (sorted) address list
-	o.lock.Lock()
-	o.tunAddrs = append(o.tunAddrs, addr.String())
-	sort.Strings(o.tunAddrs)
-	o.lock.Unlock()
-
-	// Notify the overlay of the successful listen
-	live <- struct{}{}
+	// Save the new listener address into the local (sorted) address list, unless overridden
+	if len(config.IrisTunnelAdvertise) == 0 {
+		o.lock.Lock()
+		o.tunAddrs = append(o.tunAddrs, addr.String())
+		sort.Strings(o.tunAddrs)
+		o.lock.Unlock()
+	}
+	return sock, nil
+}
 
+// Accepts the inbound tunnel streams of a listener until termination.
+func (o *Overlay) tunneler(sock *stream.Listener, quit chan chan error) {
 	// Process incoming connection until termination is requested
 	var errc chan error
 	for errc == nil {
@@ -99,21 +153,89 @@ func (o *Overlay) tunneler(ipnet *net.IPNet, live chan struct{}, quit chan chan
 	// Terminate the peer listener
 	errv := sock.Close()
 	if errv != nil {
-		log.Printf("iris: failed to terminate tunnel listener: %v.", err)
+		log.Printf("iris: failed to terminate tunnel listener: %v.", errv)
 	}
 	errc <- errv
 }
 
+// Transport mode of a tunnel.
+type TunnelMode int
+
+const (
+	TunnelDirect TunnelMode = iota // Direct encrypted stream between the nodes
+	TunnelRouted                   // Routed messages through the overlay
+)
+
+// Returns the textual name of the tunnel mode.
+func (m TunnelMode) String() string {
+	switch m {
+	case TunnelDirect:
+		return "direct"
+	case TunnelRouted:
+		return "routed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(m))
+	}
+}
+
 // Communication stream between the local app and a remote endpoint. Ordered
-// message delivery is guaranteed.
+// message delivery is guaranteed. If a direct stream cannot be established, the
+// tunnel falls back to routing its messages through the overlay.
+//
+// Flow control is credit based: each endpoint advertises its receive window
+// during the handshake, and the sender may have at most that many messages in
+// flight. The receiver grants credits back in batches, as the application
+// consumes the arrived messages.
+//
+// Termination is graceful: either side may half close the tunnel, signalling
+// the end of its stream while still receiving, and a full close waits for the
+// remote endpoint to confirm the receipt of all messages sent before it.
+//
+// Direct tunnels survive transient stream failures: sent messages are retained
+// until acknowledged, and if the stream drops, the dialing endpoint redials the
+// remote listeners within a grace period, after which both sides retransmit the
+// messages the other did not receive, transparently to the application.
+// Routed tunnels retransmit the messages lost in the overlay from the same
+// buffer of unacknowledged messages.
 type Tunnel struct {
 	id    uint64      // Auto-incremented tunnel identifier
 	owner *Connection // Iris connection through which to communicate
 
-	conn   *link.Link // Encrypted data link of the tunnel
+	conn   *link.Link // Encrypted data link of the tunnel (nil if routed)
+	route  *route     // Overlay route of the tunnel (nil if direct)
 	secret []byte     // Master key from which to derive the link keys
 
-	init chan *link.Link // Channel to receive the reverse tunnel link
+	addrs    []string // Remote listener addresses to redial (dialing side only)
+	peerConn uint64   // Connection id of the remote endpoint (dialing side only)
+	peerTun  uint64   // Tunnel id of the remote endpoint (dialing side only)
+
+	send     chan *proto.Message // Outbound queue of the link or route
+	recv     chan *proto.Message // Inbound queue of the link or route
+	down     chan struct{}       // Channel closed when the current link fails
+	linkLock sync.RWMutex        // Mutex to protect the link swaps on resumption
+
+	window   chan struct{}       // Messages in flight to the remote, full if credits exhausted
+	data     chan *proto.Message // Data messages arrived, waiting for the application
+	credit   int                 // Number of consumed messages not yet credited back
+	granted  uint64              // Total credits granted to the remote (atomic)
+	credited uint64              // Total credits granted by the remote
+	arrived  uint64              // Number of data and end-of-stream messages arrived
+
+	replay     []*proto.Message // Sent messages not yet acknowledged by the remote
+	replayBase uint64           // Sequence number of the first message in the replay buffer
+	replayLock sync.Mutex       // Mutex to protect the replay buffer
+
+	sendLock sync.Mutex    // Mutex to order the data messages and end-of-stream
+	finSent  bool          // Whether the local endpoint half closed the tunnel
+	closed   bool          // Whether the local endpoint fully closed the tunnel
+	remote   error         // End-of-stream reported by the remote endpoint (Recv only)
+	ended    chan struct{} // Channel closed when the remote fully closed the tunnel
+	shutOnce sync.Once     // Ensures the link or route is torn down only once
+	shutErr  error         // Result of tearing down the link or route
+	stop     chan struct{} // Channel closed when the tunnel is torn down locally
+
+	init chan *link.Link // Channel to receive the reverse tunnel link (also when resumed)
+	fall chan *route     // Channel to receive the confirmed overlay route
 	term chan struct{}   // Channel to signal termination to blocked go-routines
 }
 
@@ -128,6 +250,7 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 		owner: c,
 
 		init: make(chan *link.Link, 1),
+		fall: make(chan *route, 1),
 		term: make(chan struct{}),
 	}
 	c.tunIdx++
@@ -151,30 +274,60 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 	case <-time.After(timeout):
 		err = ErrTimeout
 	case tun.conn = <-tun.init:
-		// Clean up init fields
-		tun.secret, tun.init = nil, nil
+		// Start the data flow, keeping the secret and init channel for resumption
+		tun.start()
+		return tun, nil
+	case <-tun.fall:
+		// Direct stream failed, start the data flow through the overlay
+		log.Printf("iris: tunnel %d falling back to overlay routing.", tunId)
+		tun.start()
 		return tun, nil
 	}
-	// Tunneling failed, clean up and report error
-	c.tunLock.Lock()
-	delete(c.tunLive, tunId)
-	c.tunLock.Unlock()
-
+	// Tunneling failed, tear down any late remote endpoint and report error
+	go tun.abandon()
 	return nil, err
 }
 
+// Cleans up after a tunnel initiation that was given up on. The remote endpoint
+// may still complete a direct link or overlay route after the local timeout, so
+// these are waited for a while, and if arriving, the tunnel is started and closed
+// right away, notifying the remote endpoint of the closure.
+func (t *Tunnel) abandon() {
+	defer func() {
+		t.owner.tunLock.Lock()
+		delete(t.owner.tunLive, t.id)
+		t.owner.tunLock.Unlock()
+	}()
+	select {
+	case t.conn = <-t.init:
+	case <-t.fall:
+	case <-time.After(config.IrisTunnelInitTimeout):
+		return
+	}
+	t.start()
+	if err := t.CloseReason("tunnel initiation timed out"); err != nil {
+		log.Printf("iris: failed to close abandoned tunnel: %v.", err)
+	}
+}
+
 // Accepts an incoming tunneling request from a remote, initializes and stores
-// the new tunnel into the connection state.
-func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []string, timeout time.Duration) (*Tunnel, error) {
+// the new tunnel into the connection state. If none of the remote listeners can
+// be reached, the tunnel is routed through the overlay instead.
+func (c *Connection) buildTunnel(node *big.Int, remote uint64, id uint64, key []byte, addrs []string, timeout time.Duration) (*Tunnel, error) {
 	deadline := time.Now().Add(timeout)
 
 	// Create the local tunnel endpoint
 	c.tunLock.Lock()
 	tunId := c.tunIdx
 	tun := &Tunnel{
-		id:    tunId,
-		owner: c,
-		term:  make(chan struct{}),
+		id:       tunId,
+		owner:    c,
+		secret:   key,
+		addrs:    addrs,
+		peerConn: remote,
+		peerTun:  id,
+		fall:     make(chan *route, 1),
+		term:     make(chan struct{}),
 	}
 	c.tunIdx++
 	c.tunLive[tunId] = tun
@@ -183,21 +336,27 @@ func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []s
 	// Dial the remote tunnel listener
 	var err error
 	var strm *stream.Stream
+	err = errors.New("no tunnel endpoints")
 	for _, addr := range addrs {
-		strm, err = stream.Dial(addr, timeout)
+		strm, err = stream.Dial(addr, deadline.Sub(time.Now()))
 		if err == nil {
 			break
 		}
 	}
 	// If no error occurred, initialize the client endpoint
 	if err == nil {
-		tun.conn, err = c.initClientTunnel(strm, remote, id, key, deadline)
+		tun.conn, tun.window, err = c.initClientTunnel(strm, remote, id, key, nil, deadline)
 		if err != nil {
 			if err := strm.Close(); err != nil {
 				log.Printf("iris: failed to close uninitialized client tunnel stream: %v.", err)
 			}
 		}
 	}
+	// If the direct stream failed, fall back to routing through the overlay
+	if err != nil && time.Now().Before(deadline) {
+		log.Printf("iris: direct tunnel failed (%v), falling back to overlay routing.", err)
+		err = c.routeTunnel(tun, node, remote, id, deadline)
+	}
 	// Tunneling failed, clean up and report error
 	if err != nil {
 		c.tunLock.Lock()
@@ -205,10 +364,66 @@ func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []s
 		c.tunLock.Unlock()
 		return nil, err
 	}
+	tun.start()
 	return tun, nil
 }
 
-// Initializes a stream into an encrypted tunnel link.
+// Redials the remote listeners of a direct tunnel after its link failed, until
+// one accepts the resumption or the deadline expires.
+func (c *Connection) redialTunnel(tun *Tunnel, deadline time.Time) (*link.Link, error) {
+	err := errors.New("no tunnel endpoints")
+	for time.Now().Before(deadline) {
+		for _, addr := range tun.addrs {
+			var strm *stream.Stream
+			if strm, err = stream.Dial(addr, deadline.Sub(time.Now())); err != nil {
+				continue
+			}
+			// Derive fresh link keys for each attempt, never reusing the old ones
+			var nonce []byte
+			if nonce, err = tunnelNonce(); err != nil {
+				strm.Close()
+				return nil, err
+			}
+			var conn *link.Link
+			if conn, _, err = c.initClientTunnel(strm, tun.peerConn, tun.peerTun, tun.secret, nonce, deadline); err == nil {
+				return conn, nil
+			}
+			if err := strm.Close(); err != nil {
+				log.Printf("iris: failed to close unresumed client tunnel stream: %v.", err)
+			}
+		}
+		// Wait a bit before retrying, unless the tunnel is being closed
+		select {
+		case <-tun.stop:
+			return nil, ErrTerminating
+		case <-c.term:
+			return nil, ErrTerminating
+		case <-time.After(config.IrisTunnelResumeBackoff):
+		}
+	}
+	return nil, err
+}
+
+// Creates the key derivation stream of a tunnel link. Resumed links mix in the
+// nonces of both the dialer and the listener, so that no two links share the
+// same keys and neither side can be fed a recorded handshake.
+func tunnelKeys(secret []byte, dialNonce []byte, listenNonce []byte) io.Reader {
+	hasher := func() hash.Hash { return config.HkdfHash.New() }
+	info := append(append(append([]byte{}, config.HkdfInfo...), dialNonce...), listenNonce...)
+	return hkdf.New(hasher, secret, config.HkdfSalt, info)
+}
+
+// Generates a random key derivation nonce for a resumed tunnel link.
+func tunnelNonce() ([]byte, error) {
+	nonce := make([]byte, config.StsCipherBits>>3)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Initializes a stream into an encrypted tunnel link. If the client resumes an
+// established tunnel, the link is passed to it as a replacement.
 func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	// Set a socket deadline for finishing the handshake
 	strm.Sock().SetDeadline(time.Now().Add(config.IrisTunnelInitTimeout))
@@ -228,111 +443,542 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	c.tunLock.RLock()
 	tun, ok := c.tunLive[init.TunId]
 	c.tunLock.RUnlock()
-	if !ok {
+	if !ok || tun.init == nil {
 		return errors.New("tunnel not found")
 	}
+	// If resuming, contribute a fresh nonce to the link keys too
+	var nonce []byte
+	if init.Nonce != nil {
+		var err error
+		if nonce, err = tunnelNonce(); err != nil {
+			return err
+		}
+		if err := strm.Send(&initPacket{Nonce: nonce}); err != nil {
+			return err
+		}
+		if err := strm.Flush(); err != nil {
+			return err
+		}
+	}
 	// Create the encrypted link
-	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, tun.secret, config.HkdfSalt, config.HkdfInfo)
-	conn := link.New(strm, hkdf, true)
+	conn := link.New(strm, tunnelKeys(tun.secret, init.Nonce, nonce), true)
 
 	// Send and retrieve an authorization to verify both directions
 	auth := &proto.Message{
 		Head: proto.Header{
-			Meta: &authPacket{Id: tun.id},
+			Meta: &authPacket{Id: tun.id, Window: uint64(config.IrisTunnelWindow)},
 		},
 	}
 	if err := conn.SendDirect(auth); err != nil {
 		return err
 	}
-	if msg, err := conn.RecvDirect(); err != nil {
+	msg, err := conn.RecvDirect()
+	if err != nil {
 		return err
-	} else if auth, ok := msg.Head.Meta.(*authPacket); !ok || auth.Id != tun.id {
+	}
+	remote, ok := msg.Head.Meta.(*authPacket)
+	if !ok || remote.Id != tun.id || remote.Window == 0 {
 		return errors.New("protocol violation")
 	}
+	c.tunLock.Lock()
+	if resume := init.Nonce != nil; resume != (tun.window != nil) || tun.route != nil {
+		c.tunLock.Unlock()
+		if resume {
+			return errors.New("tunnel not resumable")
+		}
+		return errors.New("tunnel already established")
+	}
+	if tun.window == nil {
+		tun.window = make(chan struct{}, remote.Window)
+	}
+	c.tunLock.Unlock()
 	conn.Start(config.IrisTunnelBuffer)
 
-	// Send back the initialized link to the pending tunnel
-	tun.init <- conn
-	return nil
+	// Send back the initialized link to the pending or resuming tunnel
+	select {
+	case tun.init <- conn:
+		return nil
+	case <-tun.term:
+		if err := conn.Close(); err != nil {
+			log.Printf("iris: failed to close unused tunnel link: %v.", err)
+		}
+		return nil
+	}
 }
 
-// Initializes a stream into an encrypted tunnel link.
-func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uint64, key []byte, deadline time.Time) (*link.Link, error) {
+// Initializes a stream into an encrypted tunnel link, returning also the send
+// window permitted by the remote endpoint. A non-nil nonce resumes an existing
+// tunnel, deriving fresh keys for the new link.
+func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uint64, key []byte, nonce []byte, deadline time.Time) (*link.Link, chan struct{}, error) {
 	// Set a socket deadline for finishing the handshake
 	strm.Sock().SetDeadline(deadline)
 	defer strm.Sock().SetDeadline(time.Time{})
 
 	// Send the unencrypted tunnel id to associate with the remote tunnel
-	init := &initPacket{ConnId: remote, TunId: id}
+	init := &initPacket{ConnId: remote, TunId: id, Nonce: nonce}
 	if err := strm.Send(init); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	// If resuming, retrieve the nonce contributed by the listener
+	var peerNonce []byte
+	if nonce != nil {
+		if err := strm.Flush(); err != nil {
+			return nil, nil, err
+		}
+		reply := new(initPacket)
+		if err := strm.Recv(reply); err != nil {
+			return nil, nil, err
+		}
+		if len(reply.Nonce) == 0 {
+			return nil, nil, errors.New("protocol violation")
+		}
+		peerNonce = reply.Nonce
 	}
 	// Create the encrypted link and authorize it
-	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, key, config.HkdfSalt, config.HkdfInfo)
-	conn := link.New(strm, hkdf, false)
+	conn := link.New(strm, tunnelKeys(key, nonce, peerNonce), false)
 
 	// Send and retrieve an authorization to verify both directions
 	auth := &proto.Message{
 		Head: proto.Header{
-			Meta: &authPacket{Id: id},
+			Meta: &authPacket{Id: id, Window: uint64(config.IrisTunnelWindow)},
 		},
 	}
 	if err := conn.SendDirect(auth); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if msg, err := conn.RecvDirect(); err != nil {
-		return nil, err
-	} else if auth, ok := msg.Head.Meta.(*authPacket); !ok || auth.Id != id {
-		return nil, errors.New("protocol violation")
+	msg, err := conn.RecvDirect()
+	if err != nil {
+		return nil, nil, err
+	}
+	reply, ok := msg.Head.Meta.(*authPacket)
+	if !ok || reply.Id != id || reply.Window == 0 {
+		return nil, nil, errors.New("protocol violation")
 	}
 	conn.Start(config.IrisTunnelBuffer)
 
-	// Return the initialized link
-	return conn, nil
+	// Return the initialized link and send window
+	return conn, make(chan struct{}, reply.Window), nil
+}
+
+// Starts the inbound data flow of an initialized tunnel, through whichever of
+// the link or overlay route was established.
+func (t *Tunnel) start() {
+	if t.conn != nil {
+		t.send, t.recv = t.conn.Send, t.conn.Recv
+	} else {
+		t.send, t.recv = t.route.Send, t.route.Recv
+	}
+	t.down = make(chan struct{})
+	t.stop = make(chan struct{})
+
+	// Leave room for the two end-of-stream packets beyond the window
+	t.data = make(chan *proto.Message, config.IrisTunnelWindow+2)
+	t.ended = make(chan struct{})
+
+	// Account for the tunnel in the node statistics until it terminates
+	atomic.AddInt64(t.counter(), 1)
+	go t.receiver()
+}
+
+// Returns the node statistic counting the live tunnels of the same mode.
+func (t *Tunnel) counter() *int64 {
+	if t.Mode() == TunnelRouted {
+		return &t.owner.iris.tunRouted
+	}
+	return &t.owner.iris.tunDirect
+}
+
+// Returns whether the tunnel uses a direct stream or is routed via the overlay.
+func (t *Tunnel) Mode() TunnelMode {
+	if t.route != nil {
+		return TunnelRouted
+	}
+	return TunnelDirect
 }
 
 // Closes the tunnel connection.
 func (t *Tunnel) Close() error {
-	// Terminate the encrypted link
-	return t.conn.Close()
+	return t.CloseReason("")
+}
+
+// Closes the tunnel connection, reporting the reason to the remote endpoint. All
+// messages sent before are delivered, the call waiting for the remote endpoint
+// to confirm the closure, at most until a timeout is reached.
+func (t *Tunnel) CloseReason(reason string) error {
+	// Signal the end of the stream and wait for the confirmation
+	if err := t.finish(false, reason); err == nil {
+		select {
+		case <-t.ended:
+		case <-t.term:
+		case <-time.After(config.IrisTunnelCloseTimeout):
+			log.Printf("iris: tunnel close unconfirmed, terminating.")
+		}
+	}
+	return t.teardown()
+}
+
+// Terminates the encrypted link or overlay route of the tunnel, once, also
+// aborting any resumption in progress.
+func (t *Tunnel) teardown() error {
+	t.shutOnce.Do(func() {
+		if t.route != nil {
+			t.shutErr = t.route.Close()
+			return
+		}
+		t.linkLock.Lock()
+		defer t.linkLock.Unlock()
+
+		close(t.stop)
+		t.shutErr = t.conn.Close()
+	})
+	return t.shutErr
 }
 
-// Sends an asynchronous message to the remote pair. Not reentrant (order).
-func (t *Tunnel) Send(msg []byte) error {
-	// Create and encrypt the message
+// Half closes the tunnel, signalling the remote endpoint that no more messages
+// will be sent. Receiving is still possible until the remote closes too.
+func (t *Tunnel) CloseSend() error {
+	return t.finish(true, "")
+}
+
+// Sends an end-of-stream packet to the remote endpoint after all the pending
+// data messages, unless an equivalent one was already sent.
+func (t *Tunnel) finish(half bool, reason string) error {
+	t.sendLock.Lock()
+	defer t.sendLock.Unlock()
+
+	if t.closed || (half && t.finSent) {
+		return nil
+	}
+	t.finSent = true
+	t.closed = !half
+
+	fin := &proto.Message{
+		Head: proto.Header{
+			Meta: &finPacket{Half: half, Reason: reason},
+		},
+	}
+	return t.push(fin, true)
+}
+
+// Sends an asynchronous message to the remote pair. If the remote window is
+// exhausted, the call blocks until credits are granted or the timeout expires.
+// Not reentrant (order).
+func (t *Tunnel) Send(msg []byte, timeout time.Duration) error {
+	t.sendLock.Lock()
+	defer t.sendLock.Unlock()
+
+	// Make sure none of the endpoints closed the stream
+	if t.finSent {
+		return ErrTerminating
+	}
+	// Wait for the remote endpoint to permit a new message
+	select {
+	case t.window <- struct{}{}:
+		// Ok, credit consumed
+	case <-t.ended:
+		return ErrTerminating
+	case <-t.term:
+		return ErrTerminating
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+	// Create and encrypt the message (routed ones are encrypted by the overlay)
 	packet := &proto.Message{Data: msg}
-	if err := packet.Encrypt(); err != nil {
-		return err
+	if t.route == nil {
+		if err := packet.Encrypt(); err != nil {
+			<-t.window
+			return err
+		}
 	}
 	// Queue the message for sending
 	select {
-	case t.conn.Send <- packet:
+	case <-t.ended:
+		return ErrTerminating
+	default:
+		return t.push(packet, true)
+	}
+}
+
+// Queues a message into the current link or route of the tunnel. Sequenced
+// messages (data and end-of-stream) are retained until the remote acknowledges
+// them, so the ones caught in a link failure are dropped, to be retransmitted
+// after the tunnel resumes, whereas routed ones lost in the overlay are resent
+// by the route.
+func (t *Tunnel) push(packet *proto.Message, sequenced bool) error {
+	t.linkLock.RLock()
+	defer t.linkLock.RUnlock()
+
+	if sequenced {
+		t.replayLock.Lock()
+		t.replay = append(t.replay, packet)
+		t.replayLock.Unlock()
+	}
+	select {
+	case t.send <- packet:
+		return nil
+	case <-t.down:
 		return nil
 	case <-t.term:
-		return errors.New("closed")
+		return ErrTerminating
 	}
 }
 
 // Retrieves a message waiting in the local queue. If none is available, the
-// call blocks until either one arrives or a timeout is reached.
+// call blocks until either one arrives or a timeout is reached. Consumed
+// messages are credited back to the remote endpoint in batches. Not reentrant.
+//
+// After the remote endpoint half closed the tunnel, io.EOF is returned. If it
+// was fully closed, a *CloseError is returned with the remote's reason.
 func (t *Tunnel) Recv(timeout time.Duration) ([]byte, error) {
-	// Retrieve an encrypted packet from the tunnel link
 	select {
-	case packet, ok := <-t.conn.Recv:
+	case packet, ok := <-t.data:
 		// Terminate the tunnel if closed remotely
 		if !ok {
-			close(t.term)
+			if t.remote != nil {
+				return nil, t.remote
+			}
 			return nil, ErrTerminating
 		}
-		// Decrypt and pass upstream
-		if err := packet.Decrypt(); err != nil {
-			return nil, err
+		// Report the end of the remote stream if reached
+		if fin, ok := packet.Head.Meta.(*finPacket); ok {
+			if fin.Half {
+				t.remote = io.EOF
+			} else {
+				t.remote = &CloseError{Reason: fin.Reason}
+			}
+			return nil, t.remote
+		}
+		// Grant the remote endpoint further credits if enough were consumed
+		if t.credit++; t.credit >= (config.IrisTunnelWindow+3)/4 {
+			t.grant(t.credit)
+			t.credit = 0
+		}
+		// Decrypt and pass upstream (routed ones were decrypted by the overlay)
+		if t.route == nil {
+			if err := packet.Decrypt(); err != nil {
+				packet.Release()
+				return nil, err
+			}
 		}
+		packet.Detach()
 		return packet.Data, nil
 
 	case <-time.After(timeout):
+		if t.remote != nil {
+			return nil, t.remote
+		}
 		return nil, ErrTimeout
 	}
 }
+
+// Sends a window update to the remote endpoint, permitting it to send a number
+// of additional messages. Failures are ignored, as a terminated tunnel has no use
+// for credits, but the messages already arrived should still be delivered.
+func (t *Tunnel) grant(credit int) {
+	update := &proto.Message{
+		Head: proto.Header{
+			Meta: &windowPacket{Credit: atomic.AddUint64(&t.granted, uint64(credit))},
+		},
+	}
+	t.push(update, false)
+}
+
+// Processes a cumulative credit grant of the remote endpoint, freeing up send
+// credits and dropping the consumed messages from the replay buffer. Returns
+// false if the remote granted credits for messages never sent.
+func (t *Tunnel) acknowledge(credit uint64) bool {
+	for ; t.credited < credit; t.credited++ {
+		select {
+		case <-t.window:
+		default:
+			return false
+		}
+	}
+	t.release(credit)
+	return true
+}
+
+// Drops the messages preceding the given sequence number from the replay buffer.
+func (t *Tunnel) release(seq uint64) {
+	t.replayLock.Lock()
+	defer t.replayLock.Unlock()
+
+	for t.replayBase < seq && len(t.replay) > 0 {
+		t.replay[0] = nil
+		t.replay = t.replay[1:]
+		t.replayBase++
+	}
+}
+
+// Demultiplexes the messages arriving on the tunnel link: window updates are
+// consumed, freeing up send credits, whilst data messages and end-of-streams are
+// queued for the application. A full close is confirmed back asynchronously,
+// after which the link or route is not needed any more and is torn down.
+// A remote exceeding the advertised window, or granting credits for messages
+// never sent is considered a protocol violation, terminating the tunnel. If the
+// link of a direct tunnel fails, or the remote redials it, the tunnel resumes.
+func (t *Tunnel) receiver() {
+	defer atomic.AddInt64(t.counter(), -1)
+	defer close(t.term)
+	defer close(t.data)
+
+	ended := false
+	for {
+		var packet *proto.Message
+		select {
+		case msg, ok := <-t.recv:
+			if !ok {
+				// Link or route closed, resume unless the tunnel ended
+				if ended || !t.reconnect(nil) {
+					return
+				}
+				continue
+			}
+			packet = msg
+		case conn := <-t.init:
+			// Remote redialed while the local link still seemed alive
+			if !t.reconnect(conn) {
+				return
+			}
+			continue
+		}
+		if update, ok := packet.Head.Meta.(*windowPacket); ok {
+			if !t.acknowledge(update.Credit) {
+				log.Printf("iris: tunnel credit out of bounds, terminating.")
+				t.discard()
+				return
+			}
+			continue
+		}
+		select {
+		case t.data <- packet:
+			t.arrived++
+		default:
+			log.Printf("iris: tunnel window exceeded, terminating.")
+			packet.Release()
+			t.discard()
+			return
+		}
+		// If the remote closed the tunnel, unblock senders and confirm
+		if fin, ok := packet.Head.Meta.(*finPacket); ok && !fin.Half && !ended {
+			ended = true
+			close(t.ended)
+			go func() {
+				t.finish(false, "")
+				t.teardown()
+			}()
+		}
+	}
+}
+
+// Resumes a direct tunnel after its link failed or the remote redialed it. The
+// dialing side redials the remote listeners, whereas the listening side waits
+// for the new link (unless already arrived), both within the grace period.
+func (t *Tunnel) reconnect(conn *link.Link) bool {
+	if t.route != nil {
+		return false
+	}
+	// Abandon the current link, unblocking anyone sending into it
+	close(t.down)
+
+	select {
+	case <-t.stop:
+		if conn != nil {
+			conn.Close()
+		}
+		return false
+	default:
+	}
+	if conn == nil {
+		log.Printf("iris: tunnel %d link failed, resuming.", t.id)
+
+		var err error
+		deadline := time.Now().Add(config.IrisTunnelResumeGrace)
+		if len(t.addrs) > 0 {
+			conn, err = t.owner.redialTunnel(t, deadline)
+		} else {
+			select {
+			case conn = <-t.init:
+			case <-t.stop:
+				err = ErrTerminating
+			case <-t.owner.term:
+				err = ErrTerminating
+			case <-time.After(deadline.Sub(time.Now())):
+				err = ErrTimeout
+			}
+		}
+		if err != nil {
+			log.Printf("iris: failed to resume tunnel %d: %v.", t.id, err)
+			return false
+		}
+	}
+	return t.resume(conn)
+}
+
+// Exchanges the resumption states over a new link, swaps it in place of the old
+// one and retransmits all the messages the remote endpoint did not receive.
+func (t *Tunnel) resume(conn *link.Link) bool {
+	// Report the local state and wait for the remote one
+	conn.Send <- &proto.Message{
+		Head: proto.Header{
+			Meta: &resumePacket{Recv: t.arrived, Credit: atomic.LoadUint64(&t.granted)},
+		},
+	}
+	var state *resumePacket
+	select {
+	case msg, ok := <-conn.Recv:
+		if ok {
+			state, _ = msg.Head.Meta.(*resumePacket)
+		}
+	case <-time.After(config.IrisTunnelInitTimeout):
+	}
+	if state == nil || !t.acknowledge(state.Credit) {
+		log.Printf("iris: invalid tunnel resumption, terminating.")
+		conn.Close()
+		return false
+	}
+	// Swap the links, making sure no new messages are sent meanwhile
+	t.linkLock.Lock()
+	defer t.linkLock.Unlock()
+
+	select {
+	case <-t.stop:
+		conn.Close()
+		return false
+	default:
+	}
+	old := t.conn
+	t.conn, t.send, t.recv, t.down = conn, conn.Send, conn.Recv, make(chan struct{})
+	go old.Close()
+
+	// Retransmit everything not yet received by the remote
+	t.replayLock.Lock()
+	valid := state.Recv >= t.replayBase && state.Recv <= t.replayBase+uint64(len(t.replay))
+	t.replayLock.Unlock()
+	if !valid {
+		log.Printf("iris: tunnel resumption out of bounds, terminating.")
+		return false
+	}
+	t.release(state.Recv)
+
+	timeout := time.After(config.IrisTunnelResumeGrace)
+	for _, packet := range t.replay {
+		select {
+		case t.send <- packet:
+		case <-timeout:
+			log.Printf("iris: tunnel retransmission timed out, terminating.")
+			return false
+		}
+	}
+	log.Printf("iris: tunnel %d resumed, %d messages retransmitted.", t.id, len(t.replay))
+	return true
+}
+
+// Discards any further messages arriving on the tunnel link until it's closed.
+func (t *Tunnel) discard() {
+	go func() {
+		for packet := range t.recv {
+			packet.Release()
+		}
+	}()
+}
@@ -19,8 +19,8 @@ package iris
 
 import (
 	"bytes"
-	"crypto/x509"
 	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -43,20 +43,28 @@ func (r *tunneler) HandleRequest(req []byte, timeout time.Duration) []byte {
 	panic("Request passed to tunnel handler")
 }
 
+// Echoes the tunnel messages in the background, as a live tunnel pinning one of
+// the limited handler threads could starve the inbound tunnel requests.
 func (r *tunneler) HandleTunnel(tun *Tunnel) {
-	for {
-		if msg, err := tun.Recv(3 * time.Second); err == nil {
-			if r.self != int(msg[0]) {
-				atomic.AddUint32(&r.remote, 1)
-			}
-			if err := tun.Send(msg); err != nil {
-				panic(err)
+	go func() {
+		for {
+			if msg, err := tun.Recv(3 * time.Second); err == nil {
+				if r.self != int(msg[0]) {
+					atomic.AddUint32(&r.remote, 1)
+				}
+				if err := tun.Send(msg, 3*time.Second); err != nil {
+					panic(err)
+				}
+			} else {
+				break
 			}
-		} else {
-			break
 		}
-	}
-	tun.Close()
+		tun.Close()
+	}()
+}
+
+func (r *tunneler) HandleMessage(msg []byte) {
+	panic("Direct message passed to tunnel handler")
 }
 
 func (r *tunneler) HandleDrop(reason error) {
@@ -82,58 +90,21 @@ func TestTunnelMultiNodeMultiConn(t *testing.T) {
 
 // Tests multi node multi connection request/replies.
 func testTunnel(t *testing.T, nodes, conns, tuns, msgs int) {
-	// Configure the test
-	swapConfigs()
-	defer swapConfigs()
-
-	olds := config.BootPorts
-	for i := 0; i < nodes; i++ {
-		config.BootPorts = append(config.BootPorts, 65000+i)
-	}
-	defer func() { config.BootPorts = olds }()
-
-	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
-	overlay := "tunnel-test"
 	cluster := fmt.Sprintf("tunnel-test-%d-%d", nodes, conns)
 
-	// Boot the iris overlays
-	liveNodes := make([]*Overlay, nodes)
+	// Boot the iris overlays and connect with a lot of clients
+	liveHands := make([][]*tunneler, nodes)
 	for i := 0; i < nodes; i++ {
-		liveNodes[i] = New(overlay, key)
-		if _, err := liveNodes[i].Boot(); err != nil {
-			t.Fatalf("failed to boot iris overlay: %v.", err)
-		}
-		defer func(node *Overlay) {
-			if err := node.Shutdown(); err != nil {
-				t.Fatalf("failed to terminate iris node: %v.", err)
-			}
-		}(liveNodes[i])
-	}
-	// Connect to all nodes with a lot of clients
-	liveHands := make(map[int][]*tunneler)
-	liveConns := make(map[int][]*Connection)
-	for i, node := range liveNodes {
 		liveHands[i] = make([]*tunneler, conns)
-		liveConns[i] = make([]*Connection, conns)
 		for j := 0; j < conns; j++ {
 			liveHands[i][j] = &tunneler{i, 0}
-			conn, err := node.Connect(cluster, liveHands[i][j])
-			if err != nil {
-				t.Fatalf("failed to connect to the iris overlay: %v.", err)
-			}
-			liveConns[i][j] = conn
-
-			defer func(conn *Connection) {
-				if err := conn.Close(); err != nil {
-					t.Fatalf("failed to close iris connection: %v.", err)
-				}
-			}(liveConns[i][j])
 		}
 	}
-	// Make sure there is a little time to propagate state and reports (TODO, fix this)
-	if nodes > 1 {
-		time.Sleep(3 * time.Second)
-	}
+	_, liveConns, closer := bootCluster(t, "tunnel-test", cluster, nodes, conns, func(i, j int) ConnectionHandler {
+		return liveHands[i][j]
+	})
+	defer closer()
+
 	// Request with each and every node in parallel
 	pend := new(sync.WaitGroup)
 	for i := 0; i < nodes; i++ {
@@ -159,7 +130,7 @@ func testTunnel(t *testing.T, nodes, conns, tuns, msgs int) {
 						msg := make([]byte, len(orig))
 						copy(msg, orig)
 
-						if err := tun.Send(msg); err != nil {
+						if err := tun.Send(msg, 3*time.Second); err != nil {
 							t.Fatalf("failed to send message: %v.", err)
 						}
 						if msg, err := tun.Recv(3 * time.Second); err != nil {
@@ -185,3 +156,321 @@ func testTunnel(t *testing.T, nodes, conns, tuns, msgs int) {
 		}
 	}
 }
+
+// Connection handler for the tunnel flow control tests, passing inbound tunnels
+// to the test without consuming them.
+type windower struct {
+	tuns chan *Tunnel
+}
+
+func (w *windower) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to tunnel handler")
+}
+
+func (w *windower) HandleRequest(req []byte, timeout time.Duration) []byte {
+	panic("Request passed to tunnel handler")
+}
+
+func (w *windower) HandleTunnel(tun *Tunnel) {
+	w.tuns <- tun
+}
+
+func (w *windower) HandleMessage(msg []byte) {
+	panic("Direct message passed to tunnel handler")
+}
+
+func (w *windower) HandleDrop(reason error) {
+	panic("Connection dropped on tunnel handler")
+}
+
+// Tests that a tunnel sender blocks when the remote window is exhausted, and
+// resumes after the receiver consumes enough messages.
+func TestTunnelWindow(t *testing.T) {
+	defer func(window int) { config.IrisTunnelWindow = window }(config.IrisTunnelWindow)
+	config.IrisTunnelWindow = 8
+
+	// Boot an iris overlay and connect with a non-consuming handler
+	hand := &windower{make(chan *Tunnel, 1)}
+	_, conns, closer := bootCluster(t, "tunnel-window-test", "tunnel-window-test", 1, 1, func(i, j int) ConnectionHandler {
+		return hand
+	})
+	defer closer()
+
+	conn := conns[0][0]
+
+	// Establish a tunnel and fetch the remote endpoint
+	tun, err := conn.Tunnel("tunnel-window-test", time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish tunnel: %v.", err)
+	}
+	defer tun.Close()
+
+	remote := <-hand.tuns
+	defer remote.Close()
+
+	// Fill the remote window and verify that further sends block
+	for i := 0; i < config.IrisTunnelWindow; i++ {
+		if err := tun.Send([]byte{byte(i)}, 100*time.Millisecond); err != nil {
+			t.Fatalf("send %d within window failed: %v.", i, err)
+		}
+	}
+	if err := tun.Send([]byte{0xff}, 100*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("send beyond window mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	// Consume enough messages to trigger a window update and send again
+	for i := 0; i < (config.IrisTunnelWindow+3)/4; i++ {
+		if msg, err := remote.Recv(time.Second); err != nil {
+			t.Fatalf("failed to receive message %d: %v.", i, err)
+		} else if !bytes.Equal(msg, []byte{byte(i)}) {
+			t.Fatalf("message %d mismatch: have %v, want %v.", i, msg, []byte{byte(i)})
+		}
+	}
+	if err := tun.Send([]byte{byte(config.IrisTunnelWindow)}, time.Second); err != nil {
+		t.Fatalf("send after window update failed: %v.", err)
+	}
+	// Drain the remaining messages, verifying ordering
+	for i := (config.IrisTunnelWindow + 3) / 4; i <= config.IrisTunnelWindow; i++ {
+		if msg, err := remote.Recv(time.Second); err != nil {
+			t.Fatalf("failed to receive message %d: %v.", i, err)
+		} else if !bytes.Equal(msg, []byte{byte(i)}) {
+			t.Fatalf("message %d mismatch: have %v, want %v.", i, msg, []byte{byte(i)})
+		}
+	}
+}
+
+// Tests that tunnels fall back to overlay routing if the direct stream cannot
+// be established, retaining the message ordering even if frames are lost.
+func TestTunnelRouted(t *testing.T) {
+	nodes, msgs := 2, 100
+
+	// Boot the iris overlays, advertising unreachable tunnel endpoints
+	liveNodes, clients, closer := bootCluster(t, "tunnel-routed-test", "tunnel-routed-test", nodes, 1, func(i, j int) ConnectionHandler {
+		return &tunneler{i, 0}
+	})
+	defer closer()
+
+	liveConns := make([]*Connection, nodes)
+	for i, node := range liveNodes {
+		node.lock.Lock()
+		node.tunAddrs = []string{"127.0.0.1:1"}
+		node.lock.Unlock()
+
+		liveConns[i] = clients[i][0]
+	}
+	// Establish a tunnel and verify that it's routed
+	tun, err := liveConns[0].Tunnel("tunnel-routed-test", 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish tunnel: %v.", err)
+	}
+	defer tun.Close()
+
+	if mode := tun.Mode(); mode != TunnelRouted {
+		t.Fatalf("tunnel mode mismatch: have %v, want %v.", mode, TunnelRouted)
+	}
+	// Pipeline a batch of messages through and verify the ordering of the echoes
+	for i := 0; i < msgs; i++ {
+		if err := tun.Send([]byte{0, byte(i)}, time.Second); err != nil {
+			t.Fatalf("failed to send message %d: %v.", i, err)
+		}
+	}
+	for i := 0; i < msgs; i++ {
+		if msg, err := tun.Recv(3 * time.Second); err != nil {
+			t.Fatalf("failed to receive message %d: %v.", i, err)
+		} else if !bytes.Equal(msg, []byte{0, byte(i)}) {
+			t.Fatalf("message %d mismatch: have %v, want %v.", i, msg, []byte{0, byte(i)})
+		}
+	}
+	if stats := liveConns[0].iris.Stats(); stats.RoutedTunnels == 0 {
+		t.Fatalf("routed tunnel not reported: %+v.", stats)
+	}
+	// Lose a few of the arriving frames and verify that they are retransmitted
+	go func() {
+		for i := 0; i < 10; i++ {
+			<-tun.route.frames
+		}
+	}()
+	for i := 0; i < msgs; i++ {
+		if err := tun.Send([]byte{0, byte(i)}, time.Second); err != nil {
+			t.Fatalf("failed to send message %d: %v.", i, err)
+		}
+	}
+	for i := 0; i < msgs; i++ {
+		if msg, err := tun.Recv(3 * time.Second); err != nil {
+			t.Fatalf("failed to receive message %d after losses: %v.", i, err)
+		} else if !bytes.Equal(msg, []byte{0, byte(i)}) {
+			t.Fatalf("message %d mismatch after losses: have %v, want %v.", i, msg, []byte{0, byte(i)})
+		}
+	}
+}
+
+// Tests that tunnels can be half closed while still receiving, and that a full
+// close delivers all previously sent messages along with the close reason.
+func TestTunnelClose(t *testing.T) {
+	// Boot an iris overlay and connect with a non-consuming handler
+	hand := &windower{make(chan *Tunnel, 1)}
+	_, conns, closer := bootCluster(t, "tunnel-close-test", "tunnel-close-test", 1, 1, func(i, j int) ConnectionHandler {
+		return hand
+	})
+	defer closer()
+
+	conn := conns[0][0]
+
+	// Establish a tunnel and fetch the remote endpoint
+	local, err := conn.Tunnel("tunnel-close-test", time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish tunnel: %v.", err)
+	}
+	remote := <-hand.tuns
+
+	// Send a few messages, half close and verify the remote end of stream
+	for i := 0; i < 3; i++ {
+		if err := local.Send([]byte{byte(i)}, time.Second); err != nil {
+			t.Fatalf("failed to send message %d: %v.", i, err)
+		}
+	}
+	if err := local.CloseSend(); err != nil {
+		t.Fatalf("failed to half close tunnel: %v.", err)
+	}
+	if err := local.Send([]byte{0xff}, time.Second); err != ErrTerminating {
+		t.Fatalf("send after half close mismatch: have %v, want %v.", err, ErrTerminating)
+	}
+	for i := 0; i < 3; i++ {
+		if msg, err := remote.Recv(time.Second); err != nil || !bytes.Equal(msg, []byte{byte(i)}) {
+			t.Fatalf("message %d mismatch: have %v/%v, want %v/nil.", i, msg, err, []byte{byte(i)})
+		}
+	}
+	if _, err := remote.Recv(time.Second); err != io.EOF {
+		t.Fatalf("end of stream mismatch: have %v, want %v.", err, io.EOF)
+	}
+	// Fill the window from the remote side and close it immediately
+	for i := 0; i < config.IrisTunnelWindow; i++ {
+		if err := remote.Send([]byte{byte(i)}, time.Second); err != nil {
+			t.Fatalf("failed to send reverse message %d: %v.", i, err)
+		}
+	}
+	if err := remote.CloseReason("done"); err != nil {
+		t.Fatalf("failed to close tunnel: %v.", err)
+	}
+	// Verify that all messages arrived, followed by the close reason
+	for i := 0; i < config.IrisTunnelWindow; i++ {
+		if msg, err := local.Recv(time.Second); err != nil || !bytes.Equal(msg, []byte{byte(i)}) {
+			t.Fatalf("reverse message %d mismatch: have %v/%v, want %v/nil.", i, msg, err, []byte{byte(i)})
+		}
+	}
+	if _, err := local.Recv(time.Second); err == nil {
+		t.Fatalf("close reason missing.")
+	} else if cerr, ok := err.(*CloseError); !ok || cerr.Reason != "done" {
+		t.Fatalf("close reason mismatch: have %v, want %v.", err, &CloseError{Reason: "done"})
+	}
+	if err := local.Close(); err != nil {
+		t.Fatalf("failed to close local tunnel endpoint: %v.", err)
+	}
+}
+
+// Tests that remote endpoints completing a tunnel after the initiator already
+// timed out are closed, both for direct and routed tunnels.
+func TestTunnelAbandon(t *testing.T) {
+	// Boot an iris overlay and connect with a non-consuming handler
+	hand := &windower{make(chan *Tunnel, 1)}
+	nodes, conns, closer := bootCluster(t, "tunnel-abandon-test", "tunnel-abandon-test", 1, 1, func(i, j int) ConnectionHandler {
+		return hand
+	})
+	defer closer()
+
+	node, conn := nodes[0], conns[0][0]
+
+	node.lock.RLock()
+	direct := append([]string{}, node.tunAddrs...)
+	node.lock.RUnlock()
+
+	for i, addrs := range [][]string{direct, nil} {
+		// Request a tunnel nobody answers in time
+		if _, err := conn.Tunnel("tunnel-abandon-nobody", 100*time.Millisecond); err != ErrTimeout {
+			t.Fatalf("test %d: unanswered tunnel error mismatch: have %v, want %v.", i, err, ErrTimeout)
+		}
+		conn.tunLock.RLock()
+		id := conn.tunIdx - 1
+		pend, ok := conn.tunLive[id]
+		conn.tunLock.RUnlock()
+		if !ok {
+			t.Fatalf("test %d: timed out tunnel dropped before the grace period.", i)
+		}
+
+		// Accept the request late and make sure the initiator closes the tunnel
+		late, err := conn.buildTunnel(node.scribe.Self(), conn.id, id, pend.secret, addrs, time.Second)
+		if err != nil {
+			t.Fatalf("test %d: failed to build late tunnel: %v.", i, err)
+		}
+		if _, err := late.Recv(3 * time.Second); err == nil {
+			t.Fatalf("test %d: late tunnel not closed.", i)
+		} else if cerr, ok := err.(*CloseError); !ok || cerr.Reason != "tunnel initiation timed out" {
+			t.Fatalf("test %d: late tunnel close mismatch: have %v, want %v.", i, err, &CloseError{Reason: "tunnel initiation timed out"})
+		}
+		if err := late.Close(); err != nil {
+			t.Fatalf("test %d: failed to close late tunnel: %v.", i, err)
+		}
+		// The abandoned tunnel should be forgotten after closing
+		time.Sleep(100 * time.Millisecond)
+
+		conn.tunLock.RLock()
+		_, ok = conn.tunLive[id]
+		conn.tunLock.RUnlock()
+		if ok {
+			t.Fatalf("test %d: abandoned tunnel not forgotten.", i)
+		}
+	}
+}
+
+// Tests that a direct tunnel survives its stream being dropped, delivering all
+// messages exactly once and in order.
+func TestTunnelResume(t *testing.T) {
+	// Boot an iris overlay and connect with a non-consuming handler
+	hand := &windower{make(chan *Tunnel, 1)}
+	_, conns, closer := bootCluster(t, "tunnel-resume-test", "tunnel-resume-test", 1, 1, func(i, j int) ConnectionHandler {
+		return hand
+	})
+	defer closer()
+
+	conn := conns[0][0]
+
+	// Establish a tunnel and fetch the remote endpoint
+	local, err := conn.Tunnel("tunnel-resume-test", time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish tunnel: %v.", err)
+	}
+	remote := <-hand.tuns
+
+	// Stream messages through the tunnel, dropping the link of either side midway
+	msgs := 4 * config.IrisTunnelWindow
+	for round, tun := range []*Tunnel{local, remote} {
+		done := make(chan error, 1)
+		go func() {
+			for i := 0; i < msgs; i++ {
+				if err := local.Send([]byte{byte(round), byte(i)}, 3*time.Second); err != nil {
+					done <- fmt.Errorf("failed to send message %d: %v", i, err)
+					return
+				}
+			}
+			done <- nil
+		}()
+		for i := 0; i < msgs; i++ {
+			if i == msgs/2 {
+				tun.linkLock.RLock()
+				tun.conn.Sock().Close()
+				tun.linkLock.RUnlock()
+			}
+			if msg, err := remote.Recv(3 * time.Second); err != nil || !bytes.Equal(msg, []byte{byte(round), byte(i)}) {
+				t.Fatalf("round %d: message %d mismatch: have %v/%v, want %v/nil.", round, i, msg, err, []byte{byte(round), byte(i)})
+			}
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("round %d: %v.", round, err)
+		}
+		if mode := local.Mode(); mode != TunnelDirect {
+			t.Fatalf("round %d: tunnel mode mismatch: have %v, want %v.", round, mode, TunnelDirect)
+		}
+	}
+	if err := local.Close(); err != nil {
+		t.Fatalf("failed to close tunnel: %v.", err)
+	}
+}
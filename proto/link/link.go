@@ -19,10 +19,8 @@
 package link
 
 import (
-	"bytes"
 	"crypto/cipher"
 	"crypto/hmac"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"hash"
@@ -33,6 +31,7 @@ import (
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/codec"
 	"github.com/project-iris/iris/proto/stream"
 )
 
@@ -40,14 +39,57 @@ import (
 type closePacket struct {
 }
 
-// Make sure the close packet is registered with gob.
+// Make sure the close packet is registered with the codec.
 func init() {
-	gob.Register(&closePacket{})
+	codec.Register(1, &closePacket{})
+}
+
+// Serializes the close packet (no fields).
+func (p *closePacket) MarshalCodec(e *codec.Encoder) {}
+
+// Deserializes the close packet (no fields).
+func (p *closePacket) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		d.Skip()
+	}
+	return d.Err()
+}
+
+// Headers of a batch of messages coalesced into a single link frame. The data
+// payloads follow the frame headers on the stream in the same order.
+type frame struct {
+	msgs []*proto.Message
+}
+
+// Serializes the headers of the frame messages.
+func (f *frame) MarshalCodec(e *codec.Encoder) {
+	for _, msg := range f.msgs {
+		e.Message(1, &msg.Head)
+	}
+}
+
+// Deserializes the headers of the frame messages.
+func (f *frame) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			msg := new(proto.Message)
+			d.Message(&msg.Head)
+			f.msgs = append(f.msgs, msg)
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
 }
 
 // Accomplishes secure and authenticated full duplex communication. Note, only
 // the headers are encrypted and decrypted. It is the responsibility of the
 // caller to call proto.Message.Encrypt/Decrypt (link would bottleneck).
+//
+// Messages queued on the Send channel pass their payload buffer reference over
+// to the link, which releases it once sent. Messages received on Recv hold a
+// reference to their pooled payload buffer, owned by the receiver.
 type Link struct {
 	socket *stream.Stream
 
@@ -57,14 +99,12 @@ type Link struct {
 	inMacer  hash.Hash
 	outMacer hash.Hash
 
-	inBuffer  bytes.Buffer
-	outBuffer bytes.Buffer
-
-	inCoder  *gob.Decoder
-	outCoder *gob.Encoder
+	outCoder *codec.Encoder
+	outBatch []*proto.Message
 
 	inHeadBuf []byte
 	inMacBuf  []byte
+	inBatch   []*proto.Message
 
 	Send     chan *proto.Message
 	Recv     chan *proto.Message
@@ -87,9 +127,9 @@ func New(conn *stream.Stream, hkdf io.Reader, server bool) *Link {
 	} else {
 		l.inCipher, l.outCipher, l.inMacer, l.outMacer = sc, cc, sm, cm
 	}
-	// Create the gob coders
-	l.inCoder = gob.NewDecoder(&l.inBuffer)
-	l.outCoder = gob.NewEncoder(&l.outBuffer)
+	// Create the header encoder and frame batch
+	l.outCoder = codec.NewEncoder()
+	l.outBatch = make([]*proto.Message, config.SessionBatchSize)
 
 	return l
 }
@@ -169,88 +209,155 @@ func (l *Link) Close() error {
 	return res
 }
 
-// The actual message sending logic. Calculates the payload MAC, encrypts the
-// headers and sends it down to the stream. Direct send is public for handshake
-// simplifications. After that is done, the link should switch to channel mode.
+// The actual message sending logic. Sends a single message as a standalone
+// frame. Direct send is public for handshake simplifications. After that is
+// done, the link should switch to channel mode.
 func (l *Link) SendDirect(msg *proto.Message) error {
+	l.outBatch[0] = msg
+	defer func() { l.outBatch[0] = nil }()
+
+	return l.sendFrame(l.outBatch[:1])
+}
+
+// Coalesces a batch of messages into a single frame: encrypts the headers, MACs
+// them separately (so the remote side can verify before decoding), calculates
+// the MAC of the whole frame and sends it down to the stream, flushing it only
+// once.
+func (l *Link) sendFrame(msgs []*proto.Message) error {
 	var err error
 
 	// Sanity check for message data security
-	if !msg.Secure() && len(msg.Data) > 0 {
-		log.Printf("link: unsecured data, send denied.")
-		return errors.New("unsecured data, send denied")
+	for _, msg := range msgs {
+		if !msg.Secure() && len(msg.Data) > 0 {
+			log.Printf("link: unsecured data, send denied.")
+			return errors.New("unsecured data, send denied")
+		}
 	}
 	// Flatten and encrypt the headers
-	if err = l.outCoder.Encode(msg.Head); err != nil {
-		return err
-	}
-	l.outCipher.XORKeyStream(l.outBuffer.Bytes(), l.outBuffer.Bytes())
-	defer l.outBuffer.Reset()
+	head := l.outCoder.Encode(&frame{msgs: msgs})
+	l.outCipher.XORKeyStream(head, head)
 
-	// Generate the MAC of the encrypted payload and headers
-	l.outMacer.Write(l.outBuffer.Bytes())
-	l.outMacer.Write(msg.Data)
-
-	// Send the multi-part message (headers + payload + MAC)
-	if err = l.socket.Send(l.outBuffer.Bytes()); err != nil {
+	// Generate the MAC of the encrypted headers and send them
+	l.outMacer.Write(head)
+	if err = l.socket.SendBinary(head); err != nil {
 		return err
 	}
-	if err = l.socket.Send(msg.Data); err != nil {
+	if err = l.socket.SendBinary(l.outMacer.Sum(nil)); err != nil {
 		return err
 	}
-	if err = l.socket.Send(l.outMacer.Sum(nil)); err != nil {
+	// Send the payloads and the MAC of the whole frame (headers + payloads)
+	for _, msg := range msgs {
+		l.outMacer.Write(msg.Data)
+	}
+	for _, msg := range msgs {
+		if err = l.socket.SendBinary(msg.Data); err != nil {
+			return err
+		}
+	}
+	if err = l.socket.SendBinary(l.outMacer.Sum(nil)); err != nil {
 		return err
 	}
 	return l.socket.Flush()
 }
 
-// The actual message receiving logic. Reads a message from the stream, verifies
-// its mac, decodes the headers and send it upwards. Direct receive is public for
-// handshake simplifications, after which the link should switch to channel mode.
+// The actual message receiving logic. Returns the next message of the current
+// frame, or reads a new one from the stream if all were consumed. Direct receive
+// is public for handshake simplifications, after which the link should switch
+// to channel mode.
 func (l *Link) RecvDirect() (*proto.Message, error) {
-	var msg proto.Message
+	if len(l.inBatch) == 0 {
+		if err := l.recvFrame(); err != nil {
+			return nil, err
+		}
+	}
+	msg := l.inBatch[0]
+	l.inBatch[0], l.inBatch = nil, l.inBatch[1:]
+	return msg, nil
+}
+
+// Reads a frame from the stream, verifies its headers' mac before decoding them,
+// verifies the mac of the whole frame and queues the contained messages.
+func (l *Link) recvFrame() error {
 	var err error
 
-	// Retrieve a new package
-	if err = l.socket.Recv(&l.inHeadBuf); err != nil {
-		return nil, err
-	}
-	if err = l.socket.Recv(&msg.Data); err != nil {
-		return nil, err
-	}
-	if err = l.socket.Recv(&l.inMacBuf); err != nil {
-		return nil, err
+	// Retrieve the frame headers, verify and decode them
+	if err = l.socket.RecvBinary(&l.inHeadBuf); err != nil {
+		return err
 	}
-	// Verify the message contents (payload + header)
 	l.inMacer.Write(l.inHeadBuf)
-	l.inMacer.Write(msg.Data)
-	if !bytes.Equal(l.inMacBuf, l.inMacer.Sum(nil)) {
-		err = errors.New(fmt.Sprintf("mac mismatch: have %v, want %v.", l.inMacer.Sum(nil), l.inMacBuf))
-		return nil, err
+	if err = l.socket.RecvBinary(&l.inMacBuf); err != nil {
+		return err
+	}
+	if !hmac.Equal(l.inMacBuf, l.inMacer.Sum(nil)) {
+		return errors.New("header mac mismatch")
 	}
-	// Extract the package contents
 	l.inCipher.XORKeyStream(l.inHeadBuf, l.inHeadBuf)
-	l.inBuffer.Write(l.inHeadBuf)
-	if err = l.inCoder.Decode(&msg.Head); err != nil {
-		return nil, err
+
+	batch := new(frame)
+	if err = codec.Decode(l.inHeadBuf, batch); err != nil {
+		return err
+	}
+	if len(batch.msgs) == 0 {
+		return errors.New("empty frame")
+	}
+	if len(batch.msgs) > config.SessionBatchSize {
+		return fmt.Errorf("frame too large: %d > %d messages", len(batch.msgs), config.SessionBatchSize)
+	}
+	// Retrieve the payloads and the MAC
+	for i, msg := range batch.msgs {
+		if msg.Buf, err = l.socket.RecvBuffer(); err != nil {
+			releaseAll(batch.msgs[:i])
+			return err
+		}
+		if msg.Buf != nil {
+			msg.Data = msg.Buf.Data
+		}
+		l.inMacer.Write(msg.Data)
+	}
+	if err = l.socket.RecvBinary(&l.inMacBuf); err != nil {
+		releaseAll(batch.msgs)
+		return err
+	}
+	// Verify the frame contents (headers + payloads)
+	if !hmac.Equal(l.inMacBuf, l.inMacer.Sum(nil)) {
+		err = errors.New(fmt.Sprintf("mac mismatch: have %v, want %v.", l.inMacer.Sum(nil), l.inMacBuf))
+		releaseAll(batch.msgs)
+		return err
 	}
 	// Set the message security knowingly to true
-	msg.KnownSecure()
-	return &msg, nil
+	for _, msg := range batch.msgs {
+		msg.KnownSecure()
+	}
+	l.inBatch = batch.msgs
+	return nil
 }
 
-// Sends messages from the upper layers into the encrypted link.
+// Releases the payloads of a batch of messages.
+func releaseAll(msgs []*proto.Message) {
+	for _, msg := range msgs {
+		msg.Release()
+	}
+}
+
+// Sends messages from the upper layers into the encrypted link, coalescing the
+// queued ones into larger frames. If the link is under load (the last frame was
+// not a single message), a small linger time is allowed for the batch to fill.
 func (l *Link) sender() {
 	var errc chan error
 	var errv error
 
 	// Loop until an error occurs or quit is requested
+	busy := false
 	for errv == nil && errc == nil {
 		select {
 		case errc = <-l.sendQuit:
 			continue
 		case msg := <-l.Send:
-			errv = l.SendDirect(msg)
+			batch := l.collect(msg, busy)
+			busy = len(batch) > 1
+
+			errv = l.sendFrame(batch)
+			l.flush(batch)
 		}
 	}
 	// If quit was requested, send all pending messages and close packet
@@ -259,7 +366,9 @@ func (l *Link) sender() {
 		for done := false; !done && errv == nil; {
 			select {
 			case msg := <-l.Send:
-				errv = l.SendDirect(msg)
+				batch := l.collect(msg, false)
+				errv = l.sendFrame(batch)
+				l.flush(batch)
 			default:
 				done = true
 			}
@@ -279,6 +388,44 @@ func (l *Link) sender() {
 	errc <- errv
 }
 
+// Collects a batch of queued messages, starting with msg. If linger is set, the
+// collector waits a bit for new messages to arrive if the queue drains.
+func (l *Link) collect(msg *proto.Message, linger bool) []*proto.Message {
+	batch := append(l.outBatch[:0], msg)
+
+	var timeout <-chan time.Time
+	for len(batch) < cap(l.outBatch) {
+		select {
+		case msg := <-l.Send:
+			batch = append(batch, msg)
+			continue
+		default:
+		}
+		if !linger {
+			break
+		}
+		if timeout == nil {
+			timeout = time.After(config.SessionBatchLinger)
+		}
+		select {
+		case msg := <-l.Send:
+			batch = append(batch, msg)
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	return batch
+}
+
+// Releases the payloads of a sent batch and clears the batch buffer.
+func (l *Link) flush(batch []*proto.Message) {
+	for i, msg := range batch {
+		msg.Release()
+		batch[i] = nil
+	}
+}
+
 // Transfers messages from the session to the upper layers decoding the headers.
 func (l *Link) receiver() {
 	var errc chan error
@@ -307,10 +454,14 @@ func (l *Link) receiver() {
 				// Ok, upstream unblocked
 			case errc = <-l.recvQuit:
 				// Terminating
+				msg.Release()
 			}
 		}
 	}
-	// Close the upward stream and sync termination
+	// Drop any undelivered messages, close the upward stream and sync termination
+	releaseAll(l.inBatch)
+	l.inBatch = nil
+
 	close(l.Recv)
 	if errc == nil {
 		errc = <-l.recvQuit
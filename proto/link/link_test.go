@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"code.google.com/p/go.crypto/hkdf"
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/stream"
 )
@@ -251,3 +252,153 @@ func TestSendRecv(t *testing.T) {
 		t.Fatalf("failed to close server link: %v.", err)
 	}
 }
+
+// Creates a pair of started links connected to each other.
+func newLinkPair(tb testing.TB) (*Link, *Link) {
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		tb.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		tb.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Second)
+	if err != nil {
+		tb.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientLink := New(clientStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), false)
+	serverLink := New(serverStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), true)
+
+	clientLink.Start(1024)
+	serverLink.Start(1024)
+
+	return clientLink, serverLink
+}
+
+// Tests that bursts of messages are coalesced without reordering or losses.
+func TestBatching(t *testing.T) {
+	t.Parallel()
+
+	client, server := newLinkPair(t)
+
+	// Send a burst of messages, tagged with their sequence number
+	count := 10000
+	go func() {
+		for i := 0; i < count; i++ {
+			send := &proto.Message{
+				Head: proto.Header{
+					Meta: []byte{byte(i >> 8), byte(i)},
+				},
+				Data: make([]byte, i%100),
+			}
+			send.Encrypt()
+			client.Send <- send
+		}
+	}()
+	// Verify the arrival and order of all the messages
+	for i := 0; i < count; i++ {
+		select {
+		case recv := <-server.Recv:
+			if meta := recv.Head.Meta.([]byte); int(meta[0])<<8|int(meta[1]) != i {
+				t.Fatalf("message %d: sequence mismatch: have %v.", i, meta)
+			}
+			if len(recv.Data) != i%100 {
+				t.Fatalf("message %d: payload size mismatch: have %v, want %v.", i, len(recv.Data), i%100)
+			}
+			recv.Release()
+		case <-time.After(time.Second):
+			t.Fatalf("message %d: receive timed out.", i)
+		}
+	}
+	go client.Close()
+	if err := server.Close(); err != nil {
+		t.Fatalf("failed to close server link: %v.", err)
+	}
+}
+
+// Tests that frames with more messages than allowed are refused before reading
+// any of the payloads.
+func TestOversizedFrame(t *testing.T) {
+	t.Parallel()
+
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	clientStrm, err := stream.Dial(fmt.Sprintf("%s:%d", "localhost", addr.Port), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	defer clientStrm.Close()
+	defer serverStrm.Close()
+
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	client := New(clientStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), false)
+	server := New(serverStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), true)
+
+	// Send a properly authenticated, but oversized frame
+	msgs := make([]*proto.Message, config.SessionBatchSize+1)
+	for i := 0; i < len(msgs); i++ {
+		msgs[i] = &proto.Message{Head: proto.Header{Meta: []byte{byte(i)}}}
+	}
+	go client.sendFrame(msgs)
+
+	if msg, err := server.RecvDirect(); err == nil {
+		t.Fatalf("oversized frame accepted: %v.", msg)
+	}
+}
+
+func BenchmarkThroughputUnbatched(b *testing.B) {
+	defer func(size int) { config.SessionBatchSize = size }(config.SessionBatchSize)
+	config.SessionBatchSize = 1
+
+	benchmarkThroughput(b)
+}
+
+func BenchmarkThroughputBatched(b *testing.B) {
+	benchmarkThroughput(b)
+}
+
+func benchmarkThroughput(b *testing.B) {
+	client, server := newLinkPair(b)
+
+	// Pre-encrypt a small message to pass through the links
+	msg := &proto.Message{Data: make([]byte, 64)}
+	msg.Encrypt()
+
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			cpy := *msg
+			client.Send <- &cpy
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		(<-server.Recv).Release()
+	}
+	b.StopTimer()
+
+	go client.Close()
+	server.Close()
+}
@@ -0,0 +1,175 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the binary codec serializers of the pastry headers and packets.
+
+package pastry
+
+import "github.com/project-iris/iris/proto/codec"
+
+// Network addresses of a single peer in a state exchange.
+type addrEntry struct {
+	Id    string
+	Addrs []string
+}
+
+// Serializes the pastry header.
+func (h *header) MarshalCodec(e *codec.Encoder) {
+	e.Meta(1, h.Meta)
+	e.Uint(2, uint64(h.Op))
+	e.BigInt(3, h.Dest)
+	e.Message(4, h.State)
+	e.Int(5, h.Stamp)
+	e.Int(6, h.Echo)
+	e.Duration(7, h.Hold)
+	e.Uint(8, h.Hops)
+	e.Uint(9, h.TTL)
+	for _, id := range h.Trace {
+		e.BigInt(10, id)
+	}
+}
+
+// Deserializes the pastry header.
+func (h *header) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			h.Meta = d.Meta()
+		case 2:
+			h.Op = opcode(d.Uint())
+		case 3:
+			h.Dest = d.BigInt()
+		case 4:
+			h.State = new(state)
+			d.Message(h.State)
+		case 5:
+			h.Stamp = d.Int()
+		case 6:
+			h.Echo = d.Int()
+		case 7:
+			h.Hold = d.Duration()
+		case 8:
+			h.Hops = d.Uint()
+		case 9:
+			h.TTL = d.Uint()
+		case 10:
+			h.Trace = append(h.Trace, d.BigInt())
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the routing state exchange.
+func (s *state) MarshalCodec(e *codec.Encoder) {
+	for id, addrs := range s.Addrs {
+		e.Message(1, &addrEntry{id, addrs})
+	}
+	e.Uint(2, s.Version)
+	e.Int(3, int64(s.Space))
+	e.Int(4, int64(s.Base))
+	e.Int(5, int64(s.Leaves))
+}
+
+// Deserializes the routing state exchange.
+func (s *state) UnmarshalCodec(d *codec.Decoder) error {
+	s.Addrs = make(map[string][]string)
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			entry := new(addrEntry)
+			d.Message(entry)
+			s.Addrs[entry.Id] = entry.Addrs
+		case 2:
+			s.Version = d.Uint()
+		case 3:
+			s.Space = int(d.Int())
+		case 4:
+			s.Base = int(d.Int())
+		case 5:
+			s.Leaves = int(d.Int())
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes a peer address entry.
+func (a *addrEntry) MarshalCodec(e *codec.Encoder) {
+	e.String(1, a.Id)
+	for _, addr := range a.Addrs {
+		e.String(2, addr)
+	}
+}
+
+// Deserializes a peer address entry.
+func (a *addrEntry) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			a.Id = d.String()
+		case 2:
+			a.Addrs = append(a.Addrs, d.String())
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the connection initialization packet.
+func (p *initPacket) MarshalCodec(e *codec.Encoder) {
+	e.BigInt(1, p.Id)
+	for _, addr := range p.Addrs {
+		e.String(2, addr)
+	}
+	e.Int(3, int64(p.Space))
+	e.Int(4, int64(p.Base))
+	e.Int(5, int64(p.Leaves))
+	e.Bytes(6, p.Key)
+	e.BigInt(7, p.SigR)
+	e.BigInt(8, p.SigS)
+}
+
+// Deserializes the connection initialization packet.
+func (p *initPacket) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			p.Id = d.BigInt()
+		case 2:
+			p.Addrs = append(p.Addrs, d.String())
+		case 3:
+			p.Space = int(d.Int())
+		case 4:
+			p.Base = int(d.Int())
+		case 5:
+			p.Leaves = int(d.Int())
+		case 6:
+			p.Key = d.Bytes()
+		case 7:
+			p.SigR = d.BigInt()
+		case 8:
+			p.SigS = d.BigInt()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
@@ -22,59 +22,94 @@
 package pastry
 
 import (
-	"encoding/gob"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"math/big"
 	"net"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/bootstrap"
+	"github.com/project-iris/iris/proto/codec"
 	"github.com/project-iris/iris/proto/session"
 )
 
-// The initialization packet when the connection is set up.
+// The initialization packet when the connection is set up, also advertising the
+// overlay parameters of the node.
 type initPacket struct {
-	Id    *big.Int
-	Addrs []string
+	Id     *big.Int
+	Addrs  []string
+	Space  int
+	Base   int
+	Leaves int
+
+	// Id certificate with secure routing
+	Key  []byte   // Public key certifying the node id
+	SigR *big.Int // Signature over the session binding (R part)
+	SigS *big.Int // Signature over the session binding (S part)
+}
+
+// Checks whether the overlay parameters advertised by a remote peer are usable
+// together with the local ones. The id space and routing base define the ids and
+// routing tables, so they must match; leaf set sizes may differ between nodes.
+func compatible(space, base int) error {
+	if space != config.PastrySpace || base != config.PastryBase {
+		return fmt.Errorf("incompatible overlay: have space %d/base %d, want %d/%d", space, base, config.PastrySpace, config.PastryBase)
+	}
+	return nil
 }
 
-// Make sure the init packet is registered with gob.
+// Make sure the init packet is registered with the codec.
 func init() {
-	gob.Register(&initPacket{})
+	codec.Register(4, &initPacket{})
 }
 
-// Starts up the overlay networking on a specified interface and fans in all the
-// inbound connections into the overlay-global channels.
-func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
-	// Listen for incoming session on the given interface and random port.
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), "0"))
+// Binds the overlay networking to a specified interface: a session listener on
+// the configured port and a bootstrapper advertising it. Failures are reported
+// synchronously, so a misconfigured node refuses to boot instead of crashing.
+func (o *Overlay) listen(ipnet *net.IPNet) (*session.Listener, *bootstrap.Bootstrapper, chan *bootstrap.Event, error) {
+	// Listen for incoming session on the given interface and configured port.
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), strconv.Itoa(config.PastryListenPort)))
 	if err != nil {
-		panic(fmt.Sprintf("failed to resolve interface (%v): %v.", ipnet.IP, err))
+		return nil, nil, nil, fmt.Errorf("failed to resolve interface (%v): %v", ipnet.IP, err)
 	}
 	sock, err := session.Listen(addr, o.authKey)
 	if err != nil {
-		panic(fmt.Sprintf("failed to start session listener: %v.", err))
+		return nil, nil, nil, fmt.Errorf("failed to start session listener: %v", err)
 	}
 	sock.Accept(config.PastryAcceptTimeout)
 
-	// Save the new listener address into the local (sorted) address list
-	o.lock.Lock()
-	o.addrs = append(o.addrs, addr.String())
-	sort.Strings(o.addrs)
-	o.lock.Unlock()
-
-	// Start the bootstrapper on the specified interface
-	boot, discover, err := bootstrap.New(ipnet, []byte(o.authId), o.nodeId, addr.Port)
+	// Start the bootstrapper on the specified interface (beacons keyed by the cluster credentials)
+	secret := x509.MarshalPKCS1PrivateKey(o.authKey)
+	boot, discover, err := bootstrap.New(ipnet, []byte(o.authId), secret, o.nodeId, addr.Port)
 	if err != nil {
-		panic(fmt.Sprintf("failed to create bootstrapper: %v.", err))
+		sock.Close()
+		return nil, nil, nil, fmt.Errorf("failed to create bootstrapper: %v", err)
 	}
 	if err := boot.Boot(); err != nil {
-		panic(fmt.Sprintf("failed to boot bootstrapper: %v.", err))
+		sock.Close()
+		return nil, nil, nil, fmt.Errorf("failed to boot bootstrapper: %v", err)
+	}
+	// Save the new listener address into the local (sorted) address lists
+	o.lock.Lock()
+	o.laddrs = append(o.laddrs, addr.String())
+	sort.Strings(o.laddrs)
+	if len(config.PastryAdvertise) == 0 {
+		o.addrs = append(o.addrs, addr.String())
+		sort.Strings(o.addrs)
 	}
+	o.lock.Unlock()
+
+	return sock, boot, discover, nil
+}
+
+// Fans in all the inbound connections and bootstrap events of an interface into
+// the overlay-global channels.
+func (o *Overlay) acceptor(sock *session.Listener, boot *bootstrap.Bootstrapper, discover chan *bootstrap.Event, quit chan chan error) {
 	// Process incoming connection until termination is requested
 	var errc chan error
 	for errc == nil {
@@ -153,46 +188,65 @@ func (o *Overlay) filter(id *big.Int) bool {
 	return true
 }
 
-// Asynchronously connects to a remote overlay peer and executes handshake.
-func (o *Overlay) dial(addrs []*net.TCPAddr) {
+// Asynchronously connects to a remote overlay peer and executes handshake. The
+// id announced by the remote peer is returned, or nil if none was reached.
+func (o *Overlay) dial(addrs []*net.TCPAddr) *big.Int {
 	// Sanity check to make sure self connections are not possible (i.e. malicious bootstrapper)
-	for _, ownAddr := range o.addrs {
+	o.lock.RLock()
+	owns := append(append([]string{}, o.laddrs...), o.addrs...)
+	o.lock.RUnlock()
+
+	for _, ownAddr := range owns {
 		for _, peerAddr := range addrs {
 			if peerAddr.String() == ownAddr {
 				log.Printf("pastry: self connection not allowed: %v.", o.nodeId)
-				return
+				return nil
 			}
 		}
 	}
 	// Dial away, trying interfaces one after the other until connection succeeds
 	for _, addr := range addrs {
 		if ses, err := session.Dial(addr.IP.String(), addr.Port, o.authKey); err == nil {
-			o.shake(ses)
-			return
+			return o.shake(ses)
 		} else {
 			log.Printf("pastry: failed to dial remote peer at %v: %v.", addr, err)
 		}
 	}
+	return nil
 }
 
 // Executes a two way overlay handshake where both peers exchange their server
 // addresses and virtual ids to enable them both to filter out multiple
 // connections. To prevent resource exhaustion, a timeout is attached to the
-// handshake, the violation of which results in a dropped connection.
-func (o *Overlay) shake(ses *session.Session) {
+// handshake, the violation of which results in a dropped connection. The id
+// announced by the remote peer is returned, or nil if none arrived.
+func (o *Overlay) shake(ses *session.Session) *big.Int {
 	// Start the message transfers and create the peer
 	ses.Start(config.PastryNetBuffer)
 	p := o.newPeer(ses)
 
 	// Send an init packet to the remote peer
-	pkt := new(initPacket)
-	pkt.Id = new(big.Int).Set(o.nodeId)
+	pkt := &initPacket{
+		Id:     new(big.Int).Set(o.nodeId),
+		Space:  config.PastrySpace,
+		Base:   config.PastryBase,
+		Leaves: config.PastryLeaves,
+	}
 
 	o.lock.RLock()
 	pkt.Addrs = make([]string, len(o.addrs))
 	copy(pkt.Addrs, o.addrs)
 	o.lock.RUnlock()
 
+	if config.PastrySecureRouting {
+		if err := o.prove(pkt, ses.Binding); err != nil {
+			log.Printf("pastry: failed to certify node id: %v.", err)
+			if err := ses.Close(); err != nil {
+				log.Printf("pastry: failed to close uncertified session: %v.", err)
+			}
+			return nil
+		}
+	}
 	msg := new(proto.Message)
 	msg.Head.Meta = pkt
 	if err := p.send(msg); err != nil {
@@ -200,7 +254,7 @@ func (o *Overlay) shake(ses *session.Session) {
 		if err := ses.Close(); err != nil {
 			log.Printf("pastry: failed to close uninited session: %v.", err)
 		}
-		return
+		return nil
 	}
 	// Wait for an incoming init packet
 	select {
@@ -215,8 +269,21 @@ func (o *Overlay) shake(ses *session.Session) {
 			p.nodeId = pkt.Id
 			p.addrs = pkt.Addrs
 
+			// Refuse peers with incompatible overlay parameters or uncertified ids
+			err := compatible(pkt.Space, pkt.Base)
+			if err == nil && config.PastrySecureRouting {
+				err = verify(pkt, ses.Binding)
+			}
+			if err != nil {
+				log.Printf("pastry: refusing peer %v: %v.", pkt.Id, err)
+				if err := ses.Close(); err != nil {
+					log.Printf("pastry: failed to close incompatible session: %v.", err)
+				}
+				return nil
+			}
 			// Everything ok, accept connection
 			o.dedup(p)
+			return pkt.Id
 		} else {
 			log.Printf("pastry: session closed before init arrived.")
 			if err := ses.Close(); err != nil {
@@ -224,6 +291,7 @@ func (o *Overlay) shake(ses *session.Session) {
 			}
 		}
 	}
+	return nil
 }
 
 // Filters a new peer connection to ensure there are no duplicates.
@@ -253,7 +321,7 @@ func (o *Overlay) dedup(p *peer) {
 
 		// Same network, different direction
 		case old.lhost == p.lhost:
-			if i := sort.SearchStrings(o.addrs, p.laddr); i < len(o.addrs) && o.addrs[i] == p.laddr {
+			if i := sort.SearchStrings(o.laddrs, p.laddr); i < len(o.laddrs) && o.laddrs[i] == p.laddr {
 				// We're the server in 'p', remote is the server in 'old'
 				keepOld = old.raddr < p.laddr
 			} else {
@@ -288,13 +356,14 @@ func (o *Overlay) dedup(p *peer) {
 		} else if stat == done {
 			o.sendState(p)
 		}
-		// If brand new peer, start monitoring it
+		// If brand new peer, start monitoring it (and check for healed partitions)
 		if old == nil {
 			o.heart.heart.Monitor(p.nodeId)
+			o.found(p.nodeId)
 		}
 	}
 	// Terminate the duplicate if any
 	if dump != nil {
-		o.drop(dump)
+		o.dismiss(dump)
 	}
 }
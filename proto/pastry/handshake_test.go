@@ -21,8 +21,12 @@ import (
 	"crypto/x509"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
 )
 
 // Another private key to check security negotiation
@@ -156,3 +160,92 @@ func TestHandshake(t *testing.T) {
 		t.Fatalf("mallory (%v) found in the pool of bob: %v.", mallory.nodeId, bob.livePeers)
 	}
 }
+
+func TestCompatible(t *testing.T) {
+	// Save the previous config values
+	s, b := config.PastrySpace, config.PastryBase
+	defer func() { config.PastrySpace, config.PastryBase = s, b }()
+
+	// Only matching parameters should be accepted
+	config.PastrySpace, config.PastryBase = 40, 4
+	if err := compatible(40, 4); err != nil {
+		t.Fatalf("matching parameters refused: %v.", err)
+	}
+	if err := compatible(0, 0); err == nil {
+		t.Fatalf("missing parameters accepted.")
+	}
+	if err := compatible(64, 4); err == nil {
+		t.Fatalf("mismatching space accepted.")
+	}
+	if err := compatible(40, 8); err == nil {
+		t.Fatalf("mismatching base accepted.")
+	}
+	// Reconfigured overlays should accept their own parameters only
+	config.PastrySpace = 64
+	if err := compatible(64, 4); err != nil {
+		t.Fatalf("matching custom parameters refused: %v.", err)
+	}
+	if err := compatible(40, 4); err == nil {
+		t.Fatalf("default parameters accepted with custom space.")
+	}
+}
+
+func TestListeners(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	exclude, port, advertise := config.NetExclude, config.PastryListenPort, config.PastryAdvertise
+	defer func() { config.NetExclude, config.PastryListenPort, config.PastryAdvertise = exclude, port, advertise }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Booting without any selected interfaces should fail
+	config.NetExclude = []string{"*"}
+	failed := New(appId, key, new(nopCallback))
+	if _, err := failed.Boot(); err == nil {
+		t.Fatalf("overlay booted without interfaces.")
+	}
+	config.NetExclude = exclude
+
+	// Shutting down a failed overlay should be refused, not block
+	errc := make(chan error, 1)
+	go func() { errc <- failed.Shutdown() }()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("non-booted overlay shut down.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("non-booted overlay shutdown blocked.")
+	}
+
+	// Invalid advertised addresses should be refused
+	config.PastryAdvertise = []string{"203.0.113.1"}
+	if _, err := New(appId, key, new(nopCallback)).Boot(); err == nil {
+		t.Fatalf("overlay booted with invalid advertised address.")
+	}
+	// Fixed ports should be listened on, but only the overrides advertised
+	config.PastryListenPort, config.PastryAdvertise = 46464, []string{"203.0.113.1:4242"}
+
+	node := New(appId, key, new(nopCallback))
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot overlay: %v.", err)
+	}
+	defer node.Shutdown()
+
+	node.lock.RLock()
+	defer node.lock.RUnlock()
+
+	if len(node.addrs) != 1 || node.addrs[0] != config.PastryAdvertise[0] {
+		t.Fatalf("advertised address mismatch: have %v, want %v.", node.addrs, config.PastryAdvertise)
+	}
+	if len(node.laddrs) == 0 {
+		t.Fatalf("no listener addresses.")
+	}
+	for _, addr := range node.laddrs {
+		if _, port, _ := net.SplitHostPort(addr); port != "46464" {
+			t.Fatalf("listener port mismatch: have %v, want %v.", port, 46464)
+		}
+	}
+}
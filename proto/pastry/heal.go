@@ -0,0 +1,175 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the network partition detection and healing: peers failing (instead
+// of leaving or being unneeded) are remembered and periodically redialed, so
+// that the separately converged halves of a split overlay merge back together
+// once connectivity returns.
+
+package pastry
+
+import (
+	"log"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// A failed peer waiting to become reachable again.
+type lostPeer struct {
+	id    *big.Int  // Overlay id of the lost peer
+	addrs []string  // Last known listener addresses of the peer
+	since time.Time // Time when the peer was lost
+}
+
+// Remembers the network addresses of the peers in a state exchange, to be able
+// to reach them after a partition. Only a limited number of peers are stored.
+func (o *Overlay) remember(addrs map[string][]string) {
+	o.healLock.Lock()
+	defer o.healLock.Unlock()
+
+	for id, addr := range addrs {
+		if _, ok := o.known[id]; ok || len(o.known) < config.PastryHealMemory {
+			o.known[id] = addr
+		}
+	}
+}
+
+// Registers a batch of failed peers for reachability probing. If at least half
+// of the live peers (and more than one) failed at once, a partition is assumed.
+// Peers closing their sessions to a leaving node are not considered failed.
+func (o *Overlay) lose(peers []*peer, live int) {
+	o.healLock.Lock()
+	defer o.healLock.Unlock()
+
+	if o.leaving {
+		return
+	}
+	for _, p := range peers {
+		addrs, ok := o.known[p.nodeId.String()]
+		if !ok {
+			addrs = p.addrs
+		}
+		log.Printf("pastry: lost contact with %v, probing for recovery.", p.nodeId)
+		o.lost[p.nodeId.String()] = &lostPeer{id: p.nodeId, addrs: addrs, since: time.Now()}
+	}
+	if len(peers) > 1 && 2*len(peers) >= live {
+		o.partitions++
+		log.Printf("pastry: network partition suspected, lost %d of %d peers.", len(peers), live)
+	}
+}
+
+// Checks whether a newly connected peer was lost before, in which case the
+// partition is healed and the overlay halves merge via the state exchanges.
+func (o *Overlay) found(id *big.Int) {
+	o.healLock.Lock()
+	defer o.healLock.Unlock()
+
+	if _, ok := o.lost[id.String()]; ok {
+		delete(o.lost, id.String())
+		o.merges++
+		log.Printf("pastry: lost peer %v reachable again, merging overlays.", id)
+	}
+}
+
+// Periodically probes the lost peers until termination is requested.
+func (o *Overlay) healer() {
+	var errc chan error
+	for errc == nil {
+		select {
+		case errc = <-o.healQuit:
+			continue
+		case <-time.After(config.PastryHealPeriod):
+			o.probe()
+		}
+	}
+	errc <- nil
+}
+
+// Forgets a listener address of a lost peer, after a different node answered
+// on it (e.g. the lost one restarted with a fresh id). Peers without addresses
+// left are given up on.
+func (o *Overlay) reassigned(id *big.Int, addr string) {
+	o.healLock.Lock()
+	defer o.healLock.Unlock()
+
+	lost, ok := o.lost[id.String()]
+	if !ok {
+		return
+	}
+	addrs := make([]string, 0, len(lost.addrs))
+	for _, address := range lost.addrs {
+		if address != addr {
+			addrs = append(addrs, address)
+		}
+	}
+	lost.addrs = addrs
+	if len(addrs) == 0 {
+		log.Printf("pastry: giving up on lost peer %v, addresses taken over.", id)
+		delete(o.lost, id.String())
+	}
+}
+
+// Redials all the lost peers not yet reconnected, giving up on the ones lost
+// for too long.
+func (o *Overlay) probe() {
+	// Collect the lost peers (copying the addresses), expiring the old ones
+	o.healLock.Lock()
+	targets := make([]*lostPeer, 0, len(o.lost))
+	for id, lost := range o.lost {
+		if time.Since(lost.since) > config.PastryHealTimeout {
+			log.Printf("pastry: giving up on lost peer %v.", lost.id)
+			delete(o.lost, id)
+			continue
+		}
+		targets = append(targets, &lostPeer{id: lost.id, addrs: append([]string{}, lost.addrs...)})
+	}
+	o.healLock.Unlock()
+
+	// Dial each peer not yet reconnected (e.g. by the remote side)
+	for _, lost := range targets {
+		o.lock.RLock()
+		_, ok := o.livePeers[lost.id.String()]
+		o.lock.RUnlock()
+		if ok {
+			o.found(lost.id)
+			continue
+		}
+		lost := lost // Copy for closure!
+		o.authInit.Schedule(func() { o.redial(lost) })
+	}
+}
+
+// Dials a lost peer on its listener addresses one after the other, until the
+// peer answers. Addresses answered by a different node are forgotten.
+func (o *Overlay) redial(lost *lostPeer) {
+	for _, address := range lost.addrs {
+		addr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			log.Printf("pastry: failed to resolve address %v: %v.", address, err)
+			continue
+		}
+		if id := o.dial([]*net.TCPAddr{addr}); id != nil {
+			if id.Cmp(lost.id) == 0 {
+				return
+			}
+			o.reassigned(lost.id, address)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+)
+
+func TestHealBookkeeping(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+
+	a, b, c := big.NewInt(1), big.NewInt(2), big.NewInt(3)
+	o.remember(map[string][]string{a.String(): {"10.0.0.1:1000"}})
+
+	// Lose a single peer out of many, which isn't a partition
+	o.lose([]*peer{{nodeId: c, addrs: []string{"10.0.0.3:1000"}}}, 10)
+	if stats := o.Stats(); stats.Lost != 1 || stats.Partitions != 0 {
+		t.Fatalf("single loss stats mismatch: have %+v, want 1 lost, 0 partitions.", stats)
+	}
+	// Lose half the peers, which should be considered a partition
+	o.lose([]*peer{{nodeId: a}, {nodeId: b, addrs: []string{"10.0.0.2:1000"}}}, 4)
+	if stats := o.Stats(); stats.Lost != 3 || stats.Partitions != 1 {
+		t.Fatalf("partition stats mismatch: have %+v, want 3 lost, 1 partition.", stats)
+	}
+	// Make sure the remembered addresses are preferred over the peer's own
+	if addrs := o.lost[a.String()].addrs; len(addrs) != 1 || addrs[0] != "10.0.0.1:1000" {
+		t.Fatalf("lost peer address mismatch: have %v, want %v.", addrs, []string{"10.0.0.1:1000"})
+	}
+	if addrs := o.lost[b.String()].addrs; len(addrs) != 1 || addrs[0] != "10.0.0.2:1000" {
+		t.Fatalf("lost peer address mismatch: have %v, want %v.", addrs, []string{"10.0.0.2:1000"})
+	}
+	// Reach a lost and an unknown peer, only the former being a merge
+	o.found(a)
+	o.found(big.NewInt(4))
+	if stats := o.Stats(); stats.Lost != 2 || stats.Merges != 1 {
+		t.Fatalf("merge stats mismatch: have %+v, want 2 lost, 1 merge.", stats)
+	}
+	// Forget addresses taken over by other nodes, giving up when none remain
+	d := big.NewInt(5)
+	o.lose([]*peer{{nodeId: d, addrs: []string{"10.0.0.5:1000", "10.0.0.5:2000"}}}, 10)
+	o.reassigned(d, "10.0.0.5:1000")
+	if addrs := o.lost[d.String()].addrs; len(addrs) != 1 || addrs[0] != "10.0.0.5:2000" {
+		t.Fatalf("lost peer address mismatch: have %v, want %v.", addrs, []string{"10.0.0.5:2000"})
+	}
+	o.reassigned(d, "10.0.0.5:2000")
+	if stats := o.Stats(); stats.Lost != 2 {
+		t.Fatalf("reassigned stats mismatch: have %+v, want 2 lost.", stats)
+	}
+}
@@ -0,0 +1,147 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// This file contains the node id assignment strategies. By default a node picks
+// a fresh random id on every start, but it can also be given an explicit id, an
+// id derived from a configured name, or a random one persisted to disk, so that
+// restarted nodes rejoin the overlay at the same ring position. With secure
+// routing the id is certified by a node key (see secure.go), so only the fresh
+// and persisted strategies apply, the latter persisting the key instead.
+
+package pastry
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Verifies that the configured node id can be assigned, so that a bad spec or a
+// corrupt id file is reported before creating the overlay (which panics on it).
+// Persistent ids (or node keys with secure routing) are created if missing.
+func CheckIdentity() error {
+	if config.PastrySecureRouting {
+		_, _, err := secureId(config.PastryNodeId)
+		return err
+	}
+	_, err := assignId(config.PastryNodeId)
+	return err
+}
+
+// Assigns the local node id based on the configured strategy:
+//   - "":            fresh random id
+//   - "id:<hex>":    explicit id
+//   - "name:<text>": id derived from the given name
+//   - "file:<path>": random id persisted into (and reloaded from) the given file
+func assignId(spec string) (*big.Int, error) {
+	switch {
+	case spec == "":
+		return randomId()
+	case strings.HasPrefix(spec, "id:"):
+		id, ok := new(big.Int).SetString(strings.TrimPrefix(spec, "id:"), 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid explicit node id: %s", spec)
+		}
+		return id, checkId(id)
+	case strings.HasPrefix(spec, "name:"):
+		name := strings.TrimPrefix(spec, "name:")
+		if name == "" {
+			return nil, errors.New("empty node name")
+		}
+		return Resolve(name), nil
+	case strings.HasPrefix(spec, "file:"):
+		return persistentId(strings.TrimPrefix(spec, "file:"))
+	default:
+		return nil, fmt.Errorf("unknown node id strategy: %s", spec)
+	}
+}
+
+// Generates a random node id within the configured id space.
+func randomId() (*big.Int, error) {
+	raw := make([]byte, (config.PastrySpace+7)/8)
+	if n, err := io.ReadFull(rand.Reader, raw); n < len(raw) || err != nil {
+		return nil, fmt.Errorf("failed to generate node id: %v", err)
+	}
+	return truncate(raw), nil
+}
+
+// Loads the node id persisted in the given file, or generates a random one and
+// saves it there if none was persisted yet.
+func persistentId(path string) (*big.Int, error) {
+	if path == "" {
+		return nil, errors.New("empty node id path")
+	}
+	// Try to reload a previously persisted id
+	blob, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		id, ok := new(big.Int).SetString(strings.TrimSpace(string(blob)), 16)
+		if !ok {
+			return nil, fmt.Errorf("corrupt node id file %s", path)
+		}
+		return id, checkId(id)
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	// No id yet, generate one and persist it
+	id, err := randomId()
+	if err != nil {
+		return nil, err
+	}
+	if err := persist(path, []byte(fmt.Sprintf("%x\n", id))); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Atomically writes some data into a file, replacing any previous contents.
+func persist(path string, data []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return nil
+}
+
+// Verifies that a node id fits into the configured id space.
+func checkId(id *big.Int) error {
+	if id.Sign() < 0 || id.BitLen() > config.PastrySpace {
+		return fmt.Errorf("node id %x outside of the %d bit id space", id, config.PastrySpace)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package pastry
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+func TestAssignId(t *testing.T) {
+	// Random ids should differ between assignments
+	a, err := assignId("")
+	if err != nil {
+		t.Fatalf("failed to assign random id: %v.", err)
+	}
+	b, err := assignId("")
+	if err != nil {
+		t.Fatalf("failed to assign random id: %v.", err)
+	}
+	if a.Cmp(b) == 0 {
+		t.Fatalf("random ids collide: %v.", a)
+	}
+	// Explicit ids should be taken verbatim
+	if id, err := assignId("id:abcdef"); err != nil || id.Cmp(big.NewInt(0xabcdef)) != 0 {
+		t.Fatalf("explicit id mismatch: have %v/%v, want %v.", id, err, 0xabcdef)
+	}
+	// Derived ids should be stable
+	if id, err := assignId("name:node-1"); err != nil || id.Cmp(Resolve("node-1")) != 0 {
+		t.Fatalf("derived id mismatch: have %v/%v, want %v.", id, err, Resolve("node-1"))
+	}
+	// Invalid specs should be rejected
+	for _, spec := range []string{"id:", "id:xyz", "id:ffffffffffffffffffff", "name:", "file:", "unknown"} {
+		if id, err := assignId(spec); err == nil {
+			t.Errorf("invalid spec %q accepted: %v.", spec, id)
+		}
+	}
+}
+
+func TestPersistentId(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastry")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node.id")
+
+	// Generate a fresh id, and make sure it's reloaded afterwards
+	first, err := assignId("file:" + path)
+	if err != nil {
+		t.Fatalf("failed to generate persistent id: %v.", err)
+	}
+	second, err := assignId("file:" + path)
+	if err != nil {
+		t.Fatalf("failed to reload persistent id: %v.", err)
+	}
+	if first.Cmp(second) != 0 {
+		t.Fatalf("persistent id mismatch: have %v, want %v.", second, first)
+	}
+	// Make sure corrupt files are not silently overwritten
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("failed to corrupt id file: %v.", err)
+	}
+	if id, err := assignId("file:" + path); err == nil {
+		t.Fatalf("corrupt id file accepted: %v.", id)
+	}
+}
+
+func TestCheckIdentity(t *testing.T) {
+	// Save the previous config values
+	spec, secure := config.PastryNodeId, config.PastrySecureRouting
+	defer func() { config.PastryNodeId, config.PastrySecureRouting = spec, secure }()
+
+	for i, tt := range []struct {
+		spec   string
+		secure bool
+		valid  bool
+	}{
+		{"", false, true},
+		{"id:abcdef", false, true},
+		{"id:xyz", false, false},
+		{"unknown", false, false},
+		{"", true, true},
+		{"name:node-1", true, false},
+	} {
+		config.PastryNodeId, config.PastrySecureRouting = tt.spec, tt.secure
+		if err := CheckIdentity(); (err == nil) != tt.valid {
+			t.Errorf("test %d: validity mismatch: have %v, want %v.", i, err == nil, tt.valid)
+		}
+	}
+}
@@ -48,10 +48,10 @@ func (o *Overlay) manager() {
 
 	addrs := make(map[string][]string)
 	exchs := make(map[*peer]*state)
-	drops := make(map[*peer]struct{})
+	drops := make(map[*peer]bool)
 
 	// Mark the overlay as unstable
-	stable := false
+	stable, converged := false, false
 	stableTime := config.PastryBootTimeout
 
 	var errc chan error
@@ -70,7 +70,7 @@ func (o *Overlay) manager() {
 			exchs = make(map[*peer]*state)
 		}
 		if len(drops) > 0 {
-			drops = make(map[*peer]struct{})
+			drops = make(map[*peer]bool)
 		}
 		// Block till an event arrives
 		select {
@@ -92,20 +92,22 @@ func (o *Overlay) manager() {
 			// No update arrived for a while, consider stable
 			if !stable {
 				stable = true
-				o.stable.Done()
+				if !converged {
+					converged = true
+					close(o.stable)
+				}
 			}
 			continue
 		}
 		// Mark overlay as unstable and set a reduced convergence time
-		if stable {
-			stable = false
-			o.stable.Add(1)
-		}
+		stable = false
 		stableTime = config.PastryConvTimeout
 
 		// Merge all state exchanges into the temporary routing table and drop unneeded nodes
-		for _, s := range exchs {
-			o.merge(routes, addrs, s)
+		for p, s := range exchs {
+			if !o.suspicious(p, s) {
+				o.merge(routes, addrs, s)
+			}
 		}
 		o.dropAll(drops, &pending)
 
@@ -202,11 +204,22 @@ func (o *Overlay) exch(p *peer, s *state) {
 	}
 }
 
-// Inserts a peer into the drop queue.
+// Inserts a failed peer into the drop queue.
 func (o *Overlay) drop(p *peer) {
+	o.queueDrop(p, false)
+}
+
+// Inserts a deliberately dropped peer (left or unneeded) into the drop queue.
+// Contrary to failed ones, these are not probed for reachability afterwards.
+func (o *Overlay) dismiss(p *peer) {
+	o.queueDrop(p, true)
+}
+
+// Inserts a peer into the drop queue, remembering whether it was deliberate.
+func (o *Overlay) queueDrop(p *peer, deliberate bool) {
 	// Insert the drop request
 	o.eventLock.Lock()
-	o.dropSet[p] = struct{}{}
+	o.dropSet[p] = o.dropSet[p] || deliberate
 	o.eventLock.Unlock()
 
 	// Wake the manager if blocking
@@ -218,8 +231,9 @@ func (o *Overlay) drop(p *peer) {
 	}
 }
 
-// Drops an active peer connection due to either a failure or uselessness.
-func (o *Overlay) dropAll(peers map[*peer]struct{}, pending *sync.WaitGroup) {
+// Drops an active peer connection due to either a failure or uselessness. The
+// failed ones are handed over to the healer to probe for reachability.
+func (o *Overlay) dropAll(peers map[*peer]bool, pending *sync.WaitGroup) {
 	// Make sure there's actually something to remove
 	if len(peers) == 0 {
 		return
@@ -249,21 +263,32 @@ func (o *Overlay) dropAll(peers map[*peer]struct{}, pending *sync.WaitGroup) {
 	}
 	// Remove the peers from the overlay state
 	o.lock.Lock()
-	defer o.lock.Unlock()
-
-	for d, _ := range peers {
+	live := len(o.livePeers)
+	lost := []*peer{}
+	for d, deliberate := range peers {
 		id := d.nodeId.String()
 		if p, ok := o.livePeers[id]; ok && p == d {
 			// Delete the peer and stop monitoring it
 			delete(o.livePeers, id)
 			o.heart.heart.Unmonitor(d.nodeId)
+			if !deliberate {
+				lost = append(lost, d)
+			}
 		}
 	}
+	o.lock.Unlock()
+
+	// Remember the failed peers for reachability probing
+	if len(lost) > 0 {
+		o.lose(lost, live)
+	}
 }
 
 // Merges the received state into the provided routing table according to the
 // reduced pastry specs (no neighborhood sets). Also each peers network addresses
-// are collected to connect later if needed.
+// are collected to connect later if needed. Routing table entries are replaced
+// if a candidate (received or already connected) is closer by network latency,
+// or closer to the entry's constraint point with secure routing.
 func (o *Overlay) merge(t *table, a map[string][]string, s *state) {
 	// Extract the ids from the state exchange
 	ids := make([]*big.Int, 0, len(s.Addrs))
@@ -281,6 +306,9 @@ func (o *Overlay) merge(t *table, a map[string][]string, s *state) {
 	// Generate the new leaf set
 	t.leaves = o.mergeLeaves(t.leaves, ids)
 
+	// Remember the addresses for probing after a potential network partition
+	o.remember(s.Addrs)
+
 	// Merge the received addresses into the routing table
 	for _, id := range ids {
 		row, col := prefix(o.nodeId, id)
@@ -288,10 +316,50 @@ func (o *Overlay) merge(t *table, a map[string][]string, s *state) {
 		switch {
 		case old == nil:
 			t.routes[row][col] = id
+		case old.Cmp(id) != 0 && o.better(row, col, id, old):
+			// Closer candidate found, replace the entry
+			t.routes[row][col] = id
 		case old.Cmp(id) != 0:
 			// Discard new entry (less disruptive)
 		}
 	}
+	// Live connections have measured latencies, swap in any better ones
+	o.lock.RLock()
+	live := make([]*big.Int, 0, len(o.livePeers))
+	for _, p := range o.livePeers {
+		live = append(live, p.nodeId)
+	}
+	o.lock.RUnlock()
+
+	for _, id := range live {
+		row, col := prefix(o.nodeId, id)
+		if old := t.routes[row][col]; old != nil && old.Cmp(id) != 0 && o.better(row, col, id, old) {
+			t.routes[row][col] = id
+		}
+	}
+}
+
+// Returns the measured round trip time to a node, or 0 if unknown.
+func (o *Overlay) latency(id *big.Int) time.Duration {
+	o.lock.RLock()
+	p, ok := o.livePeers[id.String()]
+	o.lock.RUnlock()
+
+	if !ok {
+		return 0
+	}
+	return p.latency()
+}
+
+// Checks whether node a is closer than node b by a large enough margin to be
+// worth replacing a routing entry. Unmeasured nodes are never deemed closer,
+// nor are measured ones closer than unmeasured entries (less disruptive).
+func (o *Overlay) closer(a, b *big.Int) bool {
+	la, lb := o.latency(a), o.latency(b)
+	if la == 0 || lb == 0 {
+		return false
+	}
+	return float64(la) < float64(lb)*config.PastryProximityMargin
 }
 
 // Merges two leafsets and returns the result.
@@ -369,13 +437,20 @@ func (o *Overlay) revoke(t *table, down []*big.Int) {
 		for c, id := range row {
 			if id != nil {
 				if idx := downs.Search(id); idx < len(downs) && downs[idx].Cmp(id) == 0 {
-					// Try and fix routing entry from connection pool
+					// Try and fix routing entry from connection pool, picking the closest
 					t.routes[r][c] = nil
+					var best time.Duration
 					o.lock.RLock()
 					for _, p := range o.livePeers {
 						if pre, dig := prefix(o.nodeId, p.nodeId); pre == r && dig == c {
-							t.routes[r][c] = p.nodeId
-							break
+							if config.PastrySecureRouting {
+								// Constrained tables are closest by id, not latency
+								if t.routes[r][c] == nil || o.better(r, c, p.nodeId, t.routes[r][c]) {
+									t.routes[r][c] = p.nodeId
+								}
+							} else if rtt := p.latency(); t.routes[r][c] == nil || (rtt > 0 && (best == 0 || rtt < best)) {
+								t.routes[r][c], best = p.nodeId, rtt
+							}
 						}
 					}
 					o.lock.RUnlock()
@@ -209,3 +209,64 @@ func TestMaintenanceDOS(t *testing.T) {
 	}
 }
 */
+
+func TestProximity(t *testing.T) {
+	// Create an overlay with two candidates for the same routing table entry
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+
+	flip := new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace-1))
+	a := new(big.Int).Xor(o.nodeId, new(big.Int).Or(flip, big.NewInt(1)))
+	b := new(big.Int).Xor(o.nodeId, new(big.Int).Or(flip, big.NewInt(2)))
+	row, col := prefix(o.nodeId, a)
+
+	routes := o.routes.copy()
+	addrs := make(map[string][]string)
+
+	// Merge the first candidate into the empty table
+	o.livePeers[a.String()] = &peer{nodeId: a, rtt: 10 * time.Millisecond}
+	o.merge(routes, addrs, &state{Addrs: map[string][]string{a.String(): nil}})
+	if id := routes.routes[row][col]; id == nil || id.Cmp(a) != 0 {
+		t.Fatalf("initial entry mismatch: have %v, want %v.", id, a)
+	}
+	// Merge a slightly closer candidate, which shouldn't replace the entry
+	o.livePeers[b.String()] = &peer{nodeId: b, rtt: 9 * time.Millisecond}
+	o.merge(routes, addrs, &state{Addrs: map[string][]string{b.String(): nil}})
+	if id := routes.routes[row][col]; id.Cmp(a) != 0 {
+		t.Fatalf("entry replaced within margin: have %v, want %v.", id, a)
+	}
+	o.routes = routes
+	if stats := o.Stats(); stats.Routes != 1 || stats.Latency != 10*time.Millisecond || stats.Stretch <= 1 {
+		t.Fatalf("stats mismatch: have %+v, want 1 route, 10ms latency, stretch above 1.", stats)
+	}
+	// Make the second candidate much closer, which should replace the entry
+	o.livePeers[b.String()].rtt = 2 * time.Millisecond
+	routes = o.routes.copy()
+	o.merge(routes, addrs, &state{Addrs: map[string][]string{b.String(): nil}})
+	if id := routes.routes[row][col]; id.Cmp(b) != 0 {
+		t.Fatalf("closer entry not selected: have %v, want %v.", id, b)
+	}
+	o.routes = routes
+	if stats := o.Stats(); stats.Routes != 1 || stats.Stretch != 1 {
+		t.Fatalf("stats mismatch: have %+v, want 1 route, stretch 1.", stats)
+	}
+}
+
+func TestProximityProbe(t *testing.T) {
+	p := new(peer)
+
+	// Receive a heartbeat without echo, which should only be echoed back
+	p.probed(&header{Stamp: 1})
+	if echo, _ := p.echoed(); echo != 1 {
+		t.Fatalf("echo mismatch: have %v, want %v.", echo, 1)
+	}
+	if rtt := p.latency(); rtt != 0 {
+		t.Fatalf("unmeasured latency mismatch: have %v, want %v.", rtt, 0)
+	}
+	// Receive an echo of a local stamp, held for a while remotely
+	sent := time.Now().Add(-50 * time.Millisecond).UnixNano()
+	p.probed(&header{Stamp: 2, Echo: sent, Hold: 20 * time.Millisecond})
+	if rtt := p.latency(); rtt < 30*time.Millisecond || rtt > 40*time.Millisecond {
+		t.Fatalf("latency mismatch: have %v, want 30ms-40ms.", rtt)
+	}
+}
@@ -16,19 +16,22 @@
 // author(s).
 
 // Package pastry contains a simplified version of Pastry, where proximity is
-// not taken into consideration (i.e. no neighbor set).
+// only taken into consideration for the routing table (i.e. no neighbor set).
 package pastry
 
 import (
-	"crypto/rand"
+	"crypto/ecdsa"
 	"crypto/rsa"
+	"errors"
 	"fmt"
-	"io"
 	"math/big"
-	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/ext/netext"
 	"github.com/project-iris/iris/pool"
 	"github.com/project-iris/iris/proto"
 )
@@ -42,7 +45,8 @@ const (
 	done
 )
 
-// Callback for events leaving the overlay network.
+// Callback for events leaving the overlay network. The pooled payload of the
+// messages is valid only during the callback, unless retained or detached.
 type Callback interface {
 	Deliver(msg *proto.Message, key *big.Int)
 	Forward(msg *proto.Message, key *big.Int) bool
@@ -50,13 +54,19 @@ type Callback interface {
 
 // Internal structure for the overlay state information.
 type Overlay struct {
+	expired  uint64 // Number of messages discarded for exceeding their TTL (atomic, 64 bit aligned)
+	loops    uint64 // Number of traced messages found looping back (atomic, 64 bit aligned)
+	suspects uint64 // Number of state exchanges distrusted for density (atomic, 64 bit aligned)
+
 	app Callback // Upstream application callback
 
 	authId  string          // Iris network id
 	authKey *rsa.PrivateKey // Iris authentication key
 
-	nodeId *big.Int // Pastry peer id
-	addrs  []string // Listener addresses
+	nodeId  *big.Int          // Pastry peer id
+	nodeKey *ecdsa.PrivateKey // Key certifying the node id (secure routing only)
+	addrs   []string          // Advertised listener addresses
+	laddrs  []string          // Local listener addresses
 
 	livePeers map[string]*peer // Active connection pool
 	heart     *heartbeat       // Beater for the active peers
@@ -72,25 +82,41 @@ type Overlay struct {
 	authAccept *pool.ThreadPool // Remotely initiated authentication pool
 	stateExch  *pool.ThreadPool // Pool for limiting active state exchanges
 
-	exchSet map[*peer]*state   // State exchanges pending merging
-	dropSet map[*peer]struct{} // Peers pending dropping
+	exchSet map[*peer]*state // State exchanges pending merging
+	dropSet map[*peer]bool   // Peers pending dropping (deliberately or not)
 
 	eventLock   sync.Mutex    // Lock protecting overlay events
 	eventNotify chan struct{} // Notifier for event changes
 
-	stable sync.WaitGroup // Syncer for reaching convergence
-	lock   sync.RWMutex   // Syncer for state mods after booting
+	known      map[string][]string  // Network addresses of previously seen peers
+	lost       map[string]*lostPeer // Failed peers probed for reachability
+	partitions uint64               // Number of suspected network partitions
+	merges     uint64               // Number of lost peers reached again
+	leaving    bool                 // Whether the node is shutting down (no more losses)
+	healLock   sync.Mutex           // Lock protecting the partition healing state
+	healQuit   chan chan error      // Quit sync channel for the partition healer (nil if not booted)
+
+	stable chan struct{} // Closed when the overlay first converges
+	lock   sync.RWMutex  // Syncer for state mods after booting
 }
 
 // Creates a new overlay structure with all internal state initialized, ready to
 // be booted.
 func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
-	// Generate the random node id for this overlay peer
-	peerId := make([]byte, config.PastrySpace/8)
-	if n, err := io.ReadFull(rand.Reader, peerId); n < len(peerId) || err != nil {
-		panic(fmt.Sprintf("failed to generate node id: %v", err))
+	// Assign the node id for this overlay peer, certified by a key if secure
+	var (
+		nodeId  *big.Int
+		nodeKey *ecdsa.PrivateKey
+		err     error
+	)
+	if config.PastrySecureRouting {
+		nodeKey, nodeId, err = secureId(config.PastryNodeId)
+	} else {
+		nodeId, err = assignId(config.PastryNodeId)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to assign node id: %v", err))
 	}
-	nodeId := new(big.Int).SetBytes(peerId)
 
 	// Assemble and return the overlay instance
 	o := &Overlay{
@@ -99,8 +125,10 @@ func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
 		authId:  id,
 		authKey: key,
 
-		nodeId: nodeId,
-		addrs:  []string{},
+		nodeId:  nodeId,
+		nodeKey: nodeKey,
+		addrs:   []string{},
+		laddrs:  []string{},
 
 		livePeers: make(map[string]*peer),
 		routes:    newRoutingTable(nodeId),
@@ -114,35 +142,65 @@ func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
 		stateExch:  pool.NewThreadPool(config.PastryExchThreads),
 
 		exchSet:     make(map[*peer]*state),
-		dropSet:     make(map[*peer]struct{}),
+		dropSet:     make(map[*peer]bool),
 		eventNotify: make(chan struct{}, 1), // Buffer one notification
+
+		known:  make(map[string][]string),
+		lost:   make(map[string]*lostPeer),
+		stable: make(chan struct{}),
 	}
 	o.heart = newHeart(o)
 	return o
 }
 
 // Boots the overlay network: it starts up boostrappers and connection acceptors
-// on all local IPv4 interfaces, after which the overlay management is booted.
+// on all selected local interfaces (IPv6 ones only with multicast discovery),
+// after which the overlay management is booted.
 // The method returns the number of remote peers after convergence is reached.
 func (o *Overlay) Boot() (int, error) {
-	// Start the individual acceptors
-	addrs, err := net.InterfaceAddrs()
+	// Make sure the overlay parameters are sane
+	if err := checkParams(); err != nil {
+		return 0, err
+	}
+	// Select the interfaces to bind to and apply any advertised address override
+	ipnets, err := netext.Interfaces(config.NetInclude, config.NetExclude, config.BootMulticast)
 	if err != nil {
 		return 0, err
 	}
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok {
-			if !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-				// Create a quit channel and start the acceptor
-				quit := make(chan chan error)
-				o.acceptQuit = append(o.acceptQuit, quit)
-				go o.acceptor(ipnet, quit)
+	if len(ipnets) == 0 {
+		return 0, errors.New("no network interfaces selected")
+	}
+	if len(config.PastryAdvertise) > 0 {
+		if err := netext.CheckAddrs(config.PastryAdvertise); err != nil {
+			return 0, fmt.Errorf("invalid advertised address: %v", err)
+		}
+		o.lock.Lock()
+		o.addrs = append([]string{}, config.PastryAdvertise...)
+		sort.Strings(o.addrs)
+		o.lock.Unlock()
+	}
+	// Bind and start the individual acceptors, tearing down on any failure
+	for _, ipnet := range ipnets {
+		sock, boot, discover, err := o.listen(ipnet)
+		if err != nil {
+			errc := make(chan error)
+			for _, quit := range o.acceptQuit {
+				quit <- errc
+				<-errc
 			}
+			o.acceptQuit = nil
+			return 0, err
 		}
+		// Create a quit channel and start the acceptor
+		quit := make(chan chan error)
+		o.acceptQuit = append(o.acceptQuit, quit)
+		go o.acceptor(sock, boot, discover, quit)
 	}
 	// Start the overlay processes
-	o.stable.Add(1)
+	o.healQuit = make(chan chan error)
+
 	go o.manager()
+	go o.healer()
 	o.heart.start()
 
 	o.authInit.Start()
@@ -150,7 +208,7 @@ func (o *Overlay) Boot() (int, error) {
 	o.stateExch.Start()
 
 	// Wait for convergence and report remote connections
-	o.stable.Wait()
+	<-o.stable
 
 	o.lock.RLock()
 	defer o.lock.RUnlock()
@@ -166,6 +224,10 @@ func (o *Overlay) Boot() (int, error) {
 
 // Sends a termination signal to all the go routines part of the overlay.
 func (o *Overlay) Shutdown() error {
+	// Make sure the overlay was actually started
+	if o.healQuit == nil {
+		return errors.New("non-booted overlay")
+	}
 	errs := []error{}
 	errc := make(chan error)
 
@@ -178,6 +240,27 @@ func (o *Overlay) Shutdown() error {
 			errs = append(errs, err)
 		}
 	}
+	// Stop probing for lost peers
+	o.healQuit <- errc
+	if err := <-errc; err != nil {
+		errs = append(errs, err)
+	}
+	// Notify the peers of the leave while the heartbeats still run, so they are
+	// dismissed, not considered failed and probed for (nor locally the other way)
+	o.healLock.Lock()
+	o.leaving = true
+	o.healLock.Unlock()
+
+	o.lock.RLock()
+	peers := make([]*peer, 0, len(o.livePeers))
+	for _, p := range o.livePeers {
+		peers = append(peers, p)
+	}
+	o.lock.RUnlock()
+
+	for _, p := range peers {
+		o.sendClose(p)
+	}
 	// Wait for all pending handshakes to finish
 	o.authAccept.Terminate(false)
 	o.authInit.Terminate(false)
@@ -210,15 +293,130 @@ func (o *Overlay) Self() *big.Int {
 	return o.nodeId
 }
 
+// Returns the current leaf set of the local node, excluding itself.
+func (o *Overlay) Leaves() []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	leaves := make([]*big.Int, 0, len(o.routes.leaves))
+	for _, leaf := range o.routes.leaves {
+		if leaf.Cmp(o.nodeId) != 0 {
+			leaves = append(leaves, leaf)
+		}
+	}
+	return leaves
+}
+
+// Routing, partition healing and loop protection statistics of the overlay node.
+type Stats struct {
+	Peers   int           // Number of live peer connections
+	Routes  int           // Number of filled routing table entries
+	Latency time.Duration // Average round trip time to the measured routing entries
+	Stretch float64       // Average latency ratio of the routing entries to the closest eligible peers
+
+	Lost       int    // Number of failed peers being probed for reachability
+	Partitions uint64 // Number of suspected network partitions
+	Merges     uint64 // Number of lost peers reached again, merging the overlay
+
+	Expired uint64 // Number of messages discarded for exceeding their hop limit
+	Loops   uint64 // Number of traced messages found looping back to the node
+
+	Suspects uint64 // Number of state exchanges distrusted for leaf set density
+}
+
+// Gathers the routing statistics of the local node. The stretch measures how
+// well the routing table follows network proximity: each measured entry's round
+// trip time is compared to the closest live peer eligible for the same slot, a
+// value of 1 meaning that all entries are the closest known candidates.
+func (o *Overlay) Stats() *Stats {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	// Collect the closest live peer for each routing slot
+	best := make(map[[2]int]time.Duration)
+	for _, p := range o.livePeers {
+		if rtt := p.latency(); rtt > 0 {
+			row, col := prefix(o.nodeId, p.nodeId)
+			if old, ok := best[[2]int{row, col}]; !ok || rtt < old {
+				best[[2]int{row, col}] = rtt
+			}
+		}
+	}
+	// Compare the routing entries against the best candidates
+	stats := &Stats{Peers: len(o.livePeers), Stretch: 1}
+
+	measured, latency, stretch := 0, time.Duration(0), 0.0
+	for r, row := range o.routes.routes {
+		for c, id := range row {
+			if id == nil {
+				continue
+			}
+			stats.Routes++
+			if p, ok := o.livePeers[id.String()]; ok {
+				if rtt := p.latency(); rtt > 0 {
+					measured++
+					latency += rtt
+					stretch += float64(rtt) / float64(best[[2]int{r, c}])
+				}
+			}
+		}
+	}
+	if measured > 0 {
+		stats.Latency = latency / time.Duration(measured)
+		stats.Stretch = stretch / float64(measured)
+	}
+	// Gather the partition healing counters
+	o.healLock.Lock()
+	stats.Lost, stats.Partitions, stats.Merges = len(o.lost), o.partitions, o.merges
+	o.healLock.Unlock()
+
+	// Gather the routing loop counters
+	stats.Expired = atomic.LoadUint64(&o.expired)
+	stats.Loops = atomic.LoadUint64(&o.loops)
+	stats.Suspects = atomic.LoadUint64(&o.suspects)
+
+	return stats
+}
+
 // Sends a message to the closest node to the given destination.
 func (o *Overlay) Send(dest *big.Int, msg *proto.Message) {
 	// Package into overlay envelope
 	head := &header{
 		Meta: msg.Head.Meta,
 		Dest: dest,
+		TTL:  uint64(config.PastryRouteTTL),
 	}
 	msg.Head.Meta = head
 
 	// Assemble and send an internal message with overlay state included
 	o.route(nil, msg)
 }
+
+// Sends a message to the closest node to the given destination along multiple
+// routes: the first of the replicas takes the regular path, whilst the rest are
+// handed to other live peers as first hops, each routed onwards independently.
+// Replicas skip the local forwarding callback and may share their payloads, but
+// not their headers; it is the receiver's duty to deduplicate them. If the local
+// node is the destination, or not enough peers are live, surplus replicas are
+// not sent.
+func (o *Overlay) SendReplicated(dest *big.Int, replicas []*proto.Message) {
+	// Pick the alternative first hops for the replicas
+	o.lock.RLock()
+	var hops []*peer
+	if best := o.next(dest); len(replicas) > 1 && o.nodeId.Cmp(best) != 0 {
+		hops = o.alternates(dest, best, len(replicas)-1)
+	}
+	o.lock.RUnlock()
+
+	// Send off the replicas, followed by the original on the regular path
+	for i, p := range hops {
+		msg := replicas[i+1]
+		msg.Head.Meta = &header{
+			Meta: msg.Head.Meta,
+			Dest: dest,
+			TTL:  uint64(config.PastryRouteTTL),
+		}
+		o.send(msg, p)
+	}
+	o.Send(dest, replicas[0])
+}
@@ -50,8 +50,19 @@ type peer struct {
 	rhost string // Remote IP, flattened
 
 	// Overlay state infos
-	time    uint64
-	passive bool
+	time     uint64
+	passive  bool
+	compress bool // Whether the remote side accepts compressed payloads
+
+	// Proximity measurement fields
+	echo      int64         // Latest heartbeat stamp received from the remote
+	echoTime  time.Time     // Local time when the latest stamp arrived
+	rtt       time.Duration // Smoothed round trip time to the remote (0 if unmeasured)
+	probeLock sync.Mutex    // Lock to protect the proximity measurements
+
+	// Prioritized outbound data queues
+	queues [proto.Priorities]chan *proto.Message // Data messages waiting for the link
+	flush  chan chan error                       // Synchronizes the data queue termination
 
 	// Maintenance fields
 	quit chan chan error // Synchronizes peer termination
@@ -62,9 +73,10 @@ type peer struct {
 
 // Creates a new peer instance, ready to begin communicating.
 func (o *Overlay) newPeer(ses *session.Session) *peer {
-	return &peer{
-		owner: o,
-		conn:  ses,
+	p := &peer{
+		owner:    o,
+		conn:     ses,
+		compress: ses.Compress,
 
 		// Connection details
 		laddr: ses.CtrlLink.Sock().LocalAddr().String(),
@@ -73,15 +85,21 @@ func (o *Overlay) newPeer(ses *session.Session) *peer {
 		rhost: ses.CtrlLink.Sock().LocalAddr().(*net.TCPAddr).IP.String(),
 
 		// Transport and maintenance channels
-		quit: make(chan chan error),
-		drop: make(chan struct{}, 2),
+		flush: make(chan chan error),
+		quit:  make(chan chan error),
+		drop:  make(chan struct{}, 2),
+	}
+	for i := 0; i < len(p.queues); i++ {
+		p.queues[i] = make(chan *proto.Message, config.PastryNetBuffer)
 	}
+	return p
 }
 
-// Starts the inbound message processor and router.
+// Starts the inbound message processors and the outbound data scheduler.
 func (p *peer) Start() {
 	go p.processor(p.conn.CtrlLink)
 	go p.processor(p.conn.DataLink)
+	go p.scheduler()
 }
 
 // Terminates a peer connection.
@@ -95,11 +113,14 @@ func (p *peer) Close() error {
 	}
 	p.term = true
 
-	// Gracefully close the peer session, flushing pending messages
+	// Flush the queued data messages and gracefully close the peer session
+	errc := make(chan error)
+	p.flush <- errc
+	<-errc
+
 	res := p.conn.Close()
 
 	// Sync the processor terminations and return
-	errc := make(chan error)
 	for i := 0; i < 2; i++ {
 		p.quit <- errc
 		if err := <-errc; res != nil {
@@ -109,22 +130,122 @@ func (p *peer) Close() error {
 	return res
 }
 
-// Sends a message to the remote peer.
+// Sends a message to the remote peer. System messages are sent directly on the
+// control link, whereas application data is queued based on its priority class.
+// Compressed payloads are inflated first if the remote side did not negotiate
+// compression.
 func (p *peer) send(msg *proto.Message) error {
+	if msg.Head.Comp && !p.compress {
+		plain, err := msg.Uncompressed()
+		if err != nil {
+			return err
+		}
+		msg = plain
+	}
 	// Select the outbound channel based on message contents
-	link := p.conn.DataLink
-	if len(msg.Data) == 0 {
-		link = p.conn.CtrlLink
+	queue := p.conn.CtrlLink.Send
+	if len(msg.Data) != 0 && msg.Head.Prio != proto.PrioControl {
+		if msg.Head.Prio < proto.Priorities {
+			queue = p.queues[msg.Head.Prio]
+		} else {
+			queue = p.queues[proto.PrioBulk]
+		}
 	}
-	// Send the message on the selected channel
+	// Send the message on the selected channel (the link releases the payload)
+	msg.Retain()
 	select {
-	case link.Send <- msg:
+	case queue <- msg:
 		return nil
 	case <-time.After(config.PastrySendTimeout):
+		msg.Release()
 		return errors.New("timeout")
 	}
 }
 
+// Records a heartbeat arriving from the remote peer, saving its stamp to echo
+// back and updating the round trip time estimate if a local stamp was echoed.
+func (p *peer) probed(head *header) {
+	now := time.Now()
+
+	p.probeLock.Lock()
+	defer p.probeLock.Unlock()
+
+	p.echo, p.echoTime = head.Stamp, now
+	if head.Echo != 0 {
+		if sample := time.Duration(now.UnixNano()-head.Echo) - head.Hold; sample > 0 {
+			if p.rtt == 0 {
+				p.rtt = sample
+			} else {
+				p.rtt += (sample - p.rtt) / 8
+			}
+		}
+	}
+}
+
+// Returns the remote heartbeat stamp to echo back and the time it was held.
+func (p *peer) echoed() (int64, time.Duration) {
+	p.probeLock.Lock()
+	defer p.probeLock.Unlock()
+
+	if p.echo == 0 {
+		return 0, 0
+	}
+	return p.echo, time.Since(p.echoTime)
+}
+
+// Returns the smoothed round trip time to the remote peer, or 0 if unmeasured.
+func (p *peer) latency() time.Duration {
+	p.probeLock.Lock()
+	defer p.probeLock.Unlock()
+
+	return p.rtt
+}
+
+// Moves the queued data messages onto the data link, always picking the most
+// urgent one available. Upon termination, the pending ones are flushed.
+func (p *peer) scheduler() {
+	var errc chan error
+	for errc == nil {
+		// Pick the most urgent message, or wait for any if none are queued
+		var msg *proto.Message
+		for _, queue := range p.queues {
+			select {
+			case msg = <-queue:
+			default:
+			}
+			if msg != nil {
+				break
+			}
+		}
+		if msg == nil {
+			select {
+			case errc = <-p.flush:
+				continue
+			case msg = <-p.queues[proto.PrioInteractive]:
+			case msg = <-p.queues[proto.PrioBulk]:
+			}
+		}
+		p.forward(msg)
+	}
+	// Flush any pending messages in priority order
+	for _, queue := range p.queues {
+		for len(queue) > 0 {
+			p.forward(<-queue)
+		}
+	}
+	errc <- nil
+}
+
+// Hands a queued data message over to the data link, dropping it if the link
+// does not accept it in time.
+func (p *peer) forward(msg *proto.Message) {
+	select {
+	case p.conn.DataLink.Send <- msg:
+	case <-time.After(config.PastrySendTimeout):
+		msg.Release()
+	}
+}
+
 // Accepts inbound messages and routes them into the overlay.
 func (p *peer) processor(link *link.Link) {
 	var errc chan error
@@ -142,8 +263,9 @@ func (p *peer) processor(link *link.Link) {
 				closed = true
 				continue
 			}
-			// Route the control message
+			// Route the control message and drop the payload if not retained
 			p.owner.route(p, msg)
+			msg.Release()
 		}
 	}
 	// Signal the overlay of the connection drop
@@ -20,10 +20,12 @@
 package pastry
 
 import (
-	"encoding/gob"
 	"math/big"
+	"time"
 
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/codec"
 )
 
 // Pastry operation code type.
@@ -44,6 +46,11 @@ const (
 type state struct {
 	Addrs   map[string][]string // Known peers and their network addresses
 	Version uint64              // Version counter to skip old messages
+
+	// Overlay parameters of the joining node (join requests only)
+	Space  int // Bit size of the id space
+	Base   int // Bits per routing digit
+	Leaves int // Leaf set size
 }
 
 // Extra headers for the overlay.
@@ -52,11 +59,21 @@ type header struct {
 	Op    opcode      // The operation to execute
 	Dest  *big.Int    // Destination id
 	State *state      // Routing table state exchange
+
+	// Optional fields for heartbeats, measuring the round trip times
+	Stamp int64         // Local time of sending the heartbeat (unix nanos)
+	Echo  int64         // Latest heartbeat stamp received from the destination
+	Hold  time.Duration // Time elapsed since the echoed stamp arrived
+
+	// Loop protection fields, accounting for the routing hops
+	Hops  uint64     // Number of overlay hops taken so far
+	TTL   uint64     // Maximum number of hops allowed (0 for the local default)
+	Trace []*big.Int // Nodes traversed so far (only if route tracing is enabled)
 }
 
-// Make sure the header struct is registered with gob.
+// Make sure the header struct is registered with the codec.
 func init() {
-	gob.Register(&header{})
+	codec.Register(3, &header{})
 }
 
 // Simple wrapper around the peer send method, to handle errors by dropping.
@@ -70,6 +87,7 @@ func (o *Overlay) send(msg *proto.Message, p *peer) {
 // its destination via the peer connection.
 func (o *Overlay) sendPacket(dest *peer, head *header) {
 	// Assemble and send the final message
+	head.TTL = uint64(config.PastryRouteTTL)
 	msg := &proto.Message{
 		Head: proto.Header{
 			Meta: head,
@@ -84,7 +102,10 @@ func (o *Overlay) sendPacket(dest *peer, head *header) {
 // network addresses, sending it towards the destination node.
 func (o *Overlay) sendJoin(dest *peer) {
 	state := &state{
-		Addrs: map[string][]string{o.nodeId.String(): o.addrs},
+		Addrs:  map[string][]string{o.nodeId.String(): o.addrs},
+		Space:  config.PastrySpace,
+		Base:   config.PastryBase,
+		Leaves: config.PastryLeaves,
 	}
 	o.sendPacket(dest, &header{Op: opJoin, Dest: o.nodeId, State: state})
 }
@@ -97,13 +118,15 @@ func (o *Overlay) sendRepair(dest *peer) {
 
 // Assembles an overlay heartbeat message, consisting of the beat opcode and
 // tagged whether the connection is an active route entry or not, sending it
-// towards the destination node.
+// towards the destination node. The beat also carries the local time and echoes
+// the last one received from the destination, to measure the round trip time.
 func (o *Overlay) sendBeat(dest *peer, passive bool) {
+	head := &header{Op: opActive, Dest: dest.nodeId, Stamp: time.Now().UnixNano()}
 	if passive {
-		o.sendPacket(dest, &header{Op: opPassive, Dest: dest.nodeId})
-	} else {
-		o.sendPacket(dest, &header{Op: opActive, Dest: dest.nodeId})
+		head.Op = opPassive
 	}
+	head.Echo, head.Hold = dest.echoed()
+	o.sendPacket(dest, head)
 }
 
 // Assembles an overlay state message, consisting of the exchange opcode, the
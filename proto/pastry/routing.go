@@ -17,7 +17,7 @@
 
 // This file contains the routing logic in the overlay network, which currently
 // is a simplified version of Pastry: the leafset and routing table is the same,
-// but no proximity metric is taken into consideration.
+// but proximity is only considered when selecting the routing table entries.
 //
 // Beside the above, it also contains the system event processing logic.
 
@@ -27,18 +27,36 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"sort"
+	"sync/atomic"
 
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
 )
 
 // Pastry routing algorithm.
 func (o *Overlay) route(src *peer, msg *proto.Message) {
+	// Discard messages bouncing around the overlay
+	if o.hop(src, msg.Head.Meta.(*header)) {
+		msg.Release()
+		return
+	}
 	// Sync the routing table
 	o.lock.RLock() // Note, unlock is in deliver and forward!!!
 
+	// If self, deliver, otherwise forward
+	if best := o.next(msg.Head.Meta.(*header).Dest); o.nodeId.Cmp(best) == 0 {
+		o.deliver(src, msg)
+	} else {
+		o.forward(src, msg, best)
+	}
+}
+
+// Selects the next hop towards a destination, which may be the local node too.
+// The overlay lock must be held by the caller.
+func (o *Overlay) next(dest *big.Int) *big.Int {
 	// Extract some vars for easier access
 	tab := o.routes
-	dest := msg.Head.Meta.(*header).Dest
 
 	// Check the leaf set for direct delivery
 	// TODO: corner cases with if only handful of nodes?
@@ -51,40 +69,103 @@ func (o *Overlay) route(src *peer, msg *proto.Message) {
 				best, dist = leaf, d
 			}
 		}
-		// If self, deliver, otherwise forward
-		if o.nodeId.Cmp(best) == 0 {
-			o.deliver(src, msg)
-		} else {
-			o.forward(src, msg, best)
-		}
-		return
+		return best
 	}
 	// Check the routing table for indirect delivery
 	pre, col := prefix(o.nodeId, dest)
 	if best := tab.routes[pre][col]; best != nil {
-		o.forward(src, msg, best)
-		return
+		return best
 	}
 	// Route to anybody closer than the local node
 	dist := Distance(o.nodeId, dest)
 	for _, peer := range tab.leaves {
 		if p, _ := prefix(peer, dest); p >= pre && Distance(peer, dest).Cmp(dist) < 0 {
-			o.forward(src, msg, peer)
-			return
+			return peer
 		}
 	}
 	for _, row := range tab.routes {
 		for _, peer := range row {
 			if peer != nil {
 				if p, _ := prefix(peer, dest); p >= pre && Distance(peer, dest).Cmp(dist) < 0 {
-					o.forward(src, msg, peer)
-					return
+					return peer
 				}
 			}
 		}
 	}
 	// Well, shit. Deliver locally and hope for the best.
-	o.deliver(src, msg)
+	return o.nodeId
+}
+
+// Selects a number of alternative first hops towards a destination, disjoint
+// from the regular next hop: the live peers closest to the destination, so that
+// the copies routed through them take independent paths as much as possible.
+// The overlay lock must be held by the caller.
+func (o *Overlay) alternates(dest *big.Int, primary *big.Int, count int) []*peer {
+	peers := make([]*peer, 0, len(o.livePeers))
+	for _, p := range o.livePeers {
+		if p.nodeId.Cmp(primary) != 0 {
+			peers = append(peers, p)
+		}
+	}
+	sort.Sort(byDistance{dest, peers})
+	if len(peers) > count {
+		peers = peers[:count]
+	}
+	return peers
+}
+
+// Peer slice sortable by the distance to a destination id.
+type byDistance struct {
+	dest  *big.Int
+	peers []*peer
+}
+
+// Required for sort.Sort.
+func (b byDistance) Len() int {
+	return len(b.peers)
+}
+
+// Required for sort.Sort.
+func (b byDistance) Less(i, j int) bool {
+	return Distance(b.peers[i].nodeId, b.dest).Cmp(Distance(b.peers[j].nodeId, b.dest)) < 0
+}
+
+// Required for sort.Sort.
+func (b byDistance) Swap(i, j int) {
+	b.peers[i], b.peers[j] = b.peers[j], b.peers[i]
+}
+
+// Accounts for a routing hop of a message, reporting whether it exceeded its
+// hop limit and needs to be discarded. Inconsistent routing tables during churn
+// may otherwise bounce messages between nodes indefinitely. The limit set by the
+// sender is capped by the local one, as the wire value cannot be trusted. If
+// tracing is on, the local node is appended to the route, and loops are logged.
+func (o *Overlay) hop(src *peer, head *header) bool {
+	if src != nil {
+		head.Hops++
+	}
+	ttl := uint64(config.PastryRouteTTL)
+	if head.TTL != 0 && head.TTL < ttl {
+		ttl = head.TTL
+	}
+	if head.Hops > ttl {
+		atomic.AddUint64(&o.expired, 1)
+		if config.PastryRouteTrace {
+			log.Printf("pastry: discarding message to %v after %d hops: %v.", head.Dest, head.Hops, head.Trace)
+		}
+		return true
+	}
+	if config.PastryRouteTrace {
+		for _, id := range head.Trace {
+			if id.Cmp(o.nodeId) == 0 {
+				atomic.AddUint64(&o.loops, 1)
+				log.Printf("pastry: message to %v looped back: %v.", head.Dest, head.Trace)
+				break
+			}
+		}
+		head.Trace = append(head.Trace, o.nodeId)
+	}
+	return false
 }
 
 // Delivers a message to the application layer or processes it if a system message.
@@ -152,6 +233,11 @@ func (o *Overlay) process(src *peer, head *header) {
 		if o.nodeId.Cmp(head.Dest) == 0 {
 			return
 		}
+		// Discard joins of incompatible nodes (should've been refused by the handshake)
+		if err := compatible(remState.Space, remState.Base); err != nil {
+			log.Printf("pastry: discarding join of %v: %v.", head.Dest, err)
+			return
+		}
 		// Node joining into currents responsibility list
 		if p, ok := o.livePeers[remId]; !ok {
 			// Connect new peers and let the handshake do the state exchange
@@ -175,15 +261,19 @@ func (o *Overlay) process(src *peer, head *header) {
 		o.stateExch.Schedule(func() { o.sendState(src) })
 
 	case opActive:
-		// Ensure the peer is set to an active state
+		// Ensure the peer is set to an active state and measure its distance
 		src.passive = false
+		src.probed(head)
 
 	case opPassive:
+		// Measure the distance, as the peer is a candidate for proximity routing
+		src.probed(head)
+
 		// If remote connection reported passive after being already registered as
 		// such locally too, drop the connection.
 		if src.passive && !o.active(src.nodeId) {
 			o.lock.RUnlock()
-			o.drop(src)
+			o.dismiss(src)
 			o.lock.RLock()
 		}
 	case opExchage:
@@ -199,7 +289,7 @@ func (o *Overlay) process(src *peer, head *header) {
 	case opClose:
 		// Remote side requested a graceful close
 		o.lock.RUnlock()
-		o.drop(src)
+		o.dismiss(src)
 		o.lock.RLock()
 
 	default:
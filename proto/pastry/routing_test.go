@@ -41,6 +41,7 @@ func (c *collector) Deliver(msg *proto.Message, key *big.Int) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	msg.Detach()
 	c.delivs = append(c.delivs, msg)
 }
 
@@ -271,7 +272,7 @@ func benchmarkLatency(b *testing.B, block int) {
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
 
 	// Generate a batch of messages to send around
-	head := proto.Header{[]byte{0x99, 0x98, 0x97, 0x96}, []byte{0x00, 0x01}, []byte{0x02, 0x03}}
+	head := proto.Header{[]byte{0x99, 0x98, 0x97, 0x96}, []byte{0x00, 0x01}, []byte{0x02, 0x03}, false, proto.PrioInteractive}
 	msgs := make([]proto.Message, b.N)
 	for i := 0; i < b.N; i++ {
 		msgs[i].Head = head
@@ -359,7 +360,7 @@ func benchmarkThroughput(b *testing.B, block int) {
 	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
 
 	// Generate a bach of messages to send around
-	head := proto.Header{[]byte{0x99, 0x98, 0x97, 0x96}, []byte{0x00, 0x01}, []byte{0x02, 0x03}}
+	head := proto.Header{[]byte{0x99, 0x98, 0x97, 0x96}, []byte{0x00, 0x01}, []byte{0x02, 0x03}, false, proto.PrioInteractive}
 	msgs := make([]proto.Message, b.N)
 	for i := 0; i < b.N; i++ {
 		msgs[i].Head = head
@@ -393,3 +394,52 @@ func benchmarkThroughput(b *testing.B, block int) {
 	<-wait.quit
 	b.StopTimer()
 }
+
+func TestRouteTTL(t *testing.T) {
+	// Save the previous config values
+	ttl, trace := config.PastryRouteTTL, config.PastryRouteTrace
+	defer func() { config.PastryRouteTTL, config.PastryRouteTrace = ttl, trace }()
+
+	config.PastryRouteTTL = 3
+
+	// Create an overlay node and a fake remote peer (no need to boot)
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	src := &peer{nodeId: big.NewInt(1)}
+
+	// Locally originated messages should not count as a hop
+	head := &header{Dest: big.NewInt(2), TTL: 2}
+	if o.hop(nil, head) || head.Hops != 0 {
+		t.Fatalf("local message mishandled: discarded or hops %d.", head.Hops)
+	}
+	// Messages should be forwarded until their TTL is exceeded
+	if o.hop(src, head) || o.hop(src, head) {
+		t.Fatalf("message within hop limit discarded.")
+	}
+	if !o.hop(src, head) {
+		t.Fatalf("message exceeding hop limit accepted.")
+	}
+	// Messages without a TTL should use the local default
+	head = &header{Dest: big.NewInt(2), Hops: 3}
+	if !o.hop(src, head) {
+		t.Fatalf("message exceeding default hop limit accepted.")
+	}
+	// Remote TTLs above the local limit should be capped
+	head = &header{Dest: big.NewInt(2), Hops: 3, TTL: 1000}
+	if !o.hop(src, head) {
+		t.Fatalf("message exceeding local hop limit accepted.")
+	}
+	// The tracer should detect loops
+	config.PastryRouteTrace = true
+
+	head = &header{Dest: big.NewInt(2)}
+	o.hop(src, head)
+	o.hop(src, head)
+	if len(head.Trace) != 2 {
+		t.Fatalf("trace length mismatch: have %d, want %d.", len(head.Trace), 2)
+	}
+	stats := o.Stats()
+	if stats.Expired != 3 || stats.Loops != 1 {
+		t.Fatalf("counter mismatch: have %d/%d expired/loops, want %d/%d.", stats.Expired, stats.Loops, 3, 1)
+	}
+}
@@ -0,0 +1,240 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// This file contains the secure routing defenses, following the secure Pastry
+// literature. They guard against nodes which hold the cluster key, but are
+// malicious or buggy:
+//  - Self-certified ids: each node generates its own key pair and derives its
+//    id from the public key, so ids cannot be freely chosen (e.g. next to a
+//    topic root). The handshake proves the possession of the key by signing a
+//    value bound to the authenticated session, preventing replays and relays.
+//  - Constrained routing tables: each routing entry is the node closest to a
+//    fixed point in the id space, instead of the one with the lowest latency,
+//    so that attackers cannot fill the tables by simply being fast.
+//  - Leaf set density checks: states advertising leaf sets suspiciously denser
+//    than the local one hint at an id space attack and are not merged.
+//
+// The defenses are enabled cluster wide by config.PastrySecureRouting.
+
+package pastry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/ext/sortext"
+)
+
+// Assigns the node key pair based on the configured id strategy, and derives the
+// node id from its public part. Only fresh random keys ("") and keys persisted
+// into a file ("file:<path>") are supported, as explicit or named ids cannot be
+// certified.
+func secureId(spec string) (*ecdsa.PrivateKey, *big.Int, error) {
+	var (
+		key *ecdsa.PrivateKey
+		err error
+	)
+	switch {
+	case spec == "":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case strings.HasPrefix(spec, "file:"):
+		key, err = persistentKey(strings.TrimPrefix(spec, "file:"))
+	default:
+		err = fmt.Errorf("node id %q conflicts with secure routing's certified ids", spec)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, certifiedId(pub), nil
+}
+
+// Loads the node key persisted in the given file, or generates a new one and
+// saves it there if none was persisted yet.
+func persistentKey(path string) (*ecdsa.PrivateKey, error) {
+	if path == "" {
+		return nil, errors.New("empty node key path")
+	}
+	// Try to reload a previously persisted key
+	blob, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		block, _ := pem.Decode(blob)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("corrupt node key file %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	// No key yet, generate one and persist it
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := persist(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Derives the node id certified by a serialized public key.
+func certifiedId(pub []byte) *big.Int {
+	h := config.PastryResolver()
+	h.Write(pub)
+	sum := h.Sum(nil)
+
+	return truncate(sum[:(config.PastrySpace+7)/8])
+}
+
+// Fills the handshake packet with the local public key and a signature over the
+// session binding, proving the ownership of the advertised id.
+func (o *Overlay) prove(pkt *initPacket, binding []byte) error {
+	pub, err := x509.MarshalPKIXPublicKey(&o.nodeKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(binding)
+	r, s, err := ecdsa.Sign(rand.Reader, o.nodeKey, digest[:])
+	if err != nil {
+		return err
+	}
+	pkt.Key, pkt.SigR, pkt.SigS = pub, r, s
+	return nil
+}
+
+// Verifies that a remote handshake packet carries an id certified by its key,
+// and that the key's owner signed the session binding.
+func verify(pkt *initPacket, binding []byte) error {
+	if pkt.Key == nil || pkt.SigR == nil || pkt.SigS == nil {
+		return errors.New("missing id certificate")
+	}
+	if id := certifiedId(pkt.Key); id.Cmp(pkt.Id) != 0 {
+		return fmt.Errorf("id not certified by key: have %v, want %v", pkt.Id, id)
+	}
+	key, err := x509.ParsePKIXPublicKey(pkt.Key)
+	if err != nil {
+		return err
+	}
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("unsupported node key")
+	}
+	digest := sha256.Sum256(binding)
+	if !ecdsa.Verify(pub, digest[:], pkt.SigR, pkt.SigS) {
+		return errors.New("invalid session signature")
+	}
+	return nil
+}
+
+// Calculates the point in the id space a constrained routing entry should be
+// the closest to: the local id with the digit of the given row replaced.
+func (o *Overlay) constraint(row, col int) *big.Int {
+	shift := uint(config.PastrySpace - (row+1)*config.PastryBase)
+	mask := new(big.Int).Lsh(big.NewInt(1<<uint(config.PastryBase)-1), shift)
+
+	point := new(big.Int).AndNot(o.nodeId, mask)
+	return point.Or(point, new(big.Int).Lsh(big.NewInt(int64(col)), shift))
+}
+
+// Checks whether node a should replace node b in a routing table slot. With
+// secure routing, the node closer to the slot's constraint point wins, whereas
+// otherwise the one closer by network latency.
+func (o *Overlay) better(row, col int, a, b *big.Int) bool {
+	if config.PastrySecureRouting {
+		point := o.constraint(row, col)
+		return Distance(a, point).Cmp(Distance(b, point)) < 0
+	}
+	return o.closer(a, b)
+}
+
+// Calculates the average distance of the closest few ids to an origin, as an
+// estimate of the leaf set density around it (nil if not enough ids).
+func spacing(origin *big.Int, ids []*big.Int) *big.Int {
+	dists := make([]*big.Int, 0, len(ids))
+	for _, id := range ids {
+		if id.Cmp(origin) != 0 {
+			dists = append(dists, Distance(origin, id))
+		}
+	}
+	if len(dists) < config.PastryLeaves/2 {
+		return nil
+	}
+	sortext.BigInts(dists)
+	if len(dists) > config.PastryLeaves {
+		dists = dists[:config.PastryLeaves]
+	}
+	sum := new(big.Int)
+	for _, d := range dists {
+		sum.Add(sum, d)
+	}
+	return sum.Div(sum, big.NewInt(int64(len(dists))))
+}
+
+// Checks whether a state exchange advertises a leaf set suspiciously denser
+// than the local one, hinting at an id space attack around the sender.
+func (o *Overlay) suspicious(p *peer, s *state) bool {
+	if !config.PastrySecureRouting {
+		return false
+	}
+	// Estimate the local and remote densities
+	o.lock.RLock()
+	local := spacing(o.nodeId, o.routes.leaves)
+	o.lock.RUnlock()
+
+	ids := make([]*big.Int, 0, len(s.Addrs))
+	for sid := range s.Addrs {
+		if id, ok := new(big.Int).SetString(sid, 10); ok {
+			ids = append(ids, id)
+		}
+	}
+	remote := spacing(p.nodeId, ids)
+	if local == nil || remote == nil {
+		return false
+	}
+	// Compare the two with the allowed tolerance
+	if remote.Sign() == 0 {
+		remote = big.NewInt(1)
+	}
+	ratio, _ := new(big.Rat).SetFrac(local, remote).Float64()
+	if ratio <= config.PastryDensityFactor {
+		return false
+	}
+	atomic.AddUint64(&o.suspects, 1)
+	log.Printf("pastry: distrusting state of %v: leaf set %.1fx denser than local.", p.nodeId, ratio)
+	return true
+}
@@ -0,0 +1,275 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Overlay callback dropping all the messages passing through once activated.
+type dropper struct {
+	collector
+	active int32
+}
+
+func (d *dropper) Forward(msg *proto.Message, key *big.Int) bool {
+	return atomic.LoadInt32(&d.active) == 0
+}
+
+func TestCertifiedIds(t *testing.T) {
+	key, id, err := secureId("")
+	if err != nil {
+		t.Fatalf("failed to generate certified id: %v.", err)
+	}
+	o := &Overlay{nodeId: id, nodeKey: key}
+
+	// Valid certificates should pass
+	pkt := &initPacket{Id: id}
+	if err := o.prove(pkt, []byte("binding")); err != nil {
+		t.Fatalf("failed to certify id: %v.", err)
+	}
+	if err := verify(pkt, []byte("binding")); err != nil {
+		t.Fatalf("valid certificate refused: %v.", err)
+	}
+	// Replays into other sessions, forged ids and missing certificates should fail
+	if err := verify(pkt, []byte("other binding")); err == nil {
+		t.Fatalf("replayed certificate accepted.")
+	}
+	forged := *pkt
+	forged.Id = new(big.Int).Add(id, big.NewInt(1))
+	if err := verify(&forged, []byte("binding")); err == nil {
+		t.Fatalf("forged id accepted.")
+	}
+	if err := verify(&initPacket{Id: id}, []byte("binding")); err == nil {
+		t.Fatalf("uncertified id accepted.")
+	}
+}
+
+func TestPersistentKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastry")
+	if err != nil {
+		t.Fatalf("failed to create temporary folder: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node.key")
+
+	// Generate a fresh certified id, and make sure it's reloaded afterwards
+	_, first, err := secureId("file:" + path)
+	if err != nil {
+		t.Fatalf("failed to generate persistent key: %v.", err)
+	}
+	_, second, err := secureId("file:" + path)
+	if err != nil {
+		t.Fatalf("failed to reload persistent key: %v.", err)
+	}
+	if first.Cmp(second) != 0 {
+		t.Fatalf("certified id mismatch: have %v, want %v.", second, first)
+	}
+	// Corrupt key files and uncertifiable ids should be refused
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("failed to corrupt key file: %v.", err)
+	}
+	for _, spec := range []string{"file:" + path, "file:", "id:abcdef", "name:node-1"} {
+		if _, id, err := secureId(spec); err == nil {
+			t.Errorf("invalid spec %q accepted: %v.", spec, id)
+		}
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	o := &Overlay{nodeId: big.NewInt(0x123456789a)}
+
+	// The constraint point should only differ from the local id in the given digit
+	for row := 0; row < config.PastrySpace/config.PastryBase; row++ {
+		for col := 0; col < 1<<uint(config.PastryBase); col++ {
+			point := o.constraint(row, col)
+			if pre, dig := prefix(o.nodeId, point); point.Cmp(o.nodeId) != 0 && (pre != row || dig != col) {
+				t.Fatalf("constraint %d/%d: prefix mismatch: have %d/%d.", row, col, pre, dig)
+			}
+			shift := uint(config.PastrySpace - (row+1)*config.PastryBase)
+			digit := new(big.Int).Lsh(big.NewInt(1<<uint(config.PastryBase)-1), shift)
+			if new(big.Int).AndNot(new(big.Int).Xor(point, o.nodeId), digit).Sign() != 0 {
+				t.Fatalf("constraint %d/%d: other digits changed: have %x, want %x.", row, col, point, o.nodeId)
+			}
+		}
+	}
+}
+
+func TestDensity(t *testing.T) {
+	// Save the previous config values
+	secure, leaves := config.PastrySecureRouting, config.PastryLeaves
+	defer func() { config.PastrySecureRouting, config.PastryLeaves = secure, leaves }()
+
+	config.PastrySecureRouting, config.PastryLeaves = true, 4
+
+	// Create a node with an evenly spaced leaf set
+	o := &Overlay{nodeId: big.NewInt(1 << 30)}
+	o.routes = newRoutingTable(o.nodeId)
+	o.routes.leaves = []*big.Int{big.NewInt(1<<30 - 2<<20), big.NewInt(1<<30 - 1<<20), o.nodeId, big.NewInt(1<<30 + 1<<20), big.NewInt(1<<30 + 2<<20)}
+
+	// Similarly dense states should be accepted
+	src := &peer{nodeId: big.NewInt(1 << 32)}
+	fair := &state{Addrs: map[string][]string{}}
+	for i := int64(-2); i <= 2; i++ {
+		fair.Addrs[big.NewInt(1<<32+i<<20).String()] = nil
+	}
+	if o.suspicious(src, fair) {
+		t.Fatalf("fairly dense state distrusted.")
+	}
+	// Packed states should be refused
+	packed := &state{Addrs: map[string][]string{}}
+	for i := int64(-2); i <= 2; i++ {
+		packed.Addrs[big.NewInt(1<<32+i).String()] = nil
+	}
+	if !o.suspicious(src, packed) {
+		t.Fatalf("packed state trusted.")
+	}
+	if n := o.Stats().Suspects; n != 1 {
+		t.Fatalf("suspect count mismatch: have %d, want %d.", n, 1)
+	}
+}
+
+func TestSecureRouting(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	secure, leaves := config.PastrySecureRouting, config.PastryLeaves
+	defer func() { config.PastrySecureRouting, config.PastryLeaves = secure, leaves }()
+	config.PastrySecureRouting, config.PastryLeaves = true, 4
+
+	// Use enough nodes with small leaf sets for multi-hop routes to appear
+	nodes := 16
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Start a batch of nodes, each able to drop everything passing through
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	drops := []*dropper{}
+	live := []*Overlay{}
+	for i := 0; i < nodes; i++ {
+		drops = append(drops, &dropper{collector: collector{delivs: []*proto.Message{}}})
+		live = append(live, New(appId, key, drops[i]))
+	}
+	for _, node := range live {
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer node.Shutdown()
+	}
+	time.Sleep(2 * time.Second)
+
+	// Routes may change during convergence, so allow a few attempts
+	for attempt := 0; ; attempt++ {
+		if attempt == 3 {
+			t.Fatalf("replicated messages failed to route around the dropper.")
+		}
+		src, dst, mid := findDetour(live)
+		if mid == -1 {
+			t.Fatalf("no multi-hop route found between %d nodes.", nodes)
+		}
+		atomic.StoreInt32(&drops[mid].active, 1)
+
+		// Single path messages through the intermediate dropper should be lost
+		msg := &proto.Message{Data: []byte{byte(src)}}
+		msg.Encrypt()
+		live[src].Send(live[dst].nodeId, msg)
+
+		time.Sleep(250 * time.Millisecond)
+		drops[dst].lock.RLock()
+		lost := len(drops[dst].delivs) == 0
+		drops[dst].lock.RUnlock()
+
+		// Replicated messages should route around the dropper
+		delivered := false
+		if lost {
+			replicas := make([]*proto.Message, 2)
+			for i := range replicas {
+				replicas[i] = &proto.Message{Data: []byte{byte(src)}}
+				replicas[i].Encrypt()
+			}
+			live[src].SendReplicated(live[dst].nodeId, replicas)
+
+			time.Sleep(250 * time.Millisecond)
+			drops[dst].lock.RLock()
+			delivered = len(drops[dst].delivs) == 1
+			drops[dst].lock.RUnlock()
+		}
+		atomic.StoreInt32(&drops[mid].active, 0)
+		if delivered {
+			break
+		}
+		t.Logf("attempt %d: route %d -> %d -> %d changed (lost: %v), retrying.", attempt, src, mid, dst, lost)
+
+		drops[dst].lock.Lock()
+		drops[dst].delivs = drops[dst].delivs[:0]
+		drops[dst].lock.Unlock()
+		time.Sleep(time.Second)
+	}
+}
+
+// Finds a route between two nodes with an intermediate hop, where the source
+// has an alternate first hop delivering directly to the destination. Returns
+// the indices of the source, destination and intermediate nodes (-1 if none).
+func findDetour(live []*Overlay) (int, int, int) {
+	index := make(map[string]int)
+	for i, node := range live {
+		index[node.nodeId.String()] = i
+	}
+	for s := range live {
+		for d := range live {
+			if s == d {
+				continue
+			}
+			dest := live[d].nodeId
+
+			live[s].lock.RLock()
+			hop := live[s].next(dest)
+			alts := live[s].alternates(dest, hop, 1)
+			live[s].lock.RUnlock()
+
+			if hop.Cmp(dest) == 0 || hop.Cmp(live[s].nodeId) == 0 || len(alts) == 0 {
+				continue
+			}
+			alt := live[index[alts[0].nodeId.String()]]
+			alt.lock.RLock()
+			direct := alt == live[d] || alt.next(dest).Cmp(dest) == 0
+			alt.lock.RUnlock()
+
+			if direct {
+				return s, d, index[hop.String()]
+			}
+		}
+	}
+	return -1, -1, -1
+}
@@ -22,15 +22,55 @@
 package pastry
 
 import (
+	"fmt"
 	"io"
 	"math/big"
+	"sync/atomic"
 
 	"github.com/project-iris/iris/config"
 )
 
-var modulo = new(big.Int).SetBit(new(big.Int), config.PastrySpace, 1)
-var posmid = new(big.Int).Rsh(modulo, 1)
-var negmid = new(big.Int).Mul(posmid, big.NewInt(-1))
+// Id space size and its signed midpoints, cached for the configured space.
+type bounds struct {
+	space  int
+	modulo *big.Int
+	posmid *big.Int
+	negmid *big.Int
+}
+
+var spaceBounds atomic.Value
+
+// Retrieves the bounds of the identifier space, recalculating them if the space
+// was reconfigured since the last use.
+func limits() *bounds {
+	if b, ok := spaceBounds.Load().(*bounds); ok && b.space == config.PastrySpace {
+		return b
+	}
+	b := &bounds{space: config.PastrySpace}
+	b.modulo = new(big.Int).SetBit(new(big.Int), b.space, 1)
+	b.posmid = new(big.Int).Rsh(b.modulo, 1)
+	b.negmid = new(big.Int).Neg(b.posmid)
+
+	spaceBounds.Store(b)
+	return b
+}
+
+// Verifies that the runtime configured overlay parameters are usable: the id
+// space must be split into whole digits and fit into the id resolver's hash,
+// whereas the leaf set must contain the same number of nodes on both sides.
+func checkParams() error {
+	switch {
+	case config.PastryBase < 1 || config.PastryBase > 8:
+		return fmt.Errorf("invalid routing base: have %d, want [1-8]", config.PastryBase)
+	case config.PastrySpace < config.PastryBase || config.PastrySpace%config.PastryBase != 0:
+		return fmt.Errorf("invalid id space: have %d, want multiple of %d", config.PastrySpace, config.PastryBase)
+	case config.PastrySpace > 8*config.PastryResolver().Size():
+		return fmt.Errorf("invalid id space: have %d, want at most %d", config.PastrySpace, 8*config.PastryResolver().Size())
+	case config.PastryLeaves < 2 || config.PastryLeaves%2 != 0:
+		return fmt.Errorf("invalid leaf set size: have %d, want positive even", config.PastryLeaves)
+	}
+	return nil
+}
 
 // Special id slice implementing sort.Interface.
 type idSlice struct {
@@ -57,12 +97,14 @@ func (p idSlice) Swap(i, j int) {
 
 // Calculates the signed distance between two ids on the circular ID space
 func delta(a, b *big.Int) *big.Int {
+	lim := limits()
+
 	d := new(big.Int).Sub(b, a)
 	switch {
-	case posmid.Cmp(d) < 0:
-		d.Sub(d, modulo)
-	case negmid.Cmp(d) > 0:
-		d.Add(d, modulo)
+	case lim.posmid.Cmp(d) < 0:
+		d.Sub(d, lim.modulo)
+	case lim.negmid.Cmp(d) > 0:
+		d.Add(d, lim.modulo)
 	}
 	return d
 }
@@ -96,10 +138,14 @@ func Resolve(id string) *big.Int {
 	sum := h.Sum(nil)
 
 	// Extract enough bits, and clear overflows
-	raw := sum[:(config.PastrySpace+7)/8]
+	return truncate(sum[:(config.PastrySpace+7)/8])
+}
+
+// Converts a raw byte slice of enough length into an overlay id, clearing the
+// bits overflowing the id space.
+func truncate(raw []byte) *big.Int {
 	for i := 0; i < len(raw)*8-config.PastrySpace; i++ {
 		raw[0] &= ^byte(1 << (7 - uint(i)))
 	}
-	// Return the new id
 	return new(big.Int).SetBytes(raw)
 }
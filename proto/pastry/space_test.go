@@ -39,6 +39,8 @@ type spaceTest struct {
 
 var one = big.NewInt(1)
 
+var modulo, posmid, negmid = limits().modulo, limits().posmid, limits().negmid
+
 // The tests assume the default 4 bit digits!
 var spaceTests = []spaceTest{
 	// Simple startup cases
@@ -126,3 +128,37 @@ func TestResolve(t *testing.T) {
 		}
 	}
 }
+
+type paramsTest struct {
+	space  int
+	base   int
+	leaves int
+	valid  bool
+}
+
+var paramsTests = []paramsTest{
+	{40, 4, 8, true},
+	{64, 4, 32, true},
+	{128, 8, 16, true},
+	{128, 1, 2, true},
+	{40, 3, 8, false},  // Space not divisible into digits
+	{40, 0, 8, false},  // No routing digits
+	{48, 16, 8, false}, // Digits too wide
+	{256, 4, 8, false}, // Space wider than the resolver
+	{40, 4, 7, false},  // Asymmetric leaf set
+	{40, 4, 0, false},  // Empty leaf set
+}
+
+func TestParams(t *testing.T) {
+	// Save the previous config values
+	s, b, l := config.PastrySpace, config.PastryBase, config.PastryLeaves
+	defer func() { config.PastrySpace, config.PastryBase, config.PastryLeaves = s, b, l }()
+
+	// Run the tests
+	for i, tt := range paramsTests {
+		config.PastrySpace, config.PastryBase, config.PastryLeaves = tt.space, tt.base, tt.leaves
+		if err := checkParams(); (err == nil) != tt.valid {
+			t.Errorf("test %d: validity mismatch: have %v, want %v.", i, err, tt.valid)
+		}
+	}
+}
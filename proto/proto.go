@@ -25,6 +25,20 @@ import (
 	"io"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/buffer"
+	"github.com/project-iris/iris/proto/codec"
+)
+
+// Quality of service class of a message, lower values being more urgent.
+type Priority uint8
+
+// Priority classes of the messages. Anything not explicitly tagged by the
+// application is considered system traffic.
+const (
+	PrioControl     Priority = iota // System and coordination traffic
+	PrioInteractive                 // Latency sensitive application traffic
+	PrioBulk                        // Throughput oriented, delay tolerant traffic
+	Priorities                      // Number of priority classes
 )
 
 // Baseline message headers.
@@ -32,12 +46,50 @@ type Header struct {
 	Meta interface{} // Metadata usable by upper network layers
 	Key  []byte      // AES key if the payload is encrypted (nil otherwise)
 	Iv   []byte      // Counter mode nonce if the payload is encrypted (nil otherwise)
+	Comp bool        // Whether the plaintext payload is compressed
+	Prio Priority    // Quality of service class of the message
+}
+
+// Serializes the header fields into the binary codec.
+func (h *Header) MarshalCodec(e *codec.Encoder) {
+	e.Meta(1, h.Meta)
+	e.Bytes(2, h.Key)
+	e.Bytes(3, h.Iv)
+	e.Bool(4, h.Comp)
+	e.Uint(5, uint64(h.Prio))
+}
+
+// Deserializes the header fields from the binary codec.
+func (h *Header) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			h.Meta = d.Meta()
+		case 2:
+			h.Key = d.Bytes()
+		case 3:
+			h.Iv = d.Bytes()
+		case 4:
+			h.Comp = d.Bool()
+		case 5:
+			// Unknown classes are demoted to bulk (not truncated, e.g. 256 to control)
+			if prio := d.Uint(); prio < uint64(Priorities) {
+				h.Prio = Priority(prio)
+			} else {
+				h.Prio = PrioBulk
+			}
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
 }
 
 // Iris message consisting of the payload and attached headers.
 type Message struct {
-	Head Header // Baseline headers
-	Data []byte // Payload in plain or ciphertext form
+	Head Header         // Baseline headers
+	Data []byte         // Payload in plain or ciphertext form
+	Buf  *buffer.Buffer // Pooled buffer backing the payload (nil if unmanaged)
 
 	secure bool // Flag specifying whether the data segment was encrypted or not
 }
@@ -69,7 +121,8 @@ func (m *Message) Encrypt() error {
 	return nil
 }
 
-// Decrypts a ciphertext message using the given key and IV.
+// Decrypts a ciphertext message using the given key and IV, decompressing the
+// payload if it was compressed before encryption.
 func (m *Message) Decrypt() error {
 	// Create the stream cipher for decryption
 	block, err := config.PacketCipher(m.Head.Key)
@@ -82,7 +135,29 @@ func (m *Message) Decrypt() error {
 	stream.XORKeyStream(m.Data, m.Data)
 	m.Head.Key = nil
 	m.Head.Iv = nil
-	return nil
+
+	return m.Decompress()
+}
+
+// Retains the pooled payload buffer (if any) for an additional owner. Needed by
+// everyone keeping the message beyond a synchronous call (e.g. send queues).
+func (m *Message) Retain() {
+	if m.Buf != nil {
+		m.Buf.Retain()
+	}
+}
+
+// Releases a reference to the pooled payload buffer (if any).
+func (m *Message) Release() {
+	if m.Buf != nil {
+		m.Buf.Release()
+	}
+}
+
+// Detaches the payload from the buffer pool, handing its ownership over to the
+// garbage collector. Used when the payload is passed to code outside the stack.
+func (m *Message) Detach() {
+	m.Buf = nil
 }
 
 // Internal, used by the link package to verify security.
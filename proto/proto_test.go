@@ -22,6 +22,8 @@ import (
 	"crypto/rand"
 	"io"
 	"testing"
+
+	"github.com/project-iris/iris/proto/codec"
 )
 
 func TestCrypto(t *testing.T) {
@@ -184,3 +186,32 @@ func benchmarkDecrypt(b *testing.B, block int) {
 		msgs[i].Decrypt()
 	}
 }
+
+// Header with a raw, unchecked priority field.
+type rawPrioHeader uint64
+
+func (h rawPrioHeader) MarshalCodec(e *codec.Encoder) {
+	e.Uint(5, uint64(h))
+}
+
+func (h rawPrioHeader) UnmarshalCodec(d *codec.Decoder) error {
+	return nil
+}
+
+func TestPriorityDecode(t *testing.T) {
+	tests := []struct {
+		wire uint64
+		prio Priority
+	}{
+		{0, PrioControl}, {1, PrioInteractive}, {2, PrioBulk}, {3, PrioBulk}, {256, PrioBulk},
+	}
+	for i, tt := range tests {
+		head := new(Header)
+		if err := codec.Decode(codec.NewEncoder().Encode(rawPrioHeader(tt.wire)), head); err != nil {
+			t.Fatalf("test %d: failed to decode header: %v.", i, err)
+		}
+		if head.Prio != tt.prio {
+			t.Errorf("test %d: priority mismatch: have %v, want %v.", i, head.Prio, tt.prio)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// This file contains the publish acknowledgement logic. Every node of the topic
+// tree reached by an acknowledged publish waits for the confirmations of its
+// subtree and its local deliveries, after which the sum is reported one hop up
+// towards the entry point of the publish, and from there to the origin node.
+//
+// To ensure that partial results arrive before the origin gives up, each hop
+// reduces the aggregation time of its children by a small allowance. Should a
+// subtree still miss its parent's deadline (e.g. slow links), the confirmations
+// are forwarded upwards as late increments, included by any ancestor still
+// aggregating.
+
+package scribe
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Delivery acknowledgement infos of a publish.
+type ack struct {
+	Origin *big.Int      // Node initiating the acknowledged publish
+	Id     uint64        // Origin-unique identifier of the publish
+	Time   time.Duration // Time allowance to aggregate the subtree confirmations
+	Count  int           // Number of deliveries confirmed in a subtree (reports)
+	Final  bool          // Flag whether the report is the aggregate of the whole tree
+	Late   bool          // Flag whether the report arrived after the subtree's deadline
+}
+
+// Acknowledgement aggregator of a single publish in the local node.
+type aggregate struct {
+	parent *big.Int    // Node to report the aggregated confirmations to
+	info   *ack        // Acknowledgement infos of the publish
+	final  bool        // Whether the aggregate is reported straight to the origin
+	count  int         // Number of deliveries confirmed so far
+	pend   int         // Number of confirmations still pending
+	timer  *time.Timer // Deadline timer to report even if incomplete (or to expire)
+	done   bool        // Whether the aggregate was already reported upstream
+}
+
+// Confirmation handle of an acknowledged publish delivered locally.
+type Ack struct {
+	owner *Overlay  // Overlay aggregating the acknowledgements
+	key   string    // Identifier of the aggregation to confirm into
+	once  sync.Once // Ensures a single confirmation per delivery
+}
+
+// Reports the number of local deliveries of an acknowledged publish. Only the
+// first confirmation is considered, subsequent ones are discarded.
+func (a *Ack) Confirm(count int) {
+	a.once.Do(func() { a.owner.collect(a.key, count, false) })
+}
+
+// Generates the aggregation identifier of an acknowledged publish.
+func ackKey(info *ack) string {
+	return fmt.Sprintf("%v:%d", info.Origin, info.Id)
+}
+
+// Creates the acknowledgement infos to attach to the publishes forwarded down
+// the topic tree, reserving some time for the local report.
+func (a *ack) child() *ack {
+	return &ack{
+		Origin: a.Origin,
+		Id:     a.Id,
+		Time:   a.Time - config.ScribeAckHopTime,
+	}
+}
+
+// Starts aggregating the acknowledgements of a publish caught by the local node
+// and returns the handle through which local deliveries can be confirmed.
+func (o *Overlay) aggregate(parent *big.Int, info *ack, final bool, pend int) *Ack {
+	key := ackKey(info)
+
+	o.ackLock.Lock()
+	if _, ok := o.ackAggr[key]; ok {
+		// Duplicate delivery (churn?), let the original aggregator count
+		o.ackLock.Unlock()
+		if !final {
+			o.sendAck(parent, &ack{Origin: info.Origin, Id: info.Id})
+		}
+		return &Ack{owner: o}
+	}
+	aggr := &aggregate{
+		parent: parent,
+		info:   info,
+		final:  final,
+		pend:   pend,
+	}
+	o.ackAggr[key] = aggr
+	if pend > 0 {
+		aggr.timer = time.AfterFunc(info.Time, func() { o.report(key) })
+	}
+	o.ackLock.Unlock()
+
+	// If nothing to wait for, report straight away
+	if pend == 0 {
+		o.report(key)
+	}
+	return &Ack{owner: o, key: key}
+}
+
+// Inserts a number of confirmations into a live aggregation, reporting the
+// results upstream if nothing else is pending. Late confirmations don't count
+// as pending ones, and the ones arriving after the report are passed upwards.
+func (o *Overlay) collect(key string, count int, late bool) {
+	o.ackLock.Lock()
+	aggr, ok := o.ackAggr[key]
+	if !ok {
+		// Aggregation already reported to the origin or expired
+		o.ackLock.Unlock()
+		return
+	}
+	if aggr.done {
+		// Aggregation already reported (timeout), forward the late confirmations
+		o.ackLock.Unlock()
+		if count > 0 {
+			o.sendAck(aggr.parent, &ack{Origin: aggr.info.Origin, Id: aggr.info.Id, Count: count, Late: true})
+		}
+		return
+	}
+	aggr.count += count
+	if !late {
+		aggr.pend--
+	}
+	done := aggr.pend <= 0
+	o.ackLock.Unlock()
+
+	if done {
+		o.report(key)
+	}
+}
+
+// Terminates an aggregation and reports the collected confirmations upstream.
+// Intermediate aggregations linger for their original time allowance to pass
+// up any late confirmations, whereas the final report is all the origin waits.
+func (o *Overlay) report(key string) {
+	o.ackLock.Lock()
+	aggr, ok := o.ackAggr[key]
+	if ok && !aggr.done {
+		if aggr.timer != nil {
+			aggr.timer.Stop()
+		}
+		if aggr.final {
+			delete(o.ackAggr, key)
+		} else {
+			aggr.done = true
+			aggr.timer = time.AfterFunc(aggr.info.Time, func() { o.expire(key) })
+		}
+	} else {
+		ok = false
+	}
+	o.ackLock.Unlock()
+
+	if !ok {
+		return
+	}
+	rep := &ack{
+		Origin: aggr.info.Origin,
+		Id:     aggr.info.Id,
+		Count:  aggr.count,
+		Final:  aggr.final,
+	}
+	if aggr.parent.Cmp(o.pastry.Self()) == 0 {
+		if err := o.handleAck(rep); err != nil {
+			log.Printf("scribe: failed to handle local acknowledgement: %v.", err)
+		}
+	} else {
+		o.sendAck(aggr.parent, rep)
+	}
+}
+
+// Drops a reported aggregation after it stopped accepting late confirmations.
+func (o *Overlay) expire(key string) {
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	if aggr, ok := o.ackAggr[key]; ok && aggr.done {
+		delete(o.ackAggr, key)
+	}
+}
+
+// Handles an acknowledgement report, either inserting it into a pending local
+// aggregation, or finalizing a locally originated publish.
+func (o *Overlay) handleAck(info *ack) error {
+	// If the whole tree was aggregated, notify the pending publish
+	if info.Final {
+		if info.Origin.Cmp(o.pastry.Self()) != 0 {
+			return fmt.Errorf("final report at non-origin node: have %v, want %v", o.pastry.Self(), info.Origin)
+		}
+		o.ackLock.Lock()
+		res, ok := o.ackPend[info.Id]
+		o.ackLock.Unlock()
+		if !ok {
+			return errors.New("acknowledged publish already timed out")
+		}
+		select {
+		case res <- info.Count:
+		default:
+			return errors.New("duplicate final acknowledgement")
+		}
+		return nil
+	}
+	// Otherwise collect the subtree confirmations
+	o.collect(ackKey(info), info.Count, info.Late)
+	return nil
+}
+
+// Drops all the pending aggregations during termination.
+func (o *Overlay) dropAcks() {
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	for key, aggr := range o.ackAggr {
+		if aggr.timer != nil {
+			aggr.timer.Stop()
+		}
+		delete(o.ackAggr, key)
+	}
+}
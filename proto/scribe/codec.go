@@ -0,0 +1,187 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the binary codec serializers of the scribe headers.
+
+package scribe
+
+import (
+	"math/big"
+
+	"github.com/project-iris/iris/proto/codec"
+)
+
+// Load report of a single topic in a capacity report.
+type reportEntry struct {
+	Top *big.Int
+	Cap int
+}
+
+// Serializes the scribe header.
+func (h *header) MarshalCodec(e *codec.Encoder) {
+	e.Meta(1, h.Meta)
+	e.Uint(2, uint64(h.Op))
+	e.BigInt(3, h.Sender)
+	e.BigInt(4, h.Topic)
+	e.BigInt(5, h.Prev)
+	e.Message(6, h.Report)
+	e.Message(7, h.Ack)
+	e.Message(8, h.Lease)
+	e.Uint(9, h.Replica)
+}
+
+// Deserializes the scribe header.
+func (h *header) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			h.Meta = d.Meta()
+		case 2:
+			h.Op = opcode(d.Uint())
+		case 3:
+			h.Sender = d.BigInt()
+		case 4:
+			h.Topic = d.BigInt()
+		case 5:
+			h.Prev = d.BigInt()
+		case 6:
+			h.Report = new(report)
+			d.Message(h.Report)
+		case 7:
+			h.Ack = new(ack)
+			d.Message(h.Ack)
+		case 8:
+			h.Lease = new(lease)
+			d.Message(h.Lease)
+		case 9:
+			h.Replica = d.Uint()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the capacity report, pairing up the topics and capacities.
+func (r *report) MarshalCodec(e *codec.Encoder) {
+	for i, top := range r.Tops {
+		e.Message(1, &reportEntry{top, r.Caps[i]})
+	}
+}
+
+// Deserializes the capacity report.
+func (r *report) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			entry := new(reportEntry)
+			d.Message(entry)
+			r.Tops = append(r.Tops, entry.Top)
+			r.Caps = append(r.Caps, entry.Cap)
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes a single topic load report.
+func (r *reportEntry) MarshalCodec(e *codec.Encoder) {
+	e.BigInt(1, r.Top)
+	e.Int(2, int64(r.Cap))
+}
+
+// Deserializes a single topic load report.
+func (r *reportEntry) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			r.Top = d.BigInt()
+		case 2:
+			r.Cap = int(d.Int())
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the publish acknowledgement infos.
+func (a *ack) MarshalCodec(e *codec.Encoder) {
+	e.BigInt(1, a.Origin)
+	e.Uint(2, a.Id)
+	e.Duration(3, a.Time)
+	e.Int(4, int64(a.Count))
+	e.Bool(5, a.Final)
+	e.Bool(6, a.Late)
+}
+
+// Deserializes the publish acknowledgement infos.
+func (a *ack) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			a.Origin = d.BigInt()
+		case 2:
+			a.Id = d.Uint()
+		case 3:
+			a.Time = d.Duration()
+		case 4:
+			a.Count = int(d.Int())
+		case 5:
+			a.Final = d.Bool()
+		case 6:
+			a.Late = d.Bool()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes a lease operation or state.
+func (l *lease) MarshalCodec(e *codec.Encoder) {
+	e.String(1, l.Name)
+	e.String(2, l.Holder)
+	e.Duration(3, l.TTL)
+	e.Uint(4, l.Fence)
+	e.Uint(5, l.Id)
+	e.Bool(6, l.Granted)
+}
+
+// Deserializes a lease operation or state.
+func (l *lease) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			l.Name = d.String()
+		case 2:
+			l.Holder = d.String()
+		case 3:
+			l.TTL = d.Duration()
+		case 4:
+			l.Fence = d.Uint()
+		case 5:
+			l.Id = d.Uint()
+		case 6:
+			l.Granted = d.Bool()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
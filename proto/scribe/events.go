@@ -55,6 +55,18 @@
 //    As the name suggests, direct messages have a precise destination. Only the
 //    true recipient must handle it. Delivery to a non-precise destination means
 //    either the destination terminated, or pastry's mis-delivered (churn?).
+//
+//  - Acknowledgement:
+//    Acknowledged publishes are distributed exactly as simple ones, but each
+//    node of the tree aggregates the delivery confirmations of its subtree and
+//    reports them to the previous hop. The entry point of the publish reports
+//    the final count directly to the origin node.
+//
+//  - Lease:
+//    Lock operations are routed towards the lock's name and served by the node
+//    they are delivered to. State changes are replicated to the leaf set, which
+//    holds the candidates to take over the lock after a failure. Results and
+//    replicas use precise addressing.
 
 package scribe
 
@@ -99,6 +111,11 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 		if hand, err := o.handlePublish(msg, head.Topic, head.Prev); !hand || err != nil {
 			// Simple race condition between unsubscribe and publish, left in for debug
 			log.Printf("scribe: %v failed to handle delivered publish (churn?): %v %v.", o.pastry.Self(), hand, err)
+
+			// Notify the origin of an acknowledged publish not to wait in vain
+			if !hand && head.Ack != nil && head.Prev == nil {
+				o.sendAck(head.Sender, &ack{Origin: head.Ack.Origin, Id: head.Ack.Id, Final: true})
+			}
 		}
 	case opBalance:
 		// Non-virgin balances must be delivered precisely
@@ -128,6 +145,25 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 		if err := o.handleDirect(msg); err != nil {
 			log.Printf("scribe: failed to handle direct message: %v.", err)
 		}
+	case opAck:
+		// Acknowledgements are always addressed precisely, drop any other
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: acknowledgement delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		if err := o.handleAck(head.Ack); err != nil {
+			log.Printf("scribe: failed to handle publish acknowledgement: %v.", err)
+		}
+	case opLock, opUnlock:
+		// Lease operations are served by whoever is closest to the lock
+		o.handleLease(head.Op, head.Sender, head.Lease)
+	case opLockRep, opLockSync, opLockQuery, opLockState:
+		// Lease results and replicas are always addressed precisely, drop any other
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: lease message delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		o.handleLease(head.Op, head.Sender, head.Lease)
 	default:
 		log.Printf("unknown opcode received: %v, %v", head.Op, head)
 	}
@@ -144,6 +180,12 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 		if head.Sender.Cmp(o.pastry.Self()) == 0 {
 			return true
 		}
+		// Pastry routes by prefix, so the local node might be farther from the topic
+		// than the subscriber, which would deny it as its parent. Pass such requests
+		// on towards the root untouched instead of registering a child never joining.
+		if pastry.Distance(o.pastry.Self(), key).Cmp(pastry.Distance(head.Sender, key)) > 0 {
+			return true
+		}
 		// Integrate the subscription locally
 		if err := o.handleSubscribe(head.Sender, key); err != nil {
 			// A failure most probably means double subscription caused by a race
@@ -264,18 +306,38 @@ func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *b
 	// Get the batch of nodes to broadcast to
 	nodes, local := top.Broadcast(prevHop), false
 	owner := o.pastry.Self()
+
+	remotes := make([]*big.Int, 0, len(nodes))
 	for _, id := range nodes {
 		if id.Cmp(owner) != 0 {
-			// Create a copy since overlay will modify headers
-			cpy := new(proto.Message)
-			*cpy = *msg
-			cpy.Head.Meta = head.copy()
-
-			o.fwdPublish(id, cpy)
+			remotes = append(remotes, id)
 		} else {
 			local = true
 		}
 	}
+	// If acknowledgement was requested, start aggregating the confirmations
+	var ack *Ack
+	if head.Ack != nil {
+		pend := len(remotes)
+		if local {
+			pend++
+		}
+		if prevHop != nil {
+			ack = o.aggregate(prevHop, head.Ack, false, pend)
+		} else {
+			ack = o.aggregate(head.Sender, head.Ack, true, pend)
+		}
+	}
+	for _, id := range remotes {
+		// Create a copy since overlay will modify headers (payload is shared)
+		cpy := new(proto.Message)
+		*cpy = *msg
+		cpy.Head.Meta = head.copy()
+		if head.Ack != nil {
+			cpy.Head.Meta.(*header).Ack = head.Ack.child()
+		}
+		o.fwdPublish(id, cpy)
+	}
 	// If local subscription is present, decrypt and deliver
 	if local {
 		// Assemble a fresh copy for decryption
@@ -289,9 +351,16 @@ func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *b
 		// Decrypt the message and deliver upstream
 		if err := plain.Decrypt(); err != nil {
 			// Cannot decrypt, report handled and also the error
+			if ack != nil {
+				ack.Confirm(0)
+			}
 			return true, err
 		}
-		o.app.HandlePublish(head.Sender, topName, plain)
+		if ack != nil {
+			o.app.HandlePublishAck(head.Sender, topName, plain, ack)
+		} else {
+			o.app.HandlePublish(head.Sender, topName, plain)
+		}
 	}
 	return true, nil
 }
@@ -319,26 +388,36 @@ func (o *Overlay) handleBalance(msg *proto.Message, topicId *big.Int, prevHop *b
 		o.fwdBalance(node, msg)
 		return true, nil
 	}
-	// Remove all carrier headers and decrypt
+	// Discard any further copies of replicated balances
 	head := msg.Head.Meta.(*header)
+	if o.duplicate(head) {
+		return true, nil
+	}
+	// Remove all carrier headers and decrypt
 	msg.Head.Meta = head.Meta
 	if err := msg.Decrypt(); err != nil {
 		return true, err
 	}
 	// Deliver to the application on the specific topic
+	msg.Detach()
 	o.app.HandleBalance(head.Sender, topName, msg)
 	return true, nil
 }
 
 // Handles the receiving of a direct message and delivers the contents upstream.
 func (o *Overlay) handleDirect(msg *proto.Message) error {
-	// Remove all scribe headers and decrypt contents
+	// Discard any further copies of replicated messages
 	head := msg.Head.Meta.(*header)
+	if o.duplicate(head) {
+		return nil
+	}
+	// Remove all scribe headers and decrypt contents
 	msg.Head.Meta = head.Meta
 	if err := msg.Decrypt(); err != nil {
 		return err
 	}
 	// Deliver the message upstream
+	msg.Detach()
 	o.app.HandleDirect(head.Sender, msg)
 	return nil
 }
@@ -89,6 +89,8 @@ func (o *Overlay) Beat() {
 			go o.sendSubscribe(top.Self())
 		}
 	}
+	// Replicate the served locks to the current leaf set
+	go o.maintainLeases()
 }
 
 // Implements the heat.Callback.Dead method, monitoring the death events of
@@ -0,0 +1,407 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// This file contains the lease based distributed lock service. Each lock is
+// owned by the node closest to the resolved lock name (the root), which grants,
+// renews and releases the leases. Every state change is replicated to the leaf
+// set of the root, which contains the nodes that would take over the lock if the
+// root failed. Roots additionally re-replicate their locks on every heartbeat to
+// cover leaf set changes.
+//
+// Each ownership change of a lock increments its fence version, which is also
+// used by the replicas to discard stale state updates.
+//
+// A root receiving an operation on a lock it has no state for (e.g. the lock got
+// reassigned to it before any replica arrived) first pulls the state from its
+// leaf set, queueing the operations meanwhile. If not all neighbors report back
+// in time, the queued operations are refused instead of granting a lock that may
+// still be held, and the next operation retries the pull.
+
+package scribe
+
+import (
+	"errors"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Lease service errors.
+var ErrLocked = errors.New("locked")
+var ErrInvalidTTL = errors.New("invalid lease duration")
+
+// Distributed lock operation or state.
+type lease struct {
+	Name    string        // Textual name of the lock
+	Holder  string        // Identifier of the lease holder (empty if free)
+	TTL     time.Duration // Requested lease duration, or the remaining time (replicas)
+	Fence   uint64        // Ownership version of the lock
+	Id      uint64        // Origin-unique identifier of the operation
+	Granted bool          // Whether the operation succeeded (replies)
+}
+
+// State of a single lock in the local node.
+type lockState struct {
+	holder string    // Identifier of the lease holder (empty if free)
+	expiry time.Time // Expiration time of the lease
+	fence  uint64    // Ownership version of the lock
+	root   bool      // Whether the local node served the lock
+
+	pulls  map[string]struct{} // Leaf set neighbors yet to report the state (nil if not pulling)
+	queued []*leaseOp          // Operations waiting for the state pull to finish
+}
+
+// Lease operation queued at the root until the lock state is pulled.
+type leaseOp struct {
+	op     opcode   // Lock or unlock operation
+	origin *big.Int // Node originating the operation
+	info   *lease   // Operation details
+}
+
+// Checks whether the lock is currently held by anybody.
+func (l *lockState) held() bool {
+	return l.holder != "" && time.Now().Before(l.expiry)
+}
+
+// Acquires (or renews if already held by the same holder) the lease of a lock
+// for the given duration. The fence version of the ownership is returned, or
+// ErrLocked if somebody else holds the lease. Leases shorter than the configured
+// minimum are refused with ErrInvalidTTL.
+func (o *Overlay) Acquire(name string, holder string, ttl time.Duration, timeout time.Duration) (uint64, error) {
+	if ttl < config.ScribeLeaseMinTTL {
+		return 0, ErrInvalidTTL
+	}
+	res, err := o.leaseRequest(opLock, &lease{Name: name, Holder: holder, TTL: ttl}, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if !res.Granted {
+		return 0, ErrLocked
+	}
+	return res.Fence, nil
+}
+
+// Releases the lease of a lock held by holder. ErrLocked is returned if the
+// lease is held by somebody else.
+func (o *Overlay) Release(name string, holder string, timeout time.Duration) error {
+	res, err := o.leaseRequest(opUnlock, &lease{Name: name, Holder: holder}, timeout)
+	if err != nil {
+		return err
+	}
+	if !res.Granted {
+		return ErrLocked
+	}
+	return nil
+}
+
+// Sends a lease operation to the root of the lock and waits for the result.
+func (o *Overlay) leaseRequest(op opcode, info *lease, timeout time.Duration) (*lease, error) {
+	// Register the pending operation
+	res := make(chan *lease, 1)
+
+	o.leaseLock.Lock()
+	info.Id = o.leaseIdx
+	o.leaseIdx++
+	o.leasePend[info.Id] = res
+	o.leaseLock.Unlock()
+
+	defer func() {
+		o.leaseLock.Lock()
+		delete(o.leasePend, info.Id)
+		o.leaseLock.Unlock()
+	}()
+	// Send the operation and wait for the result
+	o.sendLease(op, info)
+
+	select {
+	case rep := <-res:
+		return rep, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Checks whether the local node has the state of a lock it is asked to serve,
+// and if not, queues the operation and pulls the state from the leaf set. The
+// returned flag reports whether the operation was queued.
+func (o *Overlay) pullLease(op opcode, origin *big.Int, info *lease) bool {
+	o.leaseLock.Lock()
+	state, ok := o.leaseLive[info.Name]
+	if ok && state.pulls == nil {
+		o.leaseLock.Unlock()
+		return false
+	}
+	if ok {
+		state.queued = append(state.queued, &leaseOp{op, origin, info})
+		o.leaseLock.Unlock()
+		return true
+	}
+	// Unknown lock, serve straight away if there is nobody to ask
+	leaves := o.pastry.Leaves()
+	if len(leaves) == 0 {
+		o.leaseLock.Unlock()
+		return false
+	}
+	state = &lockState{
+		root:   true,
+		pulls:  make(map[string]struct{}),
+		queued: []*leaseOp{{op, origin, info}},
+	}
+	for _, leaf := range leaves {
+		state.pulls[leaf.String()] = struct{}{}
+	}
+	o.leaseLive[info.Name] = state
+	o.leaseLock.Unlock()
+
+	for _, leaf := range leaves {
+		o.sendLeaseQuery(leaf, info.Name)
+	}
+	time.AfterFunc(config.ScribeLeasePullTimeout, func() { o.abortPull(info.Name, state) })
+	return true
+}
+
+// Handles a lock state request from a new root, reporting the local state (or
+// a blank one with a zero fence if none is known).
+func (o *Overlay) handleLockQuery(origin *big.Int, info *lease) {
+	o.leaseLock.Lock()
+	rep := &lease{Name: info.Name}
+	if state, ok := o.leaseLive[info.Name]; ok && state.pulls == nil {
+		rep = o.leaseReplica(info.Name, state)
+	}
+	o.leaseLock.Unlock()
+
+	o.sendLeaseState(origin, rep)
+}
+
+// Handles a lock state reported by a leaf set neighbor, adopting it if newer
+// than the one collected so far. After all neighbors reported, the queued
+// operations are served.
+func (o *Overlay) handleLockState(sender *big.Int, info *lease) {
+	o.leaseLock.Lock()
+	state, ok := o.leaseLive[info.Name]
+	if !ok || state.pulls == nil {
+		o.leaseLock.Unlock()
+		return
+	}
+	if _, ok := state.pulls[sender.String()]; !ok {
+		o.leaseLock.Unlock()
+		return
+	}
+	delete(state.pulls, sender.String())
+	if info.Fence > state.fence {
+		state.holder = info.Holder
+		state.expiry = time.Now().Add(info.TTL)
+		state.fence = info.Fence
+	}
+	if len(state.pulls) > 0 {
+		o.leaseLock.Unlock()
+		return
+	}
+	queued := state.queued
+	state.pulls, state.queued = nil, nil
+	o.leaseLock.Unlock()
+
+	for _, op := range queued {
+		o.handleLease(op.op, op.origin, op.info)
+	}
+}
+
+// Gives up on a lock state pull not completed in time, refusing the queued
+// operations and dropping the partial state, so the next operation retries.
+func (o *Overlay) abortPull(name string, state *lockState) {
+	o.leaseLock.Lock()
+	if o.leaseLive[name] != state || state.pulls == nil {
+		o.leaseLock.Unlock()
+		return
+	}
+	delete(o.leaseLive, name)
+	queued := state.queued
+	o.leaseLock.Unlock()
+
+	log.Printf("scribe: failed to pull state of lock %v, refusing %d operations.", name, len(queued))
+	for _, op := range queued {
+		o.sendLeaseReply(op.origin, &lease{Name: name, Id: op.info.Id})
+	}
+}
+
+// Handles a lease acquisition or renewal at the root of the lock, replying to
+// the origin with the result and replicating any state change.
+func (o *Overlay) handleLock(origin *big.Int, info *lease) {
+	o.leaseLock.Lock()
+	state, ok := o.leaseLive[info.Name]
+	if !ok {
+		state = new(lockState)
+		o.leaseLive[info.Name] = state
+	}
+	state.root = true
+
+	// Grant the lease if free or already owned (never with a bogus duration)
+	granted := info.TTL >= config.ScribeLeaseMinTTL && (!state.held() || state.holder == info.Holder)
+	if granted {
+		if state.holder != info.Holder || !state.held() {
+			state.fence++
+		}
+		state.holder = info.Holder
+		state.expiry = time.Now().Add(info.TTL)
+	}
+	rep := &lease{Name: info.Name, Holder: state.holder, Fence: state.fence, Id: info.Id, Granted: granted}
+	sync := o.leaseReplica(info.Name, state)
+	o.leaseLock.Unlock()
+
+	if granted {
+		o.replicate(sync)
+	}
+	o.sendLeaseReply(origin, rep)
+}
+
+// Handles a lease release at the root of the lock, replying to the origin with
+// the result and replicating any state change.
+func (o *Overlay) handleUnlock(origin *big.Int, info *lease) {
+	o.leaseLock.Lock()
+	state, ok := o.leaseLive[info.Name]
+	if !ok {
+		state = new(lockState)
+		o.leaseLive[info.Name] = state
+	}
+	state.root = true
+
+	// Releasing a free lock is a no-op, but someone else's is denied
+	granted, changed := true, false
+	if state.held() {
+		if state.holder == info.Holder {
+			state.holder, state.expiry, changed = "", time.Now(), true
+			state.fence++
+		} else {
+			granted = false
+		}
+	}
+	rep := &lease{Name: info.Name, Holder: state.holder, Fence: state.fence, Id: info.Id, Granted: granted}
+	sync := o.leaseReplica(info.Name, state)
+	o.leaseLock.Unlock()
+
+	if changed {
+		o.replicate(sync)
+	}
+	o.sendLeaseReply(origin, rep)
+}
+
+// Handles the result of a locally originated lease operation.
+func (o *Overlay) handleLockReply(info *lease) error {
+	o.leaseLock.Lock()
+	res, ok := o.leasePend[info.Id]
+	o.leaseLock.Unlock()
+
+	if !ok {
+		return errors.New("lease operation already timed out")
+	}
+	select {
+	case res <- info:
+		return nil
+	default:
+		return errors.New("duplicate lease operation result")
+	}
+}
+
+// Handles a lease state replica arriving from the root of the lock. Stale
+// updates (lower fence version) are discarded.
+func (o *Overlay) handleLockSync(info *lease) {
+	o.leaseLock.Lock()
+	defer o.leaseLock.Unlock()
+
+	state, ok := o.leaseLive[info.Name]
+	if !ok {
+		state = new(lockState)
+		o.leaseLive[info.Name] = state
+	}
+	if ok && info.Fence < state.fence {
+		return
+	}
+	state.holder = info.Holder
+	state.expiry = time.Now().Add(info.TTL)
+	state.fence = info.Fence
+	state.root = false
+}
+
+// Assembles the replica of a lock state. The method assumes the lease lock is
+// held by the caller.
+func (o *Overlay) leaseReplica(name string, state *lockState) *lease {
+	return &lease{
+		Name:   name,
+		Holder: state.holder,
+		TTL:    state.expiry.Sub(time.Now()),
+		Fence:  state.fence,
+	}
+}
+
+// Sends a lease state replica to all the leaf set neighbors.
+func (o *Overlay) replicate(info *lease) {
+	for _, leaf := range o.pastry.Leaves() {
+		o.sendLeaseSync(leaf, info)
+	}
+}
+
+// Re-replicates the locks served by the local node and drops the long expired
+// states. Invoked periodically by the heartbeat mechanism.
+func (o *Overlay) maintainLeases() {
+	syncs := []*lease{}
+
+	o.leaseLock.Lock()
+	for name, state := range o.leaseLive {
+		if state.pulls != nil {
+			continue
+		}
+		if time.Since(state.expiry) > config.ScribeLeaseLinger {
+			delete(o.leaseLive, name)
+			continue
+		}
+		if state.root {
+			syncs = append(syncs, o.leaseReplica(name, state))
+		}
+	}
+	o.leaseLock.Unlock()
+
+	for _, sync := range syncs {
+		o.replicate(sync)
+	}
+}
+
+// Handles a lease message delivered to the local node.
+func (o *Overlay) handleLease(op opcode, sender *big.Int, info *lease) {
+	switch op {
+	case opLock, opUnlock:
+		if o.pullLease(op, sender, info) {
+			return
+		}
+		if op == opLock {
+			o.handleLock(sender, info)
+		} else {
+			o.handleUnlock(sender, info)
+		}
+	case opLockRep:
+		if err := o.handleLockReply(info); err != nil {
+			log.Printf("scribe: failed to handle lease result: %v.", err)
+		}
+	case opLockSync:
+		o.handleLockSync(info)
+	case opLockQuery:
+		o.handleLockQuery(sender, info)
+	case opLockState:
+		o.handleLockState(sender, info)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"log"
 	"math/big"
 	"sync"
+	"time"
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/heart"
@@ -35,10 +36,12 @@ import (
 
 // Custom topic error messages
 var ErrSubscribed = errors.New("already subscribed")
+var ErrTimeout = errors.New("timeout")
 
 // Callback for events leaving the overlay network.
 type Callback interface {
 	HandlePublish(sender *big.Int, topic string, msg *proto.Message)
+	HandlePublishAck(sender *big.Int, topic string, msg *proto.Message, ack *Ack)
 	HandleBalance(sender *big.Int, topic string, msg *proto.Message)
 	HandleDirect(sender *big.Int, msg *proto.Message)
 }
@@ -54,6 +57,21 @@ type Overlay struct {
 	topics map[string]*topic.Topic // Topics active in the local node
 	names  map[string]string       // Mapping from topic id to its textual name
 
+	ackIdx  uint64                // Index to assign the next acknowledged publish
+	ackPend map[uint64]chan int   // Locally originated publishes waiting for acks
+	ackAggr map[string]*aggregate // Acknowledgements being aggregated locally
+	ackLock sync.Mutex            // Mutex to protect the acknowledgement state
+
+	leaseIdx  uint64                 // Index to assign the next lease operation
+	leasePend map[uint64]chan *lease // Locally originated lease operations waiting for results
+	leaseLive map[string]*lockState  // Locks served or replicated by the local node
+	leaseLock sync.Mutex             // Mutex to protect the lease state
+
+	replIdx   uint64               // Index to assign the next replicated message
+	replSeen  map[string]time.Time // Replicated messages seen locally, with their expiry
+	replPrune int                  // Size of the seen set triggering the next eviction
+	replLock  sync.Mutex           // Mutex to protect the replication state
+
 	lock sync.RWMutex
 }
 
@@ -64,6 +82,16 @@ func New(overId string, key *rsa.PrivateKey, app Callback) *Overlay {
 		app:    app,
 		topics: make(map[string]*topic.Topic),
 		names:  make(map[string]string),
+
+		ackPend: make(map[uint64]chan int),
+		ackAggr: make(map[string]*aggregate),
+
+		leasePend: make(map[uint64]chan *lease),
+		leaseLive: make(map[string]*lockState),
+
+		replIdx:   replicaSeed(),
+		replSeen:  make(map[string]time.Time),
+		replPrune: 64,
 	}
 	o.pastry = pastry.New(overId, key, o)
 	o.heart = heart.New(config.ScribeBeatPeriod, config.ScribeKillCount, o)
@@ -96,11 +124,19 @@ func (o *Overlay) Shutdown() error {
 	}
 	o.lock.RUnlock()
 
+	// Drop any pending acknowledgements
+	o.dropAcks()
+
 	// Terminate the heartbeat mechanism and shut down pastry
 	o.heart.Terminate()
 	return o.pastry.Shutdown()
 }
 
+// Returns the overlay id of the local node.
+func (o *Overlay) Self() *big.Int {
+	return o.pastry.Self()
+}
+
 // Subscribes to the specified scribe topic.
 func (o *Overlay) Subscribe(topic string) error {
 	// Resolve the topic id
@@ -135,8 +171,16 @@ func (o *Overlay) Unsubscribe(topic string) error {
 	return o.handleUnsubscribe(o.pastry.Self(), id)
 }
 
+// Compresses an outbound payload before encryption, if enabled.
+func (o *Overlay) compress(msg *proto.Message) {
+	if config.SessionCompress {
+		msg.Compress()
+	}
+}
+
 // Publishes a message into topic to be broadcast to everyone.
 func (o *Overlay) Publish(topic string, msg *proto.Message) error {
+	o.compress(msg)
 	if err := msg.Encrypt(); err != nil {
 		return err
 	}
@@ -144,8 +188,47 @@ func (o *Overlay) Publish(topic string, msg *proto.Message) error {
 	return nil
 }
 
+// Publishes a message into topic to be broadcast to everyone, waiting for the
+// subscribers to confirm the delivery. The number of confirmations aggregated
+// within the timeout is returned.
+func (o *Overlay) PublishAck(topic string, msg *proto.Message, timeout time.Duration) (int, error) {
+	o.compress(msg)
+	if err := msg.Encrypt(); err != nil {
+		return 0, err
+	}
+	// Register the pending acknowledgement
+	res := make(chan int, 1)
+
+	o.ackLock.Lock()
+	id := o.ackIdx
+	o.ackIdx++
+	o.ackPend[id] = res
+	o.ackLock.Unlock()
+
+	defer func() {
+		o.ackLock.Lock()
+		delete(o.ackPend, id)
+		o.ackLock.Unlock()
+	}()
+	// Send the publish and wait for the aggregated confirmations
+	info := &ack{
+		Origin: o.pastry.Self(),
+		Id:     id,
+		Time:   timeout - config.ScribeAckHopTime,
+	}
+	o.sendPublishAck(pastry.Resolve(topic), msg, info)
+
+	select {
+	case count := <-res:
+		return count, nil
+	case <-time.After(timeout):
+		return 0, ErrTimeout
+	}
+}
+
 // Balances a message to one of the subscribed nodes.
 func (o *Overlay) Balance(topic string, msg *proto.Message) error {
+	o.compress(msg)
 	if err := msg.Encrypt(); err != nil {
 		return err
 	}
@@ -153,11 +236,36 @@ func (o *Overlay) Balance(topic string, msg *proto.Message) error {
 	return nil
 }
 
+// Balances a message to one of the subscribed nodes, sending it along multiple
+// overlay paths to survive hops dropping it during churn. The copies are tagged
+// so that nodes discard any duplicates, but copies caught by different topic
+// tree nodes may reach different members: the delivery is at least once.
+func (o *Overlay) BalanceReplicated(topic string, msg *proto.Message, copies int) error {
+	o.compress(msg)
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendBalanceReplicated(pastry.Resolve(topic), msg, o.replicaId(), copies)
+	return nil
+}
+
 // Sends a direct message to a known node.
 func (o *Overlay) Direct(dest *big.Int, msg *proto.Message) error {
+	o.compress(msg)
 	if err := msg.Encrypt(); err != nil {
 		return err
 	}
 	o.sendDirect(dest, msg)
 	return nil
 }
+
+// Sends a direct message to a known node along multiple overlay paths, the node
+// discarding any duplicates.
+func (o *Overlay) DirectReplicated(dest *big.Int, msg *proto.Message, copies int) error {
+	o.compress(msg)
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendDirectReplicated(dest, msg, o.replicaId(), copies)
+	return nil
+}
@@ -26,6 +26,7 @@ import (
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/pastry"
 )
 
 type collector struct {
@@ -42,6 +43,11 @@ func (c *collector) HandlePublish(sender *big.Int, topic string, msg *proto.Mess
 	c.publish = append(c.publish, msg)
 }
 
+func (c *collector) HandlePublishAck(sender *big.Int, topic string, msg *proto.Message, ack *Ack) {
+	c.HandlePublish(sender, topic, msg)
+	ack.Confirm(1)
+}
+
 func (c *collector) HandleBalance(sender *big.Int, topic string, msg *proto.Message) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -158,6 +164,72 @@ func TestPublish(t *testing.T) {
 	}
 }
 
+// Tests whether acknowledged publishes aggregate the delivery confirmations.
+func TestPublishAck(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+	pubs := 10
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start a single scribe node
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start up the scribe nodes, subscribing every second one
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := make([]*Overlay, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		live = append(live, node)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate scribe node: %v.", err)
+			}
+		}(node)
+
+		if i%2 == 0 {
+			if err := node.Subscribe(topicId); err != nil {
+				t.Fatalf("failed to subscribe to topic: %v.", err)
+			}
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Publish from every node and verify the confirmation counts
+	subs := (nodes + 1) / 2
+	for i := 0; i < nodes; i++ {
+		for j := 0; j < pubs; j++ {
+			msg := &proto.Message{
+				Data: []byte{byte(i)},
+			}
+			if n, err := live[i].PublishAck(topicId, msg, time.Second); err != nil {
+				t.Fatalf("failed to publish into topic: %v.", err)
+			} else if n != subs {
+				t.Fatalf("confirmation count mismatch: have %v, want %v.", n, subs)
+			}
+		}
+	}
+	if n := len(coll.publish); n != nodes*pubs*subs {
+		t.Fatalf("arrive event mismatch: have %v, want %v", n, nodes*pubs*subs)
+	}
+}
+
 // Tests whether topic balancing work as expected.
 func TestBalance(t *testing.T) {
 	// Override the overlay configuration
@@ -354,3 +426,261 @@ func TestDirect(t *testing.T) {
 		time.Sleep(time.Second)
 	}
 }
+
+func TestLease(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start the scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{}
+	live := make(map[int]*Overlay)
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		live[i] = node
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+	}
+	defer func() {
+		for _, node := range live {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate scribe node: %v.", err)
+			}
+		}
+	}()
+	time.Sleep(time.Second)
+
+	// Acquire the lock and verify exclusivity
+	fence, err := live[0].Acquire("lock", "alice", 5*time.Second, time.Second)
+	if err != nil {
+		t.Fatalf("failed to acquire free lock: %v.", err)
+	}
+	if _, err := live[1].Acquire("lock", "bob", 5*time.Second, time.Second); err != ErrLocked {
+		t.Fatalf("lock acquisition error mismatch: have %v, want %v.", err, ErrLocked)
+	}
+	if err := live[1].Release("lock", "bob", time.Second); err != ErrLocked {
+		t.Fatalf("foreign release error mismatch: have %v, want %v.", err, ErrLocked)
+	}
+	if renew, err := live[2].Acquire("lock", "alice", 5*time.Second, time.Second); err != nil {
+		t.Fatalf("failed to renew lease: %v.", err)
+	} else if renew != fence {
+		t.Fatalf("renewal fence mismatch: have %v, want %v.", renew, fence)
+	}
+	// Locate the root of the lock and the node taking over after it
+	dest := pastry.Resolve("lock")
+
+	root, next := -1, -1
+	for i, node := range live {
+		if root == -1 || pastry.Distance(node.Self(), dest).Cmp(pastry.Distance(live[root].Self(), dest)) < 0 {
+			root, next = i, root
+		} else if next == -1 || pastry.Distance(node.Self(), dest).Cmp(pastry.Distance(live[next].Self(), dest)) < 0 {
+			next = i
+		}
+	}
+	// Wait until the lease is replicated to the successor, as the leaf set of the
+	// root might not have contained it yet during the operations
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		live[next].leaseLock.Lock()
+		state, ok := live[next].leaseLive["lock"]
+		synced := ok && state.holder == "alice" && state.fence == fence
+		live[next].leaseLock.Unlock()
+
+		if synced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lease failed to replicate to the successor of the root.")
+		}
+	}
+	// Terminate the root of the lock and verify that the lease survived
+	if err := live[root].Shutdown(); err != nil {
+		t.Fatalf("failed to terminate scribe node: %v.", err)
+	}
+	delete(live, root)
+
+	time.Sleep(time.Second)
+
+	for _, node := range live {
+		if _, err := node.Acquire("lock", "bob", 5*time.Second, time.Second); err != ErrLocked {
+			t.Fatalf("failed-over lock acquisition error mismatch: have %v, want %v.", err, ErrLocked)
+		}
+		if err := node.Release("lock", "alice", time.Second); err != nil {
+			t.Fatalf("failed to release lease: %v.", err)
+		}
+		if next, err := node.Acquire("lock", "bob", 5*time.Second, time.Second); err != nil {
+			t.Fatalf("failed to acquire released lock: %v.", err)
+		} else if next <= fence {
+			t.Fatalf("fence not increasing: have %v, want > %v.", next, fence)
+		}
+		if err := node.Release("lock", "bob", time.Second); err != nil {
+			t.Fatalf("failed to release lease: %v.", err)
+		}
+		break
+	}
+}
+
+// Tests that a lock held while its root changes is neither granted to somebody
+// else, nor reset to a lower fence by the new root.
+func TestLeaseHandover(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 4
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i <= nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start the scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{}
+	live := make([]*Overlay, 0, nodes+1)
+	defer func() {
+		for _, node := range live {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate scribe node: %v.", err)
+			}
+		}
+	}()
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	fence, err := live[0].Acquire("lock", "alice", 5*time.Second, time.Second)
+	if err != nil {
+		t.Fatalf("failed to acquire free lock: %v.", err)
+	}
+	// Join a node sitting exactly at the lock id, taking over as its root
+	spec := config.PastryNodeId
+	config.PastryNodeId = "name:lock"
+	root := New(overId, key, coll)
+	config.PastryNodeId = spec
+
+	if _, err := root.Boot(); err != nil {
+		t.Fatalf("failed to boot new lock root: %v.", err)
+	}
+	live = append(live, root)
+
+	// Forget any replica that made it over already, forcing a state pull
+	root.leaseLock.Lock()
+	delete(root.leaseLive, "lock")
+	root.leaseLock.Unlock()
+
+	if _, err := root.Acquire("lock", "bob", 5*time.Second, time.Second); err != ErrLocked {
+		t.Fatalf("handed over lock acquisition error mismatch: have %v, want %v.", err, ErrLocked)
+	}
+	if renew, err := live[1].Acquire("lock", "alice", 5*time.Second, time.Second); err != nil {
+		t.Fatalf("failed to renew handed over lease: %v.", err)
+	} else if renew != fence {
+		t.Fatalf("renewal fence mismatch: have %v, want %v.", renew, fence)
+	}
+	root.leaseLock.Lock()
+	state, ok := root.leaseLive["lock"]
+	served := ok && state.root && state.holder == "alice"
+	root.leaseLock.Unlock()
+	if !served {
+		t.Fatalf("lock not taken over by the new root.")
+	}
+	// Release the lease and ensure fencing continues upwards
+	if err := live[2].Release("lock", "alice", time.Second); err != nil {
+		t.Fatalf("failed to release lease: %v.", err)
+	}
+	if next, err := live[3].Acquire("lock", "bob", 5*time.Second, time.Second); err != nil {
+		t.Fatalf("failed to acquire released lock: %v.", err)
+	} else if next <= fence {
+		t.Fatalf("fence not increasing: have %v, want > %v.", next, fence)
+	}
+}
+
+// Tests whether replicated messages are delivered exactly once.
+func TestReplicated(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+	msgs := 100
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start the scribe nodes, one collecting everything
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := make([]*Overlay, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		app := coll
+		if i > 0 {
+			app = new(collector)
+		}
+		node := New(overId, key, app)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer func() {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate scribe node: %v.", err)
+			}
+		}()
+		live = append(live, node)
+	}
+	if err := live[0].Subscribe("replicated"); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	// Send a batch of replicated direct and balance messages
+	for i := 0; i < msgs; i++ {
+		msg := &proto.Message{Data: []byte{byte(i)}}
+		if err := live[nodes-1].DirectReplicated(live[0].Self(), msg, 3); err != nil {
+			t.Fatalf("failed to send replicated direct message: %v.", err)
+		}
+		msg = &proto.Message{Data: []byte{byte(i)}}
+		if err := live[nodes-1].BalanceReplicated("replicated", msg, 3); err != nil {
+			t.Fatalf("failed to send replicated balance message: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+
+	if n := len(coll.direct); n != msgs {
+		t.Fatalf("direct delivery mismatch: have %v, want %v.", n, msgs)
+	}
+	if n := len(coll.balance); n != msgs {
+		t.Fatalf("balance delivery mismatch: have %v, want %v.", n, msgs)
+	}
+}
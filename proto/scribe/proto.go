@@ -20,10 +20,11 @@
 package scribe
 
 import (
-	"encoding/gob"
 	"math/big"
 
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/codec"
+	"github.com/project-iris/iris/proto/pastry"
 )
 
 // Scribe operation code type.
@@ -37,6 +38,13 @@ const (
 	opBalance                   // Topic balance
 	opReport                    // Load report
 	opDirect                    // Direct send
+	opAck                       // Publish acknowledgement
+	opLock                      // Lease acquisition or renewal
+	opUnlock                    // Lease release
+	opLockRep                   // Lease operation result
+	opLockSync                  // Lease state replication
+	opLockQuery                 // Lease state request of a new lock root
+	opLockState                 // Lease state reported to a new lock root
 )
 
 // Extra headers for the scribe.
@@ -50,6 +58,10 @@ type header struct {
 	Topic  *big.Int // Topic id used during unsubscribing, broadcasting and balancing
 	Prev   *big.Int // Previous hop inside topic to prevent optimize routes
 	Report *report  // CPU load/capacity report
+	Ack    *ack     // Delivery acknowledgement of a publish
+	Lease  *lease   // Distributed lock operation or state
+
+	Replica uint64 // Origin-unique id of a replicated message (0 if single path)
 }
 
 // Creates a copy of the header needed by the broadcast.
@@ -59,9 +71,9 @@ func (h *header) copy() *header {
 	return cpy
 }
 
-// Make sure the header struct is registered with gob.
+// Make sure the header struct is registered with the codec.
 func init() {
-	gob.Register(&header{})
+	codec.Register(5, &header{})
 }
 
 // Envelopes a scribe header into the generic packet container and sends it to
@@ -91,6 +103,31 @@ func (o *Overlay) sendDataPacket(dest *big.Int, head *header, msg *proto.Message
 	o.pastry.Send(dest, msg)
 }
 
+// Envelopes a scribe header into an existing packet container and sends it to
+// its destination along multiple paths via the overlay transport. Each replica
+// gets its own header, as in-flight hops may modify it (e.g. catching a balance
+// in the topic tree), and its own payload, as a local delivery decrypts it in
+// place while the other replicas may still be queued for sending.
+func (o *Overlay) sendReplicatedPacket(dest *big.Int, head *header, msg *proto.Message, copies int) {
+	// Add the origin node and envelope the original meta
+	head.Sender = o.pastry.Self()
+	head.Meta = msg.Head.Meta
+
+	// Create the replicas and fire away
+	replicas := make([]*proto.Message, 0, copies)
+	for i := 0; i < copies || i == 0; i++ {
+		cpy := new(proto.Message)
+		*cpy = *msg
+		cpy.Head.Meta = head.copy()
+		if i > 0 {
+			cpy.Data = append([]byte(nil), msg.Data...)
+			cpy.Buf = nil
+		}
+		replicas = append(replicas, cpy)
+	}
+	o.pastry.SendReplicated(dest, replicas)
+}
+
 // Forwards a scribe message to a new destination, leaving the original message
 // intact, except inserting the local node as the previous hop.
 func (o *Overlay) fwdDataPacket(dest *big.Int, msg *proto.Message) {
@@ -117,6 +154,13 @@ func (o *Overlay) sendPublish(topicId *big.Int, msg *proto.Message) {
 	o.sendDataPacket(topicId, &header{Op: opPublish, Topic: topicId}, msg)
 }
 
+// Assembles an acknowledged topic publish message, consisting of the publish
+// opcode, the destination topic and the acknowledgement infos to aggregate the
+// delivery confirmations with.
+func (o *Overlay) sendPublishAck(topicId *big.Int, msg *proto.Message, info *ack) {
+	o.sendDataPacket(topicId, &header{Op: opPublish, Topic: topicId, Ack: info}, msg)
+}
+
 // Reroutes a publish message to a new destination to traverse the topic tree
 // directly instead of going up till he root and back down.
 func (o *Overlay) fwdPublish(dest *big.Int, msg *proto.Message) {
@@ -130,6 +174,12 @@ func (o *Overlay) sendBalance(topicId *big.Int, msg *proto.Message) {
 	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId}, msg)
 }
 
+// Assembles a replicated topic balance message, tagged with the replica id to
+// deduplicate with, and sends it along multiple paths towards the topic.
+func (o *Overlay) sendBalanceReplicated(topicId *big.Int, msg *proto.Message, id uint64, copies int) {
+	o.sendReplicatedPacket(topicId, &header{Op: opBalance, Topic: topicId, Replica: id}, msg, copies)
+}
+
 // Reroutes a balanced message to a new destination to traverse the topic tree
 // directly instead of going up till he root and back down.
 func (o *Overlay) fwdBalance(dest *big.Int, msg *proto.Message) {
@@ -145,3 +195,40 @@ func (o *Overlay) sendReport(nodeId *big.Int, rep *report) {
 func (o *Overlay) sendDirect(dest *big.Int, msg *proto.Message) {
 	o.sendDataPacket(dest, &header{Op: opDirect}, msg)
 }
+
+// Sends out a replicated message directed to a specific node.
+func (o *Overlay) sendDirectReplicated(dest *big.Int, msg *proto.Message, id uint64, copies int) {
+	o.sendReplicatedPacket(dest, &header{Op: opDirect, Replica: id}, msg, copies)
+}
+
+// Assembles a publish acknowledgement report and sends it to the aggregating
+// parent node.
+func (o *Overlay) sendAck(dest *big.Int, info *ack) {
+	o.sendPacket(dest, &header{Op: opAck, Ack: info})
+}
+
+// Assembles a lease operation (acquire, renew or release) and sends it towards
+// the root node of the lock.
+func (o *Overlay) sendLease(op opcode, info *lease) {
+	o.sendPacket(pastry.Resolve(info.Name), &header{Op: op, Lease: info})
+}
+
+// Assembles the result of a lease operation and sends it back to the origin.
+func (o *Overlay) sendLeaseReply(dest *big.Int, info *lease) {
+	o.sendPacket(dest, &header{Op: opLockRep, Lease: info})
+}
+
+// Assembles a lease state replica and sends it to a leaf set neighbor.
+func (o *Overlay) sendLeaseSync(dest *big.Int, info *lease) {
+	o.sendPacket(dest, &header{Op: opLockSync, Lease: info})
+}
+
+// Requests the state of a lock from a leaf set neighbor.
+func (o *Overlay) sendLeaseQuery(dest *big.Int, name string) {
+	o.sendPacket(dest, &header{Op: opLockQuery, Lease: &lease{Name: name}})
+}
+
+// Reports the local state of a lock to the root requesting it.
+func (o *Overlay) sendLeaseState(dest *big.Int, info *lease) {
+	o.sendPacket(dest, &header{Op: opLockState, Lease: info})
+}
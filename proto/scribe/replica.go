@@ -0,0 +1,97 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// This file contains the replicated routing of critical messages. A replicated
+// balance or direct message is sent along multiple overlay paths, each copy
+// tagged with the same origin-unique identifier. Every node delivering a copy
+// to its application remembers the tag for a while and discards any further
+// copies, so a message surviving on any of the paths is delivered, but only
+// once per node. The identifiers start from a random offset on every boot, so
+// a restarted node reusing its persistent id cannot have its fresh messages
+// discarded as copies of ones sent before the restart.
+//
+// Note, replicated balances caught by different topic tree nodes may still be
+// delivered to different members, so the delivery is at least once. Nodes may
+// not deduplicate while balancing, as a message can legitimately pass through
+// the same node twice inside the topic tree.
+
+package scribe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Generates the deduplication identifier of a replicated message.
+func replicaKey(sender *big.Int, id uint64) string {
+	return fmt.Sprintf("%v:%d", sender, id)
+}
+
+// Generates a random starting point for the replica identifiers of this boot.
+func replicaSeed() uint64 {
+	var seed [8]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate replica seed: %v.", err))
+	}
+	return binary.BigEndian.Uint64(seed[:])
+}
+
+// Reserves a new origin-unique identifier for a replicated message. Zero marks
+// non replicated messages, so it is skipped on wrap around.
+func (o *Overlay) replicaId() uint64 {
+	o.replLock.Lock()
+	defer o.replLock.Unlock()
+
+	o.replIdx++
+	if o.replIdx == 0 {
+		o.replIdx++
+	}
+	return o.replIdx
+}
+
+// Checks whether a replicated message was already seen by the local node, also
+// marking it as seen if not. Non replicated messages are never duplicates.
+func (o *Overlay) duplicate(head *header) bool {
+	if head.Replica == 0 {
+		return false
+	}
+	key := replicaKey(head.Sender, head.Replica)
+	now := time.Now()
+
+	o.replLock.Lock()
+	defer o.replLock.Unlock()
+
+	if expiry, ok := o.replSeen[key]; ok && now.Before(expiry) {
+		return true
+	}
+	// Evict the expired entries once in a while, and mark the new message
+	if len(o.replSeen) >= o.replPrune {
+		for k, expiry := range o.replSeen {
+			if !now.Before(expiry) {
+				delete(o.replSeen, k)
+			}
+		}
+		o.replPrune = 2*len(o.replSeen) + 64
+	}
+	o.replSeen[key] = now.Add(config.ScribeReplicaMemory)
+	return false
+}
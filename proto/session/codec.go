@@ -0,0 +1,126 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+
+// Contains the binary codec serializers of the session handshake packets.
+
+package session
+
+import "github.com/project-iris/iris/proto/codec"
+
+// Serializes the session initiation request.
+func (r *initRequest) MarshalCodec(e *codec.Encoder) {
+	e.Message(1, r.Auth)
+	e.Message(2, r.Link)
+}
+
+// Deserializes the session initiation request.
+func (r *initRequest) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			r.Auth = new(authRequest)
+			d.Message(r.Auth)
+		case 2:
+			r.Link = new(linkRequest)
+			d.Message(r.Link)
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the authentication request.
+func (r *authRequest) MarshalCodec(e *codec.Encoder) {
+	e.BigInt(1, r.Exp)
+	e.Bool(2, r.Compress)
+}
+
+// Deserializes the authentication request.
+func (r *authRequest) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			r.Exp = d.BigInt()
+		case 2:
+			r.Compress = d.Bool()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the authentication challenge.
+func (c *authChallenge) MarshalCodec(e *codec.Encoder) {
+	e.BigInt(1, c.Exp)
+	e.Bytes(2, c.Token)
+	e.Bool(3, c.Compress)
+}
+
+// Deserializes the authentication challenge.
+func (c *authChallenge) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			c.Exp = d.BigInt()
+		case 2:
+			c.Token = d.Bytes()
+		case 3:
+			c.Compress = d.Bool()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the authentication response.
+func (r *authResponse) MarshalCodec(e *codec.Encoder) {
+	e.Bytes(1, r.Token)
+}
+
+// Deserializes the authentication response.
+func (r *authResponse) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			r.Token = d.Bytes()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Serializes the data link request.
+func (r *linkRequest) MarshalCodec(e *codec.Encoder) {
+	e.Int(1, r.Id)
+}
+
+// Deserializes the data link request.
+func (r *linkRequest) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			r.Id = d.Int()
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
@@ -20,7 +20,6 @@ package session
 import (
 	"crypto/rand"
 	"crypto/rsa"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"log"
@@ -33,6 +32,7 @@ import (
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/crypto/sts"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/codec"
 	"github.com/project-iris/iris/proto/stream"
 )
 
@@ -44,16 +44,20 @@ type initRequest struct {
 }
 
 // Authenticated connection request message. Contains the originators ID for
-// key lookup and the client exponential.
+// key lookup and the client exponential, and whether the client supports
+// payload compression.
 type authRequest struct {
-	Exp *big.Int
+	Exp      *big.Int
+	Compress bool
 }
 
 // Authentication challenge message. Contains the server exponential and the
-// server side auth token (both verification and challenge at the same time).
+// server side auth token (both verification and challenge at the same time),
+// and whether payload compression was accepted.
 type authChallenge struct {
-	Exp   *big.Int
-	Token []byte
+	Exp      *big.Int
+	Token    []byte
+	Compress bool
 }
 
 // Authentication challenge response message. Contains the client side token.
@@ -66,9 +70,9 @@ type linkRequest struct {
 	Id int64
 }
 
-// Make sure the link request packet is registered with gob.
+// Make sure the link request packet is registered with the codec.
 func init() {
-	gob.Register(&linkRequest{})
+	codec.Register(2, &linkRequest{})
 }
 
 // Session listener to accept inbound authenticated sessions.
@@ -173,7 +177,7 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 	switch {
 	case req.Auth != nil:
 		// Authenticate and clean up if unsuccessful
-		secret, err := l.serverAuth(strm, req.Auth)
+		secret, compress, err := l.serverAuth(strm, req.Auth)
 		if err != nil {
 			log.Printf("session: failed to authenticate remote stream: %v.", err)
 			if err = strm.Close(); err != nil {
@@ -183,6 +187,7 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 		}
 		// Create the session and link a data channel to it
 		sess := newSession(strm, secret, true)
+		sess.Compress = compress
 		if err = l.serverLink(sess); err != nil {
 			log.Printf("session: failed to retrieve data link: %v.", err)
 			if err = strm.Close(); err != nil {
@@ -229,15 +234,17 @@ func Dial(host string, port int, key *rsa.PrivateKey) (*Session, error) {
 		return nil, err
 	}
 	// Set up the authenticated session
-	secret, err := clientAuth(strm, key)
+	secret, compress, err := clientAuth(strm, key)
 	if err != nil {
 		log.Printf("session: failed to authenticate connection: %v.", err)
 		if err := strm.Close(); err != nil {
 			log.Printf("session: failed to close unauthenticated connection: %v.", err)
 		}
+		return nil, err
 	}
 	// Link a new data connection to it
 	sess := newSession(strm, secret, false)
+	sess.Compress = compress
 	if err = clientLink(sess); err != nil {
 		log.Printf("session: failed to link data connection: %v.", err)
 		if err := strm.Close(); err != nil {
@@ -248,8 +255,27 @@ func Dial(host string, port int, key *rsa.PrivateKey) (*Session, error) {
 	return sess, nil
 }
 
-// Client side of the STS session negotiation.
-func clientAuth(strm *stream.Stream, key *rsa.PrivateKey) ([]byte, error) {
+// Assembles the session options negotiated during the handshake (compression
+// offer and decision), signed by both sides to prevent downgrades or forced
+// upgrades in transit. Nothing is signed if no option was offered, matching the
+// transcript of peers predating the negotiation.
+func negotiation(offer, accept bool) []byte {
+	if !offer && !accept {
+		return nil
+	}
+	context := []byte{0, 0}
+	if offer {
+		context[0] = 1
+	}
+	if accept {
+		context[1] = 1
+	}
+	return context
+}
+
+// Client side of the STS session negotiation. Returns the agreed secret session
+// key and whether payload compression was negotiated.
+func clientAuth(strm *stream.Stream, key *rsa.PrivateKey) ([]byte, bool, error) {
 	// Set an overall time limit for the handshake to complete
 	strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
 	defer strm.Sock().SetDeadline(time.Time{})
@@ -257,69 +283,75 @@ func clientAuth(strm *stream.Stream, key *rsa.PrivateKey) ([]byte, error) {
 	// Create a new empty session
 	stsSess, err := sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new session: %v", err)
+		return nil, false, fmt.Errorf("failed to create new session: %v", err)
 	}
 	// Initiate a key exchange, send the exponential
 	exp, err := stsSess.Initiate()
 	if err != nil {
-		return nil, fmt.Errorf("failed to initiate key exchange: %v", err)
+		return nil, false, fmt.Errorf("failed to initiate key exchange: %v", err)
 	}
 	req := &initRequest{
-		Auth: &authRequest{exp},
+		Auth: &authRequest{exp, config.SessionCompress},
 	}
 	if err = strm.Send(req); err != nil {
-		return nil, fmt.Errorf("failed to send auth request: %v", err)
+		return nil, false, fmt.Errorf("failed to send auth request: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth request: %v", err)
+		return nil, false, fmt.Errorf("failed to flush auth request: %v", err)
 	}
 	// Receive the foreign exponential and auth token and if verifies, send own auth
 	chall := new(authChallenge)
 	if err = strm.Recv(chall); err != nil {
-		return nil, fmt.Errorf("failed to receive auth challenge: %v", err)
+		return nil, false, fmt.Errorf("failed to receive auth challenge: %v", err)
 	}
+	stsSess.Bind(negotiation(config.SessionCompress, chall.Compress))
 	token, err := stsSess.Verify(rand.Reader, key, &key.PublicKey, chall.Exp, chall.Token)
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify acceptor auth token: %v", err)
+		return nil, false, fmt.Errorf("failed to verify acceptor auth token: %v", err)
 	}
-	if err = strm.Send(authResponse{token}); err != nil {
-		return nil, fmt.Errorf("failed to send auth response: %v", err)
+	if err = strm.Send(&authResponse{token}); err != nil {
+		return nil, false, fmt.Errorf("failed to send auth response: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth response: %v", err)
+		return nil, false, fmt.Errorf("failed to flush auth response: %v", err)
 	}
-	return stsSess.Secret()
+	secret, err := stsSess.Secret()
+	return secret, chall.Compress, err
 }
 
 // Executes the server side authentication and returns either the agreed secret
-// session key or the a failure reason.
-func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest) ([]byte, error) {
+// session key and the compression decision or the a failure reason.
+func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest) ([]byte, bool, error) {
 	// Create a new STS session
 	stsSess, err := sts.New(rand.Reader, config.StsGroup, config.StsGenerator,
 		config.StsCipher, config.StsCipherBits, config.StsSigHash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create STS session: %v", err)
+		return nil, false, fmt.Errorf("failed to create STS session: %v", err)
 	}
 	// Accept the incoming key exchange request and send back own exp + auth token
+	compress := req.Compress && config.SessionCompress
+	stsSess.Bind(negotiation(req.Compress, compress))
+
 	exp, token, err := stsSess.Accept(rand.Reader, l.key, req.Exp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to accept incoming exchange: %v", err)
+		return nil, false, fmt.Errorf("failed to accept incoming exchange: %v", err)
 	}
-	if err = strm.Send(authChallenge{exp, token}); err != nil {
-		return nil, fmt.Errorf("failed to encode auth challenge: %v", err)
+	if err = strm.Send(&authChallenge{exp, token, compress}); err != nil {
+		return nil, false, fmt.Errorf("failed to encode auth challenge: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth challenge: %v", err)
+		return nil, false, fmt.Errorf("failed to flush auth challenge: %v", err)
 	}
 	// Receive the foreign auth token and if verifies conclude session
 	resp := new(authResponse)
 	if err = strm.Recv(resp); err != nil {
-		return nil, fmt.Errorf("failed to decode auth response: %v", err)
+		return nil, false, fmt.Errorf("failed to decode auth response: %v", err)
 	}
 	if err = stsSess.Finalize(&l.key.PublicKey, resp.Token); err != nil {
-		return nil, fmt.Errorf("failed to finalize exchange: %v", err)
+		return nil, false, fmt.Errorf("failed to finalize exchange: %v", err)
 	}
-	return stsSess.Secret()
+	secret, err := stsSess.Secret()
+	return secret, compress, err
 }
 
 // Initializes a data channel linking process, waiting for the data stream to be
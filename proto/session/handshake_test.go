@@ -23,6 +23,8 @@ import (
 	"net"
 	"testing"
 	"time"
+
+	"github.com/project-iris/iris/config"
 )
 
 // Tests whether the session handshake works.
@@ -48,6 +50,10 @@ func TestHandshake(t *testing.T) {
 		// Make sure the server also gets back a live session
 		select {
 		case server := <-sock.Sink:
+			// Verify the compression negotiation
+			if client.Compress != config.SessionCompress || server.Compress != config.SessionCompress {
+				t.Fatalf("compression mismatch: client %v, server %v, want %v.", client.Compress, server.Compress, config.SessionCompress)
+			}
 			// Close the two sessions
 			if err := client.Close(); err != nil {
 				t.Fatalf("failed to close client session: %v.", err)
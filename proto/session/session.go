@@ -35,6 +35,9 @@ type Session struct {
 
 	CtrlLink *link.Link // Network connection for high priority control messages
 	DataLink *link.Link // Network connection for low priority data messages
+
+	Compress bool   // Whether the remote side accepts compressed payloads
+	Binding  []byte // Value unique to the session, to bind upper layer proofs to
 }
 
 // Creates a new, double link session for authenticated data transfer. The
@@ -42,12 +45,18 @@ type Session struct {
 func newSession(conn *stream.Stream, secret []byte, server bool) *Session {
 	// Create the key derivation function
 	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, secret, config.HkdfSalt, config.HkdfInfo)
+	kdf := hkdf.New(hasher, secret, config.HkdfSalt, config.HkdfInfo)
 
+	// Derive the channel binding value from an independent expansion
+	binding := make([]byte, config.HkdfHash.Size())
+	if _, err := io.ReadFull(hkdf.New(hasher, secret, config.HkdfSalt, config.HkdfBindInfo), binding); err != nil {
+		panic(err) // Cannot happen, a single hash is way below the HKDF limit
+	}
 	// Create the encrypted control link
 	return &Session{
-		kdf:      hkdf,
-		CtrlLink: link.New(conn, hkdf, server),
+		kdf:      kdf,
+		CtrlLink: link.New(conn, kdf, server),
+		Binding:  binding,
 	}
 }
 
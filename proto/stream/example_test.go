@@ -74,14 +74,14 @@ func server(live, quit chan struct{}) {
 		case strm := <-sock.Sink:
 			defer strm.Close()
 
-			// Receive and echo back a string
-			var data string
-			if err = strm.Recv(&data); err != nil {
-				fmt.Println("Failed to receive a string object:", err)
+			// Receive and echo back a binary blob
+			var data []byte
+			if err = strm.RecvBinary(&data); err != nil {
+				fmt.Println("Failed to receive a binary blob:", err)
 				continue
 			}
-			if err = strm.Send(&data); err != nil {
-				fmt.Println("Failed to send back a string object:", err)
+			if err = strm.SendBinary(data); err != nil {
+				fmt.Println("Failed to send back a binary blob:", err)
 				continue
 			}
 			if err = strm.Flush(); err != nil {
@@ -103,7 +103,7 @@ func client(msg string, ch chan string) {
 	defer strm.Close()
 
 	// Send the message and receive a reply
-	if err = strm.Send(msg); err != nil {
+	if err = strm.SendBinary([]byte(msg)); err != nil {
 		fmt.Println("Failed to send the message:", err)
 		return
 	}
@@ -111,10 +111,11 @@ func client(msg string, ch chan string) {
 		fmt.Println("Failed to flush the message:", err)
 		return
 	}
-	if err = strm.Recv(&msg); err != nil {
+	var reply []byte
+	if err = strm.RecvBinary(&reply); err != nil {
 		fmt.Println("Failed to receive the reply:", err)
 		return
 	}
 	// Return the reply to the caller and terminate
-	ch <- msg
+	ch <- string(reply)
 }
@@ -15,7 +15,8 @@
 // and conditions contained in a signed written agreement between you and the
 // author(s).
 
-// Package stream wraps a TCP/IP network connection with the Go gob en/decoder.
+// Package stream wraps a TCP/IP network connection with a length prefixed frame
+// protocol, carrying either raw binary blobs or binary codec messages.
 //
 // Note, in case of a serialization error (encoding or decoding failure), it is
 // assumed that there is either a protocol mismatch between the parties, or an
@@ -25,10 +26,16 @@ package stream
 
 import (
 	"bufio"
-	"encoding/gob"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/buffer"
+	"github.com/project-iris/iris/proto/codec"
 )
 
 // Constants for the protocol TCP/IP layer
@@ -42,12 +49,13 @@ type Listener struct {
 	quit   chan chan error  // Termination synchronization channel
 }
 
-// TCP/IP based stream with a gob encoder on top.
+// TCP/IP based stream with a binary frame codec on top.
 type Stream struct {
 	socket  *net.TCPConn      // Network connection to the remote endpoint
 	buffers *bufio.ReadWriter // Buffered access to the network socket
-	encoder *gob.Encoder      // Gob encoder for data serialization
-	decoder *gob.Decoder      // Gob decoder for data deserialization
+	encoder *codec.Encoder    // Binary encoder for message serialization
+	decBuf  []byte            // Buffer for message deserialization
+	sizeBuf []byte            // Buffer for the frame size prefix
 }
 
 // Opens a TCP server socket and returns a stream listener, ready to accept. If
@@ -81,7 +89,7 @@ func (l *Listener) Close() error {
 	return <-errc
 }
 
-// Accepts incoming connection requests, converts them info a TCP/IP gob stream
+// Accepts incoming connection requests, converts them info a TCP/IP frame stream
 // and send them back on the sink channel.
 func (l *Listener) accepter(timeout time.Duration) {
 	var errc chan error
@@ -122,7 +130,7 @@ func (l *Listener) accepter(timeout time.Duration) {
 	errc <- errv
 }
 
-// Creates a new, gob backed network stream based on a live TCP/IP connection.
+// Creates a new, frame based network stream on top of a live TCP/IP connection.
 func newStream(sock *net.TCPConn) *Stream {
 	reader := bufio.NewReader(sock)
 	writer := bufio.NewWriter(sock)
@@ -130,8 +138,8 @@ func newStream(sock *net.TCPConn) *Stream {
 	return &Stream{
 		socket:  sock,
 		buffers: bufio.NewReadWriter(reader, writer),
-		encoder: gob.NewEncoder(writer),
-		decoder: gob.NewDecoder(reader),
+		encoder: codec.NewEncoder(),
+		sizeBuf: make([]byte, binary.MaxVarintLen64),
 	}
 }
 
@@ -149,10 +157,21 @@ func (s *Stream) Sock() *net.TCPConn {
 	return s.socket
 }
 
-// Serializes an object and sends it over the wire. In case of an error, the
+// Serializes a message and sends it over the wire. In case of an error, the
 // connection is torn down.
-func (s *Stream) Send(data interface{}) error {
-	if err := s.encoder.Encode(data); err != nil {
+func (s *Stream) Send(msg codec.Message) error {
+	return s.SendBinary(s.encoder.Encode(msg))
+}
+
+// Sends a raw binary frame over the wire. In case of an error, the connection
+// is torn down.
+func (s *Stream) SendBinary(data []byte) error {
+	n := binary.PutUvarint(s.sizeBuf, uint64(len(data)))
+	if _, err := s.buffers.Write(s.sizeBuf[:n]); err != nil {
+		s.socket.Close()
+		return err
+	}
+	if _, err := s.buffers.Write(data); err != nil {
 		s.socket.Close()
 		return err
 	}
@@ -169,16 +188,71 @@ func (s *Stream) Flush() error {
 	return nil
 }
 
-// Receives a gob of the given type and returns it. If an  error occurs, the
+// Receives a message frame and deserializes it into msg. If an error occurs, the
 // network stream is torn down.
-func (s *Stream) Recv(data interface{}) error {
-	if err := s.decoder.Decode(data); err != nil {
+func (s *Stream) Recv(msg codec.Message) error {
+	if err := s.RecvBinary(&s.decBuf); err != nil {
+		return err
+	}
+	if err := codec.Decode(s.decBuf, msg); err != nil {
+		s.socket.Close()
+		return err
+	}
+	return nil
+}
+
+// Reads the size prefix of the next frame, refusing ones over the allowed limit.
+// If an error occurs, the network stream is torn down.
+func (s *Stream) recvSize() (int, error) {
+	size, err := binary.ReadUvarint(s.buffers)
+	if err != nil {
+		s.socket.Close()
+		return 0, err
+	}
+	if size > uint64(config.StreamMaxFrame) {
+		s.socket.Close()
+		return 0, fmt.Errorf("frame too large: %v > %v", size, config.StreamMaxFrame)
+	}
+	return int(size), nil
+}
+
+// Receives a raw binary frame, reusing the buffer if it has enough capacity. If
+// an error occurs, the network stream is torn down.
+func (s *Stream) RecvBinary(data *[]byte) error {
+	size, err := s.recvSize()
+	if err != nil {
+		return err
+	}
+	if cap(*data) < size {
+		*data = make([]byte, size)
+	}
+	*data = (*data)[:size]
+	if _, err := io.ReadFull(s.buffers, *data); err != nil {
 		s.socket.Close()
 		return err
 	}
 	return nil
 }
 
+// Receives a raw binary frame into a pooled buffer, or nil if the frame was
+// empty. If an error occurs, the network stream is torn down.
+func (s *Stream) RecvBuffer() (*buffer.Buffer, error) {
+	size, err := s.recvSize()
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := buffer.Get(size)
+	if _, err := io.ReadFull(s.buffers, buf.Data); err != nil {
+		buf.Release()
+		s.socket.Close()
+		return nil, err
+	}
+	return buf, nil
+}
+
 // Closes the underlying network connection of a stream.
 func (s *Stream) Close() error {
 	return s.socket.Close()
@@ -18,6 +18,7 @@
 package stream
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -25,8 +26,61 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/project-iris/iris/proto/codec"
 )
 
+// Simple test message with a configurable set of fields.
+type testMessage struct {
+	A, B, C int
+}
+
+func (m *testMessage) MarshalCodec(e *codec.Encoder) {
+	e.Int(1, int64(m.A))
+	e.Int(2, int64(m.B))
+	e.Int(3, int64(m.C))
+}
+
+func (m *testMessage) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			m.A = int(d.Int())
+		case 2:
+			m.B = int(d.Int())
+		case 3:
+			m.C = int(d.Int())
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
+// Test message with a missing field to check unknown field skipping.
+type testPartialMessage struct {
+	A, C int
+}
+
+func (m *testPartialMessage) MarshalCodec(e *codec.Encoder) {
+	e.Int(1, int64(m.A))
+	e.Int(3, int64(m.C))
+}
+
+func (m *testPartialMessage) UnmarshalCodec(d *codec.Decoder) error {
+	for d.Next() {
+		switch d.Tag() {
+		case 1:
+			m.A = int(d.Int())
+		case 3:
+			m.C = int(d.Int())
+		default:
+			d.Skip()
+		}
+	}
+	return d.Err()
+}
+
 // Tests whether the stream listener can be set up and torn down correctly.
 func TestListen(t *testing.T) {
 	t.Parallel()
@@ -138,34 +192,34 @@ func TestSendRecv(t *testing.T) {
 	// Swap some data a few times to ensure all works
 	for i := 0; i < 1000; i++ {
 		// Execute a data transfer from client to server
-		send1 := struct{ A, B int }{3, 14}
-		recv1 := struct{ A, B int }{}
+		send1 := &testMessage{3, 14, 0}
+		recv1 := &testMessage{}
 		if err = client.Send(send1); err != nil {
 			t.Fatalf("failed to send through client: %v.", err)
 		}
 		if err = client.Flush(); err != nil {
 			t.Fatalf("failed to flush client: %v.", err)
 		}
-		if err = server.Recv(&recv1); err != nil {
+		if err = server.Recv(recv1); err != nil {
 			t.Fatalf("failed to receive through server: %v.", err)
 		}
 		if send1.A != recv1.A || send1.B != recv1.B {
 			t.Fatalf("send/recv mismatch: have %v, want %v.", recv1, send1)
 		}
 		// Execute a data transfer from server to client
-		send2 := struct{ A, B, C int }{3, 1, 4}
-		recv2 := struct{ A, C int }{}
+		send2 := &testMessage{3, 1, 4}
+		recv2 := &testPartialMessage{}
 		if err = server.Send(send2); err != nil {
 			t.Fatalf("failed to send through server: %v", err)
 		}
 		if err = server.Flush(); err != nil {
 			t.Fatalf("failed to flush server: %v", err)
 		}
-		if err = client.Recv(&recv2); err != nil {
+		if err = client.Recv(recv2); err != nil {
 			t.Fatalf("failed to receive through client: %v", err)
 		}
 		if send2.A != recv2.A || send2.C != recv2.C {
-			t.Fatalf("send/recv mismatch: have %v, want %v", recv1, send1)
+			t.Fatalf("send/recv mismatch: have %v, want %v", recv2, send2)
 		}
 	}
 	// Close the active connections
@@ -180,3 +234,44 @@ func TestSendRecv(t *testing.T) {
 		t.Fatalf("failed to close listener: %v.", err)
 	}
 }
+
+func TestFrameLimit(t *testing.T) {
+	t.Parallel()
+
+	// Resolve a random local port and listen on it
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	sock, err := Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	sock.Accept(10 * time.Millisecond)
+	defer sock.Close()
+
+	// Send oversized frame headers (both raw and pooled reads) and check failure
+	for i := 0; i < 2; i++ {
+		client, err := Dial(fmt.Sprintf("%s:%d", "localhost", addr.Port), time.Millisecond)
+		if err != nil {
+			t.Fatalf("failed to connect to stream listener: %v.", err)
+		}
+		defer client.Close()
+		server := <-sock.Sink
+
+		size := make([]byte, binary.MaxVarintLen64)
+		if _, err := client.Sock().Write(size[:binary.PutUvarint(size, 1<<63)]); err != nil {
+			t.Fatalf("failed to send frame size: %v.", err)
+		}
+		if i == 0 {
+			var data []byte
+			if err := server.RecvBinary(&data); err == nil {
+				t.Fatalf("oversized raw frame accepted.")
+			}
+		} else {
+			if _, err := server.RecvBuffer(); err == nil {
+				t.Fatalf("oversized pooled frame accepted.")
+			}
+		}
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"time"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/buffer"
 	"github.com/project-iris/iris/proto/iris"
 )
 
@@ -40,13 +42,23 @@ func (r *relay) HandleBroadcast(msg []byte) {
 
 // Forwards an app broadcast from the attached relay to the Iris network. Any
 // error is considered a protocol violation.
-func (r *relay) handleBroadcast(app string, msg []byte) {
-	if err := r.iris.Broadcast(app, msg); err != nil {
+func (r *relay) handleBroadcast(app string, msg *buffer.Buffer, prio proto.Priority) {
+	if err := r.iris.BroadcastBuffer(app, msg, prio); err != nil {
 		log.Printf("relay: broadcast error: %v.", err)
 		r.drop()
 	}
 }
 
+// Forwards an acknowledged app broadcast from the attached relay to the Iris
+// network, and relays back the number of confirmations, or the timeout.
+func (r *relay) handleBroadcastAck(app string, ackId uint64, msg []byte, timeout time.Duration) {
+	if count, err := r.iris.BroadcastAck(app, msg, timeout); err != nil {
+		r.sendBroadcastAck(ackId, 0, true)
+	} else {
+		r.sendBroadcastAck(ackId, count, false)
+	}
+}
+
 // Forwards a request arriving from the Iris network to the attached app. Also a
 // local timer is started to ensure a faulty client doesn't fill the node with
 // stale requests. Any error is considered a protocol violation.
@@ -86,14 +98,42 @@ func (r *relay) HandleRequest(req []byte, timeout time.Duration) []byte {
 // Forwards a request arriving from the attached app to the Iris network, and
 // waits for a reply to arrive back which can be forwarded. If the request times
 // out, a reply is sent back accordingly.
-func (r *relay) handleRequest(app string, reqId uint64, req []byte, timeout time.Duration) {
-	if rep, err := r.iris.Request(app, req, timeout); err != nil {
+func (r *relay) handleRequest(app string, reqId uint64, req []byte, timeout time.Duration, prio proto.Priority) {
+	if rep, err := r.iris.RequestPriority(app, req, timeout, prio); err != nil {
+		r.sendReply(reqId, nil, true)
+	} else {
+		r.sendReply(reqId, rep, false)
+	}
+}
+
+// Forwards a request arriving from the attached app to a specific connection,
+// and waits for a reply to arrive back which can be forwarded. If the request
+// times out, a reply is sent back accordingly.
+func (r *relay) handleRequestTo(addr *iris.Address, reqId uint64, req []byte, timeout time.Duration) {
+	if rep, err := r.iris.RequestTo(addr, req, timeout); err != nil {
 		r.sendReply(reqId, nil, true)
 	} else {
 		r.sendReply(reqId, rep, false)
 	}
 }
 
+// Forwards a scatter-gather request arriving from the attached app to the Iris
+// network, streaming back each reply as it arrives, and finally the number of
+// non-responding members, or the timeout if nobody was reached or the count of
+// the reached members is unknown.
+func (r *relay) handleGather(app string, gatId uint64, req []byte, timeout time.Duration) {
+	missing, err := r.iris.GatherStream(app, req, timeout, func(from *iris.Address, rep []byte) {
+		if err := r.sendGatherReply(gatId, from, rep); err != nil {
+			log.Printf("relay: gather reply forward error: %v.", err)
+		}
+	})
+	if err != nil || missing < 0 {
+		r.sendGatherEnd(gatId, 0, true)
+	} else {
+		r.sendGatherEnd(gatId, missing, false)
+	}
+}
+
 // Forwards a reply arriving from the attached app to the Iris node by looking
 // up the pending request channel and if still live, inserting the results.
 func (r *relay) handleReply(reqId uint64, msg []byte) {
@@ -105,6 +145,33 @@ func (r *relay) handleReply(reqId uint64, msg []byte) {
 	}
 }
 
+// Forwards a directly addressed message arriving from the Iris network to the
+// attached app. Any error is considered a protocol violation.
+func (r *relay) HandleMessage(msg []byte) {
+	if err := r.sendMessage(msg); err != nil {
+		log.Printf("relay: direct message forward error: %v.", err)
+		r.drop()
+	}
+}
+
+// Forwards a directly addressed message from the attached relay to the Iris
+// network. Any error is considered a protocol violation.
+func (r *relay) handleSendTo(addr *iris.Address, msg []byte) {
+	if err := r.iris.SendTo(addr, msg); err != nil {
+		log.Printf("relay: direct message error: %v.", err)
+		r.drop()
+	}
+}
+
+// Reports the address of the relay's Iris connection to the attached app. Any
+// error is considered a protocol violation.
+func (r *relay) handleAddress() {
+	if err := r.sendAddress(r.iris.Address()); err != nil {
+		log.Printf("relay: address report error: %v.", err)
+		r.drop()
+	}
+}
+
 // Handler for a topic subscription. Forwards all published events to the app
 // attached.
 type subscriptionHandler struct {
@@ -139,8 +206,8 @@ func (r *relay) handleSubscribe(topic string) {
 
 // Forwards a publish event arriving from the attached app to the Iris node. Any
 // error is considered a protocol violation.
-func (r *relay) handlePublish(topic string, msg []byte) {
-	if err := r.iris.Publish(topic, msg); err != nil {
+func (r *relay) handlePublish(topic string, msg *buffer.Buffer, prio proto.Priority) {
+	if err := r.iris.PublishBuffer(topic, msg, prio); err != nil {
 		log.Printf("relay: publish error: %v.", err)
 		r.drop()
 	}
@@ -155,6 +222,130 @@ func (r *relay) handleUnsubscribe(topic string) {
 	}
 }
 
+// Retrieves the members of a cluster and forwards them to the attached app, or
+// the timeout if the listing failed.
+func (r *relay) handleMembers(reqId uint64, cluster string) {
+	if addrs, err := r.iris.Members(cluster); err != nil {
+		r.sendMembers(reqId, nil, true)
+	} else {
+		r.sendMembers(reqId, addrs, false)
+	}
+}
+
+// Handler for a cluster membership watch. Forwards all membership changes to
+// the app attached.
+type membershipHandler struct {
+	relay   *relay
+	cluster string
+}
+
+// Forwards a member join event to the attached app. Any error is considered a
+// protocol violation.
+func (m *membershipHandler) HandleJoin(addr *iris.Address) {
+	if err := m.relay.sendMembership(m.cluster, addr, true); err != nil {
+		log.Printf("relay: join forward error: %v.", err)
+		m.relay.drop()
+	}
+}
+
+// Forwards a member leave event to the attached app. Any error is considered a
+// protocol violation.
+func (m *membershipHandler) HandleLeave(addr *iris.Address) {
+	if err := m.relay.sendMembership(m.cluster, addr, false); err != nil {
+		log.Printf("relay: leave forward error: %v.", err)
+		m.relay.drop()
+	}
+}
+
+// Forwards a membership watch request arriving from the attached app to the
+// Iris node. Any error is considered a protocol violation.
+func (r *relay) handleWatch(cluster string) {
+	handler := &membershipHandler{
+		relay:   r,
+		cluster: cluster,
+	}
+	if err := r.iris.Watch(cluster, handler); err != nil {
+		log.Printf("relay: watch error: %v.", err)
+		r.drop()
+	}
+}
+
+// Forwards a membership watch removal arriving from the attached app to the
+// Iris node. Any error is considered a protocol violation.
+func (r *relay) handleUnwatch(cluster string) {
+	if err := r.iris.Unwatch(cluster); err != nil {
+		log.Printf("relay: unwatch error: %v.", err)
+		r.drop()
+	}
+}
+
+// Forwards a lock acquisition arriving from the attached app to the Iris
+// network, and relays back whether it was granted, or the timeout.
+func (r *relay) handleLock(reqId uint64, name string, ttl time.Duration) {
+	switch err := r.iris.Lock(name, ttl); err {
+	case nil:
+		r.sendLock(reqId, true, false)
+	case iris.ErrLocked:
+		r.sendLock(reqId, false, false)
+	default:
+		r.sendLock(reqId, false, true)
+	}
+}
+
+// Forwards a lock release arriving from the attached app to the Iris network.
+// Since the lease might have been lost in the mean time, errors are only logged.
+func (r *relay) handleUnlock(name string) {
+	if err := r.iris.Unlock(name); err != nil {
+		log.Printf("relay: unlock error: %v.", err)
+	}
+}
+
+// Handler for a leader election campaign. Forwards all leadership changes to
+// the app attached.
+type electionHandler struct {
+	relay *relay
+	role  string
+}
+
+// Forwards a leadership gain to the attached app. Any error is considered a
+// protocol violation.
+func (e *electionHandler) HandleElected() {
+	if err := e.relay.sendLeadership(e.role, true); err != nil {
+		log.Printf("relay: election forward error: %v.", err)
+		e.relay.drop()
+	}
+}
+
+// Forwards a leadership loss to the attached app. Any error is considered a
+// protocol violation.
+func (e *electionHandler) HandleDeposed() {
+	if err := e.relay.sendLeadership(e.role, false); err != nil {
+		log.Printf("relay: depose forward error: %v.", err)
+		e.relay.drop()
+	}
+}
+
+// Forwards a leader election campaign arriving from the attached app to the
+// Iris node. Any error is considered a protocol violation.
+func (r *relay) handleElect(role string) {
+	handler := &electionHandler{
+		relay: r,
+		role:  role,
+	}
+	if err := r.iris.Elect(role, handler); err != nil {
+		log.Printf("relay: election error: %v.", err)
+		r.drop()
+	}
+}
+
+// Forwards a leader election resignation arriving from the attached app to the
+// Iris node. Errors are only logged.
+func (r *relay) handleResign(role string) {
+	if err := r.iris.Resign(role); err != nil {
+		log.Printf("relay: resign error: %v.", err)
+	}
+}
+
 // Forwards a tunneling request from the Iris network to the attached app. If no
 // reply comes within some alloted time, the tunnel and connection are dropped.
 func (r *relay) HandleTunnel(tun *iris.Tunnel) {
@@ -271,8 +462,28 @@ func (r *relay) handleTunnelAck(tunId uint64) {
 	}
 }
 
+// Forwards a tunnel half-close from the attached app to the remote endpoint,
+// after all the messages buffered before it.
+func (r *relay) handleTunnelFinSend(tunId uint64) {
+	r.tunLock.RLock()
+	defer r.tunLock.RUnlock()
+
+	if tun, ok := r.tunLive[tunId]; ok {
+		tun.finish()
+	}
+}
+
+// Forwards a tunnel half-close from the Iris network to the attached app.
+func (r *relay) handleTunnelFinRecv(tunId uint64) {
+	if err := r.sendTunnelFin(tunId); err != nil {
+		log.Printf("relay: tunnel half-close notification failed: %v.", err)
+		r.drop()
+	}
+}
+
 // Terminates the tunnel data transfer threads and notifies the remote endpoint.
-func (r *relay) handleTunnelClose(tunId uint64, local bool) {
+// Messages buffered from the app are delivered before the tunnel is closed.
+func (r *relay) handleTunnelClose(tunId uint64, local bool, reason string) {
 	// Remove the tunnel
 	r.tunLock.Lock()
 	tun, ok := r.tunLive[tunId]
@@ -280,15 +491,18 @@ func (r *relay) handleTunnelClose(tunId uint64, local bool) {
 	r.tunLock.Unlock()
 
 	if ok {
-		// In case of a local close, signal the remote endpoint
-		if local {
-			go tun.tun.Close()
-		}
-		// Terminate the tunnel transfers
-		go tun.close()
-
+		// Terminate the tunnel transfers, and close the Iris tunnel afterwards (in
+		// case of a local close, signalling the reason to the remote endpoint)
+		go func() {
+			tun.close()
+			if local {
+				tun.tun.CloseReason(reason)
+			} else {
+				tun.tun.Close()
+			}
+		}()
 		// Signal the application of termination
-		if err := r.sendTunnelClose(tunId); err != nil {
+		if err := r.sendTunnelClose(tunId, reason); err != nil {
 			log.Printf("relay: tunnel close notification failed: %v", err)
 			r.drop()
 		}
@@ -20,28 +20,75 @@
 package relay
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
 	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/buffer"
+	"github.com/project-iris/iris/proto/iris"
 )
 
 const (
-	opInit     byte = iota // Connection initialization
-	opBcast                // Application broadcast
-	opReq                  // Application request
-	opRep                  // Application reply
-	opSub                  // Topic subscription
-	opPub                  // Topic publish
-	opUnsub                // Topic subscription removal
-	opClose                // Connection closing
-	opTunReq               // Tunnel building request
-	opTunRep               // Tunnel building reply
-	opTunData              // Tunnel data transfer
-	opTunAck               // Tunnel data acknowledgement
-	opTunClose             // Tunnel closing
+	opInit       byte = iota // Connection initialization
+	opBcast                  // Application broadcast
+	opReq                    // Application request
+	opRep                    // Application reply
+	opSub                    // Topic subscription
+	opPub                    // Topic publish
+	opUnsub                  // Topic subscription removal
+	opClose                  // Connection closing
+	opTunReq                 // Tunnel building request
+	opTunRep                 // Tunnel building reply
+	opTunData                // Tunnel data transfer
+	opTunAck                 // Tunnel data acknowledgement
+	opTunClose               // Tunnel closing
+	opBcastAck               // Acknowledged application broadcast
+	opGather                 // Application scatter-gather request
+	opGatRep                 // Application scatter-gather reply
+	opGatEnd                 // Application scatter-gather completion
+	opAddr                   // Connection address query
+	opSendTo                 // Directly addressed application message
+	opReqTo                  // Directly addressed application request
+	opMembers                // Cluster membership listing
+	opWatch                  // Cluster membership watch
+	opUnwatch                // Cluster membership watch removal
+	opJoin                   // Cluster member join notification
+	opLeave                  // Cluster member leave notification
+	opLock                   // Distributed lock acquisition
+	opUnlock                 // Distributed lock release
+	opElect                  // Leader election campaign
+	opResign                 // Leader election resignation
+	opElected                // Leadership gained notification
+	opDeposed                // Leadership lost notification
+	opStreamData             // Streamed payload frame
+	opStreamAck              // Streamed payload frame acknowledgement
+	opTunFin                 // Tunnel half-close (end of stream)
 )
 
-// Relay protocol version
+// Relay protocol versions: the base protocol and the extended one carrying the
+// feature flags negotiated during initialization.
 var relayVersion = "v1.0"
+var relayVersionFlags = "v1.1"
+
+// Relay feature flags negotiated during initialization.
+const (
+	flagCompress byte = 1 << iota // Payload compression
+	flagPriority                  // Priority classes on application messages
+	flagStream                    // Streaming of large payloads in frames
+	flagTunFin                    // Tunnel half-close and close reasons
+)
+
+// Payload encodings used when compression or streaming is negotiated.
+const (
+	payloadRaw     byte = iota // Uncompressed payload
+	payloadDeflate             // Deflate compressed payload
+	payloadStream              // Reference to a previously streamed payload
+)
 
 // Serializes a single byte into the relay.
 func (r *relay) sendByte(data byte) error {
@@ -87,6 +134,97 @@ func (r *relay) sendBinary(data []byte) error {
 	return nil
 }
 
+// Serializes an application payload into the relay, either as a reference to a
+// previously streamed body (non-zero stream id), or inline, compressing it first
+// if it was negotiated and is worthwhile.
+func (r *relay) sendPayload(data []byte, stream uint64) error {
+	if !r.compress && !r.stream {
+		return r.sendBinary(data)
+	}
+	if stream != 0 {
+		if err := r.sendByte(payloadStream); err != nil {
+			return err
+		}
+		return r.sendVarint(stream)
+	}
+	if !r.compress {
+		if err := r.sendByte(payloadRaw); err != nil {
+			return err
+		}
+		return r.sendBinary(data)
+	}
+	data, ok := proto.Deflate(data)
+	if ok {
+		if err := r.sendByte(payloadDeflate); err != nil {
+			return err
+		}
+	} else {
+		if err := r.sendByte(payloadRaw); err != nil {
+			return err
+		}
+	}
+	return r.sendBinary(data)
+}
+
+// Streams a large application payload into the relay in flow controlled frames,
+// returning the id of the stream to reference it by. Small payloads, or clients
+// not supporting streaming are not touched, returning a zero id.
+func (r *relay) streamPayload(data []byte) (uint64, error) {
+	if !r.stream || len(data) <= config.RelayStreamChunk {
+		return 0, nil
+	}
+	id := atomic.AddUint64(&r.streamIdx, 1)
+	for len(data) > 0 {
+		// Wait for the client to permit a new frame
+		select {
+		case r.streamWin <- struct{}{}:
+		case <-r.term:
+			return 0, errors.New("relay: terminating")
+		}
+		// Send the next frame, allowing other messages in between
+		size := config.RelayStreamChunk
+		if size > len(data) {
+			size = len(data)
+		}
+		if err := r.sendStreamData(id, data[:size]); err != nil {
+			return 0, err
+		}
+		data = data[size:]
+	}
+	return id, nil
+}
+
+// Atomically sends a single frame of a streamed payload into the relay.
+func (r *relay) sendStreamData(id uint64, data []byte) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opStreamData); err != nil {
+		return err
+	}
+	if err := r.sendVarint(id); err != nil {
+		return err
+	}
+	if err := r.sendBinary(data); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends the acknowledgement of a streamed frame into the relay.
+func (r *relay) sendStreamAck(id uint64) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opStreamAck); err != nil {
+		return err
+	}
+	if err := r.sendVarint(id); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
 // Serializes a length-tagged string into the relay.
 func (r *relay) sendString(data string) error {
 	return r.sendBinary([]byte(data))
@@ -100,30 +238,89 @@ func (r *relay) sendFlush() error {
 	return nil
 }
 
-// Serializes the initialization confirmation.
-func (r *relay) sendInit() error {
+// Serializes the initialization confirmation, along with the accepted feature
+// flags if the client requested any. If streaming was accepted, the maximum
+// message size and the stream window are also announced.
+func (r *relay) sendInit(flags bool) error {
 	if err := r.sendByte(opInit); err != nil {
 		return err
 	}
+	if flags {
+		accepted := byte(0)
+		if r.compress {
+			accepted |= flagCompress
+		}
+		if r.priority {
+			accepted |= flagPriority
+		}
+		if r.stream {
+			accepted |= flagStream
+		}
+		if r.tunFin {
+			accepted |= flagTunFin
+		}
+		if err := r.sendByte(accepted); err != nil {
+			return err
+		}
+		if r.stream {
+			if err := r.sendVarint(uint64(config.RelayMaxMessageSize)); err != nil {
+				return err
+			}
+			if err := r.sendVarint(uint64(config.RelayStreamWindow)); err != nil {
+				return err
+			}
+		}
+	}
 	return r.sendFlush()
 }
 
 // Atomically sends an application broadcast message into the relay.
 func (r *relay) sendBroadcast(msg []byte) error {
+	stream, err := r.streamPayload(msg)
+	if err != nil {
+		return err
+	}
 	r.sockLock.Lock()
 	defer r.sockLock.Unlock()
 
 	if err := r.sendByte(opBcast); err != nil {
 		return err
 	}
-	if err := r.sendBinary(msg); err != nil {
+	if err := r.sendPayload(msg, stream); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends the confirmation count of an acknowledged broadcast into the
+// relay.
+func (r *relay) sendBroadcastAck(ackId uint64, count int, timeout bool) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opBcastAck); err != nil {
+		return err
+	}
+	if err := r.sendVarint(ackId); err != nil {
+		return err
+	}
+	if err := r.sendBool(timeout); err != nil {
 		return err
 	}
+	if !timeout {
+		if err := r.sendVarint(uint64(count)); err != nil {
+			return err
+		}
+	}
 	return r.sendFlush()
 }
 
 // Atomically sends a request message into the relay.
 func (r *relay) sendRequest(reqId uint64, req []byte) error {
+	stream, err := r.streamPayload(req)
+	if err != nil {
+		return err
+	}
 	r.sockLock.Lock()
 	defer r.sockLock.Unlock()
 
@@ -133,7 +330,7 @@ func (r *relay) sendRequest(reqId uint64, req []byte) error {
 	if err := r.sendVarint(reqId); err != nil {
 		return err
 	}
-	if err := r.sendBinary(req); err != nil {
+	if err := r.sendPayload(req, stream); err != nil {
 		return err
 	}
 	return r.sendFlush()
@@ -141,6 +338,10 @@ func (r *relay) sendRequest(reqId uint64, req []byte) error {
 
 // Atomically sends a reply message into the relay.
 func (r *relay) sendReply(reqId uint64, rep []byte, timeout bool) error {
+	stream, err := r.streamPayload(rep)
+	if err != nil {
+		return err
+	}
 	r.sockLock.Lock()
 	defer r.sockLock.Unlock()
 
@@ -154,15 +355,187 @@ func (r *relay) sendReply(reqId uint64, rep []byte, timeout bool) error {
 		return err
 	}
 	if !timeout {
-		if err := r.sendBinary(rep); err != nil {
+		if err := r.sendPayload(rep, stream); err != nil {
 			return err
 		}
 	}
 	return r.sendFlush()
 }
 
+// Atomically sends a single streamed reply of a gather, together with the
+// address of the responder into the relay.
+func (r *relay) sendGatherReply(gatId uint64, from *iris.Address, rep []byte) error {
+	stream, err := r.streamPayload(rep)
+	if err != nil {
+		return err
+	}
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opGatRep); err != nil {
+		return err
+	}
+	if err := r.sendVarint(gatId); err != nil {
+		return err
+	}
+	if err := r.sendString(from.String()); err != nil {
+		return err
+	}
+	if err := r.sendPayload(rep, stream); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends the completion of a gather into the relay, consisting of the
+// number of non-responding members, or the timeout if no member was reached.
+func (r *relay) sendGatherEnd(gatId uint64, missing int, timeout bool) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opGatEnd); err != nil {
+		return err
+	}
+	if err := r.sendVarint(gatId); err != nil {
+		return err
+	}
+	if err := r.sendBool(timeout); err != nil {
+		return err
+	}
+	if !timeout {
+		if err := r.sendVarint(uint64(missing)); err != nil {
+			return err
+		}
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends the address of the relay's connection into the relay.
+func (r *relay) sendAddress(addr *iris.Address) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opAddr); err != nil {
+		return err
+	}
+	if err := r.sendString(addr.String()); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends a directly addressed message into the relay.
+func (r *relay) sendMessage(msg []byte) error {
+	stream, err := r.streamPayload(msg)
+	if err != nil {
+		return err
+	}
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opSendTo); err != nil {
+		return err
+	}
+	if err := r.sendPayload(msg, stream); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends the members of a cluster into the relay.
+func (r *relay) sendMembers(reqId uint64, addrs []*iris.Address, timeout bool) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opMembers); err != nil {
+		return err
+	}
+	if err := r.sendVarint(reqId); err != nil {
+		return err
+	}
+	if err := r.sendBool(timeout); err != nil {
+		return err
+	}
+	if !timeout {
+		if err := r.sendVarint(uint64(len(addrs))); err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if err := r.sendString(addr.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends a membership change of a watched cluster into the relay.
+func (r *relay) sendMembership(cluster string, addr *iris.Address, join bool) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	op := opLeave
+	if join {
+		op = opJoin
+	}
+	if err := r.sendByte(op); err != nil {
+		return err
+	}
+	if err := r.sendString(cluster); err != nil {
+		return err
+	}
+	if err := r.sendString(addr.String()); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends the result of a lock acquisition into the relay.
+func (r *relay) sendLock(reqId uint64, granted bool, timeout bool) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opLock); err != nil {
+		return err
+	}
+	if err := r.sendVarint(reqId); err != nil {
+		return err
+	}
+	if err := r.sendBool(timeout); err != nil {
+		return err
+	}
+	if !timeout {
+		if err := r.sendBool(granted); err != nil {
+			return err
+		}
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends a leadership change of a role into the relay.
+func (r *relay) sendLeadership(role string, elected bool) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	op := opDeposed
+	if elected {
+		op = opElected
+	}
+	if err := r.sendByte(op); err != nil {
+		return err
+	}
+	if err := r.sendString(role); err != nil {
+		return err
+	}
+	return r.sendFlush()
+}
+
 // Atomically sends a topic publish message into the relay.
 func (r *relay) sendPublish(topic string, msg []byte) error {
+	stream, err := r.streamPayload(msg)
+	if err != nil {
+		return err
+	}
 	r.sockLock.Lock()
 	defer r.sockLock.Unlock()
 
@@ -172,7 +545,7 @@ func (r *relay) sendPublish(topic string, msg []byte) error {
 	if err := r.sendString(topic); err != nil {
 		return err
 	}
-	if err := r.sendBinary(msg); err != nil {
+	if err := r.sendPayload(msg, stream); err != nil {
 		return err
 	}
 	return r.sendFlush()
@@ -230,6 +603,10 @@ func (r *relay) sendTunnelReply(tunId uint64, buf int, timeout bool) error {
 
 // Atomically sends a tunnel data packet into the relay.
 func (r *relay) sendTunnelData(tunId uint64, msg []byte) error {
+	stream, err := r.streamPayload(msg)
+	if err != nil {
+		return err
+	}
 	r.sockLock.Lock()
 	defer r.sockLock.Unlock()
 
@@ -239,7 +616,7 @@ func (r *relay) sendTunnelData(tunId uint64, msg []byte) error {
 	if err := r.sendVarint(tunId); err != nil {
 		return err
 	}
-	if err := r.sendBinary(msg); err != nil {
+	if err := r.sendPayload(msg, stream); err != nil {
 		return err
 	}
 	return r.sendFlush()
@@ -259,8 +636,9 @@ func (r *relay) sendTunnelAck(tunId uint64) error {
 	return r.sendFlush()
 }
 
-// Atomically sends a tunnel close request into the relay.
-func (r *relay) sendTunnelClose(tunId uint64) error {
+// Atomically sends a tunnel close request into the relay, together with the
+// reason if the client supports it.
+func (r *relay) sendTunnelClose(tunId uint64, reason string) error {
 	r.sockLock.Lock()
 	defer r.sockLock.Unlock()
 
@@ -270,6 +648,25 @@ func (r *relay) sendTunnelClose(tunId uint64) error {
 	if err := r.sendVarint(tunId); err != nil {
 		return err
 	}
+	if r.tunFin {
+		if err := r.sendString(reason); err != nil {
+			return err
+		}
+	}
+	return r.sendFlush()
+}
+
+// Atomically sends a tunnel half-close notification into the relay.
+func (r *relay) sendTunnelFin(tunId uint64) error {
+	r.sockLock.Lock()
+	defer r.sockLock.Unlock()
+
+	if err := r.sendByte(opTunFin); err != nil {
+		return err
+	}
+	if err := r.sendVarint(tunId); err != nil {
+		return err
+	}
 	return r.sendFlush()
 }
 
@@ -302,9 +699,22 @@ func (r *relay) recvVarint() (uint64, error) {
 	return num, nil
 }
 
+// Retrieves the size of a length-tagged binary array from the relay, enforcing
+// the maximum message size.
+func (r *relay) recvSize() (uint64, error) {
+	size, err := r.recvVarint()
+	if err != nil {
+		return 0, err
+	}
+	if size > uint64(config.RelayMaxMessageSize) {
+		return 0, fmt.Errorf("relay: protocol violation: message too large: %v > %v.", size, config.RelayMaxMessageSize)
+	}
+	return size, nil
+}
+
 // Retrieves a length-tagged binary array from the relay.
 func (r *relay) recvBinary() ([]byte, error) {
-	size, err := r.recvVarint()
+	size, err := r.recvSize()
 	if err != nil {
 		return nil, err
 	}
@@ -320,6 +730,111 @@ func (r *relay) recvBinary() ([]byte, error) {
 	return data, nil
 }
 
+// Retrieves a length-tagged binary data from the relay into a pooled buffer.
+func (r *relay) recvBuffer() (*buffer.Buffer, error) {
+	size, err := r.recvSize()
+	if err != nil {
+		return nil, err
+	}
+	buf := buffer.Get(int(size))
+	if _, err := io.ReadFull(r.sockBuf, buf.Data); err != nil {
+		buf.Release()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Retrieves an application payload from the relay, decompressing it or looking
+// up the streamed body if needed.
+func (r *relay) recvPayload() ([]byte, error) {
+	if !r.compress && !r.stream {
+		return r.recvBinary()
+	}
+	kind, err := r.recvByte()
+	if err != nil {
+		return nil, err
+	}
+	if kind == payloadRaw {
+		return r.recvBinary()
+	}
+	return r.recvEncoded(kind)
+}
+
+// Retrieves an application payload from the relay into a pooled buffer,
+// decompressing it or looking up the streamed body if needed.
+func (r *relay) recvPayloadBuffer() (*buffer.Buffer, error) {
+	if !r.compress && !r.stream {
+		return r.recvBuffer()
+	}
+	kind, err := r.recvByte()
+	if err != nil {
+		return nil, err
+	}
+	if kind == payloadRaw {
+		return r.recvBuffer()
+	}
+	data, err := r.recvEncoded(kind)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Wrap(data), nil
+}
+
+// Retrieves a compressed or streamed application payload from the relay.
+func (r *relay) recvEncoded(kind byte) ([]byte, error) {
+	switch {
+	case kind == payloadDeflate && r.compress:
+		data, err := r.recvBinary()
+		if err != nil {
+			return nil, err
+		}
+		if data, err = proto.Inflate(data); err != nil {
+			return nil, err
+		}
+		if len(data) > config.RelayMaxMessageSize {
+			return nil, fmt.Errorf("relay: protocol violation: message too large: %v > %v.", len(data), config.RelayMaxMessageSize)
+		}
+		return data, nil
+
+	case kind == payloadStream && r.stream:
+		id, err := r.recvVarint()
+		if err != nil {
+			return nil, err
+		}
+		data, ok := r.streamIn[id]
+		if !ok {
+			return nil, fmt.Errorf("relay: protocol violation: unknown stream: %v.", id)
+		}
+		delete(r.streamIn, id)
+		r.streamBuf -= len(data)
+		return data, nil
+
+	default:
+		return nil, fmt.Errorf("relay: protocol violation: invalid payload encoding: %v.", kind)
+	}
+}
+
+// Retrieves the priority class of an application message, if negotiated. Old
+// clients are considered interactive, and so are the ones requesting the class
+// reserved for system traffic.
+func (r *relay) recvPriority() (proto.Priority, error) {
+	if !r.priority {
+		return proto.PrioInteractive, nil
+	}
+	prio, err := r.recvByte()
+	if err != nil {
+		return 0, err
+	}
+	switch proto.Priority(prio) {
+	case proto.PrioControl:
+		return proto.PrioInteractive, nil
+	case proto.PrioInteractive, proto.PrioBulk:
+		return proto.Priority(prio), nil
+	default:
+		return 0, fmt.Errorf("relay: protocol violation: invalid priority: %v.", prio)
+	}
+}
+
 // Retrieves a length-tagged string from the relay.
 func (r *relay) recvString() (string, error) {
 	if data, err := r.recvBinary(); err != nil {
@@ -329,44 +844,89 @@ func (r *relay) recvString() (string, error) {
 	}
 }
 
-// Retrieves the connection initialization and processes it.
-func (r *relay) procInit() (string, error) {
+// Retrieves the connection initialization and processes it. Besides the app id,
+// it is reported whether the client uses the feature flagged protocol version.
+func (r *relay) procInit() (string, bool, error) {
 	// Retrieve the init code
 	if op, err := r.recvByte(); err != nil {
-		return "", err
+		return "", false, err
 	} else if op != opInit {
-		return "", fmt.Errorf("relay: protocol violation: invalid init code: %v.", op)
+		return "", false, fmt.Errorf("relay: protocol violation: invalid init code: %v.", op)
 	}
 	// Retrieve and check the protocol version
-	if ver, err := r.recvString(); err != nil {
-		return "", err
-	} else if ver != relayVersion {
-		return "", fmt.Errorf("relay: protocol violation: incompatible version: have %v, want %v", ver, relayVersion)
+	ver, err := r.recvString()
+	if err != nil {
+		return "", false, err
+	} else if ver != relayVersion && ver != relayVersionFlags {
+		return "", false, fmt.Errorf("relay: protocol violation: incompatible version: have %v, want %v", ver, relayVersionFlags)
 	}
 	// Retrieve the app id
 	app, err := r.recvString()
 	if err != nil {
-		return "", err
+		return "", false, err
+	}
+	// Retrieve the requested feature flags, if any
+	if ver == relayVersionFlags {
+		flags, err := r.recvByte()
+		if err != nil {
+			return "", false, err
+		}
+		r.compress = flags&flagCompress != 0 && config.SessionCompress
+		r.priority = flags&flagPriority != 0
+		r.stream = flags&flagStream != 0
+		r.tunFin = flags&flagTunFin != 0
+		return app, true, nil
 	}
-	return app, nil
+	return app, false, nil
 }
 
 // Retrieves a local broadcast message from the relay and forwards to the Iris network.
 func (r *relay) procBroadcast() error {
+	prio, err := r.recvPriority()
+	if err != nil {
+		return err
+	}
+	app, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	msg, err := r.recvPayloadBuffer()
+	if err != nil {
+		return err
+	}
+	r.workers.SchedulePriority(func() { r.handleBroadcast(app, msg, prio) }, int(prio))
+	return nil
+}
+
+// Retrieves a local acknowledged broadcast from the relay and forwards to the
+// Iris network.
+func (r *relay) procBroadcastAck() error {
+	ackId, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
 	app, err := r.recvString()
 	if err != nil {
 		return err
 	}
-	msg, err := r.recvBinary()
+	msg, err := r.recvPayload()
+	if err != nil {
+		return err
+	}
+	timeout, err := r.recvVarint()
 	if err != nil {
 		return err
 	}
-	r.workers.Schedule(func() { r.handleBroadcast(app, msg) })
+	go r.handleBroadcastAck(app, ackId, msg, time.Duration(timeout)*time.Millisecond)
 	return nil
 }
 
 // Retrieves a local request from the relay and forwards to the Iris network.
 func (r *relay) procRequest() error {
+	prio, err := r.recvPriority()
+	if err != nil {
+		return err
+	}
 	reqId, err := r.recvVarint()
 	if err != nil {
 		return err
@@ -375,7 +935,30 @@ func (r *relay) procRequest() error {
 	if err != nil {
 		return err
 	}
-	req, err := r.recvBinary()
+	req, err := r.recvPayload()
+	if err != nil {
+		return err
+	}
+	timeout, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	go r.handleRequest(app, reqId, req, time.Duration(timeout)*time.Millisecond, prio)
+	return nil
+}
+
+// Retrieves a local scatter-gather request from the relay and forwards to the
+// Iris network.
+func (r *relay) procGather() error {
+	gatId, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	app, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	req, err := r.recvPayload()
 	if err != nil {
 		return err
 	}
@@ -383,7 +966,149 @@ func (r *relay) procRequest() error {
 	if err != nil {
 		return err
 	}
-	go r.handleRequest(app, reqId, req, time.Duration(timeout)*time.Millisecond)
+	go r.handleGather(app, gatId, req, time.Duration(timeout)*time.Millisecond)
+	return nil
+}
+
+// Retrieves a textual connection address from the relay.
+func (r *relay) recvAddress() (*iris.Address, error) {
+	addr, err := r.recvString()
+	if err != nil {
+		return nil, err
+	}
+	return iris.ParseAddress(addr)
+}
+
+// Retrieves a local address query and schedules the reply.
+func (r *relay) procAddress() error {
+	r.workers.Schedule(func() { r.handleAddress() })
+	return nil
+}
+
+// Retrieves a local directly addressed message from the relay and forwards to
+// the Iris network.
+func (r *relay) procSendTo() error {
+	addr, err := r.recvAddress()
+	if err != nil {
+		return err
+	}
+	msg, err := r.recvPayload()
+	if err != nil {
+		return err
+	}
+	r.workers.Schedule(func() { r.handleSendTo(addr, msg) })
+	return nil
+}
+
+// Retrieves a local directly addressed request from the relay and forwards to
+// the Iris network.
+func (r *relay) procRequestTo() error {
+	reqId, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	addr, err := r.recvAddress()
+	if err != nil {
+		return err
+	}
+	req, err := r.recvPayload()
+	if err != nil {
+		return err
+	}
+	timeout, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	go r.handleRequestTo(addr, reqId, req, time.Duration(timeout)*time.Millisecond)
+	return nil
+}
+
+// Retrieves a local membership listing request and forwards it to the Iris
+// network.
+func (r *relay) procMembers() error {
+	reqId, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	cluster, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	go r.handleMembers(reqId, cluster)
+	return nil
+}
+
+// Retrieves a membership watch request and forwards it to the Iris node.
+func (r *relay) procWatch() error {
+	cluster, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	r.workers.Schedule(func() { r.handleWatch(cluster) })
+	return nil
+}
+
+// Retrieves a membership watch removal and forwards it to the Iris node.
+func (r *relay) procUnwatch() error {
+	cluster, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	r.workers.Schedule(func() { r.handleUnwatch(cluster) })
+	return nil
+}
+
+// Retrieves a lock acquisition request and forwards it to the Iris network.
+func (r *relay) procLock() error {
+	reqId, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	name, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	ttl, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	// Refuse out of range lease durations straight away
+	if ttl > uint64(math.MaxInt64/int64(time.Millisecond)) || time.Duration(ttl)*time.Millisecond < config.ScribeLeaseMinTTL {
+		go r.sendLock(reqId, false, true)
+		return nil
+	}
+	go r.handleLock(reqId, name, time.Duration(ttl)*time.Millisecond)
+	return nil
+}
+
+// Retrieves a lock release request and forwards it to the Iris network.
+func (r *relay) procUnlock() error {
+	name, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	go r.handleUnlock(name)
+	return nil
+}
+
+// Retrieves a leader election campaign request and forwards it to the Iris
+// node.
+func (r *relay) procElect() error {
+	role, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	r.workers.Schedule(func() { r.handleElect(role) })
+	return nil
+}
+
+// Retrieves a leader election resignation and forwards it to the Iris node.
+func (r *relay) procResign() error {
+	role, err := r.recvString()
+	if err != nil {
+		return err
+	}
+	go r.handleResign(role)
 	return nil
 }
 
@@ -393,7 +1118,7 @@ func (r *relay) procReply() error {
 	if err != nil {
 		return err
 	}
-	rep, err := r.recvBinary()
+	rep, err := r.recvPayload()
 	if err != nil {
 		return err
 	}
@@ -413,15 +1138,19 @@ func (r *relay) procSubscribe() error {
 
 // Retrieves a publish request and forwards it to the Iris network.
 func (r *relay) procPublish() error {
+	prio, err := r.recvPriority()
+	if err != nil {
+		return err
+	}
 	topic, err := r.recvString()
 	if err != nil {
 		return err
 	}
-	msg, err := r.recvBinary()
+	msg, err := r.recvPayloadBuffer()
 	if err != nil {
 		return err
 	}
-	r.workers.Schedule(func() { r.handlePublish(topic, msg) })
+	r.workers.SchedulePriority(func() { r.handlePublish(topic, msg, prio) }, int(prio))
 	return nil
 
 }
@@ -482,7 +1211,7 @@ func (r *relay) procTunnelData() error {
 	if err != nil {
 		return err
 	}
-	msg, err := r.recvBinary()
+	msg, err := r.recvPayload()
 	if err != nil {
 		return err
 	}
@@ -500,16 +1229,76 @@ func (r *relay) procTunnelAck() error {
 	return nil
 }
 
-// Retrieves a tunneling request and relays it.
+// Retrieves a tunnel close request (with the reason if supported) and relays it.
 func (r *relay) procTunnelClose() error {
 	tunId, err := r.recvVarint()
 	if err != nil {
 		return err
 	}
-	r.workers.Schedule(func() { r.handleTunnelClose(tunId, true) })
+	reason := ""
+	if r.tunFin {
+		if reason, err = r.recvString(); err != nil {
+			return err
+		}
+	}
+	r.workers.Schedule(func() { r.handleTunnelClose(tunId, true, reason) })
+	return nil
+}
+
+// Retrieves a tunnel half-close request and relays it.
+func (r *relay) procTunnelFin() error {
+	if !r.tunFin {
+		return fmt.Errorf("relay: protocol violation: tunnel half-close not negotiated.")
+	}
+	tunId, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	r.handleTunnelFinSend(tunId) // Note, NOT separate go-routine, must follow the data
 	return nil
 }
 
+// Retrieves a frame of a streamed payload, appends it to the partial body and
+// acknowledges it. Processed in order with the message referencing the stream.
+// Both the number of open streams and their total size are limited, otherwise
+// a client could pile up unreferenced partial payloads without bounds.
+func (r *relay) procStreamData() error {
+	id, err := r.recvVarint()
+	if err != nil {
+		return err
+	}
+	data, err := r.recvBinary()
+	if err != nil {
+		return err
+	}
+	body, ok := r.streamIn[id]
+	if !ok && len(r.streamIn) >= config.RelayStreamMaxOpen {
+		return fmt.Errorf("relay: protocol violation: too many open streams: %v.", len(r.streamIn)+1)
+	}
+	if len(body)+len(data) > config.RelayMaxMessageSize {
+		return fmt.Errorf("relay: protocol violation: stream too large: %v > %v.", len(body)+len(data), config.RelayMaxMessageSize)
+	}
+	if r.streamBuf+len(data) > config.RelayStreamMaxBuffer {
+		return fmt.Errorf("relay: protocol violation: streams too large: %v > %v.", r.streamBuf+len(data), config.RelayStreamMaxBuffer)
+	}
+	r.streamIn[id] = append(body, data...)
+	r.streamBuf += len(data)
+	return r.sendStreamAck(id)
+}
+
+// Retrieves a streamed frame acknowledgement, permitting further frames.
+func (r *relay) procStreamAck() error {
+	if _, err := r.recvVarint(); err != nil {
+		return err
+	}
+	select {
+	case <-r.streamWin:
+		return nil
+	default:
+		return errors.New("relay: protocol violation: stream ack out of bounds.")
+	}
+}
+
 // Retrieves messages from the client connection and keeps processing them until
 // either side closes the socket or the connection drops.
 func (r *relay) process() {
@@ -522,8 +1311,32 @@ func (r *relay) process() {
 			switch op {
 			case opBcast:
 				err = r.procBroadcast()
+			case opBcastAck:
+				err = r.procBroadcastAck()
 			case opReq:
 				err = r.procRequest()
+			case opGather:
+				err = r.procGather()
+			case opReqTo:
+				err = r.procRequestTo()
+			case opSendTo:
+				err = r.procSendTo()
+			case opAddr:
+				err = r.procAddress()
+			case opMembers:
+				err = r.procMembers()
+			case opWatch:
+				err = r.procWatch()
+			case opUnwatch:
+				err = r.procUnwatch()
+			case opLock:
+				err = r.procLock()
+			case opUnlock:
+				err = r.procUnlock()
+			case opElect:
+				err = r.procElect()
+			case opResign:
+				err = r.procResign()
 			case opRep:
 				err = r.procReply()
 			case opSub:
@@ -542,6 +1355,12 @@ func (r *relay) process() {
 				err = r.procTunnelAck()
 			case opTunClose:
 				err = r.procTunnelClose()
+			case opTunFin:
+				err = r.procTunnelFin()
+			case opStreamData:
+				err = r.procStreamData()
+			case opStreamAck:
+				err = r.procStreamAck()
 			case opClose:
 				err = r.sendClose()
 				closed = true
@@ -48,6 +48,16 @@ type relay struct {
 	sock     net.Conn          // Network connection to the attached client
 	sockBuf  *bufio.ReadWriter // Buffered access to the network socket
 	sockLock sync.Mutex        // Mutex to atomise message sending
+	compress bool              // Whether payloads are compressed on the wire
+	priority bool              // Whether application messages carry priority classes
+	stream   bool              // Whether large payloads are streamed in frames
+	tunFin   bool              // Whether tunnels support half-close and close reasons
+
+	// Payload streaming fields
+	streamIdx uint64            // Index to assign the next outbound stream
+	streamIn  map[uint64][]byte // Inbound streamed payloads being assembled
+	streamBuf int               // Total size of the partial inbound payloads
+	streamWin chan struct{}     // Window of unacknowledged outbound stream frames
 
 	// Quality of service fields
 	workers *pool.ThreadPool // Concurrent threads handling the connection
@@ -67,6 +77,10 @@ func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
 		tunInit: make(map[uint64]chan struct{}),
 		tunLive: make(map[uint64]*tunnel),
 
+		// Payload streaming
+		streamIn:  make(map[uint64][]byte),
+		streamWin: make(chan struct{}, config.RelayStreamWindow),
+
 		// Network layer
 		sock:    sock,
 		sockBuf: bufio.NewReadWriter(bufio.NewReader(sock), bufio.NewWriter(sock)),
@@ -84,7 +98,7 @@ func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
 	defer rel.sockLock.Unlock()
 
 	// Initialize the relay
-	app, err := rel.procInit()
+	app, flags, err := rel.procInit()
 	if err != nil {
 		rel.drop()
 		return nil, err
@@ -98,7 +112,7 @@ func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
 	rel.iris = conn
 
 	// Report the connection accepted
-	if err := rel.sendInit(); err != nil {
+	if err := rel.sendInit(flags); err != nil {
 		rel.drop()
 		return nil, err
 	}
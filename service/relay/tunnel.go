@@ -19,6 +19,7 @@ package relay
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"time"
 
@@ -37,6 +38,7 @@ type tunnel struct {
 	itoa chan struct{} // Iris to application pending ack buffer
 
 	// Bookkeeping fields
+	fin  chan struct{}   // Half-close request, after the buffered messages
 	quit chan chan error // Quit channel to synchronize tunnel termination
 }
 
@@ -48,6 +50,7 @@ func (r *relay) newTunnel(id uint64, tun *iris.Tunnel, atoiBuf int, itoaBuf int)
 		rel:  r,
 		atoi: make(chan []byte, atoiBuf),
 		itoa: make(chan struct{}, itoaBuf),
+		fin:  make(chan struct{}, 1),
 		quit: make(chan chan error),
 	}
 }
@@ -73,7 +76,17 @@ func (t *tunnel) ack() error {
 	}
 }
 
-// Closes the tunnel and stops any data transfer.
+// Requests the half-close of the tunnel, once the buffered messages are sent.
+func (t *tunnel) finish() {
+	select {
+	case t.fin <- struct{}{}:
+	default:
+		// Already requested
+	}
+}
+
+// Closes the tunnel and stops any data transfer, after the buffered messages are
+// sent to the remote endpoint.
 func (t *tunnel) close() {
 	// Terminate the two transfer routines
 	for i := 0; i < 2; i++ {
@@ -95,10 +108,26 @@ func (t *tunnel) sender() {
 	for errc == nil && err == nil {
 		select {
 		case errc = <-t.quit:
-			// Closing
+			// Closing, flush below
+		case <-t.fin:
+			// Half closing, flush the buffered messages and signal the remote
+			if err = t.flush(); err == nil {
+				err = t.tun.CloseSend()
+			}
 		case msg := <-t.atoi:
-			// Send the message and ack the client (async)
-			if err = t.tun.Send(msg); err == nil {
+			// Send the message, waiting for the remote window if exhausted
+			err = iris.ErrTimeout
+			for err == iris.ErrTimeout && errc == nil {
+				select {
+				case errc = <-t.quit:
+					// Closing, retry during the flush
+					err = t.tun.Send(msg, time.Duration(config.RelayTunnelTimeout)*time.Millisecond)
+				default:
+					err = t.tun.Send(msg, time.Duration(config.RelayTunnelPoll)*time.Millisecond)
+				}
+			}
+			// Ack the client (async)
+			if err == nil && errc == nil {
 				go func() {
 					if err := t.rel.sendTunnelAck(t.id); err != nil {
 						log.Printf("relay: send ack failed: %v.", err)
@@ -108,6 +137,10 @@ func (t *tunnel) sender() {
 			}
 		}
 	}
+	// If closing, deliver any messages still buffered
+	if errc != nil && err == nil {
+		err = t.flush()
+	}
 	// Sync termination and send back any error
 	if errc == nil {
 		errc = <-t.quit
@@ -115,24 +148,55 @@ func (t *tunnel) sender() {
 	errc <- err
 }
 
+// Sends all the buffered app messages to the remote endpoint, allowing each a
+// limited time to wait for the remote window. No acks are sent to the app, as
+// it's either not sending any more, or the tunnel is closing.
+func (t *tunnel) flush() error {
+	for {
+		select {
+		case msg := <-t.atoi:
+			if err := t.tun.Send(msg, time.Duration(config.RelayTunnelTimeout)*time.Millisecond); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
 // Forwards messages arriving from the Iris network to the attached application.
+// A remote half-close is forwarded to the application if supported, otherwise
+// the tunnel is closed as before. A full close is relayed with its reason.
 func (t *tunnel) receiver() {
 	var err error
 	var errc chan error
 
 	// Loop until termination is requested
+	eof := false
 	for errc == nil && err == nil {
 		select {
 		case errc = <-t.quit:
 			// Closing
 		case t.itoa <- struct{}{}:
 			// Message send permitted
-			if msg, rerr := t.tun.Recv(time.Duration(config.RelayTunnelPoll) * time.Millisecond); rerr == nil {
+			msg, rerr := t.tun.Recv(time.Duration(config.RelayTunnelPoll) * time.Millisecond)
+			switch {
+			case rerr == nil:
 				t.rel.handleTunnelRecv(t.id, msg)
-			} else if rerr == iris.ErrTimeout {
+			case rerr == iris.ErrTimeout:
+				<-t.itoa
+			case rerr == io.EOF && t.rel.tunFin:
 				<-t.itoa
-			} else {
-				go t.rel.handleTunnelClose(t.id, false)
+				if !eof {
+					eof = true
+					t.rel.handleTunnelFinRecv(t.id)
+				}
+			default:
+				reason := ""
+				if cerr, ok := rerr.(*iris.CloseError); ok {
+					reason = cerr.Reason
+				}
+				go t.rel.handleTunnelClose(t.id, false, reason)
 				err = rerr
 			}
 		}